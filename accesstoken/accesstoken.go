@@ -0,0 +1,395 @@
+// Package accesstoken implements the bearer tokens used by the API clients
+// which can't use the cookie sessions, like the mobile applications: personal
+// access tokens, created by the users, and OAuth2-style pairs of short-lived
+// access tokens and refresh tokens. Only the SHA-256 hashes of the tokens are
+// stored in Appengine's datastore.
+package accesstoken
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const TokenKind = "accesstoken"
+
+// Kinds of tokens.
+const (
+	Personal = "personal"
+	Access   = "access"
+	Refresh  = "refresh"
+)
+
+// Scopes which can be granted to a token.
+const (
+	// ReadScope allows the safe requests (GET, HEAD).
+	ReadScope = "read"
+	// WriteScope allows the requests changing data.
+	WriteScope = "write"
+)
+
+// Scopes lists all the scopes.
+var Scopes = []string{ReadScope, WriteScope}
+
+var (
+	// AccessLimit is the validity period of the access tokens.
+	AccessLimit = time.Hour
+	// RefreshLimit is the validity period of the refresh tokens.
+	RefreshLimit = 30 * 24 * time.Hour
+	// LastUsedPrecision is the precision of the last use of the tokens,
+	// recorded at most once per period to spare the datastore writes.
+	LastUsedPrecision = time.Hour
+)
+
+// Prefixes of the tokens, making them recognizable.
+var prefixes = map[string]string{
+	Personal: "pat_",
+	Access:   "at_",
+	Refresh:  "rt_",
+}
+
+var (
+	// Error returned if the token does not exist or has the wrong kind.
+	InvalidTokenErr = errors.New("invalid token")
+	// Error returned if the token is expired.
+	ExpiredErr = errors.New("token is expired")
+	// Error returned if the token was revoked.
+	RevokedErr = errors.New("token was revoked")
+	// Error returned if the requested scope is unknown.
+	InvalidScopeErr = errors.New("invalid scope")
+)
+
+// Token holds the information of an issued token.
+type Token struct {
+	// ID is the hash of the token, which is also the name of its entity.
+	ID   string `datastore:"-"`
+	Kind string `datastore:"kind"`
+	// Email is the email of the user the token was issued for.
+	Email string `datastore:"email"`
+	// Name describes a personal token, for the user.
+	Name    string    `datastore:"name,noindex"`
+	Scopes  []string  `datastore:"scopes,noindex"`
+	Created time.Time `datastore:"created"`
+	// Expires is zero for the personal tokens which never expire.
+	Expires  time.Time `datastore:"expires,noindex"`
+	Revoked  bool      `datastore:"revoked,noindex"`
+	LastUsed time.Time `datastore:"last_used,noindex"`
+	// Pair is the ID of the other token of an access/refresh pair.
+	Pair string `datastore:"pair,noindex"`
+}
+
+// Pair is an access token along with the refresh token used for
+// obtaining a new pair once the access token expires.
+type Pair struct {
+	AccessToken  string
+	RefreshToken string
+	Access       *Token
+	Refresh      *Token
+}
+
+// HasScope returns whether the token was granted the scope.
+func (t *Token) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired returns whether the token is expired.
+func (t *Token) Expired() bool {
+	return !t.Expires.IsZero() && !t.Expires.After(time.Now())
+}
+
+// IssuePersonal creates a new personal token for the user, having the name,
+// the scopes and the validity duration provided. The token never expires if
+// valid is zero. Returns the token, which is not stored and can't be retrieved
+// later, and its information.
+func IssuePersonal(c appengine.Context, email, name string, scopes []string, valid time.Duration) (string, *Token, error) {
+	if name == "" {
+		return "", nil, errors.New("token name can't be empty")
+	}
+	if valid < 0 {
+		return "", nil, errors.New("duration can't be negative")
+	}
+
+	raw, t, err := newToken(Personal, email, scopes, valid)
+	if err != nil {
+		return "", nil, err
+	}
+	t.Name = name
+
+	if _, err := datastore.Put(c, tokenKey(c, t.ID), t); err != nil {
+		return "", nil, err
+	}
+	return raw, t, nil
+}
+
+// IssuePair creates a new pair of access and refresh tokens for the user,
+// having the scopes provided.
+func IssuePair(c appengine.Context, email string, scopes []string) (*Pair, error) {
+	p, err := newPair(email, scopes)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []*datastore.Key{tokenKey(c, p.Access.ID), tokenKey(c, p.Refresh.ID)}
+	if _, err := datastore.PutMulti(c, keys, []*Token{p.Access, p.Refresh}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// RefreshPair exchanges the refresh token for a new pair having the same scopes.
+// The refresh token and its access token are revoked, so that each refresh token
+// can be used only once.
+func RefreshPair(c appengine.Context, refreshToken string) (*Pair, error) {
+	if !strings.HasPrefix(refreshToken, prefixes[Refresh]) {
+		return nil, InvalidTokenErr
+	}
+	id := hashToken(refreshToken)
+
+	var p *Pair
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		refresh, err := getToken(tc, id)
+		if err != nil {
+			return err
+		}
+		if err := refresh.check(Refresh); err != nil {
+			return err
+		}
+
+		if p, err = newPair(refresh.Email, refresh.Scopes); err != nil {
+			return err
+		}
+
+		refresh.Revoked = true
+		keys := []*datastore.Key{tokenKey(tc, id), tokenKey(tc, p.Access.ID), tokenKey(tc, p.Refresh.ID)}
+		tokens := []*Token{refresh, p.Access, p.Refresh}
+
+		if access, err := getToken(tc, refresh.Pair); err == nil {
+			access.Revoked = true
+			keys = append(keys, tokenKey(tc, access.ID))
+			tokens = append(tokens, access)
+		}
+
+		_, err = datastore.PutMulti(tc, keys, tokens)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Authenticate returns the information of the personal or access token.
+// Returns InvalidTokenErr if the token does not exist or is a refresh token,
+// ExpiredErr if it is expired and RevokedErr if it was revoked.
+func Authenticate(c appengine.Context, token string) (*Token, error) {
+	if !strings.HasPrefix(token, prefixes[Personal]) && !strings.HasPrefix(token, prefixes[Access]) {
+		return nil, InvalidTokenErr
+	}
+
+	t, err := getToken(c, hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if err := t.check(t.Kind); err != nil {
+		return nil, err
+	}
+
+	// Recording the last use is only informative.
+	if now := time.Now(); now.Sub(t.LastUsed) >= LastUsedPrecision {
+		if err := recordUse(c, t.ID, now); err != nil {
+			c.Warningf("accesstoken: could not record last use: %v", err)
+		}
+		t.LastUsed = now
+	}
+
+	return t, nil
+}
+
+// recordUse sets the last use of the token, in a transaction so that
+// a concurrent revocation is not overwritten.
+func recordUse(c appengine.Context, id string, now time.Time) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		t, err := getToken(tc, id)
+		if err != nil {
+			return err
+		}
+		t.LastUsed = now
+		_, err = datastore.Put(tc, tokenKey(tc, id), t)
+		return err
+	}, nil)
+}
+
+// Revoke revokes the token. Revoking a token of a pair revokes the whole pair.
+func Revoke(c appengine.Context, token string) error {
+	return RevokeByID(c, "", hashToken(token))
+}
+
+// RevokeByID revokes the token with the provided ID. If email is not empty,
+// returns InvalidTokenErr if the token belongs to another user.
+func RevokeByID(c appengine.Context, email, id string) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		t, err := getToken(tc, id)
+		if err != nil {
+			return err
+		}
+		if email != "" && t.Email != email {
+			return InvalidTokenErr
+		}
+
+		t.Revoked = true
+		keys := []*datastore.Key{tokenKey(tc, id)}
+		tokens := []*Token{t}
+
+		if t.Pair != "" {
+			if other, err := getToken(tc, t.Pair); err == nil {
+				other.Revoked = true
+				keys = append(keys, tokenKey(tc, other.ID))
+				tokens = append(tokens, other)
+			}
+		}
+
+		_, err = datastore.PutMulti(tc, keys, tokens)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// GetPersonalTokens returns the personal tokens of the user, including
+// the expired and revoked ones.
+func GetPersonalTokens(c appengine.Context, email string) ([]*Token, error) {
+	query := datastore.NewQuery(TokenKind).
+		Filter("email =", email).
+		Filter("kind =", Personal)
+
+	tokens := make([]*Token, 0)
+	keys, err := query.GetAll(c, &tokens)
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		tokens[i].ID = key.StringID()
+	}
+	return tokens, nil
+}
+
+// check returns an error if the token can't be used as a token of the kind.
+func (t *Token) check(kind string) error {
+	switch {
+	case t.Kind != kind:
+		return InvalidTokenErr
+	case t.Revoked:
+		return RevokedErr
+	case t.Expired():
+		return ExpiredErr
+	}
+	return nil
+}
+
+func newPair(email string, scopes []string) (*Pair, error) {
+	accessToken, access, err := newToken(Access, email, scopes, AccessLimit)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, refresh, err := newToken(Refresh, email, scopes, RefreshLimit)
+	if err != nil {
+		return nil, err
+	}
+	access.Pair = refresh.ID
+	refresh.Pair = access.ID
+
+	return &Pair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		Access:       access,
+		Refresh:      refresh,
+	}, nil
+}
+
+// newToken generates a new token of the kind, without storing it.
+func newToken(kind, email string, scopes []string, valid time.Duration) (string, *Token, error) {
+	if email == "" {
+		return "", nil, errors.New("email can't be empty")
+	}
+	if len(scopes) == 0 {
+		return "", nil, InvalidScopeErr
+	}
+	for _, s := range scopes {
+		if s != ReadScope && s != WriteScope {
+			return "", nil, InvalidScopeErr
+		}
+	}
+
+	buffer := make([]byte, 32)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", nil, err
+	}
+	raw := prefixes[kind] + base64.RawURLEncoding.EncodeToString(buffer)
+
+	t := &Token{
+		ID:      hashToken(raw),
+		Kind:    kind,
+		Email:   email,
+		Scopes:  scopes,
+		Created: time.Now(),
+	}
+	if valid > 0 {
+		t.Expires = t.Created.Add(valid)
+	}
+
+	return raw, t, nil
+}
+
+func getToken(c appengine.Context, id string) (*Token, error) {
+	if id == "" {
+		return nil, InvalidTokenErr
+	}
+
+	var t Token
+	err := datastore.Get(c, tokenKey(c, id), &t)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, InvalidTokenErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.ID = id
+	return &t, nil
+}
+
+func tokenKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, TokenKind, id, 0, nil)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RevokeAll revokes all the tokens of the user.
+func RevokeAll(c appengine.Context, email string) error {
+	query := datastore.NewQuery(TokenKind).Filter("email =", email)
+
+	tokens := make([]*Token, 0)
+	keys, err := query.GetAll(c, &tokens)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range tokens {
+		t.Revoked = true
+	}
+	_, err = datastore.PutMulti(c, keys, tokens)
+	return err
+}
@@ -0,0 +1,111 @@
+package accesstoken
+
+import (
+	"testing"
+	"time"
+
+	"appengine/aetest"
+)
+
+const email = "test@petsy.ro"
+
+func TestPersonalToken(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	raw, issued, err := IssuePersonal(c, email, "android", []string{ReadScope}, 0)
+	if err != nil {
+		t.Fatalf("IssuePersonal: unexpected error: %v", err)
+	}
+
+	tok, err := Authenticate(c, raw)
+	if err != nil {
+		t.Fatalf("Authenticate: unexpected error: %v", err)
+	}
+	if tok.Email != email || tok.ID != issued.ID {
+		t.Errorf("Authenticate: got token %+v; want token %+v", tok, issued)
+	}
+	if !tok.HasScope(ReadScope) || tok.HasScope(WriteScope) {
+		t.Errorf("Authenticate: got scopes %v; want [%s]", tok.Scopes, ReadScope)
+	}
+	if again, err := Authenticate(c, raw); err != nil || again.LastUsed.After(tok.LastUsed) {
+		t.Errorf("Authenticate: got last use %v; want it recorded once, at %v", again.LastUsed, tok.LastUsed)
+	}
+
+	if _, err := Authenticate(c, raw+"x"); err != InvalidTokenErr {
+		t.Errorf("Authenticate: unknown token: got error %v; want %v", err, InvalidTokenErr)
+	}
+
+	if err := RevokeByID(c, "other@petsy.ro", issued.ID); err != InvalidTokenErr {
+		t.Errorf("RevokeByID: other user: got error %v; want %v", err, InvalidTokenErr)
+	}
+	if err := RevokeByID(c, email, issued.ID); err != nil {
+		t.Errorf("RevokeByID: unexpected error: %v", err)
+	}
+	if _, err := Authenticate(c, raw); err != RevokedErr {
+		t.Errorf("Authenticate: revoked token: got error %v; want %v", err, RevokedErr)
+	}
+
+	if _, _, err := IssuePersonal(c, email, "bad", []string{"admin"}, 0); err != InvalidScopeErr {
+		t.Errorf("IssuePersonal: unknown scope: got error %v; want %v", err, InvalidScopeErr)
+	}
+}
+
+func TestPair(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	p, err := IssuePair(c, email, []string{ReadScope, WriteScope})
+	if err != nil {
+		t.Fatalf("IssuePair: unexpected error: %v", err)
+	}
+
+	if _, err := Authenticate(c, p.AccessToken); err != nil {
+		t.Errorf("Authenticate: access token: unexpected error: %v", err)
+	}
+	if _, err := Authenticate(c, p.RefreshToken); err != InvalidTokenErr {
+		t.Errorf("Authenticate: refresh token: got error %v; want %v", err, InvalidTokenErr)
+	}
+
+	refreshed, err := RefreshPair(c, p.RefreshToken)
+	if err != nil {
+		t.Fatalf("RefreshPair: unexpected error: %v", err)
+	}
+	if len(refreshed.Access.Scopes) != 2 {
+		t.Errorf("RefreshPair: got scopes %v; want the scopes of the refreshed pair", refreshed.Access.Scopes)
+	}
+
+	// The refreshed pair is revoked.
+	if _, err := Authenticate(c, p.AccessToken); err != RevokedErr {
+		t.Errorf("Authenticate: refreshed access token: got error %v; want %v", err, RevokedErr)
+	}
+	if _, err := RefreshPair(c, p.RefreshToken); err != RevokedErr {
+		t.Errorf("RefreshPair: used refresh token: got error %v; want %v", err, RevokedErr)
+	}
+
+	// Revoking the refresh token revokes its access token.
+	if err := Revoke(c, refreshed.RefreshToken); err != nil {
+		t.Errorf("Revoke: unexpected error: %v", err)
+	}
+	if _, err := Authenticate(c, refreshed.AccessToken); err != RevokedErr {
+		t.Errorf("Authenticate: access token of revoked pair: got error %v; want %v", err, RevokedErr)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	tok := &Token{Expires: time.Now().Add(-time.Second)}
+	if !tok.Expired() {
+		t.Errorf("Expired: past expiration: got false")
+	}
+
+	tok.Expires = time.Time{}
+	if tok.Expired() {
+		t.Errorf("Expired: no expiration: got true")
+	}
+}
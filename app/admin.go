@@ -0,0 +1,319 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petsy/accesstoken"
+	"petsy/audit"
+	"petsy/hashstore"
+	"petsy/moderation"
+	petsyuser "petsy/user"
+	"petsy/user/permission"
+	"petsy/validation"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Maximum number of users returned by a search.
+	adminSearchLimit = 50
+	// Number of items of a moderation queue or hashstore page.
+	adminPageSize = 50
+)
+
+// adminUser is a user as shown to the administrators.
+type adminUser struct {
+	ID int64
+	*petsyuser.User
+}
+
+// listPage is a page of a listing, along with the cursor of the next page.
+type listPage struct {
+	Items  interface{}
+	Cursor string
+}
+
+func init() {
+	admin := mux.NewRouter().PathPrefix("/api/admin/").Subrouter()
+
+	admin.Handle("/users", authorize(permission.ViewUsers, nil, searchUsers)).Methods("GET")
+	admin.Handle("/users/{user:[0-9]+}", authorize(permission.ViewUsers, loadUser("user"), showUser)).Methods("GET")
+	admin.Handle("/users/{user:[0-9]+}", authorize(permission.EditUsers, loadUser("user"), editUser)).Methods("POST")
+	admin.Handle("/users/{user:[0-9]+}/logout", authorize(permission.EditUsers, loadUser("user"), forceLogout)).Methods("POST")
+	admin.Handle("/users/{user:[0-9]+}/resend-activation", authorize(permission.ResendActivation, loadUser("user"), adminResendActivation)).Methods("POST")
+	admin.Handle("/users/{user:[0-9]+}/impersonate", authorize(permission.ImpersonateUsers, loadUser("user"), impersonate)).Methods("POST")
+
+	admin.Handle("/moderation/{kind}", authorize(permission.ModerateContent, nil, showModerationQueue)).Methods("GET")
+	admin.Handle("/moderation/{kind}/{item:[0-9]+}", authorize(permission.ModerateContent, nil, moderate)).Methods("POST")
+
+	admin.Handle("/hashstore", authorize(permission.ViewHashstore, nil, showHashstore)).Methods("GET")
+
+	admin.Handle("/audit", authorize(permission.ViewAuditLog, nil, showAuditLog)).Methods("GET")
+
+	http.Handle("/api/admin/", admin)
+
+	impersonation := mux.NewRouter()
+	impersonation.Handle("/api/impersonation/stop", authReq(stopImpersonation)).Methods("POST")
+	http.Handle("/api/impersonation/stop", impersonation)
+}
+
+// targetUser returns the user loaded by the authorization, along with its id.
+func targetUser(c *Context, r *http.Request) (int64, *petsyuser.User) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["user"], 10, 64)
+	return id, c.resource.(*petsyuser.User)
+}
+
+// searchUsers returns the users whose email starts with the "q" parameter.
+func searchUsers(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	keys, users, err := petsyuser.SearchUsers(c.ctx, r.URL.Query().Get("q"), adminSearchLimit)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	result := make([]adminUser, len(users))
+	for i, u := range users {
+		result[i] = adminUser{keys[i].IntID(), u}
+	}
+
+	return json.NewEncoder(w).Encode(result), false
+}
+
+func showUser(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	id, user := targetUser(c, r)
+	return json.NewEncoder(w).Encode(adminUser{id, user}), false
+}
+
+// editUserForm holds the changes of a user by an administrator. The empty
+// fields are not changed.
+type editUserForm struct {
+	Active         string `form:"active" validate:"oneof=true|false"`
+	RemoveProvider string `form:"remove_provider" validate:"max=50"`
+	AddRole        string `form:"add_role" validate:"max=50"`
+	RemoveRole     string `form:"remove_role" validate:"max=50"`
+}
+
+// editUser changes the activation, the providers and the roles of the user.
+// Only the provided parameters are changed. Deactivating the user also
+// invalidates their sessions and revokes their tokens.
+func editUser(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	var form editUserForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+
+	id, user := targetUser(c, r)
+
+	deactivated := false
+	if form.Active != "" {
+		active := form.Active == "true"
+		deactivated = user.Active && !active
+		user.Active = active
+	}
+	if form.RemoveProvider != "" {
+		if err := user.RemoveProvider(form.RemoveProvider); err != nil {
+			return appErrorf(http.StatusBadRequest, "%v", err), false
+		}
+	}
+	if form.AddRole != "" {
+		if err := user.AddRole(form.AddRole); err != nil {
+			return appErrorf(http.StatusBadRequest, "%v", err), false
+		}
+	}
+	if form.RemoveRole != "" {
+		if err := user.RemoveRole(form.RemoveRole); err != nil {
+			return appErrorf(http.StatusBadRequest, "%v", err), false
+		}
+	}
+	if deactivated {
+		user.RevokeSessions()
+	}
+
+	if _, err := petsyuser.UpdateUser(c.ctx, user.Email, user); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	if deactivated {
+		if err := accesstoken.RevokeAll(c.ctx, user.Email); err != nil {
+			return appErrorf(http.StatusInternalServerError, "%v", err), false
+		}
+	}
+
+	c.audit(r, audit.UserEdited, user.Email, r.PostForm.Encode())
+	return json.NewEncoder(w).Encode(adminUser{id, user}), false
+}
+
+// forceLogout invalidates the sessions and revokes the tokens of the user.
+func forceLogout(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+	_, user := targetUser(c, r)
+
+	user.RevokeSessions()
+	if _, err := petsyuser.UpdateUser(c.ctx, user.Email, user); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	if err := accesstoken.RevokeAll(c.ctx, user.Email); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	c.audit(r, audit.SessionsRevoked, user.Email, "")
+	w.Write([]byte(c.translate("User was logged out.")))
+	return nil, false
+}
+
+func adminResendActivation(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+	_, user := targetUser(c, r)
+
+	if user.Active {
+		return appErrorf(http.StatusForbidden, "User is already activated."), false
+	}
+
+	// Delete previous activation links.
+	if err := hashstore.DeleteEntriesSameValueScope(c.ctx, user.Email, REGISTER_SCOPE); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	if err := generateActivationLink(c, user); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	c.audit(r, audit.ActivationSent, user.Email, "")
+
+	w.Write([]byte(c.translate("Activation link was resent.")))
+	return nil, false
+}
+
+// impersonate logs the administrator in as the user. The impersonation is
+// recorded in the audit log and lasts until stopped or until the session expires.
+// The actions performed meanwhile are recorded with the administrator as the
+// impersonator.
+func impersonate(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+	_, user := targetUser(c, r)
+
+	if c.token != nil || c.impersonator != "" {
+		return appErrorf(http.StatusForbidden, "Impersonation requires an administrator session."), false
+	}
+	if user.HasRole(petsyuser.AdminRole) {
+		return appErrorf(http.StatusForbidden, "Administrators cannot be impersonated."), false
+	}
+
+	c.audit(r, audit.ImpersonationStarted, user.Email, "")
+
+	c.session.Values["user"] = user.Email
+	c.session.Values["impersonator"] = c.user.Email
+	c.session.Values["login"] = time.Now().Unix()
+
+	w.Write([]byte(c.translate("Impersonating %s.", user.Email)))
+	return nil, true
+}
+
+// stopImpersonation logs the administrator back in as themselves.
+func stopImpersonation(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+	if c.impersonator == "" {
+		return appErrorf(http.StatusBadRequest, "No impersonation in progress."), false
+	}
+
+	c.audit(r, audit.ImpersonationStopped, c.user.Email, "")
+
+	c.session.Values["user"] = c.impersonator
+	c.session.Values["login"] = time.Now().Unix()
+	delete(c.session.Values, "impersonator")
+
+	w.Write([]byte(c.translate("Impersonation stopped.")))
+	return nil, true
+}
+
+// showModerationQueue returns a page of the pending items of a kind.
+func showModerationQueue(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	items, cursor, err := moderation.GetPending(c.ctx, mux.Vars(r)["kind"], adminPageSize, r.URL.Query().Get("cursor"))
+	if err == moderation.InvalidKindErr {
+		return appErrorf(http.StatusNotFound, "%v", err), false
+	}
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	return json.NewEncoder(w).Encode(&listPage{items, cursor}), false
+}
+
+// moderate approves or rejects a pending item, depending on the "decision"
+// parameter, which is either "approve" or "reject".
+func moderate(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+	id, err := strconv.ParseInt(mux.Vars(r)["item"], 10, 64)
+	if err != nil {
+		return appErrorf(http.StatusNotFound, "No item found."), false
+	}
+
+	var approve bool
+	switch r.PostFormValue("decision") {
+	case "approve":
+		approve = true
+	case "reject":
+		approve = false
+	default:
+		return appErrorf(http.StatusBadRequest, "Decision must be approve or reject."), false
+	}
+
+	item, err := moderation.Decide(c.ctx, id, approve, c.user.Email, r.PostFormValue("note"))
+	switch err {
+	case nil:
+	case moderation.NoSuchItemErr:
+		return appErrorf(http.StatusNotFound, "No item found."), false
+	case moderation.AlreadyDecidedErr:
+		return appErrorf(http.StatusConflict, "%v", err), false
+	default:
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	return json.NewEncoder(w).Encode(item), false
+}
+
+// showHashstore returns the hashstore entries having the "value" and "scope"
+// parameters, or a page of all the entries if both are missing.
+func showHashstore(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	query := r.URL.Query()
+
+	if value, scope := query.Get("value"), query.Get("scope"); value != "" || scope != "" {
+		errs := make(validation.Errors)
+		if value == "" {
+			errs.Add("value", validation.RequiredMsg)
+		}
+		if scope == "" {
+			errs.Add("scope", validation.RequiredMsg)
+		}
+		if err := errs.Err(); err != nil {
+			return invalidRequest(err), false
+		}
+
+		_, entries, err := hashstore.GetEntriesSameValueScope(c.ctx, value, scope)
+		if err != nil {
+			return appErrorf(http.StatusInternalServerError, "%v", err), false
+		}
+		return json.NewEncoder(w).Encode(&listPage{entries, ""}), false
+	}
+
+	_, entries, cursor, err := hashstore.ListEntries(c.ctx, adminPageSize, query.Get("cursor"))
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	return json.NewEncoder(w).Encode(&listPage{entries, cursor}), false
+}
@@ -1,13 +1,17 @@
 package petsy
 
 import (
-	"html/template"
 	"io"
 	"net/http"
 
+	"petsy/app/config"
+	"petsy/audit"
 	"petsy/hashstore"
 	petsyuser "petsy/user"
-	. "petsy/utils"
+	"petsy/user/permission"
+	"petsy/validation"
+
+	"appengine"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/securecookie"
@@ -25,25 +29,70 @@ func init() {
 		Path:     "/",
 	}
 
+	hashstore.SecretFunc = func(c appengine.Context) ([]byte, error) {
+		return config.Secret(c, config.HashstoreSecret)
+	}
+
 	api := mux.NewRouter().PathPrefix("/api/").Subrouter()
 
-	api.Handle("/profile/{profile}", authReq(updateProfile)).Methods("POST")
-	api.Handle("/profile/{profile}", appHandler(getProfile)).Methods("GET")
+	api.Handle("/profile/email-preferences", authReq(showEmailPreferences)).Methods("GET")
+	api.Handle("/profile/email-preferences", authReq(updateEmailPreferences)).Methods("POST")
+
+	api.Handle("/profile/{profile:[0-9]+}", authorize(permission.EditProfile, loadUser("profile"), updateProfile)).Methods("POST")
+	api.Handle("/profile/{profile:[0-9]+}", appHandler(getProfile)).Methods("GET")
+	api.Handle("/profile/{profile:[0-9]+}/location", authorize(permission.EditSitterProfile, loadUser("profile"), updateLocation)).Methods("POST")
+	api.Handle("/profile/{profile:[0-9]+}/rates", authorize(permission.EditSitterProfile, loadUser("profile"), updateRates)).Methods("POST")
+	api.Handle("/profile/{profile:[0-9]+}/cancellation-policy", authorize(permission.EditSitterProfile, loadUser("profile"), updateCancellationPolicy)).Methods("POST")
+
+	api.Handle("/profile", authReq(showAccount)).Methods("GET")
 
-	api.Handle("/userpage/{user}", appHandler(getUserPage)).Methods("GET")
-	api.Handle("/userpage/{user}", authReq(updateUserPage)).Methods("POST")
+	api.Handle("/profile/tokens", authReq(getPersonalTokens)).Methods("GET")
+	api.Handle("/profile/tokens", authReq(createPersonalToken)).Methods("POST")
+	api.Handle("/profile/tokens/{token}", authReq(revokePersonalToken)).Methods("DELETE")
 
-	api.Handle("/profile/pet/{pet}", authReq(updatePetProfile)).Methods("POST")
+	api.Handle("/profile/activity", authReq(showActivity)).Methods("GET")
+
+	api.Handle("/profile/locale", authReq(updateLocale)).Methods("POST")
+
+	api.Handle("/userpage/{user:[0-9]+}", appHandler(getUserPage)).Methods("GET")
+	api.Handle("/userpage/{user:[0-9]+}", authorize(permission.EditUserPage, loadUser("user"), updateUserPage)).Methods("POST")
+
+	api.Handle("/profile/pet/{pet}", authorize(permission.EditPet, loadPet, updatePetProfile)).Methods("POST")
 	api.Handle("/profile/pet/{pet}", appHandler(getPetProfile)).Methods("GET")
 
-	api.Handle("/find", appHandler(findSitters)).Methods("POST")
+	api.Handle("/find", authReq(findSitters)).Methods("POST")
+	api.Handle("/sitter/{user:[0-9]+}/quote", appHandler(getQuote)).Methods("GET")
+
+	api.Handle("/bookings", authReq(createBooking)).Methods("POST")
+	api.Handle("/bookings/{booking:[0-9]+}", authReq(getBooking)).Methods("GET")
+	api.Handle("/bookings/{booking:[0-9]+}/cancel", authReq(cancelBooking)).Methods("POST")
+	api.Handle("/payments/webhook", appHandler(paymentWebhook)).Methods("POST")
 
 	api.Handle("/verification", appHandler(verifyLink)).Methods("GET")
 
 	api.Handle("/resend-activation-link", appHandler(showResendActivationLink)).Methods("GET")
 	api.Handle("/resend-activation-link", appHandler(resendActivationLink)).Methods("POST")
 
+	api.Handle("/unsubscribe", appHandler(showUnsubscribe)).Methods("GET")
+	api.Handle("/unsubscribe", appHandler(unsubscribe)).Methods("POST")
+
+	// Internal endpoints, restricted to administrators and cron in app.yaml.
+	api.Handle("/internal/mailqueue/deliver", internalOnly(deliverMail)).Methods("GET")
+	api.Handle("/internal/mailqueue/dead", internalOnly(showDeadLetters)).Methods("GET")
+	api.Handle("/internal/mailqueue/dead/{message}", internalOnly(requeueDeadLetter)).Methods("POST")
+	api.Handle("/internal/hashstore/purge", internalOnly(purgeHashstore)).Methods("GET")
+	api.Handle("/internal/migrations", internalOnly(showMigrations)).Methods("GET")
+	api.Handle("/internal/migrations/run", internalOnly(runMigrations)).Methods("POST")
+	api.Handle("/internal/migrations/{version:[0-9]+}/reset", internalOnly(resetMigration)).Methods("POST")
+	api.Handle("/internal/metrics", internalOnly(showMetrics)).Methods("GET")
+	api.Handle("/internal/payments/release", internalOnly(releasePayments)).Methods("GET")
+
+	if outbox != nil {
+		api.Handle("/internal/outbox", internalOnly(showOutbox)).Methods("GET")
+	}
+
 	http.Handle("/api/", api)
+	http.Handle("/_ah/bounce", appHandler(handleBounce))
 }
 
 func updateProfile(c *Context, w io.Writer, r *http.Request) (error, bool) {
@@ -51,10 +100,15 @@ func updateProfile(c *Context, w io.Writer, r *http.Request) (error, bool) {
 }
 
 func getProfile(c *Context, w io.Writer, r *http.Request) error {
-	w.Write([]byte("User profile"))
+	w.Write([]byte(c.translate("User profile")))
 	return nil
 }
 
+// showAccount shows the account page of the logged in user.
+func showAccount(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	return c.render(w, "account", c.user), false
+}
+
 func getUserPage(c *Context, w io.Writer, r *http.Request) error {
 	return appErrorf(http.StatusNotFound, "not implemented")
 }
@@ -71,31 +125,21 @@ func getPetProfile(c *Context, w io.Writer, r *http.Request) error {
 	return appErrorf(http.StatusNotFound, "not implemented")
 }
 
-func findSitters(c *Context, w io.Writer, r *http.Request) error {
-	return appErrorf(http.StatusNotFound, "not implemented")
-}
-
 func verifyLink(c *Context, w io.Writer, r *http.Request) error {
-	queryValues := r.URL.Query()
-
-	hash := queryValues.Get("hash")
-	scope := queryValues.Get("scope")
-	email := queryValues.Get("email")
-
-	// Check query parameters values.
-	if IsEmpty(hash) || IsEmpty(scope) || IsEmpty(email) {
+	// Consume the validation link, so that it can't be used twice.
+	email, scope, err := consumeVerificationLink(c, r)
+	switch err {
+	case nil:
+	case linkNotFoundErr:
+		c.audit(r, audit.LinkRejected, "", "not found")
 		return appErrorf(http.StatusNotFound, "Link does not exist.")
-	}
-
-	// Check validation link validity.
-	if valid, err := hashstore.IsValidEntry(c.ctx, hash, email, scope); err == hashstore.NoSuchKeyErr {
-		return appErrorf(http.StatusNotFound, "Link does not exist.")
-	} else if err != nil {
-		return appErrorf(http.StatusInternalServerError, "%v", err)
-	} else if !valid {
-		w.Write([]byte("Confirmation link has expired.\n"))
-		w.Write([]byte("Click <a href=\"/api/resend-activation-link.html\">here</a> for a new activation link.\n"))
+	case linkExpiredErr:
+		c.audit(r, audit.LinkRejected, "", "expired")
+		w.Write([]byte(c.translate("Confirmation link has expired.") + "\n"))
+		w.Write([]byte(c.translate("Click <a href=\"%s\">here</a> for a new activation link.", "/api/resend-activation-link") + "\n"))
 		return nil
+	default:
+		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
 
 	// Get user from datastore.
@@ -103,49 +147,42 @@ func verifyLink(c *Context, w io.Writer, r *http.Request) error {
 	if err != nil {
 		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
-	if IsEmpty(user) {
+	if user == nil {
 		return appErrorf(http.StatusNotFound, "No user found.")
 	}
 
 	// Perform action depending on scope.
 	switch scope {
-	case "register":
+	case REGISTER_SCOPE:
 		user.Active = true
 		// Mark the user as active.
 		if _, err := petsyuser.UpdateUser(c.ctx, user.Email, user); err != nil {
 			return appErrorf(http.StatusInternalServerError, "%v", err)
 		}
 
-		// Delete hashstore entry.
-		if hashstore.DeleteEntry(c.ctx, hash); err != nil {
-			return appErrorf(http.StatusInternalServerError, "%v", err)
-		}
+		c.audit(r, audit.Activation, user.Email, "")
 
-		w.Write([]byte("User account activated. You can now login."))
+		c.succeed(w, r, "/auth/login", c.translate("User account activated. You can now login."))
 		return nil
 	default:
 		return appErrorf(http.StatusUnauthorized, "Unknown scope.")
 	}
-
-	return nil
 }
 
 func showResendActivationLink(c *Context, w io.Writer, r *http.Request) error {
-	t, _ := template.ParseFiles("templates/resend-activation-link.html")
-	t.Execute(w, nil)
-	return nil
+	return c.render(w, "resend-activation-link", nil)
 }
 
 func resendActivationLink(c *Context, w io.Writer, r *http.Request) error {
-	email := r.PostFormValue("email")
-	pass := r.PostFormValue("password")
-
-	if IsEmpty(email) {
-		return appErrorf(http.StatusForbidden, "Email address cannot be empty.")
+	if err := checkCSRF(c, r); err != nil {
+		return err
 	}
-	if IsEmpty(pass) {
-		return appErrorf(http.StatusForbidden, "Password cannot be empty.")
+
+	var form credentialsForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err)
 	}
+	email, pass := form.Email, form.Password
 
 	// Get user by email.
 	_, user, err := petsyuser.GetUserByEmail(c.ctx, email)
@@ -163,20 +200,16 @@ func resendActivationLink(c *Context, w io.Writer, r *http.Request) error {
 		return appErrorf(http.StatusForbidden, "User is already activated.")
 	}
 
-	name := user.Name
-
-	// Send the new activation link.
-	if generateActivationLink(c, name, email); err != nil {
+	// Delete previous activation links.
+	if err := hashstore.DeleteEntriesSameValueScope(c.ctx, user.Email, REGISTER_SCOPE); err != nil {
 		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
 
-	// Delete previous activation links.
-	if _, entries, err := hashstore.GetEntriesSameValueScope(c.ctx, email, REGISTER_SCOPE); err == nil {
-		for _, entry := range entries {
-			hashstore.DeleteEntry(c.ctx, entry.Key)
-		}
+	// Send the new activation link.
+	if err := generateActivationLink(c, user); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
 
-	w.Write([]byte("Activation link was resent."))
+	c.succeed(w, r, "/auth/login", c.translate("Activation link was resent."))
 	return nil
 }
@@ -0,0 +1,71 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"petsy/audit"
+
+	"appengine"
+)
+
+// Number of events of an audit log page.
+const auditPageSize = 50
+
+// recordEvent appends the event to the audit log. A failure is logged,
+// but doesn't fail the request which caused the event.
+func recordEvent(c appengine.Context, e *audit.Event) {
+	if err := audit.Record(c, e); err != nil {
+		c.Errorf("could not record %s event of %s: %v", e.Action, e.Target, err)
+	}
+}
+
+// audit records the action of the logged in user on the target.
+func (c *Context) audit(r *http.Request, action, target, detail string) {
+	var actor string
+	if c.user != nil {
+		actor = c.user.Email
+	}
+
+	e := audit.NewEvent(r, action, actor, target)
+	e.Impersonator = c.impersonator
+	e.Detail = detail
+	recordEvent(c.ctx, e)
+}
+
+// showActivity returns the recent events concerning the logged in user.
+func showActivity(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	events, cursor, err := audit.GetEvents(c.ctx, audit.Filter{Target: c.user.Email}, auditPageSize, r.URL.Query().Get("cursor"))
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	return json.NewEncoder(w).Encode(&listPage{events, cursor}), false
+}
+
+// showAuditLog returns the events matching the "actor", "action" or
+// "target" parameter, or all the events if none is provided.
+func showAuditLog(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	query := r.URL.Query()
+	f := audit.Filter{
+		Actor:  query.Get("actor"),
+		Action: query.Get("action"),
+		Target: query.Get("target"),
+	}
+
+	set := 0
+	for _, v := range []string{f.Actor, f.Action, f.Target} {
+		if v != "" {
+			set++
+		}
+	}
+	if set > 1 {
+		return appErrorf(http.StatusBadRequest, "Only one of actor, action and target can be provided."), false
+	}
+
+	events, cursor, err := audit.GetEvents(c.ctx, f, auditPageSize, query.Get("cursor"))
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	return json.NewEncoder(w).Encode(&listPage{events, cursor}), false
+}
@@ -1,16 +1,13 @@
 package petsy
 
 import (
-	"html/template"
 	"io"
-	_ "log"
 	"net/http"
 	"time"
 
-	"petsy/hashstore"
-	"petsy/mailer"
+	"petsy/audit"
 	petsyuser "petsy/user"
-	. "petsy/utils"
+	"petsy/validation"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/gomniauth"
@@ -32,6 +29,20 @@ var (
 	ActivationLimit, _ = time.ParseDuration("168h")
 )
 
+// registerForm holds the parameters of the registration.
+type registerForm struct {
+	Name     string `form:"name" validate:"required,max=100"`
+	Email    string `form:"email" validate:"required,email,max=254"`
+	Password string `form:"password,notrim" validate:"required,min=8,max=128"`
+}
+
+// credentialsForm holds the email and password of a user. The password is
+// not checked against the registration rules, which may have changed since.
+type credentialsForm struct {
+	Email    string `form:"email" validate:"required"`
+	Password string `form:"password,notrim" validate:"required"`
+}
+
 func init() {
 	gomniauth.SetSecurityKey("TestSecurityKey")
 	gomniauth.WithProviders(
@@ -55,7 +66,10 @@ func init() {
 	auth.Handle("/register", appHandler(register)).Methods("POST")
 
 	auth.Handle("/login", appHandler(showLoginPage)).Methods("GET")
-	auth.Handle("/login", http.HandlerFunc(login)).Methods("POST")
+	auth.Handle("/login", appHandler(login)).Methods("POST")
+
+	auth.Handle("/token", appHandler(issueToken)).Methods("POST")
+	auth.Handle("/revoke", appHandler(revokeToken)).Methods("POST")
 
 	auth.Handle("/logout", authReq(showLogoutPage)).Methods("GET")
 	auth.Handle("/logout", authReq(logout)).Methods("POST")
@@ -64,39 +78,27 @@ func init() {
 }
 
 func showRegisterPage(c *Context, w io.Writer, r *http.Request) error {
-	t, _ := template.ParseFiles("templates/register.html")
-	t.Execute(w, nil)
-
-	return nil
+	return c.render(w, "register", nil)
 }
 
 func showLoginPage(c *Context, w io.Writer, r *http.Request) error {
-	t, _ := template.ParseFiles("templates/login.html")
-	t.Execute(w, nil)
-
-	return nil
+	return c.render(w, "login", nil)
 }
 
-func showLogoutPage(c *Context, w io.Writer, r *http.Request) (err error, saveCookie bool) {
-	t, _ := template.ParseFiles("templates/logout.html")
-	t.Execute(w, nil)
-	return
+func showLogoutPage(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	return c.render(w, "logout", nil), false
 }
 
 func register(c *Context, w io.Writer, r *http.Request) error {
-	name := r.PostFormValue("name")
-	email := r.PostFormValue("email")
-	pass := r.PostFormValue("password")
-
-	if IsEmpty(name) {
-		return appErrorf(http.StatusForbidden, "Name cannot be empty.")
-	}
-	if IsEmpty(email) {
-		return appErrorf(http.StatusForbidden, "Email cannot be empty.")
+	if err := checkCSRF(c, r); err != nil {
+		return err
 	}
-	if IsEmpty(pass) {
-		return appErrorf(http.StatusForbidden, "Password cannot be empty.")
+
+	var form registerForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err)
 	}
+	name, email, pass := form.Name, form.Email, form.Password
 
 	// Check if this username is already taken.
 	_, user, err := petsyuser.GetUserByEmail(c.ctx, email)
@@ -113,200 +115,217 @@ func register(c *Context, w io.Writer, r *http.Request) error {
 		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
 	u.SetPassword(pass)
+	u.Locale = c.printer().Locale
 
 	// Add the user to the datastore.
-	if _, err := petsyuser.AddUser(c.ctx, u); err != nil {
+	if _, err := petsyuser.AddUser(c.ctx, u); err == petsyuser.DuplicateEmailErr {
+		return appErrorf(http.StatusForbidden, "This email already exists.")
+	} else if err != nil {
 		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
 
-	if err := generateActivationLink(c, name, email); err != nil {
+	recordEvent(c.ctx, audit.NewEvent(r, audit.Register, email, email))
+
+	if err := generateActivationLink(c, u); err != nil {
 		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
 
-	w.Write([]byte("user created"))
+	c.succeed(w, r, "/auth/login", c.translate("Your account was created. Please check your email for the activation link."))
 	return nil
 }
 
-func login(w http.ResponseWriter, r *http.Request) {
-	c := appengine.NewContext(r)
-
-	email := r.PostFormValue("email")
-	pass := r.PostFormValue("password")
-
-	if IsEmpty(email) {
-		http.Error(w, "Email cannot be empty.", http.StatusForbidden)
+func login(c *Context, w io.Writer, r *http.Request) error {
+	if err := checkCSRF(c, r); err != nil {
+		return err
 	}
-	if IsEmpty(pass) {
-		http.Error(w, "Password cannot be empty.", http.StatusForbidden)
+
+	var form credentialsForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err)
 	}
+	email, pass := form.Email, form.Password
 
-	_, user, err := petsyuser.GetUserByEmail(c, email)
+	_, user, err := petsyuser.GetUserByEmail(c.ctx, email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return appErrorf(http.StatusInternalServerError, "%v", err)
 	}
 	if user == nil {
-		http.Error(w, "user does not exist", http.StatusForbidden)
-		return
+		recordLoginFailure(c.ctx, r, email, "unknown user")
+		return appErrorf(http.StatusForbidden, "user does not exist")
 	}
 	if !user.CheckPassword(pass) {
-		http.Error(w, "bad password", http.StatusForbidden)
-		return
+		recordLoginFailure(c.ctx, r, email, "bad password")
+		return appErrorf(http.StatusForbidden, "bad password")
 	}
 	if !user.Active {
-		http.Error(w, "User is not activated. Please check your e-mail for the activation link.", http.StatusUnauthorized)
-		return
+		recordLoginFailure(c.ctx, r, email, "inactive")
+		return appErrorf(http.StatusUnauthorized, "User is not activated. Please check your e-mail for the activation link.")
 	}
 
-	if err = createUserSession(user, w, r); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+	createUserSession(c, user)
+	recordLogin(c.ctx, r, email, "password")
 
-	http.Redirect(w, r, "/", http.StatusFound)
+	c.succeed(w, r, "/api/profile", c.translate("Welcome back, %s!", user.Name))
+	return nil
 }
 
 func logout(c *Context, w io.Writer, r *http.Request) (err error, saveSession bool) {
-	c.session.Options.MaxAge = -1
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	c.audit(r, audit.Logout, c.user.Email, "")
 
-	w.Write([]byte("You have been logged out."))
+	// The session is kept for showing the flash message.
+	for key := range c.session.Values {
+		delete(c.session.Values, key)
+	}
+	c.user = nil
 
-	saveSession = true
-	return
+	c.succeed(w, r, "/auth/login", c.translate("You have been logged out."))
+	return nil, true
 }
 
-func loginHandler(providerName string) http.HandlerFunc {
+func loginHandler(providerName string) appHandler {
 	provider, err := gomniauth.Provider(providerName)
 	if err != nil {
 		panic(err)
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return func(c *Context, w io.Writer, r *http.Request) error {
 		// Set the urlfetch mechanism used in AppEngine
-		c := appengine.NewContext(r)
 		t := new(urlfetch.Transport)
-		t.Context = c
+		t.Context = c.ctx
 		common.SetRoundTripper(t)
 
 		state := gomniauth.NewState("after", "success")
 
 		authUrl, err := provider.GetBeginAuthURL(state, nil)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return appErrorf(http.StatusInternalServerError, "%v", err)
 		}
 
-		http.Redirect(w, r, authUrl, http.StatusFound)
+		c.redirectTo(authUrl)
+		return nil
 	}
 }
 
-func callbackHandler(providerName string) http.HandlerFunc {
+func callbackHandler(providerName string) appHandler {
 	provider, err := gomniauth.Provider(providerName)
 	if err != nil {
 		panic(err)
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
+	return func(c *Context, w io.Writer, r *http.Request) error {
 		// Set the urlfetch mechanism used in AppEngine
-		c := appengine.NewContext(r)
 		t := new(urlfetch.Transport)
-		t.Context = c
+		t.Context = c.ctx
 		common.SetRoundTripper(t)
 
 		omap, err := objx.FromURLQuery(r.URL.RawQuery)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return appErrorf(http.StatusBadRequest, "%v", err)
 		}
 
 		creds, err := provider.CompleteAuth(omap)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return appErrorf(http.StatusInternalServerError, "%v", err)
 		}
 
 		u, err := provider.GetUser(creds)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return appErrorf(http.StatusInternalServerError, "%v", err)
 		}
 
-		user, err := addOrUpdateUser(c, u.Name(), u.Email(), providerName, u.IDForProvider(providerName))
+		user, linked, err := addOrUpdateUser(c.ctx, u.Name(), u.Email(), providerName, u.IDForProvider(providerName))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			return appErrorf(http.StatusInternalServerError, "%v", err)
 		}
-
-		if err = createUserSession(user, w, r); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if linked {
+			e := audit.NewEvent(r, audit.ProviderLinked, user.Email, user.Email)
+			e.Detail = providerName
+			recordEvent(c.ctx, e)
 		}
 
-		http.Redirect(w, r, "/", http.StatusFound)
+		createUserSession(c, user)
+		recordLogin(c.ctx, r, user.Email, providerName)
+
+		c.addFlash(successFlash, c.translate("Welcome back, %s!", user.Name))
+		c.redirectTo("/api/profile")
+		return nil
 	}
 }
 
-func addOrUpdateUser(c appengine.Context, name, email, provider, providerId string) (*petsyuser.User, error) {
+// addOrUpdateUser returns the user logged in with the provider, creating it
+// if needed. Returns true if the provider was linked to the user.
+func addOrUpdateUser(c appengine.Context, name, email, provider, providerId string) (*petsyuser.User, bool, error) {
 	_, user, err := petsyuser.GetUserByEmail(c, email)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	if user == nil {
 		// User does not exist, create it.
 		user, err = petsyuser.NewUser(name, email)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		user.Active = true
 		user.AddProvider(provider, providerId)
 
 		if _, err := petsyuser.AddUser(c, user); err != nil {
-			return nil, err
+			return nil, false, err
 		}
-	} else {
-		if !user.HasProvider(provider) {
-			user.AddProvider(provider, providerId)
-			petsyuser.UpdateUser(c, email, user)
+		return user, true, nil
+	}
+
+	if !user.HasProvider(provider) {
+		user.AddProvider(provider, providerId)
+		if _, err := petsyuser.UpdateUser(c, email, user); err != nil {
+			return nil, false, err
 		}
+		return user, true, nil
 	}
 
-	return user, nil
+	return user, false, nil
 }
 
-func createUserSession(user *petsyuser.User, w http.ResponseWriter, r *http.Request) error {
-	c, err := NewContext(r)
-	if err != nil {
-		return err
-	}
+// recordLogin records the login of the user with the method, either
+// "password" or the name of the provider.
+func recordLogin(c appengine.Context, r *http.Request, email, method string) {
+	e := audit.NewEvent(r, audit.Login, email, email)
+	e.Detail = method
+	recordEvent(c, e)
+}
+
+// recordLoginFailure records a failed login for the email. The actor is
+// unknown, since the login failed.
+func recordLoginFailure(c appengine.Context, r *http.Request, email, reason string) {
+	e := audit.NewEvent(r, audit.LoginFailed, "", email)
+	e.Detail = reason
+	recordEvent(c, e)
+}
 
+// createUserSession logs the user in, once the session is saved.
+func createUserSession(c *Context, user *petsyuser.User) {
 	c.session.Values["user"] = user.Email
 	c.session.Values["login"] = time.Now().Unix()
 	c.user = user
-
-	return c.session.Save(r, w)
+	c.saveSession = true
 }
 
-func generateActivationLink(c *Context, name, email string) error {
-	// Add a validation key and send a confirmation email.
-	key, err := randomString(32)
+// generateActivationLink sends the user an activation link, in the language of the user.
+func generateActivationLink(c *Context, user *petsyuser.User) error {
+	link, err := newVerificationLink(c, user.Email, REGISTER_SCOPE, ActivationLimit)
 	if err != nil {
 		return err
 	}
-	hashstore.AddEntry(c.ctx, key, email, REGISTER_SCOPE, ActivationLimit)
-
-	// Send confirmation email
-	message := "http://petsy-ro.appspot.com" +
-		"/api/verification?" + "hash=" + key +
-		"&scope=" + REGISTER_SCOPE +
-		"&email=" + email
-
-	if err := mailer.SendEmail(c.ctx,
-		[]string{email},
-		"noreply@petsy-ro.appspotmail.com",
-		"Petsy.ro - Account Details for "+name,
-		message); err != nil {
-		return err
-	}
 
-	return nil
+	// Queue the confirmation email.
+	p := userPrinter(user)
+	return enqueueTemplateEmail(c, linkID(link), user.Email, p.Locale, petsyuser.AccountEmails, activationEmail, &activationEmailData{
+		Name:     user.Name,
+		Link:     link,
+		Validity: p.N("%d days", int(ActivationLimit.Hours()/24)),
+	})
 }
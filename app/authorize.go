@@ -0,0 +1,64 @@
+package petsy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	petsyuser "petsy/user"
+	"petsy/user/permission"
+
+	"github.com/gorilla/mux"
+)
+
+// resourceLoader loads the resource targeted by a request, so that the
+// permissions of the user can be checked against it.
+type resourceLoader func(c *Context, r *http.Request) (permission.Resource, error)
+
+// authorize checks that the logged in user has the permission for the resource
+// returned by the loader before executing the handler. The loaded resource is
+// available to the handler in the context. A nil loader checks the permission
+// for the user's own resources.
+func authorize(p permission.Permission, load resourceLoader, h authReq) authReq {
+	return func(c *Context, w io.Writer, r *http.Request) (error, bool) {
+		if load != nil {
+			res, err := load(c, r)
+			if err != nil {
+				return err, false
+			}
+			c.resource = res
+		}
+
+		if !permission.Allowed(c.user, p, c.resource) {
+			c.ctx.Infof("%s denied %s on %s", c.user.Email, p, r.URL.Path)
+			return appErrorf(http.StatusForbidden, "%v", UnauthorizedError), false
+		}
+
+		return h(c, w, r)
+	}
+}
+
+// loadUser returns a loader of the user whose id is the named route variable.
+func loadUser(name string) resourceLoader {
+	return func(c *Context, r *http.Request) (permission.Resource, error) {
+		id, err := strconv.ParseInt(mux.Vars(r)[name], 10, 64)
+		if err != nil {
+			return nil, appErrorf(http.StatusNotFound, "No user found.")
+		}
+
+		_, user, err := petsyuser.GetUser(c.ctx, id)
+		if err != nil {
+			return nil, appErrorf(http.StatusInternalServerError, "%v", err)
+		}
+		if user == nil {
+			return nil, appErrorf(http.StatusNotFound, "No user found.")
+		}
+		return user, nil
+	}
+}
+
+// loadPet loads the pet of the request. Pets are not stored yet,
+// so no pet can be found.
+func loadPet(c *Context, r *http.Request) (permission.Resource, error) {
+	return nil, appErrorf(http.StatusNotFound, "No pet found.")
+}
@@ -0,0 +1,201 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petsy/booking"
+	"petsy/payments"
+	petsyuser "petsy/user"
+	"petsy/validation"
+
+	"github.com/gorilla/mux"
+)
+
+// bookForm is the booking of a sitter, whose request is a quoteForm.
+// The source is the payment source of the owner, like a card token, and
+// the key is chosen by the client for the booking, so that it can retry it.
+type bookForm struct {
+	Sitter int64  `form:"sitter" validate:"min=1"`
+	Source string `form:"source" validate:"required,max=200"`
+	Key    string `form:"key" validate:"required,max=100"`
+}
+
+// createBooking books the sitter for the request, charging the user the
+// price of its quote. The payment is held until the stay starts. Retrying
+// with the same key returns the booking made by the first attempt.
+func createBooking(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+	provider, err := c.paymentProvider()
+	if err != nil {
+		return err, false
+	}
+
+	var form bookForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+	var quote quoteForm
+	if err := validation.Bind(r, &quote); err != nil {
+		return invalidRequest(err), false
+	}
+	if err := quote.checkStart(time.Now()); err != nil {
+		return err, false
+	}
+	if form.Sitter == c.userID {
+		return appErrorf(http.StatusBadRequest, "Invalid request."), false
+	}
+
+	_, sitter, err := petsyuser.GetUser(c.ctx, form.Sitter)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	if sitter == nil || !sitter.Active || !sitter.HasRole(petsyuser.SitterRole) {
+		return appErrorf(http.StatusNotFound, "No user found."), false
+	}
+
+	req := quote.request()
+	q, err := c.quote(form.Sitter, req)
+	if err != nil {
+		return err, false
+	}
+
+	b := &booking.Booking{
+		Owner:    c.userID,
+		Sitter:   form.Sitter,
+		Service:  req.Service,
+		Start:    req.Start,
+		End:      req.End,
+		Pets:     req.Pets,
+		Amount:   q.Total,
+		Currency: q.Currency,
+	}
+	switch err := booking.Book(c.ctx, provider, b, form.Source, form.Key); err {
+	case nil:
+	case payments.DeclinedErr:
+		return appErrorf(http.StatusPaymentRequired, "The payment was declined."), false
+	case payments.KeyReusedErr:
+		return appErrorf(http.StatusConflict, "The key is used by another booking."), false
+	default:
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	// Queued once per booking, so that the retries don't send it again.
+	if err := sendBookingEmail(c, b, sitter); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	return json.NewEncoder(w).Encode(b), false
+}
+
+// sendBookingEmail queues the email telling the sitter about the booking,
+// in the language of the sitter.
+func sendBookingEmail(c *Context, b *booking.Booking, sitter *petsyuser.User) error {
+	id := strconv.FormatInt(b.ID, 10)
+	p := userPrinter(sitter)
+	return enqueueTemplateEmail(c, id, sitter.Email, p.Locale, petsyuser.BookingEmails, bookingEmail, &bookingEmailData{
+		OwnerName:  c.user.Name,
+		SitterName: sitter.Name,
+		Service:    p.T(b.Service),
+		Start:      p.Date(b.Start),
+		End:        p.Date(b.End),
+		Price:      p.Money(b.Amount, b.Currency),
+		Link:       baseURL + "/api/bookings/" + id,
+	})
+}
+
+// loadBooking returns the booking of the request and the party the user
+// is in it. Only the owner and the sitter can see a booking.
+func loadBooking(c *Context, r *http.Request) (*booking.Booking, string, error) {
+	id, _ := strconv.ParseInt(mux.Vars(r)["booking"], 10, 64)
+	b, err := booking.Get(c.ctx, id)
+	if err != nil {
+		return nil, "", appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	switch {
+	case b == nil:
+	case b.Owner == c.userID:
+		return b, booking.ByOwner, nil
+	case b.Sitter == c.userID:
+		return b, booking.BySitter, nil
+	}
+	return nil, "", appErrorf(http.StatusNotFound, "No booking found.")
+}
+
+// getBooking shows the booking to its owner or sitter.
+func getBooking(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	b, _, err := loadBooking(c, r)
+	if err != nil {
+		return err, false
+	}
+	return json.NewEncoder(w).Encode(b), false
+}
+
+type cancelForm struct {
+	Reason string `form:"reason" validate:"required,max=500"`
+}
+
+// cancelBooking cancels the booking for the reason, refunding the owner by
+// the cancellation policy of the booking, or in full if the sitter cancels.
+func cancelBooking(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	var form cancelForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+
+	b, by, err := loadBooking(c, r)
+	if err != nil {
+		return err, false
+	}
+
+	provider, err := c.paymentProvider()
+	if err != nil {
+		return err, false
+	}
+
+	b, err = booking.Cancel(c.ctx, provider, b.ID, by, form.Reason, time.Now())
+	switch err {
+	case nil:
+	case booking.AlreadyCancelledErr:
+		return appErrorf(http.StatusConflict, "The booking is already cancelled."), false
+	case booking.StartedErr:
+		return appErrorf(http.StatusConflict, "The stay has already started."), false
+	default:
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	return json.NewEncoder(w).Encode(b), false
+}
+
+type policyForm struct {
+	Policy string `form:"policy" validate:"required,oneof=flexible|moderate|strict"`
+}
+
+// updateCancellationPolicy sets the cancellation policy of the sitter,
+// applied to the next bookings.
+func updateCancellationPolicy(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	var form policyForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["profile"], 10, 64)
+	if err := booking.SetPolicy(c.ctx, id, form.Policy); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	return json.NewEncoder(w).Encode(form), false
+}
@@ -1,3 +1,89 @@
+// Package config holds the configuration of the application.
 package config
 
-const ()
+import (
+	"crypto/rand"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const SecretKind = "secret"
+
+// Size in bytes of the generated secrets.
+const secretSize = 32
+
+// Names of the secrets used by the application.
+const (
+	// UnsubscribeSecret signs the unsubscribe links sent by email.
+	UnsubscribeSecret = "unsubscribe"
+	// HashstoreSecret hashes the keys of the hashstore.
+	HashstoreSecret = "hashstore"
+	// TokenSecret signs the tokens of the verification links, unless
+	// the TOKEN_KEYS environment variable is set.
+	TokenSecret = "token"
+	// PaymentsSecret signs the webhooks of the fake payment provider.
+	PaymentsSecret = "payments"
+)
+
+// secret is a random value stored in the datastore, shared by all the
+// instances of the application.
+type secret struct {
+	Value   []byte    `datastore:"value,noindex"`
+	Created time.Time `datastore:"created,noindex"`
+}
+
+var (
+	secretsMu sync.Mutex
+	secrets   = make(map[string][]byte)
+)
+
+// Secret returns the secret with the provided name. The secret can be set by the
+// SECRET_<NAME> environment variable; otherwise it is randomly generated and stored
+// in the datastore the first time it is requested.
+func Secret(c appengine.Context, name string) ([]byte, error) {
+	if name == "" {
+		return nil, errors.New("secret name can't be empty")
+	}
+
+	if value := os.Getenv("SECRET_" + strings.ToUpper(name)); value != "" {
+		return []byte(value), nil
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	if value, ok := secrets[name]; ok {
+		return value, nil
+	}
+
+	key := datastore.NewKey(c, SecretKind, name, 0, nil)
+	var s secret
+
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, key, &s)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		s.Value = make([]byte, secretSize)
+		if _, err := rand.Read(s.Value); err != nil {
+			return err
+		}
+		s.Created = time.Now()
+
+		_, err = datastore.Put(tc, key, &s)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets[name] = s.Value
+	return s.Value, nil
+}
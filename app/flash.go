@@ -0,0 +1,73 @@
+package petsy
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// Kinds of flash messages, which are rendered as banners by the layout.
+const (
+	successFlash = "success"
+	errorFlash   = "error"
+)
+
+// flashKinds lists the kinds of flash messages, in the order they are shown.
+var flashKinds = []string{errorFlash, successFlash}
+
+// flash is a message shown once, on the next page rendered for the session.
+type flash struct {
+	Kind    string
+	Message string
+}
+
+// addFlash adds a message to the session, shown on the next page rendered.
+func (c *Context) addFlash(kind, msg string) {
+	c.session.AddFlash(msg, kind)
+	c.saveSession = true
+}
+
+// flashes returns the flash messages of the session, which are removed
+// once shown.
+func (c *Context) flashes() []flash {
+	var messages []flash
+	for _, kind := range flashKinds {
+		for _, f := range c.session.Flashes(kind) {
+			if msg, ok := f.(string); ok {
+				messages = append(messages, flash{kind, msg})
+			}
+		}
+	}
+	if len(messages) > 0 {
+		c.saveSession = true
+	}
+	return messages
+}
+
+// succeed reports the success of the request. Browsers are redirected to the
+// location, which shows the message as a flash, so that reloading the page
+// doesn't post the form again. The other clients get the message directly.
+func (c *Context) succeed(w io.Writer, r *http.Request, location, msg string) {
+	if wantsJSON(c, r) {
+		w.Write([]byte(msg))
+		return
+	}
+
+	c.addFlash(successFlash, msg)
+	c.redirectTo(location)
+}
+
+// isFormPost returns whether the request is a form posted by a browser.
+func isFormPost(c *Context, r *http.Request) bool {
+	return r.Method == "POST" && !wantsJSON(c, r)
+}
+
+// referer returns the path of the page which made the request, if it is a
+// page of the application.
+func referer(r *http.Request) (string, bool) {
+	u, err := url.Parse(r.Referer())
+	if err != nil || u.Path == "" || u.Host != "" && u.Host != r.Host {
+		return "", false
+	}
+	return u.RequestURI(), true
+}
@@ -0,0 +1,141 @@
+package petsy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"petsy/app/config"
+	"petsy/hashstore"
+	"petsy/token"
+	. "petsy/utils"
+)
+
+// Strategies for the verification links sent by email, chosen by the
+// LINK_STRATEGY environment variable.
+const (
+	// hashstoreLinks store a random key in the hashstore for every link.
+	hashstoreLinks = "hashstore"
+	// tokenLinks carry a signed token, needing no storage until they are
+	// used. The used tokens are revoked so that they can't be used twice.
+	tokenLinks = "token"
+)
+
+var linkStrategy = os.Getenv("LINK_STRATEGY")
+
+var (
+	linkNotFoundErr = errors.New("link does not exist")
+	linkExpiredErr  = errors.New("link has expired")
+)
+
+// tokenSigner returns the signer of the token links. The signing keys are set
+// by the TOKEN_KEYS environment variable as a comma-separated list of id:secret
+// pairs, the first being the current key. If not set, a single key generated
+// and stored in the datastore is used.
+func tokenSigner(c *Context) (*token.Signer, error) {
+	if keys := os.Getenv("TOKEN_KEYS"); keys != "" {
+		var signingKeys []token.Key
+		for _, pair := range strings.Split(keys, ",") {
+			parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("TOKEN_KEYS must be a list of id:secret pairs")
+			}
+			signingKeys = append(signingKeys, token.Key{ID: parts[0], Secret: []byte(parts[1])})
+		}
+		return token.NewSigner(signingKeys...)
+	}
+
+	secret, err := config.Secret(c.ctx, config.TokenSecret)
+	if err != nil {
+		return nil, err
+	}
+	return token.NewSigner(token.Key{ID: "1", Secret: secret})
+}
+
+// newVerificationLink returns a new verification link for the email and the
+// scope, valid for the provided duration, using the configured strategy.
+func newVerificationLink(c *Context, email, scope string, valid time.Duration) (string, error) {
+	query := url.Values{}
+	query.Set("scope", scope)
+
+	if linkStrategy == tokenLinks {
+		signer, err := tokenSigner(c)
+		if err != nil {
+			return "", err
+		}
+		t, err := signer.Issue(email, scope, valid)
+		if err != nil {
+			return "", err
+		}
+		query.Set("token", t)
+	} else {
+		key, err := randomString(32)
+		if err != nil {
+			return "", err
+		}
+		if _, err := hashstore.AddEntry(c.ctx, key, email, scope, valid); err != nil {
+			return "", err
+		}
+		query.Set("hash", key)
+		query.Set("email", email)
+	}
+
+	return baseURL + "/api/verification?" + query.Encode(), nil
+}
+
+// consumeVerificationLink checks the verification link of the request and makes
+// sure that it can't be used again. Both strategies are accepted, so that the
+// links sent before changing the strategy keep working. Returns the email and
+// the scope of the link, linkNotFoundErr if the link is invalid and
+// linkExpiredErr if the link is expired.
+func consumeVerificationLink(c *Context, r *http.Request) (email, scope string, err error) {
+	query := r.URL.Query()
+	scope = query.Get("scope")
+
+	if t := query.Get("token"); !IsEmpty(t) {
+		signer, err := tokenSigner(c)
+		if err != nil {
+			return "", "", err
+		}
+
+		switch claims, err := signer.Consume(c.ctx, t, scope); err {
+		case nil:
+			return claims.Subject, scope, nil
+		case token.InvalidTokenErr, token.UnknownKeyErr, token.ScopeMismatchErr, token.RevokedErr:
+			return "", "", linkNotFoundErr
+		case token.ExpiredErr:
+			return "", "", linkExpiredErr
+		default:
+			return "", "", err
+		}
+	}
+
+	hash := query.Get("hash")
+	email = query.Get("email")
+	if IsEmpty(hash) || IsEmpty(scope) || IsEmpty(email) {
+		return "", "", linkNotFoundErr
+	}
+
+	switch _, err := hashstore.Consume(c.ctx, hash, email, scope); err {
+	case nil:
+		return email, scope, nil
+	case hashstore.NoSuchKeyErr, hashstore.ValueMismatchErr, hashstore.ScopeMismatchErr:
+		return "", "", linkNotFoundErr
+	case hashstore.ExpiredErr:
+		return "", "", linkExpiredErr
+	default:
+		return "", "", err
+	}
+}
+
+// linkID identifies a link without revealing it, e.g. for the keys of
+// the mail queue.
+func linkID(link string) string {
+	sum := sha256.Sum256([]byte(link))
+	return hex.EncodeToString(sum[:16])
+}
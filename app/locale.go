@@ -0,0 +1,130 @@
+package petsy
+
+import (
+	"io"
+	"net/http"
+	"sort"
+
+	"petsy/i18n"
+	petsyuser "petsy/user"
+	"petsy/validation"
+)
+
+// localeParam is the URL parameter choosing the locale, which is then
+// remembered in the session.
+const localeParam = "lang"
+
+// catalog holds the translations of the messages of the application.
+var catalog = i18n.MustLoadCatalog("locales")
+
+// negotiateLocale returns the locale of the request: the one chosen by the URL
+// parameter, the preference of the user, the one remembered in the session or
+// the one preferred by the Accept-Language header, in this order.
+func (c *Context) negotiateLocale(r *http.Request) string {
+	if locale := r.URL.Query().Get(localeParam); i18n.Supported(locale) {
+		if c.token == nil && c.session.Values["locale"] != locale {
+			c.session.Values["locale"] = locale
+			c.saveSession = true
+		}
+		return locale
+	}
+	if c.user != nil && i18n.Supported(c.user.Locale) {
+		return c.user.Locale
+	}
+	if locale, ok := c.session.Values["locale"].(string); ok && i18n.Supported(locale) {
+		return locale
+	}
+	if locale, ok := i18n.Match(r.Header.Get("Accept-Language")); ok {
+		return locale
+	}
+	return i18n.DefaultLocale
+}
+
+// printer returns the printer of the locale of the request.
+func (c *Context) printer() *i18n.Printer {
+	if c.locale == nil {
+		c.locale = i18n.NewPrinter(catalog, i18n.DefaultLocale)
+	}
+	return c.locale
+}
+
+// translate returns the message for the key, translated in the locale of
+// the request and formatted with the arguments.
+func (c *Context) translate(key string, args ...interface{}) string {
+	return c.printer().T(key, args...)
+}
+
+// plural is like translate, but uses the plural form for the number n.
+func (c *Context) plural(key string, n int, args ...interface{}) string {
+	return c.printer().N(key, n, args...)
+}
+
+// fieldLabels are the labels of the form fields, as shown in the forms.
+var fieldLabels = map[string]string{
+	"name":     "Full name",
+	"email":    "Email",
+	"password": "Password",
+	"days":     "Days",
+	"scope":    "Scope",
+	"address":  "Address",
+	"radius":   "Radius",
+	"reason":   "Reason",
+}
+
+// fieldLabel returns the translated label of the form field.
+func (c *Context) fieldLabel(field string) string {
+	if label, ok := fieldLabels[field]; ok {
+		return c.translate(label)
+	}
+	return field
+}
+
+// translateFields returns the translated validation failures, by field.
+func (c *Context) translateFields(errs validation.Errors) map[string][]string {
+	if len(errs) == 0 {
+		return nil
+	}
+	fields := make(map[string][]string, len(errs))
+	for field, fieldErrs := range errs {
+		for _, fe := range fieldErrs {
+			fields[field] = append(fields[field], c.translate(fe.Message, fe.Args...))
+		}
+	}
+	return fields
+}
+
+// sortedFields returns the names of the fields, in alphabetical order.
+func sortedFields(fields map[string][]string) []string {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// userPrinter returns the printer of the locale of the user, used for the
+// emails sent to the user.
+func userPrinter(u *petsyuser.User) *i18n.Printer {
+	return i18n.NewPrinter(catalog, u.Locale)
+}
+
+// updateLocale saves the locale chosen by the user for the pages and emails.
+func updateLocale(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	if err := c.user.SetLocale(r.PostFormValue("locale")); err != nil {
+		return appErrorf(http.StatusBadRequest, "Unsupported language."), false
+	}
+	if _, err := petsyuser.UpdateUser(c.ctx, c.user.Email, c.user); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	c.locale = i18n.NewPrinter(catalog, c.user.Locale)
+	c.session.Values["locale"] = c.user.Locale
+
+	c.succeed(w, r, "/api/profile", c.translate("Language saved."))
+	return nil, true
+}
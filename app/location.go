@@ -0,0 +1,257 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"petsy/booking"
+	"petsy/geo"
+	"petsy/pricing"
+	petsyuser "petsy/user"
+	"petsy/validation"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Radius in kilometers of the searches not setting one.
+	defaultSearchRadius = 10
+	// Maximum number of sitters returned by a search.
+	searchLimit = 50
+	// Maximum number of locations ranked by a search, closest first.
+	searchCandidates = 500
+)
+
+// geocoder finds the positions of the addresses entered by the users.
+var geocoder geo.Geocoder = geo.DefaultGeocoder
+
+// geocode returns the position of the address, mapping the unknown
+// addresses to a client error.
+func (c *Context) geocode(address string) (geo.Point, error) {
+	p, err := geocoder.Geocode(c.ctx, address)
+	switch err {
+	case nil:
+		return p, nil
+	case geo.UnknownAddressErr:
+		return p, appErrorf(http.StatusBadRequest, "Unknown address.")
+	default:
+		return p, appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+}
+
+type locationForm struct {
+	Address string `form:"address" validate:"required,max=200"`
+}
+
+// locationResponse shows only the public location of a sitter.
+type locationResponse struct {
+	Address string    `json:",omitempty"`
+	Public  geo.Point `json:"Location"`
+}
+
+// updateLocation sets the location of the sitter from the address.
+func updateLocation(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	var form locationForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+
+	p, err := c.geocode(form.Address)
+	if err != nil {
+		return err, false
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["profile"], 10, 64)
+	l, err := geo.NewLocation(id, form.Address, p)
+	if err != nil {
+		return appErrorf(http.StatusBadRequest, "Unknown address."), false
+	}
+	if err := geo.PutLocation(c.ctx, l); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	return json.NewEncoder(w).Encode(&locationResponse{l.Address, l.Public}), false
+}
+
+// findForm is a search of sitters. Searches of a service also hold the
+// fields of a quoteForm, and can be limited to a maximum price.
+type findForm struct {
+	Address  string  `form:"address" validate:"required,max=200"`
+	Radius   float64 `form:"radius" validate:"min=0,max=100"`
+	MaxPrice float64 `form:"max_price" validate:"min=0"`
+	Currency string  `form:"currency" validate:"oneof=RON|EUR"`
+}
+
+// sitterResult is a sitter found by a search. The distance is the public
+// one, not to reveal the exact location of the sitter.
+type sitterResult struct {
+	ID               int64
+	Name             string
+	Location         geo.Point
+	Distance         float64
+	CancellationRate float32
+	Price            *sitterPrice `json:",omitempty"`
+	// rank orders the results: the exact distance, increased for the
+	// sitters cancelling their bookings.
+	rank float64
+}
+
+// byRank sorts the search results by rank.
+type byRank []*sitterResult
+
+func (r byRank) Len() int           { return len(r) }
+func (r byRank) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byRank) Less(i, j int) bool { return r[i].rank < r[j].rank }
+
+// sitterPrice is the price of the searched service. The total is in the
+// currency of the search, the quote in the currency of the sitter.
+type sitterPrice struct {
+	Total    int64
+	Currency string
+	Quote    *pricing.Quote
+}
+
+// price returns the price of the request by the rates of the sitter, or nil
+// if the sitter does not offer the service for at most the maximum price.
+func (c *Context) price(sitterID int64, req *pricing.Request, currency string, max int64) (*sitterPrice, error) {
+	rates, err := pricing.GetRates(c.ctx, sitterID)
+	if err != nil || rates == nil || !rates.Offers(req.Service) {
+		return nil, err
+	}
+
+	q, err := pricing.NewQuote(rates, req, holidays)
+	if err != nil {
+		return nil, err
+	}
+	total, err := pricing.Convert(q.Total, q.Currency, currency)
+	if err != nil || (max > 0 && total > max) {
+		return nil, err
+	}
+	return &sitterPrice{total, currency, q}, nil
+}
+
+// sitterResults returns the results of the active sitters found at the
+// locations. If a service is searched, only the sitters offering it for at
+// most the maximum price are returned, with its price.
+func (c *Context) sitterResults(center geo.Point, found []*geo.Result, req *pricing.Request, form *findForm) ([]*sitterResult, error) {
+	ids := make([]int64, len(found))
+	for i, l := range found {
+		ids[i] = l.UserID
+	}
+	users, err := petsyuser.GetUsers(c.ctx, ids)
+	if err != nil {
+		return nil, appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	profiles, err := booking.GetProfiles(c.ctx, ids)
+	if err != nil {
+		return nil, appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	var results []*sitterResult
+	for i, l := range found {
+		user := users[i]
+		if user == nil || !user.Active || !user.HasRole(petsyuser.SitterRole) {
+			continue
+		}
+
+		result := &sitterResult{
+			ID:               l.UserID,
+			Name:             user.Name,
+			Location:         l.Public,
+			Distance:         geo.PublicDistance(center, l.Location),
+			CancellationRate: profiles[i].CancellationRate(),
+			rank:             l.Distance * profiles[i].RankingFactor(),
+		}
+		if req != nil {
+			price, err := c.price(l.UserID, req, form.Currency, pricing.Amount(form.MaxPrice))
+			if err != nil {
+				return nil, appErrorf(http.StatusInternalServerError, "%v", err)
+			}
+			if price == nil {
+				continue
+			}
+			result.Price = price
+		}
+
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// findSitters returns the active sitters within the radius of the address,
+// closest first, the sitters cancelling their bookings being ranked farther.
+// If a service is searched, only the sitters offering it are returned, with
+// its price. Only the logged in users can search, so that the searches
+// can't be automated to locate the sitters.
+func findSitters(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	var form findForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+	if form.Radius == 0 {
+		form.Radius = defaultSearchRadius
+	}
+	if form.Currency == "" {
+		form.Currency = pricing.RON
+	}
+
+	var req *pricing.Request
+	if r.FormValue("service") != "" {
+		var quote quoteForm
+		if err := validation.Bind(r, &quote); err != nil {
+			return invalidRequest(err), false
+		}
+		if err := quote.checkStart(time.Now()); err != nil {
+			return err, false
+		}
+		req = quote.request()
+		if err := req.Validate(); err != nil {
+			return quoteError(err), false
+		}
+	}
+
+	center, err := c.geocode(form.Address)
+	if err != nil {
+		return err, false
+	}
+
+	found, err := geo.Within(c.ctx, center, form.Radius, searchCandidates)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	// The locations are ranked by batches, closest first. The rank of a
+	// sitter is at least their distance, so the search stops once the
+	// next location is farther than the rank of the last result kept.
+	sitters := []*sitterResult{}
+	for len(found) > 0 {
+		if len(sitters) == searchLimit && found[0].Distance >= sitters[searchLimit-1].rank {
+			break
+		}
+
+		batch := found
+		if len(batch) > searchLimit {
+			batch = batch[:searchLimit]
+		}
+		found = found[len(batch):]
+
+		results, err := c.sitterResults(center, batch, req, &form)
+		if err != nil {
+			return err, false
+		}
+		sitters = append(sitters, results...)
+		sort.Stable(byRank(sitters))
+		if len(sitters) > searchLimit {
+			sitters = sitters[:searchLimit]
+		}
+	}
+	return json.NewEncoder(w).Encode(sitters), false
+}
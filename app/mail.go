@@ -0,0 +1,194 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+
+	"petsy/mailer"
+	petsyuser "petsy/user"
+
+	"appengine"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Sender address of all the emails of the application.
+	mailSender = "noreply@petsy-ro.appspotmail.com"
+	// Base URL used for the links sent by email.
+	baseURL = "http://petsy-ro.appspot.com"
+	// Maximum number of emails handled by a request of the mail queue endpoints.
+	mailBatchSize = 50
+)
+
+// Names of the email templates found in templates/email.
+const (
+	activationEmail = "activation"
+	bookingEmail    = "booking"
+)
+
+var emailTemplates = mailer.MustParseTemplates("templates/email")
+
+// outbox records the sent emails when MAIL_TRANSPORT is "outbox".
+// It is nil for the other transports.
+var outbox = setMailTransport()
+
+func init() {
+	mailer.DefaultSuppressor = userSuppressor{}
+}
+
+// setMailTransport sets the transport of the mailer depending on the
+// MAIL_TRANSPORT environment variable: "appengine" (default), "smtp" or
+// "outbox". Returns the outbox, if used.
+func setMailTransport() *mailer.Outbox {
+	switch os.Getenv("MAIL_TRANSPORT") {
+	case "smtp":
+		mailer.DefaultTransport = &mailer.SMTPTransport{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			StartTLS: os.Getenv("SMTP_STARTTLS") != "false",
+		}
+	case "outbox":
+		o := &mailer.Outbox{Dir: os.Getenv("OUTBOX_DIR")}
+		mailer.DefaultTransport = o
+		return o
+	}
+	return nil
+}
+
+// activationEmailData is used for rendering the activation email.
+type activationEmailData struct {
+	Name string
+	Link string
+	// Validity is the translated validity period of the link.
+	Validity string
+}
+
+// bookingEmailData is used for rendering the email sent to a sitter when
+// booked. The values are formatted in the locale of the sitter.
+type bookingEmailData struct {
+	OwnerName  string
+	SitterName string
+	Service    string
+	Start      string
+	End        string
+	// Price is the total of the quote of the booking.
+	Price string
+	Link  string
+}
+
+// enqueueTemplateEmail renders the named email template in the locale with the
+// provided data and adds it to the outbound mail queue for the given address. The
+// key identifies the email in the queue, so that it is not sent twice. Emails of
+// non-transactional categories carry an unsubscribe link.
+func enqueueTemplateEmail(c *Context, key, to, locale, category, name string, data interface{}) error {
+	unsubscribe := ""
+	if !petsyuser.IsTransactional(category) {
+		var err error
+		if unsubscribe, err = unsubscribeURL(c, to, category); err != nil {
+			return err
+		}
+	}
+
+	msg, err := emailTemplates.RenderUnsubscribable(name, locale, data, unsubscribe)
+	if err != nil {
+		return err
+	}
+	msg.To = []string{to}
+	msg.Sender = mailSender
+	msg.Category = category
+
+	_, err = mailer.Enqueue(c.ctx, name+":"+key, msg)
+	return err
+}
+
+// userSuppressor suppresses the emails of the categories the
+// recipients opted out of.
+type userSuppressor struct{}
+
+// Suppressed implements mailer.Suppressor.
+func (userSuppressor) Suppressed(c appengine.Context, address, category string) (bool, error) {
+	if petsyuser.IsTransactional(category) {
+		return false, nil
+	}
+
+	_, user, err := petsyuser.GetUserByEmail(c, address)
+	if err != nil {
+		return false, err
+	}
+	if user == nil {
+		return false, nil
+	}
+	return !user.WantsEmails(category), nil
+}
+
+// handleBounce records the bounce notifications sent by Appengine.
+// All the bounces are considered permanent.
+func handleBounce(c *Context, w io.Writer, r *http.Request) error {
+	address := r.FormValue("original-to")
+	if address == "" {
+		return appErrorf(http.StatusBadRequest, "Missing bounced address.")
+	}
+
+	if err := mailer.RecordBounce(c.ctx, address, true, r.FormValue("notification-text")); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	return nil
+}
+
+// deliverMail runs the mail queue worker. Called by cron.
+func deliverMail(c *Context, w io.Writer, r *http.Request) error {
+	report, err := mailer.Deliver(c.ctx, mailBatchSize)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	return json.NewEncoder(w).Encode(report)
+}
+
+// showDeadLetters writes as JSON the emails which could not be delivered.
+func showDeadLetters(c *Context, w io.Writer, r *http.Request) error {
+	keys, messages, err := mailer.DeadLetters(c.ctx, mailBatchSize)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	type deadLetter struct {
+		Key string
+		*mailer.QueuedMessage
+	}
+	deadLetters := make([]deadLetter, len(keys))
+	for i := range keys {
+		deadLetters[i] = deadLetter{keys[i].StringID(), messages[i]}
+	}
+
+	return json.NewEncoder(w).Encode(deadLetters)
+}
+
+// requeueDeadLetter moves an email which could not be delivered back to the queue.
+func requeueDeadLetter(c *Context, w io.Writer, r *http.Request) error {
+	key := mux.Vars(r)["message"]
+
+	if err := mailer.Requeue(c.ctx, key); err == mailer.NoSuchMessageErr {
+		return appErrorf(http.StatusNotFound, "No such message.")
+	} else if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	w.Write([]byte(c.translate("Message was requeued.")))
+	return nil
+}
+
+// showOutbox writes as JSON the emails recorded by the outbox, optionally
+// filtered by the "to" query parameter. Only available with the outbox transport.
+func showOutbox(c *Context, w io.Writer, r *http.Request) error {
+	messages := outbox.Messages()
+	if to := r.URL.Query().Get("to"); to != "" {
+		messages = outbox.MessagesTo(to)
+	}
+
+	return json.NewEncoder(w).Encode(messages)
+}
@@ -0,0 +1,146 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petsy/hashstore"
+	"petsy/migrate"
+	"petsy/validation"
+
+	"github.com/gorilla/mux"
+
+	"appengine/datastore"
+)
+
+const (
+	// Hashstore entries are purged once expired for longer than this.
+	hashstorePurgeThreshold = 24 * time.Hour
+	// Number of hashstore entries scanned by a purge batch.
+	hashstoreBatch = 500
+	// Number of hashstore purge batches run by a request, so that it ends
+	// before the request deadline.
+	hashstoreRequestBatches = 50
+	// Kind of the entity holding the cursor of an unfinished purge.
+	purgeCursorKind = "hashstore_purge"
+	// Number of entities scanned by a schema migration batch.
+	migrationBatch = 100
+	// Number of schema migration batches run by a request, so that it ends
+	// before the request deadline.
+	migrationRequestBatches = 50
+)
+
+// purgeReport is the response of the hashstore purge endpoint.
+type purgeReport struct {
+	Deleted int
+	Batches int
+	// Next is the cursor where the next purge resumes, empty if all the
+	// entries were scanned.
+	Next string
+}
+
+// purgeCursor records where an unfinished hashstore purge stopped.
+type purgeCursor struct {
+	Cursor string `datastore:"cursor,noindex"`
+}
+
+func purgeCursorKey(c *Context) *datastore.Key {
+	return datastore.NewKey(c.ctx, purgeCursorKind, "cursor", 0, nil)
+}
+
+// purgeHashstore deletes the expired hashstore entries, batch by batch, for
+// at most hashstoreRequestBatches batches. Called by cron. The cursor where
+// the purge stops is recorded, so that the next request resumes from it,
+// unless another cursor is passed as the "cursor" parameter.
+func purgeHashstore(c *Context, w io.Writer, r *http.Request) error {
+	report := &purgeReport{}
+	cursor := r.URL.Query().Get("cursor")
+	if cursor == "" {
+		var saved purgeCursor
+		if err := datastore.Get(c.ctx, purgeCursorKey(c), &saved); err != nil && err != datastore.ErrNoSuchEntity {
+			return appErrorf(http.StatusInternalServerError, "%v", err)
+		}
+		cursor = saved.Cursor
+	}
+
+	for report.Batches < hashstoreRequestBatches {
+		deleted, next, err := hashstore.PurgeExpiredEntries(c.ctx, hashstorePurgeThreshold, hashstoreBatch, cursor)
+		if err != nil {
+			if _, err := datastore.Put(c.ctx, purgeCursorKey(c), &purgeCursor{cursor}); err != nil {
+				c.ctx.Errorf("hashstore purge: saving the cursor %q: %v", cursor, err)
+			}
+			return appErrorf(http.StatusInternalServerError,
+				"hashstore purge stopped after %d batches and %d deleted entries, at cursor %q: %v",
+				report.Batches, report.Deleted, cursor, err)
+		}
+
+		report.Deleted += deleted
+		report.Batches++
+		report.Next = next
+
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if _, err := datastore.Put(c.ctx, purgeCursorKey(c), &purgeCursor{report.Next}); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	c.ctx.Infof("hashstore purge deleted %d entries in %d batches, next cursor %q", report.Deleted, report.Batches, report.Next)
+
+	return json.NewEncoder(w).Encode(report)
+}
+
+// migrationRunForm holds the parameters of a schema migration run.
+type migrationRunForm struct {
+	Batches int `form:"batches" validate:"min=1,max=1000"`
+}
+
+// showMigrations returns the progress of the schema migrations.
+func showMigrations(c *Context, w io.Writer, r *http.Request) error {
+	status, err := migrate.Status(c.ctx, migrate.DatastoreStore{})
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	return json.NewEncoder(w).Encode(status)
+}
+
+// runMigrations runs the pending schema migrations for at most the number of
+// batches provided by the "batches" parameter. The progress is recorded, so the
+// migrations are resumed by the next request until all are done.
+func runMigrations(c *Context, w io.Writer, r *http.Request) error {
+	form := migrationRunForm{Batches: migrationRequestBatches}
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err)
+	}
+
+	status, err := migrate.Run(c.ctx, migrate.DatastoreStore{}, migrationBatch, form.Batches)
+	for _, p := range status {
+		c.ctx.Infof("migration %d of %s: %d scanned, %d migrated, %d collisions, done: %v",
+			p.Version, p.Kind, p.Scanned, p.Migrated, p.Collisions, p.Done)
+	}
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	return json.NewEncoder(w).Encode(status)
+}
+
+// resetMigration forgets the progress of a schema migration, so that the
+// next run applies it again to all the entities.
+func resetMigration(c *Context, w io.Writer, r *http.Request) error {
+	version, _ := strconv.Atoi(mux.Vars(r)["version"])
+
+	err := migrate.Reset(c.ctx, migrate.DatastoreStore{}, version)
+	if err == migrate.NoSuchMigrationErr {
+		return appErrorf(http.StatusNotFound, "No such migration.")
+	}
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	return showMigrations(c, w, r)
+}
@@ -0,0 +1,124 @@
+package petsy
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"time"
+
+	petsyuser "petsy/user"
+	"petsy/view"
+
+	"appengine"
+)
+
+const (
+	// csrfField is the form field holding the CSRF token.
+	csrfField = "csrf_token"
+	// csrfHeader holds the CSRF token of the requests made by scripts.
+	csrfHeader = "X-Csrf-Token"
+)
+
+// pages holds the templates of the HTML pages. The functions are bound
+// to the request by templateFuncs when rendering.
+var pages = view.MustParseTemplates("templates", templateFuncs(nil))
+
+func init() {
+	pages.Reload = appengine.IsDevAppServer()
+}
+
+// templateFuncs returns the functions available to the page templates.
+func templateFuncs(c *Context) template.FuncMap {
+	return template.FuncMap{
+		"csrfToken": func() string {
+			return c.csrfToken()
+		},
+		"csrfField": func() template.HTML {
+			return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+				csrfField, template.HTMLEscapeString(c.csrfToken())))
+		},
+		"currentUser": func() *petsyuser.User {
+			return c.user
+		},
+		"flashes": func() []flash {
+			return c.flashes()
+		},
+		"t": func(key string, args ...interface{}) string {
+			return c.translate(key, args...)
+		},
+		"plural": func(key string, n int, args ...interface{}) string {
+			return c.plural(key, n, args...)
+		},
+		"date": func(t time.Time) string {
+			return c.printer().Date(t)
+		},
+		"money": func(amount int64, currency string) string {
+			return c.printer().Money(amount, currency)
+		},
+		"locale": func() string {
+			return c.printer().Locale
+		},
+	}
+}
+
+// render writes the named page template, rendered with the data.
+func (c *Context) render(w io.Writer, name string, data interface{}) error {
+	return pages.Render(w, name, data, templateFuncs(c))
+}
+
+// renderErrorPage writes the error page, rendered with the data. The page is
+// written once the header is, when the session can no longer be saved, so the
+// flashes are kept for the next page and no CSRF token is created.
+func (c *Context) renderErrorPage(w io.Writer, data interface{}) error {
+	token, _ := c.session.Values["csrf"].(string)
+
+	funcs := templateFuncs(c)
+	funcs["flashes"] = func() []flash {
+		return nil
+	}
+	funcs["csrfToken"] = func() string {
+		return token
+	}
+	funcs["csrfField"] = func() template.HTML {
+		return template.HTML(fmt.Sprintf(`<input type="hidden" name="%s" value="%s">`,
+			csrfField, template.HTMLEscapeString(token)))
+	}
+	return pages.Render(w, "error", data, funcs)
+}
+
+// csrfToken returns the CSRF token of the session, creating it if needed.
+func (c *Context) csrfToken() string {
+	if token, ok := c.session.Values["csrf"].(string); ok {
+		return token
+	}
+
+	token, err := randomString(32)
+	if err != nil {
+		panic(err)
+	}
+	c.session.Values["csrf"] = token
+	c.saveSession = true
+	return token
+}
+
+// checkCSRF checks that the form or the header of the request holds the CSRF
+// token of the session. The requests authenticated by bearer tokens carry no
+// cookies, so they are not checked.
+func checkCSRF(c *Context, r *http.Request) error {
+	if c.token != nil {
+		return nil
+	}
+
+	expected, _ := c.session.Values["csrf"].(string)
+	got := r.PostFormValue(csrfField)
+	if got == "" {
+		got = r.Header.Get(csrfHeader)
+	}
+
+	if expected == "" || subtle.ConstantTimeCompare([]byte(got), []byte(expected)) != 1 {
+		return appErrorf(http.StatusForbidden, "Invalid CSRF token. Please reload the page and try again.")
+	}
+	return nil
+}
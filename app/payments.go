@@ -0,0 +1,88 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"petsy/app/config"
+	"petsy/payments"
+
+	"appengine"
+)
+
+// Number of due payments released by a cron run.
+const paymentBatch = 100
+
+// The provider moving the money of the bookings, created on first use.
+var (
+	paymentOnce            sync.Once
+	defaultPaymentProvider payments.Provider
+)
+
+// newPaymentProvider returns the provider set by the PAYMENT_PROVIDER
+// environment variable, or nil if none is available. The only one is "fake",
+// the default, which keeps its charges in memory, so it is only available
+// on the development server.
+func newPaymentProvider() payments.Provider {
+	switch os.Getenv("PAYMENT_PROVIDER") {
+	case "", "fake":
+		if !appengine.IsDevAppServer() {
+			return nil
+		}
+		return payments.NewFakeProvider(func(c appengine.Context) ([]byte, error) {
+			return config.Secret(c, config.PaymentsSecret)
+		})
+	}
+	return nil
+}
+
+// paymentProvider returns the payment provider, or a 503 error if none is
+// configured, so that only the payments are unavailable.
+func (c *Context) paymentProvider() (payments.Provider, error) {
+	paymentOnce.Do(func() {
+		defaultPaymentProvider = newPaymentProvider()
+	})
+	if defaultPaymentProvider == nil {
+		c.ctx.Errorf("no payment provider for PAYMENT_PROVIDER=%q", os.Getenv("PAYMENT_PROVIDER"))
+		return nil, appErrorf(http.StatusServiceUnavailable, "Payments are unavailable.")
+	}
+	return defaultPaymentProvider, nil
+}
+
+// paymentWebhook processes the events sent by the payment provider.
+func paymentWebhook(c *Context, w io.Writer, r *http.Request) error {
+	provider, err := c.paymentProvider()
+	if err != nil {
+		return err
+	}
+
+	switch err := payments.HandleWebhook(c.ctx, provider, r); err {
+	case nil:
+		return nil
+	case payments.InvalidSignatureErr:
+		return appErrorf(http.StatusBadRequest, "Invalid webhook signature.")
+	default:
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+}
+
+// releasePayments releases to the sitters the payments of the stays which
+// started, and retries the failed payouts. Called by cron.
+func releasePayments(c *Context, w io.Writer, r *http.Request) error {
+	provider, err := c.paymentProvider()
+	if err != nil {
+		return err
+	}
+
+	released, err := payments.ReleaseDue(c.ctx, provider, time.Now(), paymentBatch)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "released %d payments: %v", released, err)
+	}
+
+	c.ctx.Infof("released %d payments", released)
+	return json.NewEncoder(w).Encode(struct{ Released int }{released})
+}
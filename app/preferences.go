@@ -0,0 +1,138 @@
+package petsy
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+
+	"petsy/app/config"
+	"petsy/mailer"
+	petsyuser "petsy/user"
+	. "petsy/utils"
+)
+
+// unsubscribeURL returns the signed link unsubscribing the address from
+// the emails of the provided category.
+func unsubscribeURL(c *Context, address, category string) (string, error) {
+	secret, err := config.Secret(c.ctx, config.UnsubscribeSecret)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("email", address)
+	query.Set("category", category)
+	query.Set("sig", mailer.UnsubscribeSignature(secret, address, category))
+
+	return baseURL + "/api/unsubscribe?" + query.Encode(), nil
+}
+
+// checkUnsubscribeQuery checks the signature of an unsubscribe link and
+// returns the email and the category of the link.
+func checkUnsubscribeQuery(c *Context, r *http.Request) (email, category string, err error) {
+	query := r.URL.Query()
+	email = query.Get("email")
+	category = query.Get("category")
+
+	if IsEmpty(email) || IsEmpty(category) {
+		return "", "", appErrorf(http.StatusNotFound, "Link does not exist.")
+	}
+
+	secret, err := config.Secret(c.ctx, config.UnsubscribeSecret)
+	if err != nil {
+		return "", "", appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	if !mailer.CheckUnsubscribeSignature(secret, email, category, query.Get("sig")) {
+		return "", "", appErrorf(http.StatusForbidden, "Invalid unsubscribe link.")
+	}
+
+	return email, category, nil
+}
+
+// showUnsubscribe asks for the confirmation of the unsubscription, so that
+// the link is not followed by mistake by email scanners.
+func showUnsubscribe(c *Context, w io.Writer, r *http.Request) error {
+	email, category, err := checkUnsubscribeQuery(c, r)
+	if err != nil {
+		return err
+	}
+
+	return c.render(w, "unsubscribe", map[string]string{
+		"Email":    email,
+		"Category": category,
+		"Action":   r.URL.RequestURI(),
+	})
+}
+
+// unsubscribe unsubscribes the user from the category of the link.
+// Also handles the one-click unsubscriptions (RFC 8058) of the mail clients.
+func unsubscribe(c *Context, w io.Writer, r *http.Request) error {
+	email, category, err := checkUnsubscribeQuery(c, r)
+	if err != nil {
+		return err
+	}
+
+	_, user, err := petsyuser.GetUserByEmail(c.ctx, email)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	if user == nil {
+		return appErrorf(http.StatusNotFound, "No user found.")
+	}
+
+	if err := user.SetEmailPreference(category, false); err != nil {
+		return appErrorf(http.StatusBadRequest, "%v", err)
+	}
+	if _, err := petsyuser.UpdateUser(c.ctx, user.Email, user); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	w.Write([]byte(c.translate("You have been unsubscribed.")))
+	return nil
+}
+
+// emailPreference is used for rendering the email preferences page.
+type emailPreference struct {
+	Category      string
+	Subscribed    bool
+	Transactional bool
+}
+
+func showEmailPreferences(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	preferences := make([]emailPreference, len(petsyuser.EmailCategories))
+	for i, category := range petsyuser.EmailCategories {
+		preferences[i] = emailPreference{
+			Category:      category,
+			Subscribed:    c.user.WantsEmails(category),
+			Transactional: petsyuser.IsTransactional(category),
+		}
+	}
+
+	return c.render(w, "email-preferences", preferences), false
+}
+
+// updateEmailPreferences subscribes the user to the checked categories
+// and unsubscribes them from the others.
+func updateEmailPreferences(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return appErrorf(http.StatusBadRequest, "%v", err), false
+	}
+
+	for _, category := range petsyuser.EmailCategories {
+		if petsyuser.IsTransactional(category) {
+			continue
+		}
+		c.user.SetEmailPreference(category, r.PostForm.Get(category) != "")
+	}
+
+	if _, err := petsyuser.UpdateUser(c.ctx, c.user.Email, c.user); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	c.succeed(w, r, "/api/profile/email-preferences", c.translate("Email preferences saved."))
+	return nil, false
+}
@@ -0,0 +1,148 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petsy/pricing"
+	"petsy/validation"
+
+	"github.com/gorilla/mux"
+)
+
+// holidays are the holidays charged with the holiday premium.
+var holidays pricing.Holidays = pricing.RomanianHolidays{}
+
+// ratesForm holds the rates in major units of the currency.
+type ratesForm struct {
+	Currency        string  `form:"currency" validate:"required,oneof=RON|EUR"`
+	Boarding        float64 `form:"boarding" validate:"min=0,max=100000"`
+	Daycare         float64 `form:"daycare" validate:"min=0,max=100000"`
+	Walk            float64 `form:"walk" validate:"min=0,max=100000"`
+	DropIn          float64 `form:"dropin" validate:"min=0,max=100000"`
+	ExtraPet        int     `form:"extra_pet" validate:"min=0,max=100"`
+	Weekend         int     `form:"weekend" validate:"min=0,max=100"`
+	Holiday         int     `form:"holiday" validate:"min=0,max=100"`
+	WeeklyDiscount  int     `form:"weekly_discount" validate:"min=0,max=100"`
+	MonthlyDiscount int     `form:"monthly_discount" validate:"min=0,max=100"`
+}
+
+// updateRates sets the rates of the sitter.
+func updateRates(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	var form ratesForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+
+	rates := &pricing.Rates{
+		Currency:        form.Currency,
+		Boarding:        pricing.Amount(form.Boarding),
+		Daycare:         pricing.Amount(form.Daycare),
+		Walk:            pricing.Amount(form.Walk),
+		DropIn:          pricing.Amount(form.DropIn),
+		ExtraPet:        form.ExtraPet,
+		Weekend:         form.Weekend,
+		Holiday:         form.Holiday,
+		WeeklyDiscount:  form.WeeklyDiscount,
+		MonthlyDiscount: form.MonthlyDiscount,
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["profile"], 10, 64)
+	if err := pricing.PutRates(c.ctx, id, rates); err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	return json.NewEncoder(w).Encode(rates), false
+}
+
+// quoteForm is a booking request. The end is the pick-up day for
+// boarding and the last day for the other services.
+type quoteForm struct {
+	Service string    `form:"service" validate:"required,oneof=boarding|daycare|walk|dropin"`
+	Start   time.Time `form:"start" validate:"required"`
+	End     time.Time `form:"end" validate:"required"`
+	Pets    int       `form:"pets" validate:"min=0,max=10"`
+	PerDay  int       `form:"per_day" validate:"min=0,max=10"`
+	Minutes int       `form:"minutes" validate:"min=0,max=240"`
+}
+
+// request returns the booking request of the form, for a pet by default.
+func (f *quoteForm) request() *pricing.Request {
+	pets := f.Pets
+	if pets == 0 {
+		pets = 1
+	}
+	return &pricing.Request{
+		Service: f.Service,
+		Start:   f.Start,
+		End:     f.End,
+		Pets:    pets,
+		PerDay:  f.PerDay,
+		Minutes: f.Minutes,
+	}
+}
+
+// checkStart checks that the stay of the form starts after now, as the
+// stays which started can't be booked.
+func (f *quoteForm) checkStart(now time.Time) error {
+	if !now.Before(f.Start) {
+		return appErrorf(http.StatusBadRequest, "The stay has already started.")
+	}
+	return nil
+}
+
+// quoteError maps the errors of the quotes to client errors.
+func quoteError(err error) error {
+	switch err {
+	case pricing.InvalidPeriodErr:
+		return appErrorf(http.StatusBadRequest, "Invalid period.")
+	case pricing.ServiceNotOfferedErr:
+		return appErrorf(http.StatusBadRequest, "The sitter does not offer this service.")
+	case pricing.UnknownServiceErr, pricing.InvalidPetsErr:
+		return appErrorf(http.StatusBadRequest, "Invalid request.")
+	default:
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+}
+
+// quote returns the quote of the booking request by the rates of the sitter.
+func (c *Context) quote(sitterID int64, req *pricing.Request) (*pricing.Quote, error) {
+	rates, err := pricing.GetRates(c.ctx, sitterID)
+	if err != nil {
+		return nil, appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	if rates == nil {
+		return nil, quoteError(pricing.ServiceNotOfferedErr)
+	}
+
+	q, err := pricing.NewQuote(rates, req, holidays)
+	if err != nil {
+		return nil, quoteError(err)
+	}
+	return q, nil
+}
+
+// getQuote returns the itemized price of a booking request to the sitter,
+// shown before booking.
+func getQuote(c *Context, w io.Writer, r *http.Request) error {
+	var form quoteForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err)
+	}
+	if err := form.checkStart(time.Now()); err != nil {
+		return err
+	}
+
+	id, _ := strconv.ParseInt(mux.Vars(r)["user"], 10, 64)
+	q, err := c.quote(id, form.request())
+	if err != nil {
+		return err
+	}
+	return json.NewEncoder(w).Encode(q)
+}
@@ -0,0 +1,112 @@
+package petsy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"petsy/metrics"
+
+	"github.com/gorilla/mux"
+)
+
+// requestIDHeader carries the request ID, which is propagated from the
+// client if valid, and returned in the response.
+const requestIDHeader = "X-Request-Id"
+
+var (
+	requestCount = metrics.NewCounter("petsy_http_requests_total",
+		"Number of HTTP requests.", "method", "route", "status")
+	requestLatency = metrics.NewHistogram("petsy_http_request_duration_seconds",
+		"Latency of the HTTP requests, in seconds.", metrics.DefaultBuckets, "method", "route")
+)
+
+// requestLog records the status of the response, in order to log the request
+// and update the metrics when it's done.
+type requestLog struct {
+	http.ResponseWriter
+	r      *http.Request
+	start  time.Time
+	status int
+}
+
+// newRequestLog assigns an ID to the request, which is then available in the
+// context, and starts timing it.
+func newRequestLog(w http.ResponseWriter, r *http.Request) *requestLog {
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		id, _ = randomString(12)
+		r.Header.Set(requestIDHeader, id)
+	}
+	w.Header().Set(requestIDHeader, id)
+
+	return &requestLog{ResponseWriter: w, r: r, start: time.Now()}
+}
+
+func (l *requestLog) WriteHeader(code int) {
+	if l.status == 0 {
+		l.status = code
+	}
+	l.ResponseWriter.WriteHeader(code)
+}
+
+func (l *requestLog) Write(b []byte) (int, error) {
+	if l.status == 0 {
+		l.status = http.StatusOK
+	}
+	return l.ResponseWriter.Write(b)
+}
+
+// done logs the request in a single line and updates the metrics.
+func (l *requestLog) done(c *Context) {
+	latency := time.Since(l.start)
+	route := routeTemplate(l.r)
+	status := l.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	user := "-"
+	if c.user != nil {
+		user = strconv.FormatInt(c.userID, 10)
+	}
+
+	c.ctx.Infof("request id=%s method=%s route=%s status=%d latency=%s user=%s",
+		c.requestID, l.r.Method, route, status, latency, user)
+
+	requestCount.Inc(l.r.Method, route, strconv.Itoa(status))
+	requestLatency.Observe(latency.Seconds(), l.r.Method, route)
+}
+
+// routeTemplate returns the path template of the route matching the request,
+// so that the requests for different resources are grouped together.
+func routeTemplate(r *http.Request) string {
+	if route := mux.CurrentRoute(r); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return "unknown"
+}
+
+// validRequestID returns whether the ID provided by a client can be used,
+// keeping the logs readable.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_', r == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// showMetrics writes the metrics of the instance in the Prometheus text format.
+func showMetrics(c *Context, w io.Writer, r *http.Request) error {
+	return metrics.Write(w)
+}
@@ -0,0 +1,183 @@
+package petsy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"petsy/accesstoken"
+	"petsy/audit"
+	petsyuser "petsy/user"
+	. "petsy/utils"
+	"petsy/validation"
+
+	"github.com/gorilla/mux"
+)
+
+// tokenResponse is the OAuth2-style response of the token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// parseScopes returns the space-separated scopes, or all the scopes if
+// none is provided.
+func parseScopes(scope string) []string {
+	if scopes := strings.Fields(scope); len(scopes) > 0 {
+		return scopes
+	}
+	return accesstoken.Scopes
+}
+
+// issueToken implements the OAuth2 token endpoint, for the "password"
+// and "refresh_token" grant types.
+func issueToken(c *Context, w io.Writer, r *http.Request) error {
+	var pair *accesstoken.Pair
+	var err error
+
+	switch r.PostFormValue("grant_type") {
+	case "password":
+		email := r.PostFormValue("username")
+		pass := r.PostFormValue("password")
+		if IsEmpty(email) || IsEmpty(pass) {
+			return appErrorf(http.StatusBadRequest, "invalid_request")
+		}
+
+		_, user, err := petsyuser.GetUserByEmail(c.ctx, email)
+		if err != nil {
+			return appErrorf(http.StatusInternalServerError, "%v", err)
+		}
+		if user == nil || !user.CheckPassword(pass) || !user.Active {
+			recordLoginFailure(c.ctx, r, email, "token grant")
+			return appErrorf(http.StatusBadRequest, "invalid_grant")
+		}
+
+		pair, err = accesstoken.IssuePair(c.ctx, user.Email, parseScopes(r.PostFormValue("scope")))
+		if err == accesstoken.InvalidScopeErr {
+			return appErrorf(http.StatusBadRequest, "invalid_scope")
+		}
+	case "refresh_token":
+		pair, err = accesstoken.RefreshPair(c.ctx, r.PostFormValue("refresh_token"))
+		switch err {
+		case accesstoken.InvalidTokenErr, accesstoken.ExpiredErr, accesstoken.RevokedErr:
+			return appErrorf(http.StatusBadRequest, "invalid_grant")
+		}
+	default:
+		return appErrorf(http.StatusBadRequest, "unsupported_grant_type")
+	}
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+
+	e := audit.NewEvent(r, audit.TokenIssued, pair.Access.Email, pair.Access.Email)
+	e.Detail = r.PostFormValue("grant_type")
+	recordEvent(c.ctx, e)
+
+	return json.NewEncoder(w).Encode(&tokenResponse{
+		AccessToken:  pair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accesstoken.AccessLimit.Seconds()),
+		RefreshToken: pair.RefreshToken,
+		Scope:        strings.Join(pair.Access.Scopes, " "),
+	})
+}
+
+// revokeToken revokes an access, refresh or personal token (RFC 7009).
+// Unknown tokens are ignored.
+func revokeToken(c *Context, w io.Writer, r *http.Request) error {
+	t := r.PostFormValue("token")
+	if IsEmpty(t) {
+		return appErrorf(http.StatusBadRequest, "invalid_request")
+	}
+
+	if err := accesstoken.Revoke(c.ctx, t); err != nil && err != accesstoken.InvalidTokenErr {
+		return appErrorf(http.StatusInternalServerError, "%v", err)
+	}
+	return nil
+}
+
+// The personal tokens can only be managed from a cookie session, so that
+// a leaked token can't be used for creating new ones.
+func requireSession(c *Context) error {
+	if c.token != nil {
+		return appErrorf(http.StatusForbidden, "Personal tokens can't be managed with a bearer token.")
+	}
+	return nil
+}
+
+func getPersonalTokens(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := requireSession(c); err != nil {
+		return err, false
+	}
+
+	tokens, err := accesstoken.GetPersonalTokens(c.ctx, c.user.Email)
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+	return json.NewEncoder(w).Encode(tokens), false
+}
+
+// personalTokenForm holds the parameters of a new personal token. A token
+// valid for 0 days does not expire.
+type personalTokenForm struct {
+	Name  string `form:"name" validate:"required,max=100"`
+	Scope string `form:"scope"`
+	Days  int    `form:"days" validate:"min=0,max=3650"`
+}
+
+// createPersonalToken creates a personal token with the name, the space-separated
+// scopes and the validity in days provided. The token is only shown once.
+func createPersonalToken(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := requireSession(c); err != nil {
+		return err, false
+	}
+	if err := checkCSRF(c, r); err != nil {
+		return err, false
+	}
+
+	var form personalTokenForm
+	if err := validation.Bind(r, &form); err != nil {
+		return invalidRequest(err), false
+	}
+	name := form.Name
+	valid := time.Duration(form.Days) * 24 * time.Hour
+
+	raw, t, err := accesstoken.IssuePersonal(c.ctx, c.user.Email, name, parseScopes(form.Scope), valid)
+	if err == accesstoken.InvalidScopeErr {
+		return appErrorf(http.StatusBadRequest, "Invalid scope."), false
+	}
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	c.audit(r, audit.TokenIssued, c.user.Email, "personal: "+name)
+
+	return json.NewEncoder(w).Encode(struct {
+		Raw string `json:"Token"`
+		*accesstoken.Token
+	}{raw, t}), false
+}
+
+func revokePersonalToken(c *Context, w io.Writer, r *http.Request) (error, bool) {
+	if err := requireSession(c); err != nil {
+		return err, false
+	}
+
+	err := accesstoken.RevokeByID(c.ctx, c.user.Email, mux.Vars(r)["token"])
+	if err == accesstoken.InvalidTokenErr {
+		return appErrorf(http.StatusNotFound, "No such token."), false
+	}
+	if err != nil {
+		return appErrorf(http.StatusInternalServerError, "%v", err), false
+	}
+
+	c.audit(r, audit.TokenRevoked, c.user.Email, "personal: "+mux.Vars(r)["token"])
+
+	w.Write([]byte(c.translate("Token was revoked.")))
+	return nil, false
+}
@@ -4,93 +4,167 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"runtime/debug"
+	"strings"
 
+	"petsy/accesstoken"
+	"petsy/i18n"
 	"petsy/user"
+	"petsy/user/permission"
+	"petsy/validation"
 
 	"appengine"
+	appengineuser "appengine/user"
 
 	"github.com/gorilla/sessions"
 )
 
 var UnauthorizedError = errors.New("unauthorized operation")
 
-// appError is an error with a HTTP response code.
+// appError is an error with a HTTP response code. The message is translated
+// in the locale of the request when rendered, along with the validation
+// failures of the fields, if any.
 type appError struct {
 	error
-	Code int
+	Code   int
+	format string
+	args   []interface{}
+	fields validation.Errors
 }
 
 type Context struct {
 	ctx     appengine.Context
 	session *sessions.Session
 	user    *user.User
+	// token is the bearer token which authenticated the request, if any.
+	token *accesstoken.Token
+	// resource is the resource loaded for checking the permissions, if any.
+	resource permission.Resource
+	// impersonator is the email of the administrator impersonating the user, if any.
+	impersonator string
+	// userID is the datastore id of the user.
+	userID int64
+	// requestID identifies the request in the logs.
+	requestID string
+	// saveSession is true if the session must be saved, even by an appHandler.
+	saveSession bool
+	// location is the url the client is redirected to, if any.
+	location string
+	// locale translates the messages in the locale of the request.
+	locale *i18n.Printer
 }
 
 func NewContext(r *http.Request) (*Context, error) {
-	sess, err := store.Get(r, "petsy")
-	if err != nil {
-		log.Println(err)
-	}
-
 	c := appengine.NewContext(r)
 
+	sess, err := store.Get(r, "petsy")
 	ctx := &Context{
-		ctx:     c,
-		session: sess,
+		ctx:       c,
+		session:   sess,
+		requestID: r.Header.Get(requestIDHeader),
 	}
 	if err != nil {
-		return ctx, err
+		// The session can't be decoded, so a new one is used.
+		c.Warningf("request id=%s invalid session: %v", ctx.requestID, err)
 	}
 
-	log.Println(sess.Values["user"])
-	log.Println(sess.IsNew)
+	// Bearer tokens take precedence over the session cookie.
+	if bearer, ok := bearerToken(r); ok {
+		return ctx, ctx.authenticateToken(bearer)
+	}
 
 	if sess.Values["user"] == nil {
 		return ctx, nil
 	}
 	if email, ok := sess.Values["user"].(string); ok {
-		_, user, err := user.GetUserByEmail(c, email)
+		key, user, err := user.GetUserByEmail(c, email)
+		if err != nil || user == nil {
+			return ctx, err
+		}
+
+		// The sessions created before the revocation are no longer valid.
+		login, _ := sess.Values["login"].(int64)
+		if !user.SessionsRevoked.IsZero() && login < user.SessionsRevoked.Unix() {
+			c.Infof("revoked session of %s", email)
+			return ctx, nil
+		}
 
 		ctx.user = user
-		return ctx, err
+		ctx.userID = key.IntID()
+		ctx.impersonator, _ = sess.Values["impersonator"].(string)
+		return ctx, nil
 	}
 
 	return ctx, errors.New("unexpected value in user session")
 }
 
-// appErrorf creates a new appError given a response code and a message.
-func appErrorf(code int, format string, args ...interface{}) *appError {
-	return &appError{fmt.Errorf(format, args...), code}
+// bearerToken returns the token of the Authorization header, if it
+// uses the Bearer scheme.
+func bearerToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len("Bearer "):]), true
 }
 
-type appHandler func(c *Context, w io.Writer, r *http.Request) error
-
-func (h appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	c, _ := NewContext(r)
-	// todo - catch and log error
+// authenticateToken sets the user of the context to the owner of the bearer
+// token. The user is left unset if the token is invalid or the user is not
+// active, so that the request is unauthorized.
+func (c *Context) authenticateToken(bearer string) error {
+	t, err := accesstoken.Authenticate(c.ctx, bearer)
+	if err != nil {
+		c.ctx.Infof("bearer token rejected: %v", err)
+		return nil
+	}
 
-	buf := &bytes.Buffer{}
-	err := h(c, buf, r)
-	if err == nil {
-		io.Copy(w, buf)
-		return
+	key, u, err := user.GetUserByEmail(c.ctx, t.Email)
+	if err != nil {
+		return err
+	}
+	if u == nil || !u.Active {
+		return nil
 	}
 
-	code := http.StatusInternalServerError
-	logf := c.ctx.Errorf
-	if err, ok := err.(*appError); ok {
-		code = err.Code
-		logf = c.ctx.Infof
+	c.user = u
+	c.userID = key.IntID()
+	c.token = t
+	return nil
+}
+
+// appErrorf creates a new appError given a response code and a message.
+func appErrorf(code int, format string, args ...interface{}) *appError {
+	return &appError{fmt.Errorf(format, args...), code, format, args, nil}
+}
+
+// invalidRequest returns the error of a request whose parameters failed the
+// validation, holding the failures by field.
+func invalidRequest(err error) *appError {
+	fields, ok := err.(validation.Errors)
+	if !ok {
+		return appErrorf(http.StatusBadRequest, "%v", err)
 	}
+	e := appErrorf(http.StatusBadRequest, "Invalid request.")
+	e.fields = fields
+	return e
+}
 
-	w.WriteHeader(code)
-	logf(err.Error())
-	fmt.Fprint(w, err)
+// redirectTo redirects the client to the url once the handler succeeds.
+func (c *Context) redirectTo(url string) {
+	c.location = url
+}
+
+type appHandler func(c *Context, w io.Writer, r *http.Request) error
+
+func (h appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, false, func(c *Context, w io.Writer, r *http.Request) (error, bool) {
+		return h(c, w, r), false
+	})
 }
 
 // authReq checks that a user is logged in before executing the appHandler.
@@ -99,36 +173,147 @@ type authReq func(c *Context, w io.Writer, r *http.Request) (error, bool)
 
 // authReq implements http.Handler.
 func (h authReq) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serve(w, r, true, h)
+}
+
+// serve executes the handler, which writes the response to a buffer, so that
+// nothing is sent if it fails. If loggedIn is true, the handler is only
+// executed for logged in users. Errors and panics stop the request and are
+// rendered by renderError.
+func serve(rw http.ResponseWriter, r *http.Request, loggedIn bool, h authReq) {
+	w := newRequestLog(rw, r)
 	c, err := NewContext(r)
+	c.locale = i18n.NewPrinter(catalog, c.negotiateLocale(r))
+	defer w.done(c)
+
+	defer func() {
+		if p := recover(); p != nil {
+			c.ctx.Criticalf("request id=%s panic: %v\n%s", c.requestID, p, debug.Stack())
+			renderError(c, w, r, appErrorf(http.StatusInternalServerError, "Internal server error."))
+		}
+	}()
+
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		renderError(c, w, r, err)
+		return
 	}
 
-	if c.user == nil {
-		http.Error(w, UnauthorizedError.Error(), http.StatusUnauthorized)
-		return
+	if loggedIn {
+		if c.user == nil {
+			renderError(c, w, r, appErrorf(http.StatusUnauthorized, "%v", UnauthorizedError))
+			return
+		}
+
+		// Bearer tokens without the write scope only allow safe requests.
+		if c.token != nil && r.Method != "GET" && r.Method != "HEAD" && !c.token.HasScope(accesstoken.WriteScope) {
+			renderError(c, w, r, appErrorf(http.StatusForbidden, "%v", UnauthorizedError))
+			return
+		}
 	}
 
 	buf := &bytes.Buffer{}
 	err, saveSession := h(c, buf, r)
-	if err == nil {
-		if saveSession {
-			c.session.Save(r, w)
+	if err != nil {
+		renderError(c, w, r, err)
+		return
+	}
+
+	// The requests authenticated by bearer tokens have no session.
+	if (saveSession || c.saveSession) && c.token == nil {
+		if err := c.session.Save(r, w); err != nil {
+			renderError(c, w, r, err)
+			return
+		}
+	}
+	if c.location != "" {
+		code := http.StatusFound
+		if r.Method == "POST" {
+			code = http.StatusSeeOther
 		}
-		io.Copy(w, buf)
+		http.Redirect(w, r, c.location, code)
 		return
 	}
+	io.Copy(w, buf)
+}
 
+// errorResponse is the JSON representation of an error.
+type errorResponse struct {
+	Error     string              `json:"error"`
+	Code      int                 `json:"code"`
+	RequestID string              `json:"request_id"`
+	Fields    map[string][]string `json:"fields,omitempty"`
+}
+
+// renderError logs the error and writes it as JSON for the API clients or as
+// an error page for the browsers, or redirects the browsers posting forms back
+// to the form. Errors which are not appErrors are internal server errors.
+func renderError(c *Context, w http.ResponseWriter, r *http.Request, err error) {
 	code := http.StatusInternalServerError
 	logf := c.ctx.Errorf
+	msg := err.Error()
+	var fields map[string][]string
 	if err, ok := err.(*appError); ok {
 		code = err.Code
 		logf = c.ctx.Infof
+		msg = c.translate(err.format, err.args...)
+		fields = c.translateFields(err.fields)
+	}
+	logf("request id=%s error=%q", c.requestID, err.Error())
+
+	// The browsers posting forms are sent back to the form, which shows the
+	// error, unless the server failed.
+	if back, ok := referer(r); ok && code < http.StatusInternalServerError && isFormPost(c, r) {
+		c.addFlash(errorFlash, msg)
+		for _, field := range sortedFields(fields) {
+			for _, fieldMsg := range fields[field] {
+				c.addFlash(errorFlash, c.fieldLabel(field)+": "+fieldMsg)
+			}
+		}
+		if err := c.session.Save(r, w); err == nil {
+			http.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+	}
+
+	resp := &errorResponse{msg, code, c.requestID, fields}
+
+	if wantsJSON(c, r) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(resp)
+		return
 	}
 
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(code)
-	logf(err.Error())
-	fmt.Fprint(w, err)
+	if err := c.renderErrorPage(w, resp); err != nil {
+		c.ctx.Errorf("request id=%s could not render error page: %v", c.requestID, err)
+	}
+}
+
+// wantsJSON returns whether the client expects JSON responses. The requests
+// authenticated by tokens and the API requests not made by browsers do.
+func wantsJSON(c *Context, r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/json") || c.token != nil {
+		return true
+	}
+	return strings.HasPrefix(r.URL.Path, "/api/") && !strings.Contains(accept, "text/html")
+}
+
+// internalOnly restricts the handler to the requests made by cron, by the task
+// queues and by the administrators of the application.
+func internalOnly(h appHandler) appHandler {
+	return func(c *Context, w io.Writer, r *http.Request) error {
+		internal := r.Header.Get("X-Appengine-Cron") == "true" ||
+			r.Header.Get("X-Appengine-TaskName") != "" ||
+			appengineuser.IsAdmin(c.ctx)
+		if !internal {
+			return appErrorf(http.StatusForbidden, "%v", UnauthorizedError)
+		}
+
+		return h(c, w, r)
+	}
 }
 
 func randomString(size int) (string, error) {
@@ -0,0 +1,143 @@
+// Package audit implements an append-only log of the security relevant
+// events, like logins, activations and administrative actions.
+package audit
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const EventKind = "audit"
+
+// Actions recorded in the audit log.
+const (
+	Login                = "login"
+	LoginFailed          = "login.failed"
+	Logout               = "logout"
+	Register             = "register"
+	Activation           = "activation"
+	LinkRejected         = "link.rejected"
+	ProviderLinked       = "provider.linked"
+	TokenIssued          = "token.issued"
+	TokenRevoked         = "token.revoked"
+	UserEdited           = "user.edited"
+	SessionsRevoked      = "sessions.revoked"
+	ActivationSent       = "activation.sent"
+	ImpersonationStarted = "impersonation.started"
+	ImpersonationStopped = "impersonation.stopped"
+)
+
+// Event is an entry of the audit log.
+type Event struct {
+	ID int64 `datastore:"-"`
+	// Actor is the email of the user performing the action, if known.
+	Actor string `datastore:"actor"`
+	// Impersonator is the email of the administrator acting as the actor, if any.
+	Impersonator string `datastore:"impersonator,noindex"`
+	Action       string `datastore:"action"`
+	// Target is the email of the user affected by the action.
+	Target    string    `datastore:"target"`
+	Detail    string    `datastore:"detail,noindex"`
+	IP        string    `datastore:"ip,noindex"`
+	UserAgent string    `datastore:"user_agent,noindex"`
+	Time      time.Time `datastore:"time"`
+}
+
+// NewEvent returns an event of the action performed by the actor on the target,
+// with the origin of the request.
+func NewEvent(r *http.Request, action, actor, target string) *Event {
+	return &Event{
+		Actor:     actor,
+		Action:    action,
+		Target:    target,
+		IP:        r.RemoteAddr,
+		UserAgent: r.UserAgent(),
+		Time:      time.Now(),
+	}
+}
+
+// Record appends the event to the audit log.
+func Record(c appengine.Context, e *Event) error {
+	if e.Action == "" {
+		return errors.New("action can't be empty")
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, EventKind, nil), e)
+	if err != nil {
+		return err
+	}
+	e.ID = key.IntID()
+	return nil
+}
+
+// Filter selects the events of the audit log. Empty fields match any event.
+// Only one of the fields can be set, unless the datastore has an index for
+// the combination.
+type Filter struct {
+	Actor  string
+	Action string
+	Target string
+}
+
+// GetEvents returns at most limit events matching the filter, most recent
+// first, starting from the provided cursor, which is empty for the first page.
+// Returns the cursor of the next page, which is empty if there are no more events.
+func GetEvents(c appengine.Context, f Filter, limit int, cursor string) ([]*Event, string, error) {
+	if limit <= 0 {
+		return nil, "", errors.New("limit must be positive")
+	}
+
+	query := datastore.NewQuery(EventKind)
+	if f.Actor != "" {
+		query = query.Filter("actor =", f.Actor)
+	}
+	if f.Action != "" {
+		query = query.Filter("action =", f.Action)
+	}
+	if f.Target != "" {
+		query = query.Filter("target =", f.Target)
+	}
+	query = query.Order("-time").Limit(limit)
+
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(start)
+	}
+
+	events := make([]*Event, 0)
+
+	t := query.Run(c)
+	for {
+		var e Event
+		key, err := t.Next(&e)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		e.ID = key.IntID()
+		events = append(events, &e)
+	}
+
+	if len(events) < limit {
+		return events, "", nil
+	}
+
+	next, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return events, next.String(), nil
+}
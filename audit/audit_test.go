@@ -0,0 +1,57 @@
+package audit
+
+import (
+	"net/http"
+	"testing"
+
+	"appengine/aetest"
+)
+
+func TestEvents(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	r, _ := http.NewRequest("POST", "/auth/login", nil)
+	r.RemoteAddr = "10.0.0.1"
+	r.Header.Set("User-Agent", "test")
+
+	if err := Record(c, &Event{}); err == nil {
+		t.Errorf("Record: empty action: want error")
+	}
+
+	events := []*Event{
+		NewEvent(r, LoginFailed, "", "ana@petsy.ro"),
+		NewEvent(r, Login, "ana@petsy.ro", "ana@petsy.ro"),
+		NewEvent(r, Login, "ion@petsy.ro", "ion@petsy.ro"),
+	}
+	for _, e := range events {
+		if err := Record(c, e); err != nil {
+			t.Fatalf("Record: unexpected error: %v", err)
+		}
+	}
+
+	got, _, err := GetEvents(c, Filter{Target: "ana@petsy.ro"}, 10, "")
+	if err != nil {
+		t.Fatalf("GetEvents: unexpected error: %v", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("GetEvents: got %d events; want 2", len(got))
+	}
+	if got[0].IP != "10.0.0.1" || got[0].UserAgent != "test" {
+		t.Errorf("GetEvents: got origin %s %s; want 10.0.0.1 test", got[0].IP, got[0].UserAgent)
+	}
+
+	got, next, err := GetEvents(c, Filter{}, 2, "")
+	if err != nil {
+		t.Fatalf("GetEvents: unexpected error: %v", err)
+	}
+	if len(got) != 2 || next == "" {
+		t.Errorf("GetEvents: got %d events and cursor %q; want 2 and a cursor", len(got), next)
+	}
+	if got, _, _ = GetEvents(c, Filter{}, 2, next); len(got) != 1 {
+		t.Errorf("GetEvents: second page: got %d events; want 1", len(got))
+	}
+}
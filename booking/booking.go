@@ -0,0 +1,305 @@
+// Package booking holds the bookings of the sitters by the owners, and their
+// cancellation.
+//
+// Each booking is paid when made and keeps a snapshot of the cancellation
+// policy of the sitter, so that later changes of the policy don't apply to
+// it. Cancelling a booking refunds the owner by the policy, or in full if the
+// sitter cancelled, and counts against the sitter in their profile.
+package booking
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"petsy/payments"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const (
+	BookingKind = "booking"
+	ProfileKind = "booking_profile"
+)
+
+// States of the bookings.
+const (
+	Confirmed = "confirmed"
+	Cancelled = "cancelled"
+)
+
+// Parties cancelling a booking.
+const (
+	ByOwner  = "owner"
+	BySitter = "sitter"
+)
+
+var (
+	NoSuchBookingErr    = errors.New("no such booking")
+	AlreadyCancelledErr = errors.New("the booking is already cancelled")
+	StartedErr          = errors.New("the stay has already started")
+)
+
+// Booking is a stay booked by an owner with a sitter.
+type Booking struct {
+	ID       int64     `datastore:"-"`
+	Owner    int64     `datastore:"owner"`
+	Sitter   int64     `datastore:"sitter"`
+	Service  string    `datastore:"service,noindex"`
+	Start    time.Time `datastore:"start"`
+	End      time.Time `datastore:"end,noindex"`
+	Pets     int       `datastore:"pets,noindex"`
+	Amount   int64     `datastore:"amount,noindex"`
+	Currency string    `datastore:"currency,noindex"`
+	// Payment is the id of the payment of the booking.
+	Payment int64 `datastore:"payment"`
+	// Policy is the cancellation policy of the sitter when booked.
+	Policy string `datastore:"policy,noindex"`
+	State  string `datastore:"state"`
+
+	CancelledBy string    `datastore:"cancelled_by,noindex"`
+	Reason      string    `datastore:"reason,noindex"`
+	Cancelled   time.Time `datastore:"cancelled,noindex"`
+	// Refund is the amount refunded to the owner on cancellation.
+	Refund  int64     `datastore:"refund,noindex"`
+	Created time.Time `datastore:"created,noindex"`
+}
+
+// Profile is the booking profile of a sitter: their cancellation policy and
+// the number of bookings they had and cancelled.
+type Profile struct {
+	Policy        string `datastore:"policy,noindex"`
+	Bookings      int    `datastore:"bookings,noindex"`
+	Cancellations int    `datastore:"cancellations,noindex"`
+}
+
+// MinRatedBookings is the minimum number of bookings the cancellation rate
+// is computed over, so that a single cancellation of a new sitter doesn't
+// rank them last.
+const MinRatedBookings = 5
+
+// CancellationPenalty scales the distance of the sitters in the searches by
+// their cancellation rate: a sitter cancelling all their bookings is ranked
+// as if 1+CancellationPenalty times farther.
+const CancellationPenalty = 2
+
+// CancellationRate returns the share of the bookings cancelled by the sitter.
+func (p *Profile) CancellationRate() float32 {
+	bookings := p.Bookings
+	if bookings < MinRatedBookings {
+		bookings = MinRatedBookings
+	}
+	return float32(p.Cancellations) / float32(bookings)
+}
+
+// RankingFactor returns the factor applied to the distance of the sitter
+// when ranking the search results.
+func (p *Profile) RankingFactor() float64 {
+	return 1 + CancellationPenalty*float64(p.CancellationRate())
+}
+
+func bookingKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, BookingKind, "", id, nil)
+}
+
+func profileKey(c appengine.Context, sitterID int64) *datastore.Key {
+	return datastore.NewKey(c, ProfileKind, "", sitterID, nil)
+}
+
+// GetProfile returns the booking profile of the sitter, with the default
+// policy if none is stored.
+func GetProfile(c appengine.Context, sitterID int64) (*Profile, error) {
+	p := &Profile{}
+	if err := datastore.Get(c, profileKey(c, sitterID), p); err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+	if p.Policy == "" {
+		p.Policy = DefaultPolicy
+	}
+	return p, nil
+}
+
+// GetProfiles returns the booking profiles of the sitters, in the same order,
+// with the default policy if none is stored.
+func GetProfiles(c appengine.Context, sitterIDs []int64) ([]*Profile, error) {
+	keys := make([]*datastore.Key, len(sitterIDs))
+	profiles := make([]*Profile, len(sitterIDs))
+	for i, id := range sitterIDs {
+		keys[i] = profileKey(c, id)
+		profiles[i] = &Profile{}
+	}
+
+	err := datastore.GetMulti(c, keys, profiles)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, err := range merr {
+			if err != nil && err != datastore.ErrNoSuchEntity {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, p := range profiles {
+		if p.Policy == "" {
+			p.Policy = DefaultPolicy
+		}
+	}
+	return profiles, nil
+}
+
+// updateProfile changes the booking profile of the sitter by f. Must be
+// called in a datastore transaction.
+func updateProfile(tc appengine.Context, sitterID int64, f func(p *Profile)) error {
+	p, err := GetProfile(tc, sitterID)
+	if err != nil {
+		return err
+	}
+	f(p)
+	_, err = datastore.Put(tc, profileKey(tc, sitterID), p)
+	return err
+}
+
+// SetPolicy sets the cancellation policy of the sitter, applied to the
+// next bookings.
+func SetPolicy(c appengine.Context, sitterID int64, policy string) error {
+	if !ValidPolicy(policy) {
+		return UnknownPolicyErr
+	}
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		return updateProfile(tc, sitterID, func(p *Profile) {
+			p.Policy = policy
+		})
+	}, nil)
+}
+
+// Get returns the booking, or nil if there is none.
+func Get(c appengine.Context, id int64) (*Booking, error) {
+	b := &Booking{}
+	if err := datastore.Get(c, bookingKey(c, id), b); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	b.ID = id
+	return b, nil
+}
+
+// Book charges the owner for the booking and stores it, paid, with the
+// current policy of the sitter. The booking is stored in the transaction
+// holding the payment, so that no payment is held without its booking. The
+// key is chosen by the client for the booking, so that retrying it charges
+// the owner and stores the booking once. The booking must have its owner,
+// sitter, stay, amount and currency set.
+func Book(c appengine.Context, provider payments.Provider, b *Booking, source, key string) error {
+	p := &payments.Payment{
+		Owner:    b.Owner,
+		Sitter:   b.Sitter,
+		Amount:   b.Amount,
+		Currency: b.Currency,
+		Start:    b.Start,
+	}
+	err := payments.Charge(c, provider, p, source, key, func(tc appengine.Context, p *payments.Payment) error {
+		b.Payment = p.ID
+		return create(tc, b)
+	})
+	if err != nil || b.ID != 0 {
+		return err
+	}
+
+	// The payment was already held by a previous attempt, with the booking.
+	stored, err := Get(c, p.ID)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		return NoSuchBookingErr
+	}
+	*b = *stored
+	return nil
+}
+
+// create stores the paid booking, keyed by the id of its payment, with the
+// current policy of the sitter. Must be called in a datastore transaction.
+func create(tc appengine.Context, b *Booking) error {
+	profile, err := GetProfile(tc, b.Sitter)
+	if err != nil {
+		return err
+	}
+	b.Policy = profile.Policy
+	b.State = Confirmed
+	b.Created = time.Now()
+
+	key := bookingKey(tc, b.Payment)
+	if _, err := datastore.Put(tc, key, b); err != nil {
+		return err
+	}
+	b.ID = key.IntID()
+
+	profile.Bookings++
+	_, err = datastore.Put(tc, profileKey(tc, b.Sitter), profile)
+	return err
+}
+
+// Cancel cancels the booking before the stay starts, refunding the owner
+// through the provider by the policy of the booking. The cancellations of
+// the sitters are counted in their profile. The booking is cancelled, with
+// its refund, before the owner is refunded, so that the refund is the one of
+// the party cancelling first. Retrying a cancellation by the same party
+// finishes its refund, once.
+func Cancel(c appengine.Context, provider payments.Provider, id int64, by, reason string, now time.Time) (*Booking, error) {
+	var b *Booking
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var err error
+		if b, err = Get(tc, id); err != nil {
+			return err
+		}
+		if b == nil {
+			return NoSuchBookingErr
+		}
+		if b.State == Cancelled {
+			if b.CancelledBy != by {
+				return AlreadyCancelledErr
+			}
+			// A retry, whose refund may have failed.
+			return nil
+		}
+		if !now.Before(b.Start) {
+			return StartedErr
+		}
+
+		refund, err := RefundAmount(b.Policy, b.Amount, b.Start, now, by)
+		if err != nil {
+			return err
+		}
+		b.State = Cancelled
+		b.CancelledBy = by
+		b.Reason = reason
+		b.Cancelled = now
+		b.Refund = refund
+		if _, err := datastore.Put(tc, bookingKey(tc, id), b); err != nil {
+			return err
+		}
+
+		if by != BySitter {
+			return nil
+		}
+		return updateProfile(tc, b.Sitter, func(p *Profile) {
+			p.Cancellations++
+		})
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Refund > 0 {
+		// The refund key is the booking, so that a retried cancellation
+		// is refunded once.
+		if _, err := payments.Refund(c, provider, b.Payment, "cancel:"+strconv.FormatInt(id, 10), b.Refund); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,165 @@
+package booking
+
+import (
+	"testing"
+	"time"
+
+	"petsy/payments"
+
+	"appengine"
+	"appengine/aetest"
+)
+
+func TestRefundPercent(t *testing.T) {
+	start := time.Date(2015, 6, 15, 10, 0, 0, 0, time.UTC)
+	before := func(d time.Duration) time.Time { return start.Add(-d) }
+
+	tests := []struct {
+		policy    string
+		cancelled time.Time
+		by        string
+		want      int
+	}{
+		{Flexible, before(2 * day), ByOwner, 100},
+		{Flexible, before(day), ByOwner, 100},
+		{Flexible, before(time.Hour), ByOwner, 50},
+		{Moderate, before(7 * day), ByOwner, 100},
+		{Moderate, before(3 * day), ByOwner, 50},
+		{Moderate, before(time.Hour), ByOwner, 0},
+		{Strict, before(30 * day), ByOwner, 50},
+		{Strict, before(10 * day), ByOwner, 0},
+		{Flexible, start.Add(time.Hour), ByOwner, 0},
+		{Strict, before(time.Hour), BySitter, 100},
+	}
+
+	for _, test := range tests {
+		got, err := RefundPercent(test.policy, start, test.cancelled, test.by)
+		if err != nil {
+			t.Errorf("RefundPercent(%s, %v): unexpected error: %v", test.policy, start.Sub(test.cancelled), err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("RefundPercent(%s, %v, %s): got %d; want %d",
+				test.policy, start.Sub(test.cancelled), test.by, got, test.want)
+		}
+	}
+
+	if _, err := RefundPercent("lenient", start, start, ByOwner); err != UnknownPolicyErr {
+		t.Errorf("RefundPercent: got error %v; want %v", err, UnknownPolicyErr)
+	}
+
+	if amount, _ := RefundAmount(Moderate, 33333, start, before(2*day), ByOwner); amount != 16667 {
+		t.Errorf("RefundAmount: got %d; want 16667", amount)
+	}
+}
+
+func TestProfile(t *testing.T) {
+	tests := []struct {
+		profile Profile
+		rate    float32
+		factor  float64
+	}{
+		{Profile{}, 0, 1},
+		{Profile{Bookings: 1, Cancellations: 1}, 0.2, 1.4},
+		{Profile{Bookings: 20, Cancellations: 5}, 0.25, 1.5},
+		{Profile{Bookings: 10, Cancellations: 10}, 1, 3},
+	}
+
+	for _, test := range tests {
+		if rate := test.profile.CancellationRate(); rate != test.rate {
+			t.Errorf("CancellationRate(%+v): got %v; want %v", test.profile, rate, test.rate)
+		}
+		if factor := test.profile.RankingFactor(); factor-test.factor > 1e-6 || test.factor-factor > 1e-6 {
+			t.Errorf("RankingFactor(%+v): got %v; want %v", test.profile, factor, test.factor)
+		}
+	}
+
+	for _, policy := range Policies {
+		if !ValidPolicy(policy) {
+			t.Errorf("ValidPolicy(%s): got false; want true", policy)
+		}
+	}
+}
+
+func TestBookAndCancel(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	provider := payments.NewFakeProvider(func(c appengine.Context) ([]byte, error) {
+		return []byte("webhook secret"), nil
+	})
+	start := time.Date(2015, 6, 15, 10, 0, 0, 0, time.UTC)
+	newBooking := func() *Booking {
+		return &Booking{Owner: 1, Sitter: 2, Service: "boarding", Start: start, End: start.Add(2 * day),
+			Pets: 1, Amount: 40000, Currency: "RON"}
+	}
+
+	if err := SetPolicy(c, 2, Strict); err != nil {
+		t.Fatalf("SetPolicy: unexpected error: %v", err)
+	}
+
+	// Retrying a booking with the same key charges and stores it once.
+	b := newBooking()
+	if err := Book(c, provider, b, "tok_card", "book-1"); err != nil {
+		t.Fatalf("Book: unexpected error: %v", err)
+	}
+	retried := newBooking()
+	if err := Book(c, provider, retried, "tok_card", "book-1"); err != nil {
+		t.Fatalf("Book: retry: unexpected error: %v", err)
+	}
+	if retried.ID != b.ID || retried.Policy != Strict || retried.State != Confirmed {
+		t.Errorf("Book: retry: got booking %d, policy %s, state %s; want %d, %s, %s",
+			retried.ID, retried.Policy, retried.State, b.ID, Strict, Confirmed)
+	}
+	if p, _ := GetProfile(c, 2); p.Bookings != 1 {
+		t.Errorf("Book: got %d bookings in the profile; want 1", p.Bookings)
+	}
+
+	// The strict policy refunds nothing 10 days before the stay.
+	cancelled, err := Cancel(c, provider, b.ID, ByOwner, "plans changed", start.Add(-10*day))
+	if err != nil {
+		t.Fatalf("Cancel: unexpected error: %v", err)
+	}
+	if cancelled.State != Cancelled || cancelled.CancelledBy != ByOwner || cancelled.Refund != 0 {
+		t.Errorf("Cancel: got state %s, by %s, refund %d; want %s, %s, 0",
+			cancelled.State, cancelled.CancelledBy, cancelled.Refund, Cancelled, ByOwner)
+	}
+	if _, err := Cancel(c, provider, b.ID, BySitter, "sick", start.Add(-10*day)); err != AlreadyCancelledErr {
+		t.Errorf("Cancel: by the other party: got error %v; want %v", err, AlreadyCancelledErr)
+	}
+
+	// The sitter cancelling refunds the owner in full, once, and counts
+	// against the sitter.
+	b = newBooking()
+	if err := Book(c, provider, b, "tok_card", "book-2"); err != nil {
+		t.Fatalf("Book: unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		cancelled, err = Cancel(c, provider, b.ID, BySitter, "sick", start.Add(-time.Hour))
+		if err != nil {
+			t.Fatalf("Cancel: attempt %d: unexpected error: %v", i+1, err)
+		}
+		if cancelled.Refund != 40000 {
+			t.Errorf("Cancel: attempt %d: got refund %d; want 40000", i+1, cancelled.Refund)
+		}
+	}
+	p, err := payments.GetPayment(c, b.Payment)
+	if err != nil {
+		t.Fatalf("GetPayment: unexpected error: %v", err)
+	}
+	if _, refunded, _ := provider.Charge(p.Charge); refunded != 40000 || p.Refunded != 40000 {
+		t.Errorf("Cancel: got %d refunded by the provider and %d by the payment; want 40000",
+			refunded, p.Refunded)
+	}
+	if profile, _ := GetProfile(c, 2); profile.Bookings != 2 || profile.Cancellations != 1 {
+		t.Errorf("Cancel: got %d bookings and %d cancellations in the profile; want 2 and 1",
+			profile.Bookings, profile.Cancellations)
+	}
+
+	if _, err := Cancel(c, provider, b.ID+1000, ByOwner, "", start.Add(-day)); err != NoSuchBookingErr {
+		t.Errorf("Cancel: missing booking: got error %v; want %v", err, NoSuchBookingErr)
+	}
+}
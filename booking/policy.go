@@ -0,0 +1,81 @@
+// Part of booking package. Cancellation policies of the sitters.
+
+package booking
+
+import (
+	"errors"
+	"time"
+)
+
+// Cancellation policies.
+const (
+	Flexible = "flexible"
+	Moderate = "moderate"
+	Strict   = "strict"
+)
+
+// DefaultPolicy is the policy of the sitters not choosing one.
+const DefaultPolicy = Moderate
+
+var Policies = []string{Flexible, Moderate, Strict}
+
+var UnknownPolicyErr = errors.New("unknown cancellation policy")
+
+// refundRule refunds the percentage of the payment for the cancellations
+// made at least the notice before the start of the stay.
+type refundRule struct {
+	Notice  time.Duration
+	Percent int
+}
+
+const day = 24 * time.Hour
+
+// refundRules are the rules of the policies, by decreasing notice.
+var refundRules = map[string][]refundRule{
+	// Full refund until the day before, half of it afterwards.
+	Flexible: {{day, 100}, {0, 50}},
+	// Full refund until a week before, half of it until the day before.
+	Moderate: {{7 * day, 100}, {day, 50}},
+	// Half refund until two weeks before.
+	Strict: {{14 * day, 50}},
+}
+
+// ValidPolicy checks if the policy exists.
+func ValidPolicy(policy string) bool {
+	_, ok := refundRules[policy]
+	return ok
+}
+
+// RefundPercent returns the percentage of the payment refunded to the owner
+// by the policy, for a cancellation at the time. The cancellations of the
+// sitters are always refunded in full.
+func RefundPercent(policy string, start, cancelled time.Time, by string) (int, error) {
+	rules, ok := refundRules[policy]
+	if !ok {
+		return 0, UnknownPolicyErr
+	}
+	if by == BySitter {
+		return 100, nil
+	}
+
+	notice := start.Sub(cancelled)
+	if notice < 0 {
+		return 0, nil
+	}
+	for _, rule := range rules {
+		if notice >= rule.Notice {
+			return rule.Percent, nil
+		}
+	}
+	return 0, nil
+}
+
+// RefundAmount returns the amount of the payment refunded by the policy,
+// rounded half up.
+func RefundAmount(policy string, amount int64, start, cancelled time.Time, by string) (int64, error) {
+	p, err := RefundPercent(policy, start, cancelled, by)
+	if err != nil {
+		return 0, err
+	}
+	return (amount*int64(p) + 50) / 100, nil
+}
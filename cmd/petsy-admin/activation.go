@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"petsy/migrate"
+	petsyuser "petsy/user"
+)
+
+func init() {
+	commands["resend-activation"] = &command{
+		usage: "[-app url] email",
+		help: "asks the application to send a new activation link to the user, " +
+			"authenticated by the personal token of an administrator set in PETSY_TOKEN",
+		run: resendActivation,
+	}
+}
+
+// appClient calls the administration API of the application. The activation
+// links are sent by the application, which holds the secrets and the mail queue.
+type appClient struct {
+	baseURL string
+	token   string
+}
+
+// do sends the request and decodes the JSON response into resp, if not nil.
+func (a *appClient) do(method, path string, resp interface{}) error {
+	req, err := http.NewRequest(method, a.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	req.Header.Set("Accept", "application/json")
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if r.StatusCode != http.StatusOK {
+		var appErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &appErr) == nil && appErr.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, path, appErr.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, r.Status)
+	}
+
+	if resp == nil {
+		return nil
+	}
+	return json.Unmarshal(body, resp)
+}
+
+func resendActivation(s migrate.Store, args []string) error {
+	fs := newFlagSet("resend-activation")
+	app := fs.String("app", os.Getenv("PETSY_URL"), "base URL of the application")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("the email of the user is required")
+	}
+
+	token := os.Getenv("PETSY_TOKEN")
+	if *app == "" || token == "" {
+		return errors.New("the application URL and the PETSY_TOKEN environment variable are required")
+	}
+	client := &appClient{strings.TrimRight(*app, "/"), token}
+
+	email := petsyuser.CanonicalEmail(fs.Arg(0))
+	var users []struct {
+		ID     int64
+		Email  string
+		Active bool
+	}
+	if err := client.do("GET", "/api/admin/users?q="+url.QueryEscape(email), &users); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		if petsyuser.CanonicalEmail(u.Email) != email {
+			continue
+		}
+		if u.Active {
+			return errors.New("the user is already activated")
+		}
+		if err := client.do("POST", "/api/admin/users/"+strconv.FormatInt(u.ID, 10)+"/resend-activation", nil); err != nil {
+			return err
+		}
+		fmt.Printf("sent a new activation link to %s\n", u.Email)
+		return nil
+	}
+	return noSuchUserErr
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"petsy/hashstore"
+	"petsy/migrate"
+)
+
+func init() {
+	commands["hashstore-list"] = &command{
+		usage: "[-scope scope] [-value value]",
+		help:  "lists the hashstore entries, whose keys are hashed",
+		run:   listHashstore,
+	}
+	commands["hashstore-purge"] = &command{
+		usage:  "-scope scope [-value value] [-expired]",
+		help:   "deletes the hashstore entries of the scope",
+		writes: true,
+		run:    purgeHashstore,
+	}
+}
+
+// hashstoreFilter selects the hashstore entries by scope and value.
+type hashstoreFilter struct {
+	scope, value string
+	expired      bool
+}
+
+func (f *hashstoreFilter) matches(entry *hashstore.Entry) bool {
+	return (f.scope == "" || entry.Scope == f.scope) &&
+		(f.value == "" || entry.Value == f.value) &&
+		(!f.expired || entry.Expired())
+}
+
+// scanHashstore calls fn for the entries matching the filter.
+func scanHashstore(s migrate.Store, f *hashstoreFilter, fn func(e *migrate.Entity, entry *hashstore.Entry) error) error {
+	return scanAll(s, hashstore.HashKind, func(e *migrate.Entity) error {
+		var entry hashstore.Entry
+		if err := loadEntity(e, &entry); err != nil {
+			return fmt.Errorf("entry %s: %v", e.Key, err)
+		}
+		if !f.matches(&entry) {
+			return nil
+		}
+		return fn(e, &entry)
+	})
+}
+
+func listHashstore(s migrate.Store, args []string) error {
+	fs := newFlagSet("hashstore-list")
+	var f hashstoreFilter
+	fs.StringVar(&f.scope, "scope", "", "only list the entries of the scope")
+	fs.StringVar(&f.value, "value", "", "only list the entries having the value")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SCOPE\tVALUE\tGENERATED\tEXPIRES\tEXPIRED\tHASHED")
+
+	err := scanHashstore(s, &f, func(e *migrate.Entity, entry *hashstore.Entry) error {
+		_, err := fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%v\t%v\n",
+			entry.Scope, entry.Value,
+			entry.Generated.Format(time.RFC3339), entry.Generated.Add(entry.Valid).Format(time.RFC3339),
+			entry.Expired(), entry.Hashed)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func purgeHashstore(s migrate.Store, args []string) error {
+	fs := newFlagSet("hashstore-purge")
+	var f hashstoreFilter
+	fs.StringVar(&f.scope, "scope", "", "scope of the deleted entries")
+	fs.StringVar(&f.value, "value", "", "only delete the entries having the value")
+	fs.BoolVar(&f.expired, "expired", false, "only delete the expired entries")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if f.scope == "" {
+		fs.Usage()
+		return errors.New("the scope is required")
+	}
+
+	var keys []string
+	err := scanHashstore(s, &f, func(e *migrate.Entity, entry *hashstore.Entry) error {
+		keys = append(keys, e.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The entries are deleted once scanned, so that the cursors stay valid.
+	for start := 0; start < len(keys); start += migrate.MaxBatchSize {
+		end := start + migrate.MaxBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := s.Delete(nil, hashstore.HashKind, keys[start:end]); err != nil {
+			return fmt.Errorf("deleted %d of %d entries: %v", start, len(keys), err)
+		}
+	}
+
+	fmt.Printf("deleted %d entries of scope %s\n", len(keys), f.scope)
+	return nil
+}
@@ -0,0 +1,174 @@
+// Command petsy-admin performs the operations on the users, the hashstore and
+// the migrations of Petsy from the command line.
+//
+// It works on the same stores as the migrations: either the Cloud Datastore
+// emulator used by the development server, or a JSON snapshot file kept in
+// memory and written back after the commands changing it. The migrations
+// are the ones registered by the packages it imports, as for the application,
+// but those needing the context of the application, like the migrations of
+// the hashstore keys and of the canonical emails, only run in it through
+// /api/internal/migrations/run: petsy-admin stops at them and only shows
+// their progress.
+//
+// Usage:
+//
+//	petsy-admin [-emulator host:port -project id | -snapshot file] command [arguments]
+//
+// The emulator address and the project default to the DATASTORE_EMULATOR_HOST
+// and DATASTORE_PROJECT_ID environment variables. Run "petsy-admin help" for
+// the list of commands.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"petsy/migrate"
+)
+
+// command is a subcommand of petsy-admin.
+type command struct {
+	usage string
+	help  string
+	// writes is true if the command changes the store.
+	writes bool
+	run    func(s migrate.Store, args []string) error
+}
+
+// commands holds the subcommands, by name. Each file adds its own.
+var commands = map[string]*command{}
+
+var (
+	emulatorHost = flag.String("emulator", os.Getenv("DATASTORE_EMULATOR_HOST"), "host:port of the datastore emulator")
+	project      = flag.String("project", os.Getenv("DATASTORE_PROJECT_ID"), "project id of the datastore emulator")
+	snapshotFile = flag.String("snapshot", "", "JSON snapshot file used instead of the emulator")
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: petsy-admin [-emulator host:port -project id | -snapshot file] command [arguments]")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "\nCommands:")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %s %s\n    \t%s\n", name, commands[name].usage, commands[name].help)
+	}
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || flag.Arg(0) == "help" {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "petsy-admin: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	if err := runCommand(cmd, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "petsy-admin: %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// runCommand runs the command on the chosen store, writing the snapshot back
+// if the command changed it.
+func runCommand(cmd *command, args []string) error {
+	if *snapshotFile == "" {
+		if *emulatorHost == "" || *project == "" {
+			return fmt.Errorf("either -snapshot or -emulator and -project must be set")
+		}
+		return cmd.run(&migrate.EmulatorStore{Host: *emulatorHost, Project: *project}, args)
+	}
+
+	s, err := readSnapshot(*snapshotFile)
+	if err != nil {
+		return err
+	}
+	if err := cmd.run(s, args); err != nil {
+		return err
+	}
+	if !cmd.writes {
+		return nil
+	}
+	return writeSnapshot(*snapshotFile, s)
+}
+
+// readSnapshot returns the store of the snapshot file, which is empty if the
+// file does not exist yet.
+func readSnapshot(name string) (*migrate.MemoryStore, error) {
+	s := migrate.NewMemoryStore()
+
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := s.ReadSnapshot(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return s, nil
+}
+
+// writeSnapshot replaces the snapshot file, so that it is left unchanged
+// if writing fails.
+func writeSnapshot(name string, s *migrate.MemoryStore) error {
+	tmp := filepath.Join(filepath.Dir(name), "."+filepath.Base(name)+".tmp")
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := s.WriteSnapshot(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, name)
+}
+
+// newFlagSet returns the flags of the command, printing its usage on errors.
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: petsy-admin %s %s\n", name, commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// readSecret reads a line of the standard input, used for the passwords so
+// that they do not end up in the shell history.
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"petsy/hashstore"
+	"petsy/migrate"
+	petsyuser "petsy/user"
+
+	"appengine/datastore"
+)
+
+func TestSnapshotFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "petsy-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "snapshot.json")
+
+	s, err := readSnapshot(name)
+	if err != nil {
+		t.Fatalf("readSnapshot: missing file: unexpected error: %v", err)
+	}
+	s.Add("user", &migrate.Entity{Key: "user:1", Properties: datastore.PropertyList{{Name: "email", Value: "ana@petsy.ro"}}})
+
+	if err := writeSnapshot(name, s); err != nil {
+		t.Fatalf("writeSnapshot: unexpected error: %v", err)
+	}
+	if s, err = readSnapshot(name); err != nil {
+		t.Fatalf("readSnapshot: unexpected error: %v", err)
+	}
+	if users := s.Entities("user"); len(users) != 1 || users[0].Key != "user:1" {
+		t.Errorf("readSnapshot: got users %+v; want user:1", users)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".snapshot.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("writeSnapshot: temporary file left behind")
+	}
+}
+
+func TestHashstoreFilter(t *testing.T) {
+	expired := &hashstore.Entry{Value: "ana@petsy.ro", Scope: "register", Generated: time.Now().Add(-2 * time.Hour), Valid: time.Hour}
+	valid := &hashstore.Entry{Value: "maria@petsy.ro", Scope: "register", Generated: time.Now(), Valid: time.Hour}
+
+	tests := []struct {
+		filter         hashstoreFilter
+		expired, valid bool
+	}{
+		{hashstoreFilter{}, true, true},
+		{hashstoreFilter{scope: "register"}, true, true},
+		{hashstoreFilter{scope: "password"}, false, false},
+		{hashstoreFilter{scope: "register", value: "ana@petsy.ro"}, true, false},
+		{hashstoreFilter{scope: "register", expired: true}, true, false},
+	}
+
+	for _, test := range tests {
+		if got := test.filter.matches(expired); got != test.expired {
+			t.Errorf("matches(%+v, expired entry): got %v; want %v", test.filter, got, test.expired)
+		}
+		if got := test.filter.matches(valid); got != test.valid {
+			t.Errorf("matches(%+v, valid entry): got %v; want %v", test.filter, got, test.valid)
+		}
+	}
+}
+
+func TestInsertUser(t *testing.T) {
+	s := migrate.NewMemoryStore()
+
+	user, _ := petsyuser.NewUser("Ana", "Ana@Petsy.ro")
+	if _, err := insertUser(s, user); err != nil {
+		t.Fatalf("insertUser: unexpected error: %v", err)
+	}
+	if emails := s.Entities(petsyuser.EmailKind); len(emails) != 1 || emails[0].Key != "user_email:ana@petsy.ro" {
+		t.Errorf("insertUser: got reservations %+v; want ana@petsy.ro", emails)
+	}
+
+	other, _ := petsyuser.NewUser("Ana", "ana@petsy.ro")
+	if _, err := insertUser(s, other); err != petsyuser.DuplicateEmailErr {
+		t.Errorf("insertUser: got %v for a reserved email; want DuplicateEmailErr", err)
+	}
+	if users := s.Entities(petsyuser.UserKind); len(users) != 1 {
+		t.Errorf("insertUser: got %d users; want 1", len(users))
+	}
+}
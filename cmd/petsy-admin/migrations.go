@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"petsy/migrate"
+)
+
+func init() {
+	commands["migrations"] = &command{
+		usage: "",
+		help:  "shows the progress of the migrations",
+		run:   showMigrations,
+	}
+	commands["migrate"] = &command{
+		usage:  "[-batch size] [-batches n] [-reset version]",
+		help:   "runs the pending migrations, up to the first one needing the application",
+		writes: true,
+		run:    runMigrations,
+	}
+}
+
+func printMigrations(status []*migrate.Progress) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tKIND\tDESCRIPTION\tSCANNED\tMIGRATED\tCOLLISIONS\tDONE\tUPDATED")
+	for _, p := range status {
+		updated := ""
+		if !p.Updated.IsZero() {
+			updated = p.Updated.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%d\t%v\t%s\n",
+			p.Version, p.Kind, p.Description, p.Scanned, p.Migrated, p.Collisions, p.Done, updated)
+	}
+	return w.Flush()
+}
+
+func showMigrations(s migrate.Store, args []string) error {
+	status, err := migrate.Status(nil, s)
+	if err != nil {
+		return err
+	}
+	return printMigrations(status)
+}
+
+func runMigrations(s migrate.Store, args []string) error {
+	fs := newFlagSet("migrate")
+	batch := fs.Int("batch", 100, "number of entities of a batch")
+	batches := fs.Int("batches", 0, "maximum number of batches run, all if 0")
+	reset := fs.Int("reset", 0, "version of a migration run again from the start")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *reset != 0 {
+		if err := migrate.Reset(nil, s, *reset); err != nil {
+			return err
+		}
+	}
+
+	status, err := migrate.Run(nil, s, *batch, *batches)
+	if status != nil {
+		printMigrations(status)
+	}
+	return err
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"petsy/migrate"
+	petsyuser "petsy/user"
+	"petsy/validation"
+
+	"appengine/datastore"
+)
+
+// Minimum length of the passwords set by petsy-admin, as for the registration.
+const minPasswordLength = 8
+
+var noSuchUserErr = errors.New("no user with this email")
+
+func init() {
+	commands["create-user"] = &command{
+		usage:  "[-active] [-locale locale] [-role role] name email",
+		help:   "creates a user, reading the password from the standard input",
+		writes: true,
+		run:    createUser,
+	}
+	commands["activate"] = &command{
+		usage:  "email",
+		help:   "activates the user",
+		writes: true,
+		run: func(s migrate.Store, args []string) error {
+			return setActive(s, args, true)
+		},
+	}
+	commands["deactivate"] = &command{
+		usage:  "email",
+		help:   "deactivates the user and revokes their sessions",
+		writes: true,
+		run: func(s migrate.Store, args []string) error {
+			return setActive(s, args, false)
+		},
+	}
+	commands["reset-password"] = &command{
+		usage:  "email",
+		help:   "sets the password of the user, read from the standard input, and revokes their sessions",
+		writes: true,
+		run:    resetPassword,
+	}
+	commands["export-users"] = &command{
+		usage: "[-o file]",
+		help:  "exports the users as CSV",
+		run:   exportUsers,
+	}
+}
+
+// scanAll calls f for all the entities of the kind, batch by batch.
+func scanAll(s migrate.Store, kind string, f func(e *migrate.Entity) error) error {
+	cursor := ""
+	for {
+		entities, next, err := s.Scan(nil, kind, migrate.MaxBatchSize, cursor)
+		if err != nil {
+			return err
+		}
+		for _, e := range entities {
+			if err := f(e); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// loadEntity sets the fields of dst from the entity. The properties without
+// a field are ignored.
+func loadEntity(e *migrate.Entity, dst interface{}) error {
+	err := e.Load(dst)
+	if _, ok := err.(*datastore.ErrFieldMismatch); ok {
+		return nil
+	}
+	return err
+}
+
+// saveEntity replaces the properties of the entity with the fields of src,
+// keeping the properties without a field.
+func saveEntity(e *migrate.Entity, src interface{}) error {
+	saved := &migrate.Entity{Key: e.Key}
+	if err := saved.Save(src); err != nil {
+		return err
+	}
+
+	fields := make(map[string]bool)
+	for _, p := range saved.Properties {
+		fields[p.Name] = true
+	}
+	for _, p := range e.Properties {
+		if !fields[p.Name] {
+			saved.Properties = append(saved.Properties, p)
+		}
+	}
+	e.Properties = saved.Properties
+	return nil
+}
+
+// findUser returns the user having the email, compared in canonical form.
+// The users stored before their canonical email are found by their email.
+// Returns noSuchUserErr if there is none.
+func findUser(s migrate.Store, email string) (*migrate.Entity, *petsyuser.User, error) {
+	found, err := s.Find(nil, petsyuser.UserKind, "canonical_email", petsyuser.CanonicalEmail(email), 1)
+	if err == nil && len(found) == 0 {
+		found, err = s.Find(nil, petsyuser.UserKind, "email", email, 1)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil, noSuchUserErr
+	}
+
+	var user petsyuser.User
+	if err := loadEntity(found[0], &user); err != nil {
+		return nil, nil, fmt.Errorf("user %s: %v", found[0].Key, err)
+	}
+	return found[0], &user, nil
+}
+
+// putUser saves the user in the entity of a stored user, whose email is
+// unchanged.
+func putUser(s migrate.Store, e *migrate.Entity, user *petsyuser.User) error {
+	user.CanonicalEmail = petsyuser.CanonicalEmail(user.Email)
+	if err := saveEntity(e, user); err != nil {
+		return err
+	}
+	return s.Put(nil, petsyuser.UserKind, []*migrate.Entity{e})
+}
+
+// insertUser adds the user along with the reservation of their canonical
+// email, as the application does. Returns DuplicateEmailErr if another user
+// owns the email. The users stored before their reservation are only found
+// by findUser.
+func insertUser(s migrate.Store, user *petsyuser.User) (*migrate.Entity, error) {
+	user.CanonicalEmail = petsyuser.CanonicalEmail(user.Email)
+
+	key, id, err := s.NewKey(nil, petsyuser.UserKind, "")
+	if err != nil {
+		return nil, err
+	}
+	e := &migrate.Entity{Key: key}
+	if err := saveEntity(e, user); err != nil {
+		return nil, err
+	}
+
+	emailKey, _, err := s.NewKey(nil, petsyuser.EmailKind, user.CanonicalEmail)
+	if err != nil {
+		return nil, err
+	}
+	reservation := &migrate.Entity{Key: emailKey}
+	if err := reservation.Save(&petsyuser.UserEmail{id}); err != nil {
+		return nil, err
+	}
+
+	err = s.Insert(nil, []migrate.KindEntity{
+		{petsyuser.UserKind, e},
+		{petsyuser.EmailKind, reservation},
+	})
+	if err == migrate.ExistsErr {
+		return nil, petsyuser.DuplicateEmailErr
+	}
+	return e, err
+}
+
+// readPassword reads the password from the standard input and checks its length.
+func readPassword() (string, error) {
+	pass, err := readSecret("Password: ")
+	if err != nil {
+		return "", err
+	}
+	if len([]rune(pass)) < minPasswordLength {
+		return "", fmt.Errorf("the password must be at least %d characters long", minPasswordLength)
+	}
+	return pass, nil
+}
+
+func createUser(s migrate.Store, args []string) error {
+	fs := newFlagSet("create-user")
+	active := fs.Bool("active", false, "create the user already activated")
+	locale := fs.String("locale", "", "language of the pages and emails of the user")
+	role := fs.String("role", "", "authorization role granted to the user")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return errors.New("name and email are required")
+	}
+	name, email := strings.TrimSpace(fs.Arg(0)), strings.TrimSpace(fs.Arg(1))
+
+	if !validation.IsEmail(email) {
+		return petsyuser.InvalidEmailErr
+	}
+	if _, _, err := findUser(s, email); err != noSuchUserErr {
+		if err != nil {
+			return err
+		}
+		return petsyuser.DuplicateEmailErr
+	}
+
+	user, err := petsyuser.NewUser(name, email)
+	if err != nil {
+		return err
+	}
+	user.Active = *active
+	if *locale != "" {
+		if err := user.SetLocale(*locale); err != nil {
+			return err
+		}
+	}
+	if *role != "" {
+		if err := user.AddRole(*role); err != nil {
+			return err
+		}
+	}
+
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err := user.SetPassword(pass); err != nil {
+		return err
+	}
+
+	e, err := insertUser(s, user)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created user %s with key %s\n", user.Email, e.Key)
+	return nil
+}
+
+// userArg returns the user whose email is the only argument.
+func userArg(s migrate.Store, name string, args []string) (*migrate.Entity, *petsyuser.User, error) {
+	if len(args) != 1 {
+		return nil, nil, fmt.Errorf("usage: petsy-admin %s %s", name, commands[name].usage)
+	}
+	return findUser(s, args[0])
+}
+
+func setActive(s migrate.Store, args []string, active bool) error {
+	name := "activate"
+	if !active {
+		name = "deactivate"
+	}
+
+	e, user, err := userArg(s, name, args)
+	if err != nil {
+		return err
+	}
+
+	user.Active = active
+	if !active {
+		user.RevokeSessions()
+	}
+	if err := putUser(s, e, user); err != nil {
+		return err
+	}
+	fmt.Printf("%sd user %s\n", name, user.Email)
+	return nil
+}
+
+func resetPassword(s migrate.Store, args []string) error {
+	e, user, err := userArg(s, "reset-password", args)
+	if err != nil {
+		return err
+	}
+
+	pass, err := readPassword()
+	if err != nil {
+		return err
+	}
+	if err := user.SetPassword(pass); err != nil {
+		return err
+	}
+	user.RevokeSessions()
+
+	if err := putUser(s, e, user); err != nil {
+		return err
+	}
+	fmt.Printf("reset the password of user %s\n", user.Email)
+	return nil
+}
+
+// userColumns are the columns of the exported users.
+var userColumns = []string{"key", "name", "email", "active", "roles", "providers", "locale", "unsubscribed"}
+
+func exportUsers(s migrate.Store, args []string) error {
+	fs := newFlagSet("export-users")
+	out := fs.String("o", "", "file written instead of the standard output")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f := os.Stdout
+	if *out != "" {
+		var err error
+		if f, err = os.Create(*out); err != nil {
+			return err
+		}
+		defer f.Close()
+	}
+
+	w := csv.NewWriter(f)
+	w.Write(userColumns)
+
+	err := scanAll(s, petsyuser.UserKind, func(e *migrate.Entity) error {
+		var u petsyuser.User
+		if err := loadEntity(e, &u); err != nil {
+			return fmt.Errorf("user %s: %v", e.Key, err)
+		}
+
+		providers := make([]string, len(u.Providers))
+		for i, p := range u.Providers {
+			providers[i] = p.Name
+		}
+		return w.Write([]string{
+			e.Key,
+			u.Name,
+			u.Email,
+			strconv.FormatBool(u.Active),
+			strings.Join(u.GetRoles(), " "),
+			strings.Join(providers, " "),
+			u.Locale,
+			strings.Join(u.Unsubscribed, " "),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	w.Flush()
+	return w.Error()
+}
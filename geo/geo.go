@@ -0,0 +1,218 @@
+// Package geo stores the locations of the sitters and finds the ones within
+// a distance of a point.
+//
+// The datastore can't filter a range on both the latitude and the longitude,
+// so each location is indexed by the geohash cells containing it, at several
+// precisions. A query looks up the cells covering the searched circle and
+// keeps the locations within its radius, sorted by their exact distance.
+package geo
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const LocationKind = "location"
+
+// EarthRadius is the mean radius of the Earth, in kilometers.
+const EarthRadius = 6371.0088
+
+// IndexPrecisions are the lengths of the geohashes indexed for each location,
+// in increasing order. Their cells are about 1250x625 km, 156x156 km,
+// 39x19.5 km, 4.9x4.9 km and 1.2x0.6 km large at the equator.
+var IndexPrecisions = []int{2, 3, 4, 5, 6}
+
+// PublicPrecision is the length of the geohash whose cell center is the
+// public location, shown instead of the address of the sitter.
+const PublicPrecision = 5
+
+// DistanceStep is the step in kilometers the public distances are rounded
+// up to, larger than the public cells so that the distances from several
+// centers can't locate a sitter within their cell.
+const DistanceStep = 5
+
+// MaxCellResults is the maximum number of locations read from each cell
+// covering a query, so that a dense area can't make a search unbounded.
+const MaxCellResults = 500
+
+var (
+	InvalidPointErr   = errors.New("invalid coordinates")
+	InvalidRadiusErr  = errors.New("the radius must be positive")
+	RadiusTooLargeErr = errors.New("the radius is too large")
+)
+
+// Point is a position on Earth, in degrees.
+type Point struct {
+	Lat float64 `datastore:"lat,noindex"`
+	Lng float64 `datastore:"lng,noindex"`
+}
+
+// Valid checks if the coordinates are within range.
+func (p Point) Valid() bool {
+	return p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// Coarsen returns the center of the geohash cell of the point having
+// the precision, hiding the exact position.
+func (p Point) Coarsen(precision int) Point {
+	b, _ := Bounds(Encode(p, precision))
+	return b.Center()
+}
+
+// Distance returns the great-circle distance between the points in
+// kilometers, by the haversine formula.
+func Distance(a, b Point) float64 {
+	const rad = math.Pi / 180
+	dlat := (b.Lat - a.Lat) * rad
+	dlng := (b.Lng - a.Lng) * rad
+
+	h := math.Sin(dlat/2)*math.Sin(dlat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dlng/2)*math.Sin(dlng/2)
+	return 2 * EarthRadius * math.Asin(math.Sqrt(math.Min(h, 1)))
+}
+
+// PublicDistance returns the distance of the public position of the location
+// from the point, rounded up to DistanceStep kilometers. It is the only
+// distance which can be shown to the other users.
+func PublicDistance(p Point, l *Location) float64 {
+	steps := math.Ceil(Distance(p, l.Public) / DistanceStep)
+	return DistanceStep * math.Max(steps, 1)
+}
+
+// Location is the position of a sitter, keyed by the id of the user.
+type Location struct {
+	UserID int64 `datastore:"-"`
+	// Address is the text the position was geocoded from.
+	Address string `datastore:"address,noindex"`
+	// Point is the exact position, never shown to the other users.
+	Point Point `datastore:"point"`
+	// Public is the coarsened position shown to the other users.
+	Public Point `datastore:"public"`
+	// Cells are the geohashes of the position at the indexed precisions.
+	Cells   []string  `datastore:"cells"`
+	Updated time.Time `datastore:"updated,noindex"`
+}
+
+// NewLocation returns the location of the user at the point, with its public
+// position and geohash cells.
+func NewLocation(userID int64, address string, p Point) (*Location, error) {
+	if !p.Valid() {
+		return nil, InvalidPointErr
+	}
+	return &Location{
+		UserID:  userID,
+		Address: address,
+		Point:   p,
+		Public:  p.Coarsen(PublicPrecision),
+		Cells:   cells(p),
+		Updated: time.Now(),
+	}, nil
+}
+
+func locationKey(c appengine.Context, userID int64) *datastore.Key {
+	return datastore.NewKey(c, LocationKind, "", userID, nil)
+}
+
+// PutLocation stores the location, replacing the previous one of the user.
+func PutLocation(c appengine.Context, l *Location) error {
+	if l.UserID <= 0 {
+		return errors.New("invalid user id")
+	}
+	_, err := datastore.Put(c, locationKey(c, l.UserID), l)
+	return err
+}
+
+// GetLocation returns the location of the user, or nil if there is none.
+func GetLocation(c appengine.Context, userID int64) (*Location, error) {
+	l := &Location{}
+	if err := datastore.Get(c, locationKey(c, userID), l); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	l.UserID = userID
+	return l, nil
+}
+
+// DeleteLocation removes the location of the user.
+func DeleteLocation(c appengine.Context, userID int64) error {
+	err := datastore.Delete(c, locationKey(c, userID))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// Result is a location found by a query and its distance from the center.
+type Result struct {
+	*Location
+	// Distance is the exact distance in kilometers, used to order the results.
+	// Only PublicDistance can be shown.
+	Distance float64
+}
+
+// Within returns at most limit locations within the radius in kilometers
+// of the center, closest first. All of them are returned if limit is 0.
+// At most MaxCellResults locations are read from each cell of the cover.
+func Within(c appengine.Context, center Point, radius float64, limit int) ([]*Result, error) {
+	cover, err := Cover(center, radius)
+	if err != nil {
+		return nil, err
+	}
+
+	var found []*Location
+	for _, cell := range cover {
+		var locations []*Location
+		keys, err := datastore.NewQuery(LocationKind).Filter("cells =", cell).Limit(MaxCellResults).GetAll(c, &locations)
+		if err != nil {
+			return nil, err
+		}
+		for i, l := range locations {
+			l.UserID = keys[i].IntID()
+		}
+		found = append(found, locations...)
+	}
+
+	return nearest(center, radius, limit, found), nil
+}
+
+// byDistance sorts the results by distance, then by user id.
+type byDistance []*Result
+
+func (r byDistance) Len() int      { return len(r) }
+func (r byDistance) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r byDistance) Less(i, j int) bool {
+	if r[i].Distance != r[j].Distance {
+		return r[i].Distance < r[j].Distance
+	}
+	return r[i].UserID < r[j].UserID
+}
+
+// nearest returns at most limit of the locations within the radius of the
+// center, closest first. The locations found in several cells are kept once.
+func nearest(center Point, radius float64, limit int, locations []*Location) []*Result {
+	seen := make(map[int64]bool)
+	results := make([]*Result, 0, len(locations))
+	for _, l := range locations {
+		if seen[l.UserID] {
+			continue
+		}
+		seen[l.UserID] = true
+
+		if d := Distance(center, l.Point); d <= radius {
+			results = append(results, &Result{l, d})
+		}
+	}
+
+	sort.Sort(byDistance(results))
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
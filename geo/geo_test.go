@@ -0,0 +1,269 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestEncode(t *testing.T) {
+	p := Point{57.64911, 10.40744}
+	if hash := Encode(p, 11); hash != "u4pruydqqvj" {
+		t.Errorf("Encode: got %q; want %q", hash, "u4pruydqqvj")
+	}
+
+	for precision := 1; precision <= MaxPrecision; precision++ {
+		hash := Encode(p, precision)
+		b, err := Bounds(hash)
+		if err != nil {
+			t.Fatalf("Bounds(%q): unexpected error: %v", hash, err)
+		}
+		if !b.Contains(p) {
+			t.Errorf("Bounds(%q): %v does not contain %v", hash, b, p)
+		}
+		height, width := cellSize(precision)
+		if b.MaxLat-b.MinLat != height || b.MaxLng-b.MinLng != width {
+			t.Errorf("cellSize(%d): got %v x %v; want %v x %v", precision,
+				height, width, b.MaxLat-b.MinLat, b.MaxLng-b.MinLng)
+		}
+	}
+
+	for _, hash := range []string{"", "u4a", "0123456789bcd"} {
+		if _, err := Bounds(hash); err != InvalidGeohashErr {
+			t.Errorf("Bounds(%q): got error %v; want %v", hash, err, InvalidGeohashErr)
+		}
+	}
+}
+
+func TestNeighbors(t *testing.T) {
+	tests := []struct {
+		hash string
+		want []string
+	}{
+		// Wraps around the antimeridian.
+		{"2", []string{"2", "r", "3", "0", "p", "1", "8", "x", "9"}},
+		// The cells past the north pole are left out.
+		{"b", []string{"b", "z", "c", "8", "x", "9"}},
+	}
+
+	for _, test := range tests {
+		got, err := Neighbors(test.hash)
+		if err != nil {
+			t.Errorf("Neighbors(%q): unexpected error: %v", test.hash, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("Neighbors(%q): got %v; want %v", test.hash, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("Neighbors(%q): got %v; want %v", test.hash, got, test.want)
+				break
+			}
+		}
+	}
+
+	b, _ := Bounds("u4pru")
+	neighbors, err := Neighbors("u4pru")
+	if err != nil {
+		t.Fatalf("Neighbors: unexpected error: %v", err)
+	}
+	if len(neighbors) != 9 {
+		t.Errorf("Neighbors: got %d cells; want 9", len(neighbors))
+	}
+	for _, hash := range neighbors[1:] {
+		n, _ := Bounds(hash)
+		if n.MaxLat < b.MinLat || n.MinLat > b.MaxLat || n.MaxLng < b.MinLng || n.MinLng > b.MaxLng {
+			t.Errorf("Neighbors: %q is not adjacent to %q", hash, "u4pru")
+		}
+	}
+}
+
+func TestDistance(t *testing.T) {
+	bucharest, cluj := Localities["București"], Localities["Cluj-Napoca"]
+	if d := Distance(bucharest, cluj); math.Abs(d-324.4) > 1 {
+		t.Errorf("Distance: got %.1f km; want about 324.4 km", d)
+	}
+	if d := Distance(cluj, bucharest); d != Distance(bucharest, cluj) {
+		t.Errorf("Distance: not symmetric")
+	}
+	if d := Distance(cluj, cluj); d != 0 {
+		t.Errorf("Distance: got %v for the same point; want 0", d)
+	}
+	if d := Distance(Point{0, 179.9}, Point{0, -179.9}); math.Abs(d-22.2) > 0.1 {
+		t.Errorf("Distance: got %.1f km across the antimeridian; want about 22.2 km", d)
+	}
+}
+
+func TestPublicDistance(t *testing.T) {
+	bucharest, cluj := Localities["București"], Localities["Cluj-Napoca"]
+
+	l, _ := NewLocation(1, "Cluj-Napoca", cluj)
+	exact := Distance(bucharest, l.Public)
+	if d := PublicDistance(bucharest, l); math.Mod(d, DistanceStep) != 0 || d < exact || d-exact >= DistanceStep {
+		t.Errorf("PublicDistance: got %v km for %.1f km; want it rounded up to %v km", d, exact, DistanceStep)
+	}
+	if d := PublicDistance(cluj, l); d != DistanceStep {
+		t.Errorf("PublicDistance: got %v km from the location; want %v km", d, DistanceStep)
+	}
+
+	// The public distances of close positions are the same.
+	near, _ := NewLocation(2, "", Point{cluj.Lat + 0.001, cluj.Lng + 0.001})
+	if PublicDistance(bucharest, near) != PublicDistance(bucharest, l) {
+		t.Errorf("PublicDistance: close positions have different distances")
+	}
+}
+
+func TestCover(t *testing.T) {
+	centers := []Point{
+		Localities["Cluj-Napoca"],
+		{0, 179.99},
+		{-33.87, 151.21},
+		{69.65, 18.96},
+	}
+
+	for _, center := range centers {
+		for _, radius := range []float64{0.5, 3, 10, 50, 200} {
+			cover, err := Cover(center, radius)
+			if err != nil {
+				t.Errorf("Cover(%v, %v): unexpected error: %v", center, radius, err)
+				continue
+			}
+			covered := make(map[string]bool)
+			for _, cell := range cover {
+				covered[cell] = true
+			}
+
+			// Every point of the circle must be in one of the cells.
+			precision := len(cover[0])
+			for bearing := 0.0; bearing < 360; bearing += 5 {
+				p := destination(center, bearing, radius)
+				if hash := Encode(p, precision); !covered[hash] {
+					t.Errorf("Cover(%v, %v): %v at %v degrees is in %q, not in %v",
+						center, radius, p, bearing, hash, cover)
+				}
+			}
+		}
+	}
+
+	if _, err := Cover(Point{89.9, 0}, 50); err != RadiusTooLargeErr {
+		t.Errorf("Cover: got error %v around the pole; want %v", err, RadiusTooLargeErr)
+	}
+	if _, err := Cover(centers[0], 600); err != nil {
+		t.Errorf("Cover: unexpected error: %v", err)
+	}
+	if _, err := Cover(centers[0], 5000); err != RadiusTooLargeErr {
+		t.Errorf("Cover: got error %v; want %v", err, RadiusTooLargeErr)
+	}
+	if _, err := Cover(centers[0], 0); err != InvalidRadiusErr {
+		t.Errorf("Cover: got error %v; want %v", err, InvalidRadiusErr)
+	}
+	if _, err := Cover(Point{91, 0}, 10); err != InvalidPointErr {
+		t.Errorf("Cover: got error %v; want %v", err, InvalidPointErr)
+	}
+}
+
+// destination returns the point at the distance in kilometers from the
+// start, following the initial bearing in degrees.
+func destination(start Point, bearing, distance float64) Point {
+	const rad = math.Pi / 180
+	angle := distance / EarthRadius
+	lat1, lng1, b := start.Lat*rad, start.Lng*rad, bearing*rad
+
+	lat2 := math.Asin(math.Sin(lat1)*math.Cos(angle) + math.Cos(lat1)*math.Sin(angle)*math.Cos(b))
+	lng2 := lng1 + math.Atan2(math.Sin(b)*math.Sin(angle)*math.Cos(lat1),
+		math.Cos(angle)-math.Sin(lat1)*math.Sin(lat2))
+	return Point{lat2 / rad, wrapLng(lng2 / rad)}
+}
+
+func TestNewLocation(t *testing.T) {
+	p := Point{46.770439, 23.591423}
+	l, err := NewLocation(1, "Piața Unirii, Cluj-Napoca", p)
+	if err != nil {
+		t.Fatalf("NewLocation: unexpected error: %v", err)
+	}
+
+	want := []string{"u8", "u82", "u82f", "u82f0", "u82f0f"}
+	if len(l.Cells) != len(want) {
+		t.Fatalf("NewLocation: got cells %v; want %v", l.Cells, want)
+	}
+	for i := range want {
+		if l.Cells[i] != want[i] {
+			t.Errorf("NewLocation: got cells %v; want %v", l.Cells, want)
+			break
+		}
+	}
+
+	if l.Public == p {
+		t.Errorf("NewLocation: the public location is the exact one")
+	}
+	if b, _ := Bounds(Encode(p, PublicPrecision)); l.Public != b.Center() {
+		t.Errorf("NewLocation: got public location %v; want %v", l.Public, b.Center())
+	}
+	if l.Public != (Point{46.77, 23.59}).Coarsen(PublicPrecision) {
+		t.Errorf("NewLocation: the public location differs for a nearby point")
+	}
+
+	if _, err := NewLocation(1, "", Point{0, 181}); err != InvalidPointErr {
+		t.Errorf("NewLocation: got error %v; want %v", err, InvalidPointErr)
+	}
+}
+
+func TestNearest(t *testing.T) {
+	center := Localities["Cluj-Napoca"]
+	locations := []*Location{
+		{UserID: 1, Point: destination(center, 90, 8)},
+		{UserID: 2, Point: destination(center, 0, 2)},
+		{UserID: 3, Point: destination(center, 180, 12)},
+		{UserID: 4, Point: destination(center, 270, 2)},
+		// Found again in another cell.
+		{UserID: 2, Point: destination(center, 0, 2)},
+	}
+
+	results := nearest(center, 10, 0, locations)
+	want := []int64{2, 4, 1}
+	if len(results) != len(want) {
+		t.Fatalf("nearest: got %d results; want %d", len(results), len(want))
+	}
+	for i, r := range results {
+		if r.UserID != want[i] {
+			t.Errorf("nearest: got user %d at %d; want %d", r.UserID, i, want[i])
+		}
+		if r.Distance != Distance(center, r.Point) {
+			t.Errorf("nearest: got distance %v for user %d; want %v", r.Distance, r.UserID, Distance(center, r.Point))
+		}
+	}
+
+	if results := nearest(center, 10, 2, locations); len(results) != 2 || results[1].UserID != 4 {
+		t.Errorf("nearest: the limit is not applied to the closest locations")
+	}
+}
+
+func TestLocalGeocoder(t *testing.T) {
+	tests := []struct {
+		address string
+		want    Point
+		err     error
+	}{
+		{"Cluj-Napoca, Romania", Localities["Cluj-Napoca"], nil},
+		{"Strada Memorandumului 28, Cluj-Napoca 400114, Romania", Localities["Cluj-Napoca"], nil},
+		{"TIMISOARA", Localities["Timișoara"], nil},
+		{"Târgu-Mureş, Romania", Localities["Târgu Mureș"], nil},
+		{"Sector 1, Bucharest, Romania", Localities["București"], nil},
+		{"46.77, 23.59", Point{46.77, 23.59}, nil},
+		{"Atlantis", Point{}, UnknownAddressErr},
+		{"91, 23", Point{}, UnknownAddressErr},
+		{"", Point{}, UnknownAddressErr},
+	}
+
+	for _, test := range tests {
+		p, err := DefaultGeocoder.Geocode(nil, test.address)
+		if err != test.err {
+			t.Errorf("Geocode(%q): got error %v; want %v", test.address, err, test.err)
+			continue
+		}
+		if p != test.want {
+			t.Errorf("Geocode(%q): got %v; want %v", test.address, p, test.want)
+		}
+	}
+}
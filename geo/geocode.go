@@ -0,0 +1,128 @@
+// Part of geo package. Geocoding of the addresses entered by the users.
+
+package geo
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"appengine"
+)
+
+var UnknownAddressErr = errors.New("unknown address")
+
+// Geocoder finds the position of the address strings filled in by the
+// Places autocomplete of the search page, like "Strada Memorandumului 28,
+// Cluj-Napoca, Romania".
+type Geocoder interface {
+	Geocode(c appengine.Context, address string) (Point, error)
+}
+
+// LocalGeocoder is a deterministic stand-in for a geocoding service,
+// resolving the addresses by their locality from a fixed table. It also
+// accepts addresses written as "lat, lng".
+type LocalGeocoder struct {
+	localities map[string]Point
+}
+
+// NewLocalGeocoder returns a geocoder knowing the localities, by name.
+// The names are matched regardless of case and diacritics.
+func NewLocalGeocoder(localities map[string]Point) *LocalGeocoder {
+	g := &LocalGeocoder{make(map[string]Point, len(localities))}
+	for name, p := range localities {
+		g.localities[normalizeAddress(name)] = p
+	}
+	return g
+}
+
+// Geocode returns the position of the first component of the address naming
+// a known locality. Returns UnknownAddressErr if there is none.
+func (g *LocalGeocoder) Geocode(c appengine.Context, address string) (Point, error) {
+	if p, ok := parsePoint(address); ok {
+		return p, nil
+	}
+
+	for _, component := range strings.Split(address, ",") {
+		if p, ok := g.localities[normalizeAddress(component)]; ok {
+			return p, nil
+		}
+	}
+	return Point{}, UnknownAddressErr
+}
+
+// parsePoint parses the "lat, lng" addresses.
+func parsePoint(address string) (Point, bool) {
+	parts := strings.Split(address, ",")
+	if len(parts) != 2 {
+		return Point{}, false
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil {
+		return Point{}, false
+	}
+	lng, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil {
+		return Point{}, false
+	}
+	p := Point{lat, lng}
+	return p, p.Valid()
+}
+
+// Replacements of the Romanian letters with diacritics, in both the comma
+// and the cedilla forms.
+var diacritics = strings.NewReplacer(
+	"ă", "a", "â", "a", "î", "i", "ș", "s", "ş", "s", "ț", "t", "ţ", "t",
+)
+
+// normalizeAddress lowercases the address component and removes its
+// diacritics, postal codes and extra spaces.
+func normalizeAddress(s string) string {
+	s = diacritics.Replace(strings.ToLower(s))
+
+	words := strings.FieldsFunc(s, func(r rune) bool {
+		return unicode.IsSpace(r) || r == '-'
+	})
+	kept := words[:0]
+	for _, w := range words {
+		if strings.TrimFunc(w, unicode.IsDigit) != "" {
+			kept = append(kept, w)
+		}
+	}
+	return strings.Join(kept, " ")
+}
+
+// Localities are the cities known by DefaultGeocoder.
+var Localities = map[string]Point{
+	"București":             {44.4268, 26.1025},
+	"Bucharest":             {44.4268, 26.1025},
+	"Cluj-Napoca":           {46.7712, 23.6236},
+	"Timișoara":             {45.7489, 21.2087},
+	"Iași":                  {47.1585, 27.6014},
+	"Constanța":             {44.1598, 28.6348},
+	"Craiova":               {44.3302, 23.7949},
+	"Brașov":                {45.6427, 25.5887},
+	"Galați":                {45.4353, 28.0080},
+	"Ploiești":              {44.9416, 26.0134},
+	"Oradea":                {47.0465, 21.9189},
+	"Brăila":                {45.2692, 27.9575},
+	"Arad":                  {46.1866, 21.3123},
+	"Pitești":               {44.8565, 24.8692},
+	"Sibiu":                 {45.7983, 24.1256},
+	"Bacău":                 {46.5670, 26.9146},
+	"Târgu Mureș":           {46.5386, 24.5575},
+	"Baia Mare":             {47.6567, 23.5850},
+	"Buzău":                 {45.1500, 26.8333},
+	"Suceava":               {47.6514, 26.2556},
+	"Satu Mare":             {47.7900, 22.8900},
+	"Alba Iulia":            {46.0667, 23.5833},
+	"Florești":              {46.7470, 23.4900},
+	"Otopeni":               {44.5500, 26.0700},
+	"Voluntari":             {44.4900, 26.1800},
+	"Mamaia":                {44.2500, 28.6200},
+	"Drobeta-Turnu Severin": {44.6369, 22.6597},
+}
+
+// DefaultGeocoder is the geocoder used by the application.
+var DefaultGeocoder Geocoder = NewLocalGeocoder(Localities)
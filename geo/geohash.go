@@ -0,0 +1,206 @@
+// Part of geo package. Geohash encoding of the points and covering of the
+// circles with geohash cells.
+
+package geo
+
+import (
+	"errors"
+	"math"
+	"strings"
+)
+
+// Alphabet of the geohashes, 5 bits by character.
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// MaxPrecision is the maximum length of the geohashes.
+const MaxPrecision = 12
+
+var InvalidGeohashErr = errors.New("invalid geohash")
+
+// Box is the rectangle covered by a geohash cell, in degrees.
+type Box struct {
+	MinLat, MaxLat float64
+	MinLng, MaxLng float64
+}
+
+// Center returns the point in the middle of the box.
+func (b Box) Center() Point {
+	return Point{(b.MinLat + b.MaxLat) / 2, (b.MinLng + b.MaxLng) / 2}
+}
+
+// Contains checks if the point lies in the box. The points on the
+// northern and eastern edges belong to the next cells.
+func (b Box) Contains(p Point) bool {
+	return p.Lat >= b.MinLat && (p.Lat < b.MaxLat || b.MaxLat == 90) &&
+		p.Lng >= b.MinLng && (p.Lng < b.MaxLng || b.MaxLng == 180)
+}
+
+// Encode returns the geohash of the point having the precision, clamped
+// between 1 and MaxPrecision characters.
+func Encode(p Point, precision int) string {
+	if precision < 1 {
+		precision = 1
+	}
+	if precision > MaxPrecision {
+		precision = MaxPrecision
+	}
+
+	lat := [2]float64{-90, 90}
+	lng := [2]float64{-180, 180}
+	hash := make([]byte, precision)
+
+	// The bits alternate between longitude and latitude, starting with longitude.
+	even := true
+	for i := range hash {
+		ch := 0
+		for bit := 4; bit >= 0; bit-- {
+			r, v := &lat, p.Lat
+			if even {
+				r, v = &lng, p.Lng
+			}
+			if mid := (r[0] + r[1]) / 2; v >= mid {
+				ch |= 1 << uint(bit)
+				r[0] = mid
+			} else {
+				r[1] = mid
+			}
+			even = !even
+		}
+		hash[i] = geohashAlphabet[ch]
+	}
+	return string(hash)
+}
+
+// Bounds returns the box covered by the geohash.
+func Bounds(hash string) (Box, error) {
+	if hash == "" || len(hash) > MaxPrecision {
+		return Box{}, InvalidGeohashErr
+	}
+
+	b := Box{-90, 90, -180, 180}
+	even := true
+	for _, c := range strings.ToLower(hash) {
+		ch := strings.IndexRune(geohashAlphabet, c)
+		if ch < 0 {
+			return Box{}, InvalidGeohashErr
+		}
+		for bit := 4; bit >= 0; bit-- {
+			min, max := &b.MinLat, &b.MaxLat
+			if even {
+				min, max = &b.MinLng, &b.MaxLng
+			}
+			mid := (*min + *max) / 2
+			if ch&(1<<uint(bit)) != 0 {
+				*min = mid
+			} else {
+				*max = mid
+			}
+			even = !even
+		}
+	}
+	return b, nil
+}
+
+// cellSize returns the height and the width in degrees of the geohash
+// cells having the precision.
+func cellSize(precision int) (lat, lng float64) {
+	bits := uint(5 * precision)
+	lngBits := (bits + 1) / 2
+	latBits := bits / 2
+	return 180 / float64(uint64(1)<<latBits), 360 / float64(uint64(1)<<lngBits)
+}
+
+// Neighbors returns the geohash and its adjacent cells of the same
+// precision, without duplicates. The cells past the poles are left out
+// and the longitude wraps around the antimeridian.
+func Neighbors(hash string) ([]string, error) {
+	b, err := Bounds(hash)
+	if err != nil {
+		return nil, err
+	}
+	center := b.Center()
+	height, width := b.MaxLat-b.MinLat, b.MaxLng-b.MinLng
+
+	seen := make(map[string]bool)
+	cells := make([]string, 0, 9)
+	for _, dlat := range []float64{0, -1, 1} {
+		for _, dlng := range []float64{0, -1, 1} {
+			p := Point{center.Lat + dlat*height, center.Lng + dlng*width}
+			if p.Lat < -90 || p.Lat > 90 {
+				continue
+			}
+			p.Lng = wrapLng(p.Lng)
+
+			cell := Encode(p, len(hash))
+			if !seen[cell] {
+				seen[cell] = true
+				cells = append(cells, cell)
+			}
+		}
+	}
+	return cells, nil
+}
+
+// wrapLng brings the longitude back between -180 and 180 degrees.
+func wrapLng(lng float64) float64 {
+	for lng >= 180 {
+		lng -= 360
+	}
+	for lng < -180 {
+		lng += 360
+	}
+	return lng
+}
+
+// coverPrecision returns the largest of the indexed precisions whose cell
+// and its neighbors cover all the points within the radius of the center.
+// The block of 3 by 3 cells reaches at least a cell further than the center
+// in each direction, so a cell must be larger than the extent of the circle:
+// its angular radius in latitude and, in longitude, the widest angle seen
+// from the pole, asin(sin(radius) / cos(lat)). Returns RadiusTooLargeErr if
+// even the coarsest cells are too small, or the circle contains a pole.
+func coverPrecision(center Point, radius float64) (int, error) {
+	angle := radius / EarthRadius
+	cos := math.Cos(center.Lat * math.Pi / 180)
+	if angle >= math.Pi/2 || math.Sin(angle) >= cos {
+		return 0, RadiusTooLargeErr
+	}
+
+	dlat := angle * 180 / math.Pi
+	dlng := math.Asin(math.Sin(angle)/cos) * 180 / math.Pi
+
+	for i := len(IndexPrecisions) - 1; i >= 0; i-- {
+		height, width := cellSize(IndexPrecisions[i])
+		if height >= dlat && width >= dlng {
+			return IndexPrecisions[i], nil
+		}
+	}
+	return 0, RadiusTooLargeErr
+}
+
+// Cover returns the indexed geohash cells covering the circle of the radius
+// in kilometers around the center.
+func Cover(center Point, radius float64) ([]string, error) {
+	if !center.Valid() {
+		return nil, InvalidPointErr
+	}
+	if radius <= 0 || math.IsNaN(radius) {
+		return nil, InvalidRadiusErr
+	}
+
+	precision, err := coverPrecision(center, radius)
+	if err != nil {
+		return nil, err
+	}
+	return Neighbors(Encode(center, precision))
+}
+
+// cells returns the geohashes of the point at the indexed precisions.
+func cells(p Point) []string {
+	hash := Encode(p, IndexPrecisions[len(IndexPrecisions)-1])
+	cells := make([]string, len(IndexPrecisions))
+	for i, precision := range IndexPrecisions {
+		cells[i] = hash[:precision]
+	}
+	return cells
+}
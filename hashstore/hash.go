@@ -0,0 +1,144 @@
+// Part of hashstore package. Implements the hashing of the keys and the
+// migration of the entries stored before hashing.
+package hashstore
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"petsy/migrate"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+func init() {
+	migrate.Register(migrate.Migration{
+		Version:     1,
+		Kind:        HashKind,
+		Description: "hash the keys of the entries stored before hashing",
+		Migrate:     MigrateEntry,
+		Saves:       true,
+	})
+}
+
+// SecretFunc returns the secret used for hashing the keys with HMAC-SHA256.
+// It must be set before using the hashstore. Changing the secret makes all
+// the stored entries unreachable.
+var SecretFunc func(c appengine.Context) ([]byte, error)
+
+// hashKey returns the keyed hash of the key, as stored in the datastore.
+func hashKey(c appengine.Context, key string) (string, error) {
+	if SecretFunc == nil {
+		return "", errors.New("hashstore secret is not configured")
+	}
+	secret, err := SecretFunc(c)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// unhashedKey looks up the datastore key of an entry stored before hashing,
+// either named by its key or, for the oldest entries, having a generated id.
+// Returns NoSuchKeyErr if there is no such entry.
+func unhashedKey(c appengine.Context, key string) (*datastore.Key, error) {
+	dsKey := datastore.NewKey(c, HashKind, key, 0, nil)
+
+	var entry Entry
+	err := datastore.Get(c, dsKey, &entry)
+	if err == nil && !entry.Hashed {
+		return dsKey, nil
+	}
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
+
+	query := datastore.NewQuery(HashKind).Filter("key =", key)
+
+	for t := query.Run(c); ; {
+		var entry Entry
+		k, err := t.Next(&entry)
+		if err == datastore.Done {
+			return nil, NoSuchKeyErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !entry.Hashed {
+			return k, nil
+		}
+	}
+}
+
+// migrateEntry moves the entry stored before hashing under its hashed key.
+// Returns the datastore key of the migrated entry.
+func migrateEntry(c appengine.Context, oldKey *datastore.Key, hashed string) (*datastore.Key, error) {
+	newKey := datastore.NewKey(c, HashKind, hashed, 0, nil)
+
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var entry Entry
+		err := datastore.Get(tc, oldKey, &entry)
+		if err == datastore.ErrNoSuchEntity {
+			// Migrated or deleted concurrently.
+			err = datastore.Get(tc, newKey, &entry)
+			if err == datastore.ErrNoSuchEntity {
+				return NoSuchKeyErr
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		entry.Key = hashed
+		entry.Hashed = true
+
+		if _, err := datastore.Put(tc, newKey, &entry); err != nil {
+			return err
+		}
+		return datastore.Delete(tc, oldKey)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey, nil
+}
+
+// MigrateEntry hashes the key of the entry, if it was stored before hashing.
+// The entry is moved under its hashed key in a transaction, so the migration
+// saves the entries itself.
+func MigrateEntry(c appengine.Context, e *migrate.Entity) (bool, error) {
+	var entry Entry
+	if err := e.Load(&entry); err != nil {
+		if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+			return false, err
+		}
+	}
+	if entry.Hashed {
+		return false, nil
+	}
+
+	key, err := datastore.DecodeKey(e.Key)
+	if err != nil {
+		return false, err
+	}
+	hashed, err := hashKey(c, entry.Key)
+	if err != nil {
+		return false, err
+	}
+	if _, err := migrateEntry(c, key, hashed); err != nil {
+		if err == NoSuchKeyErr {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
@@ -1,5 +1,8 @@
 // Package hashstore implements a hash store over Appengine's datastore.
-// The hashstore holds expirable (key, value, scope) string tuples.
+// The hashstore holds expirable (key, value, scope) string tuples. Only a keyed
+// hash of the key of a tuple is stored, as the name of its datastore entity, so
+// that the keys can't be recovered from the datastore and the lookups by key
+// are strongly consistent.
 package hashstore
 
 import (
@@ -18,9 +21,25 @@ var NoSuchKeyErr = errors.New("no entry with this key found")
 // Error returned if there is another entry with the specified key.
 var DuplicateKeyErr = errors.New("key already exists")
 
+// Errors returned by Consume when the entry does not match.
+var (
+	ExpiredErr       = errors.New("entry is expired")
+	ValueMismatchErr = errors.New("entry has another value")
+	ScopeMismatchErr = errors.New("entry has another scope")
+)
+
+// LookupOption changes the behaviour of the lookups.
+type LookupOption int
+
+const (
+	// IgnoreExpired makes the lookups treat the expired entries as absent.
+	IgnoreExpired LookupOption = iota
+)
+
 // Entry represents an expirable (key, value, scope) tuple stored in the hashstore.
 type Entry struct {
-	// The key of the entry. Each key has to be unique across the store.
+	// The hashed key of the entry, or the key itself for the entries stored
+	// before hashing. Each key has to be unique across the store.
 	Key string `datastore:"key"`
 	// The value associated with the key.
 	Value string `datastore:"value"`
@@ -31,6 +50,23 @@ type Entry struct {
 	Generated time.Time `datastore:"generated"`
 	// Valid defines the validity duration of the entry.
 	Valid time.Duration `datastore:"valid"`
+	// Hashed is false for the entries stored before hashing, which are
+	// migrated on lookup or by MigrateEntry.
+	Hashed bool `datastore:"hashed,noindex"`
+}
+
+// Expired returns whether the validity period of the entry has passed.
+func (e *Entry) Expired() bool {
+	return !e.Generated.Add(e.Valid).After(time.Now())
+}
+
+func hasOption(opts []LookupOption, opt LookupOption) bool {
+	for _, o := range opts {
+		if o == opt {
+			return true
+		}
+	}
+	return false
 }
 
 // AddEntry adds a new entry to the datastore. Takes a key, a value, a scope and a validity duration.
@@ -50,51 +86,109 @@ func AddEntry(c appengine.Context, key string, value string, scope string, valid
 		return nil, errors.New("duration must be positive")
 	}
 
-	// Check if the key is unique.
-	if _, _, err := GetValue(c, key); err != NoSuchKeyErr {
+	hashed, err := hashKey(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check if the key is unique among the entries stored before hashing.
+	if _, err := unhashedKey(c, key); err != NoSuchKeyErr {
+		if err != nil {
+			return nil, err
+		}
 		return nil, DuplicateKeyErr
 	}
 
 	// Construct the entry and add it to the datastore.
 	entry := &Entry{
 		Value:     value,
-		Key:       key,
+		Key:       hashed,
 		Scope:     scope,
 		Generated: time.Now(),
 		Valid:     valid,
+		Hashed:    true,
+	}
+
+	dsKey := datastore.NewKey(c, HashKind, hashed, 0, nil)
+
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var existing Entry
+		err := datastore.Get(tc, dsKey, &existing)
+		if err == nil {
+			return DuplicateKeyErr
+		}
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err = datastore.Put(tc, dsKey, entry)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return dsKey, nil
+}
+
+// entityKey returns the datastore key of the entry with the specified key.
+// Entries stored before hashing are migrated first.
+// Returns NoSuchKeyErr if there is no such entry.
+func entityKey(c appengine.Context, key string) (*datastore.Key, error) {
+	hashed, err := hashKey(c, key)
+	if err != nil {
+		return nil, err
 	}
+	dsKey := datastore.NewKey(c, HashKind, hashed, 0, nil)
 
-	dsKey := datastore.NewIncompleteKey(c, HashKind, nil)
+	var entry Entry
+	err = datastore.Get(c, dsKey, &entry)
+	if err == nil {
+		return dsKey, nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		return nil, err
+	}
 
-	return datastore.Put(c, dsKey, entry)
+	oldKey, err := unhashedKey(c, key)
+	if err != nil {
+		return nil, err
+	}
+	return migrateEntry(c, oldKey, hashed)
 }
 
 // GetValue interrogates the datastore for the Entry with the specified key.
 // Returns the entry with the associated key and the entry's datastore key.
-// Returns NoSuchKeyErr if the key is not found.
-func GetValue(c appengine.Context, key string) (*datastore.Key, *Entry, error) {
+// Returns NoSuchKeyErr if the key is not found, or if the entry is expired
+// and the IgnoreExpired option is used.
+func GetValue(c appengine.Context, key string, opts ...LookupOption) (*datastore.Key, *Entry, error) {
 	if key == "" {
 		return nil, nil, errors.New("key can't be empty")
 	}
 
-	query := datastore.NewQuery(HashKind).Filter("key =", string(key))
-
-	for t := query.Run(c); ; {
-		var entry Entry
-		key, err := t.Next(&entry)
-		if err == datastore.Done {
-			return nil, nil, NoSuchKeyErr
-		}
-		if err != nil {
-			return nil, nil, err
-		}
-		return key, &entry, nil
+	dsKey, err := entityKey(c, key)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil, nil, nil
+	var entry Entry
+	err = datastore.Get(c, dsKey, &entry)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, NoSuchKeyErr
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if hasOption(opts, IgnoreExpired) && entry.Expired() {
+		return nil, nil, NoSuchKeyErr
+	}
+	return dsKey, &entry, nil
 }
 
-func GetEntriesSameValueScope(c appengine.Context, value string, scope string) ([]*datastore.Key, []*Entry, error) {
+// GetEntriesSameValueScope returns the entries having the specified value and scope.
+// The expired entries are skipped if the IgnoreExpired option is used.
+// The keys of the returned entries are hashed.
+func GetEntriesSameValueScope(c appengine.Context, value string, scope string, opts ...LookupOption) ([]*datastore.Key, []*Entry, error) {
 	if value == "" {
 		return nil, nil, errors.New("value can't be empty")
 	}
@@ -118,10 +212,69 @@ func GetEntriesSameValueScope(c appengine.Context, value string, scope string) (
 		if err != nil {
 			return nil, nil, err
 		}
+		if hasOption(opts, IgnoreExpired) && entry.Expired() {
+			continue
+		}
+
+		keys = append(keys, key)
+		entries = append(entries, &entry)
+	}
+}
+
+// ListEntries returns at most limit entries, starting from the provided cursor,
+// which is empty for the first page. Returns the entries, their datastore keys and
+// the cursor of the next page, which is empty if there are no more entries.
+func ListEntries(c appengine.Context, limit int, cursor string) ([]*datastore.Key, []*Entry, string, error) {
+	if limit <= 0 {
+		return nil, nil, "", errors.New("limit must be positive")
+	}
+
+	query := datastore.NewQuery(HashKind).Order("generated").Limit(limit)
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, nil, "", err
+		}
+		query = query.Start(start)
+	}
+
+	keys := make([]*datastore.Key, 0)
+	entries := make([]*Entry, 0)
+
+	t := query.Run(c)
+	for {
+		var entry Entry
+		key, err := t.Next(&entry)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, "", err
+		}
 
 		keys = append(keys, key)
 		entries = append(entries, &entry)
 	}
+
+	if len(entries) < limit {
+		return keys, entries, "", nil
+	}
+
+	next, err := t.Cursor()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return keys, entries, next.String(), nil
+}
+
+// DeleteEntriesSameValueScope deletes all the entries having the specified value and scope.
+func DeleteEntriesSameValueScope(c appengine.Context, value string, scope string) error {
+	keys, _, err := GetEntriesSameValueScope(c, value, scope)
+	if err != nil {
+		return err
+	}
+
+	return datastore.DeleteMulti(c, keys)
 }
 
 // IsValidEntry checks whether the parameters are found in a valid stored entry.
@@ -133,28 +286,59 @@ func IsValidEntry(c appengine.Context, key string, value string, scope string) (
 		return false, errors.New("key can't be empty")
 	}
 
-	query := datastore.NewQuery(HashKind).
-		Filter("key =", string(key)).
-		Filter("value =", string(value)).
-		Filter("scope =", string(scope))
+	_, entry, err := GetValue(c, key)
+	if err != nil {
+		return false, err
+	}
+	if entry.Value != value || entry.Scope != scope {
+		return false, NoSuchKeyErr
+	}
 
-	for t := query.Run(c); ; {
-		var entry Entry
-		_, err := t.Next(&entry)
-		if err == datastore.Done {
-			return false, NoSuchKeyErr
+	return !entry.Expired(), nil
+}
+
+// Consume checks that the entry with the specified key has the specified value and
+// scope and is not expired, then deletes it, in a single transaction. Each entry can
+// thus be consumed only once. Returns NoSuchKeyErr if there is no entry with the key,
+// ValueMismatchErr or ScopeMismatchErr if the entry does not match, and ExpiredErr
+// if the entry is expired. The entry is not deleted if an error is returned.
+func Consume(c appengine.Context, key string, value string, scope string) (*Entry, error) {
+	if key == "" {
+		return nil, errors.New("key can't be empty")
+	}
+
+	dsKey, err := entityKey(c, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry Entry
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, dsKey, &entry)
+		if err == datastore.ErrNoSuchEntity {
+			// Consumed concurrently.
+			return NoSuchKeyErr
 		}
 		if err != nil {
-			return false, err
+			return err
 		}
 
-		if entry.Generated.Add(entry.Valid).After(time.Now()) {
-			return true, nil
+		switch {
+		case entry.Value != value:
+			return ValueMismatchErr
+		case entry.Scope != scope:
+			return ScopeMismatchErr
+		case entry.Expired():
+			return ExpiredErr
 		}
-		return false, nil
+
+		return datastore.Delete(tc, dsKey)
+	}, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return false, nil
+	return &entry, nil
 }
 
 // DeleteEntry deletes the entry associated with the specified key.
@@ -168,30 +352,59 @@ func DeleteEntry(c appengine.Context, key string) error {
 	return datastore.Delete(c, dsKey)
 }
 
-// PurgeExpiredEntries performs a cleanup on the Hashstore, by deleting
-// the entries expired a while ago (duration defined by threshold).
-func PurgeExpiredEntries(c appengine.Context, threshold time.Duration) error {
+// PurgeExpiredEntries performs a cleanup on the Hashstore, by deleting the
+// entries expired a while ago (duration defined by threshold). It scans at most
+// batchSize entries, starting from the provided cursor, which is empty for the
+// first batch. Returns the number of deleted entries and the cursor of the next
+// batch, which is empty when all the entries were scanned.
+func PurgeExpiredEntries(c appengine.Context, threshold time.Duration, batchSize int, cursor string) (int, string, error) {
 	if threshold <= 0 {
-		return errors.New("threshold must be positive")
+		return 0, "", errors.New("threshold must be positive")
+	}
+	if batchSize <= 0 {
+		return 0, "", errors.New("batch size must be positive")
 	}
 
-	keysToDelete := make([]*datastore.Key, 0)
+	query := datastore.NewQuery(HashKind).Limit(batchSize)
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return 0, "", err
+		}
+		query = query.Start(start)
+	}
 
-	query := datastore.NewQuery(HashKind)
+	keysToDelete := make([]*datastore.Key, 0)
+	scanned := 0
 
-	for t := query.Run(c); ; {
+	t := query.Run(c)
+	for {
 		var entry Entry
 		key, err := t.Next(&entry)
 		if err == datastore.Done {
 			break
 		}
 		if err != nil {
-			break
+			return 0, "", err
 		}
+
+		scanned++
 		if entry.Generated.Add(entry.Valid).Add(threshold).Before(time.Now()) {
 			keysToDelete = append(keysToDelete, key)
 		}
 	}
 
-	return datastore.DeleteMulti(c, keysToDelete)
+	if err := datastore.DeleteMulti(c, keysToDelete); err != nil {
+		return 0, "", err
+	}
+
+	if scanned < batchSize {
+		return len(keysToDelete), "", nil
+	}
+
+	next, err := t.Cursor()
+	if err != nil {
+		return len(keysToDelete), "", err
+	}
+	return len(keysToDelete), next.String(), nil
 }
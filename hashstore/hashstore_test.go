@@ -0,0 +1,150 @@
+package hashstore
+
+import (
+	"testing"
+	"time"
+
+	"petsy/migrate"
+
+	"appengine"
+	"appengine/aetest"
+	"appengine/datastore"
+)
+
+func init() {
+	SecretFunc = func(c appengine.Context) ([]byte, error) {
+		return []byte("secret"), nil
+	}
+}
+
+func TestExpiredEntries(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := AddEntry(c, "valid", "test@petsy.ro", "register", time.Hour); err != nil {
+		t.Fatalf("AddEntry: unexpected error: %v", err)
+	}
+	if _, err := AddEntry(c, "expired", "test@petsy.ro", "register", time.Nanosecond); err != nil {
+		t.Fatalf("AddEntry: unexpected error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	if _, _, err := GetValue(c, "expired"); err != nil {
+		t.Errorf("GetValue: unexpected error: %v", err)
+	}
+	if _, _, err := GetValue(c, "expired", IgnoreExpired); err != NoSuchKeyErr {
+		t.Errorf("GetValue: IgnoreExpired: got error %v; want %v", err, NoSuchKeyErr)
+	}
+	if _, entries, _ := GetEntriesSameValueScope(c, "test@petsy.ro", "register", IgnoreExpired); len(entries) != 1 {
+		t.Errorf("GetEntriesSameValueScope: IgnoreExpired: got %d entries; want 1", len(entries))
+	}
+
+	// Purge in batches of a single entry.
+	deleted, cursor := 0, ""
+	for batches := 0; batches == 0 || cursor != ""; batches++ {
+		n, next, err := PurgeExpiredEntries(c, time.Nanosecond, 1, cursor)
+		if err != nil {
+			t.Fatalf("PurgeExpiredEntries: unexpected error: %v", err)
+		}
+		deleted += n
+		cursor = next
+	}
+
+	if deleted != 1 {
+		t.Errorf("PurgeExpiredEntries: got %d deleted entries; want 1", deleted)
+	}
+	if _, _, err := GetValue(c, "valid"); err != nil {
+		t.Errorf("PurgeExpiredEntries: valid entry was deleted")
+	}
+}
+
+func TestConsume(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	AddEntry(c, "token", "test@petsy.ro", "register", time.Hour)
+	AddEntry(c, "expired", "test@petsy.ro", "register", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	if _, err := AddEntry(c, "token", "other@petsy.ro", "register", time.Hour); err != DuplicateKeyErr {
+		t.Errorf("AddEntry: duplicate key: got error %v; want %v", err, DuplicateKeyErr)
+	}
+
+	tests := []struct {
+		key, value, scope string
+		want              error
+	}{
+		{"missing", "test@petsy.ro", "register", NoSuchKeyErr},
+		{"token", "other@petsy.ro", "register", ValueMismatchErr},
+		{"token", "test@petsy.ro", "reset", ScopeMismatchErr},
+		{"expired", "test@petsy.ro", "register", ExpiredErr},
+		{"token", "test@petsy.ro", "register", nil},
+		// The entry can be consumed only once.
+		{"token", "test@petsy.ro", "register", NoSuchKeyErr},
+	}
+
+	for _, test := range tests {
+		if _, err := Consume(c, test.key, test.value, test.scope); err != test.want {
+			t.Errorf("Consume(%s, %s, %s): got error %v; want %v", test.key, test.value, test.scope, err, test.want)
+		}
+	}
+}
+
+func TestHashedKeys(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dsKey, err := AddEntry(c, "token", "test@petsy.ro", "register", time.Hour)
+	if err != nil {
+		t.Fatalf("AddEntry: unexpected error: %v", err)
+	}
+	if dsKey.StringID() == "token" {
+		t.Errorf("AddEntry: the key is stored unhashed")
+	}
+
+	var stored Entry
+	datastore.Get(c, dsKey, &stored)
+	if stored.Key == "token" || !stored.Hashed {
+		t.Errorf("AddEntry: the key is stored unhashed")
+	}
+
+	// The stored hash can't be used as a key.
+	if _, _, err := GetValue(c, stored.Key); err != NoSuchKeyErr {
+		t.Errorf("GetValue: hashed key: got error %v; want %v", err, NoSuchKeyErr)
+	}
+
+	// Entries stored before hashing are migrated on lookup.
+	legacy := &Entry{Key: "legacy", Value: "test@petsy.ro", Scope: "register", Generated: time.Now(), Valid: time.Hour}
+	legacyKey, err := datastore.Put(c, datastore.NewIncompleteKey(c, HashKind, nil), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Consume(c, "legacy", "test@petsy.ro", "register"); err != nil {
+		t.Errorf("Consume: legacy entry: unexpected error: %v", err)
+	}
+	if err := datastore.Get(c, legacyKey, &stored); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Consume: legacy entry was not deleted")
+	}
+
+	// Or by the migration.
+	legacy.Key = "legacy2"
+	datastore.Put(c, datastore.NewIncompleteKey(c, HashKind, nil), legacy)
+
+	status, err := migrate.Run(c, migrate.DatastoreStore{}, 10, 0)
+	if err != nil || status[0].Migrated != 1 {
+		t.Errorf("MigrateEntry: got progress %+v, error %v; want 1 migrated entry", status[0], err)
+	}
+	if _, entry, err := GetValue(c, "legacy2"); err != nil || !entry.Hashed {
+		t.Errorf("MigrateEntry: migrated entry not found")
+	}
+}
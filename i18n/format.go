@@ -0,0 +1,70 @@
+// Part of i18n package. Implements the locale-aware formatting of
+// dates and amounts of money.
+package i18n
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Currencies.
+const (
+	RON = "RON"
+	EUR = "EUR"
+)
+
+var romanianMonths = [...]string{
+	"ianuarie", "februarie", "martie", "aprilie", "mai", "iunie",
+	"iulie", "august", "septembrie", "octombrie", "noiembrie", "decembrie",
+}
+
+// FormatDate formats the date in the long form of the locale,
+// e.g. "June 1, 2015" or "1 iunie 2015".
+func FormatDate(locale string, t time.Time) string {
+	if locale == Romanian {
+		return fmt.Sprintf("%d %s %d", t.Day(), romanianMonths[t.Month()-1], t.Year())
+	}
+	return t.Format("January 2, 2006")
+}
+
+// FormatMoney formats the amount, in the minor unit of the currency (bani or
+// cents), e.g. "RON 1,250.50" or "1.250,50 lei". Other currencies than RON
+// and EUR are written with their code.
+func FormatMoney(locale string, amount int64, currency string) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+
+	thousands, decimal := ",", "."
+	if locale == Romanian {
+		thousands, decimal = ".", ","
+	}
+	number := fmt.Sprintf("%s%s%s%02d", sign, group(amount/100, thousands), decimal, amount%100)
+
+	if locale == Romanian {
+		switch currency {
+		case RON:
+			return number + " lei"
+		case EUR:
+			return number + " €"
+		}
+		return number + " " + currency
+	}
+
+	if currency == EUR {
+		return "€" + number
+	}
+	return currency + " " + number
+}
+
+// group writes the number with the thousands separator.
+func group(n int64, sep string) string {
+	s := strconv.FormatInt(n, 10)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + sep + s[i:]
+	}
+	return s
+}
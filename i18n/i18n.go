@@ -0,0 +1,197 @@
+// Package i18n implements the translation of the messages of the application
+// in the supported locales, with plural forms, and the formatting of dates and
+// amounts of money.
+package i18n
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Supported locales.
+const (
+	English  = "en"
+	Romanian = "ro"
+)
+
+// DefaultLocale is the locale of the messages used as keys in the catalog,
+// used when no other locale is requested.
+const DefaultLocale = English
+
+// Locales lists all the supported locales.
+var Locales = []string{English, Romanian}
+
+// Error returned for an unsupported locale.
+var InvalidLocaleErr = errors.New("unsupported locale")
+
+// Plural forms. Romanian uses "few" for 0 and the numbers ending in 01-19,
+// except 1. English has no "few" form.
+const (
+	One   = "one"
+	Few   = "few"
+	Other = "other"
+)
+
+// Supported returns whether the locale is supported.
+func Supported(locale string) bool {
+	for _, l := range Locales {
+		if l == locale {
+			return true
+		}
+	}
+	return false
+}
+
+// PluralForm returns the plural form used for the number n in the locale.
+func PluralForm(locale string, n int) string {
+	if n < 0 {
+		n = -n
+	}
+	if n == 1 {
+		return One
+	}
+	if locale == Romanian && (n == 0 || n%100 >= 1 && n%100 <= 19) {
+		return Few
+	}
+	return Other
+}
+
+// Message is the translation of a message, with its plural forms. Messages
+// without plural forms only have the Other form.
+type Message struct {
+	One   string `json:"one"`
+	Few   string `json:"few"`
+	Other string `json:"other"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler. A message is either a string or
+// an object holding the plural forms.
+func (m *Message) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*m = Message{Other: s}
+		return nil
+	}
+
+	type forms Message
+	var f forms
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	if f.Other == "" {
+		return errors.New("plural message without the other form")
+	}
+	*m = Message(f)
+	return nil
+}
+
+// form returns the plural form of the message, falling back to Other.
+func (m Message) form(form string) string {
+	switch {
+	case form == One && m.One != "":
+		return m.One
+	case form == Few && m.Few != "":
+		return m.Few
+	}
+	return m.Other
+}
+
+// Catalog holds the translations of the messages, keyed by the message in
+// the DefaultLocale. Messages missing from the catalog are not translated.
+type Catalog struct {
+	messages map[string]map[string]Message
+}
+
+// NewCatalog returns a catalog of the translations, by locale.
+func NewCatalog(messages map[string]map[string]Message) *Catalog {
+	return &Catalog{messages}
+}
+
+// LoadCatalog loads the translations from the <locale>.json files of the
+// directory, for the supported locales. Returns an error if a file can't be
+// parsed or a translation doesn't use the same verbs as its key.
+func LoadCatalog(dir string) (*Catalog, error) {
+	c := &Catalog{make(map[string]map[string]Message)}
+
+	for _, locale := range Locales {
+		data, err := ioutil.ReadFile(filepath.Join(dir, locale+".json"))
+		if err != nil {
+			return nil, err
+		}
+
+		messages := make(map[string]Message)
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, fmt.Errorf("%s.json: %v", locale, err)
+		}
+		for key, m := range messages {
+			for _, s := range []string{m.One, m.Few, m.Other} {
+				if s != "" && verbs(s) != verbs(key) {
+					return nil, fmt.Errorf("%s.json: %q doesn't use the verbs of %q", locale, s, key)
+				}
+			}
+		}
+		c.messages[locale] = messages
+	}
+
+	return c, nil
+}
+
+// MustLoadCatalog is like LoadCatalog, but panics on error.
+func MustLoadCatalog(dir string) *Catalog {
+	c, err := LoadCatalog(dir)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// verbs returns the formatting verbs of the message, in order.
+func verbs(s string) string {
+	var v []string
+	for i := 0; i < len(s)-1; i++ {
+		if s[i] != '%' {
+			continue
+		}
+		i++
+		if s[i] != '%' {
+			v = append(v, s[i:i+1])
+		}
+	}
+	return strings.Join(v, "")
+}
+
+func (c *Catalog) lookup(locale, key, form string) string {
+	if m, ok := c.messages[locale][key]; ok {
+		return m.form(form)
+	}
+	if m, ok := c.messages[DefaultLocale][key]; ok {
+		return m.form(form)
+	}
+	return key
+}
+
+// Translate returns the message translated in the locale and formatted
+// with the arguments, if any.
+func (c *Catalog) Translate(locale, key string, args ...interface{}) string {
+	return format(c.lookup(locale, key, Other), args)
+}
+
+// Plural returns the plural form of the message used in the locale for
+// the number n, formatted with the arguments, or with n if there are none.
+func (c *Catalog) Plural(locale, key string, n int, args ...interface{}) string {
+	if len(args) == 0 {
+		args = []interface{}{n}
+	}
+	return format(c.lookup(locale, key, PluralForm(locale, n)), args)
+}
+
+func format(msg string, args []interface{}) string {
+	if len(args) == 0 {
+		return msg
+	}
+	return fmt.Sprintf(msg, args...)
+}
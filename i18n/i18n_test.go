@@ -0,0 +1,137 @@
+package i18n
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var catalog = NewCatalog(map[string]map[string]Message{
+	English: {
+		"%d days": {One: "%d day", Other: "%d days"},
+	},
+	Romanian: {
+		"Hello %s":     {Other: "Salut %s"},
+		"Link expired": {Other: "Linkul a expirat"},
+		"%d days":      {One: "%d zi", Few: "%d zile", Other: "%d de zile"},
+	},
+})
+
+func TestTranslate(t *testing.T) {
+	tests := []struct {
+		locale, key string
+		args        []interface{}
+		want        string
+	}{
+		{Romanian, "Link expired", nil, "Linkul a expirat"},
+		{Romanian, "Hello %s", []interface{}{"Ana"}, "Salut Ana"},
+		{English, "Link expired", nil, "Link expired"},
+		{Romanian, "Missing", nil, "Missing"},
+		{"xx", "Hello %s", []interface{}{"Ana"}, "Hello Ana"},
+	}
+	for _, test := range tests {
+		if got := catalog.Translate(test.locale, test.key, test.args...); got != test.want {
+			t.Errorf("Translate(%s, %q): got %q; want %q", test.locale, test.key, got, test.want)
+		}
+	}
+}
+
+func TestPlural(t *testing.T) {
+	tests := []struct {
+		locale string
+		n      int
+		want   string
+	}{
+		{English, 1, "1 day"},
+		{English, 7, "7 days"},
+		{Romanian, 1, "1 zi"},
+		{Romanian, 7, "7 zile"},
+		{Romanian, 0, "0 zile"},
+		{Romanian, 20, "20 de zile"},
+		{Romanian, 101, "101 zile"},
+		{Romanian, 120, "120 de zile"},
+	}
+	for _, test := range tests {
+		if got := catalog.Plural(test.locale, "%d days", test.n); got != test.want {
+			t.Errorf("Plural(%s, %d): got %q; want %q", test.locale, test.n, got, test.want)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		header, want string
+		ok           bool
+	}{
+		{"ro-RO,ro;q=0.9,en;q=0.8", Romanian, true},
+		{"de-DE,en-US;q=0.7,ro;q=0.5", English, true},
+		{"en;q=0.5,ro;q=0.9", Romanian, true},
+		{"ro;q=0,en", English, true},
+		{"de,fr", "", false},
+		{"*", DefaultLocale, true},
+		{"", "", false},
+	}
+	for _, test := range tests {
+		got, ok := Match(test.header)
+		if got != test.want || ok != test.ok {
+			t.Errorf("Match(%q): got %q, %v; want %q, %v", test.header, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	date := time.Date(2015, time.June, 1, 0, 0, 0, 0, time.UTC)
+	if got := FormatDate(English, date); got != "June 1, 2015" {
+		t.Errorf("FormatDate(en): got %q", got)
+	}
+	if got := FormatDate(Romanian, date); got != "1 iunie 2015" {
+		t.Errorf("FormatDate(ro): got %q", got)
+	}
+
+	tests := []struct {
+		locale   string
+		amount   int64
+		currency string
+		want     string
+	}{
+		{English, 125050, RON, "RON 1,250.50"},
+		{English, 5, EUR, "€0.05"},
+		{Romanian, 125050, RON, "1.250,50 lei"},
+		{Romanian, 123456789, EUR, "1.234.567,89 €"},
+		{Romanian, -1000, RON, "-10,00 lei"},
+	}
+	for _, test := range tests {
+		if got := FormatMoney(test.locale, test.amount, test.currency); got != test.want {
+			t.Errorf("FormatMoney(%s, %d, %s): got %q; want %q", test.locale, test.amount, test.currency, got, test.want)
+		}
+	}
+}
+
+func TestLoadCatalog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "i18n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "en.json"), []byte(`{"%d pets": {"one": "%d pet", "other": "%d pets"}}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ro.json"), []byte(`{"Hello %s": "Salut %s"}`), 0644)
+
+	c, err := LoadCatalog(dir)
+	if err != nil {
+		t.Fatalf("LoadCatalog: unexpected error: %v", err)
+	}
+	if got := c.Translate(Romanian, "Hello %s", "Ana"); got != "Salut Ana" {
+		t.Errorf("Translate: got %q; want Salut Ana", got)
+	}
+	if got := c.Plural(Romanian, "%d pets", 1); got != "1 pet" {
+		t.Errorf("Plural: fallback to the default locale: got %q; want 1 pet", got)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "ro.json"), []byte(`{"Hello %s": "Salut %d"}`), 0644)
+	if _, err := LoadCatalog(dir); err == nil {
+		t.Errorf("LoadCatalog: mismatched verbs: want error")
+	}
+}
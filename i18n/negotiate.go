@@ -0,0 +1,64 @@
+// Part of i18n package. Implements the negotiation of the locale
+// from the Accept-Language header.
+package i18n
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// languageRange is a language of the Accept-Language header, with its quality.
+type languageRange struct {
+	tag     string
+	quality float64
+}
+
+type byQuality []languageRange
+
+func (r byQuality) Len() int           { return len(r) }
+func (r byQuality) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r byQuality) Less(i, j int) bool { return r[i].quality > r[j].quality }
+
+// Match returns the supported locale preferred by the Accept-Language header.
+// Returns false if the header accepts none of the supported locales.
+func Match(acceptLanguage string) (string, bool) {
+	var ranges []languageRange
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					q = 0
+				}
+				quality = q
+			}
+		}
+		if quality > 0 {
+			ranges = append(ranges, languageRange{tag, quality})
+		}
+	}
+
+	// The stable sort keeps the order of the header for equal qualities.
+	sort.Stable(byQuality(ranges))
+
+	for _, r := range ranges {
+		if r.tag == "*" {
+			return DefaultLocale, true
+		}
+		// Only the primary language is matched, e.g. ro-RO matches ro.
+		lang := strings.SplitN(r.tag, "-", 2)[0]
+		if Supported(lang) {
+			return lang, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,42 @@
+// Part of i18n package. Implements the translation and formatting
+// for a locale.
+package i18n
+
+import (
+	"time"
+)
+
+// Printer translates the messages and formats the values for a locale.
+type Printer struct {
+	Locale  string
+	Catalog *Catalog
+}
+
+// NewPrinter returns a printer for the locale, or for the DefaultLocale
+// if the locale is not supported.
+func NewPrinter(catalog *Catalog, locale string) *Printer {
+	if !Supported(locale) {
+		locale = DefaultLocale
+	}
+	return &Printer{locale, catalog}
+}
+
+// T translates the message, formatted with the arguments.
+func (p *Printer) T(key string, args ...interface{}) string {
+	return p.Catalog.Translate(p.Locale, key, args...)
+}
+
+// N translates the plural form of the message for the number n.
+func (p *Printer) N(key string, n int, args ...interface{}) string {
+	return p.Catalog.Plural(p.Locale, key, n, args...)
+}
+
+// Date formats the date.
+func (p *Printer) Date(t time.Time) string {
+	return FormatDate(p.Locale, t)
+}
+
+// Money formats the amount, in the minor unit of the currency.
+func (p *Printer) Money(amount int64, currency string) string {
+	return FormatMoney(p.Locale, amount, currency)
+}
@@ -1,19 +1,29 @@
+// Package mailer builds and sends the emails of the application.
 package mailer
 
 import (
 	"fmt"
+	"net/mail"
 
 	"appengine"
-	"appengine/mail"
 )
 
 type Message struct {
-	To      []string
-	Sender  string
-	Subject string
-	Body    string
+	To       []string
+	Sender   string
+	Subject  string
+	Body     string
+	HTMLBody string
+	// Headers holds the additional headers of the message.
+	Headers mail.Header
+	// Category is the category of the message, checked against the
+	// preferences of the recipients before sending it.
+	Category string
 }
 
+// DefaultTransport is the transport used by Send and SendEmail.
+var DefaultTransport Transport = AppEngineTransport{}
+
 func NewMessage(to []string, sender string, subject string, body string) *Message {
 	return &Message{
 		To:      to,
@@ -23,16 +33,25 @@ func NewMessage(to []string, sender string, subject string, body string) *Messag
 	}
 }
 
-func SendEmail(c appengine.Context, to []string, sender string, subject string, body string) error {
-	msg := &mail.Message{
-		Sender:  sender,
-		To:      to,
-		Subject: subject,
-		Body:    body,
+// Send sends the message through the DefaultTransport. The HTML part is only
+// included if the message has one. Suppressed recipients are skipped.
+func Send(c appengine.Context, m *Message) error {
+	to, err := filterRecipients(c, m)
+	if err != nil {
+		return err
+	}
+	if len(to) == 0 {
+		return nil
 	}
 
-	if err := mail.Send(c, msg); err != nil {
+	msg := *m
+	msg.To = to
+	if err := DefaultTransport.Send(c, &msg); err != nil {
 		return fmt.Errorf("Could not send email: %v", err)
 	}
 	return nil
 }
+
+func SendEmail(c appengine.Context, to []string, sender string, subject string, body string) error {
+	return Send(c, NewMessage(to, sender, subject, body))
+}
@@ -0,0 +1,85 @@
+// Part of mailer package. Implements the MIME encoding of messages.
+package mailer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Bytes encodes the message as a MIME message ready to be delivered
+// through SMTP. Messages having a HTML part are encoded as
+// multipart/alternative.
+func (m *Message) Bytes() ([]byte, error) {
+	buf := &bytes.Buffer{}
+
+	fmt.Fprintf(buf, "From: %s\r\n", m.Sender)
+	fmt.Fprintf(buf, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+
+	names := make([]string, 0, len(m.Headers))
+	for name := range m.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range m.Headers[name] {
+			fmt.Fprintf(buf, "%s: %s\r\n", name, value)
+		}
+	}
+
+	if m.HTMLBody == "" {
+		fmt.Fprintf(buf, "Content-Type: text/plain; charset=utf-8\r\n")
+		fmt.Fprintf(buf, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(buf, m.Body); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(buf)
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+
+	parts := []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", m.Body},
+		{"text/html; charset=utf-8", m.HTMLBody},
+	}
+	for _, part := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", part.contentType)
+		header.Set("Content-Transfer-Encoding", "quoted-printable")
+
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
@@ -0,0 +1,388 @@
+// Part of mailer package. Implements a persistent outbound queue over
+// Appengine's datastore. Messages are delivered by a worker which retries
+// failed deliveries with exponential backoff and moves the messages failing
+// too many times to a dead-letter list.
+package mailer
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const QueueKind = "mailqueue"
+
+// Delivery states of a queued message.
+const (
+	StatePending = "pending"
+	StateSent    = "sent"
+	StateDead    = "dead"
+	// StateSuppressed is the state of the messages whose recipients are
+	// all suppressed.
+	StateSuppressed = "suppressed"
+)
+
+var (
+	// MaxAttempts is the number of failed deliveries after which a message
+	// is moved to the dead-letter list.
+	MaxAttempts = 10
+	// RetryBase is the delay before the first retry. Each retry doubles it.
+	RetryBase = time.Minute
+	// RetryMax is the maximum delay between two retries.
+	RetryMax = 6 * time.Hour
+	// deliveryLease is the time a message is reserved for the worker
+	// delivering it, so that it is not picked up by another worker.
+	deliveryLease = 5 * time.Minute
+)
+
+// Error returned if there is no queued message with the specified key.
+var NoSuchMessageErr = errors.New("no queued message with this key found")
+
+// QueuedMessage is a message stored in the outbound queue, along with
+// its delivery state.
+type QueuedMessage struct {
+	To       []string `datastore:"to"`
+	Sender   string   `datastore:"sender,noindex"`
+	Subject  string   `datastore:"subject,noindex"`
+	Body     string   `datastore:"body,noindex"`
+	HTMLBody string   `datastore:"html_body,noindex"`
+	// Headers holds the additional headers as "Name: value" lines.
+	Headers  []string `datastore:"headers,noindex"`
+	Category string   `datastore:"category"`
+
+	// State is one of StatePending, StateSent, StateDead and StateSuppressed.
+	State string `datastore:"state"`
+	// Attempts is the number of delivery attempts.
+	Attempts int `datastore:"attempts,noindex"`
+	// NextAttempt is the time after which the message can be delivered.
+	NextAttempt time.Time `datastore:"next_attempt"`
+	// LastError is the error of the last failed delivery.
+	LastError string    `datastore:"last_error,noindex"`
+	Created   time.Time `datastore:"created"`
+	Sent      time.Time `datastore:"sent,noindex"`
+}
+
+// Message returns the message to be delivered.
+func (q *QueuedMessage) Message() *Message {
+	m := &Message{
+		To:       q.To,
+		Sender:   q.Sender,
+		Subject:  q.Subject,
+		Body:     q.Body,
+		HTMLBody: q.HTMLBody,
+		Category: q.Category,
+	}
+
+	for _, line := range q.Headers {
+		if i := strings.Index(line, ": "); i > 0 {
+			if m.Headers == nil {
+				m.Headers = make(map[string][]string)
+			}
+			m.Headers[line[:i]] = append(m.Headers[line[:i]], line[i+2:])
+		}
+	}
+
+	return m
+}
+
+// DeliveryReport holds the outcome of a run of the queue worker.
+type DeliveryReport struct {
+	Sent       int
+	Retried    int
+	Dead       int
+	Suppressed int
+}
+
+// Enqueue adds the message to the outbound queue. The idempotency key identifies
+// the message in the queue: enqueuing a message with a key which is already
+// queued does nothing. A random key is used if the provided key is empty.
+// Returns the datastore key of the queued message.
+func Enqueue(c appengine.Context, key string, m *Message) (*datastore.Key, error) {
+	if m == nil {
+		return nil, errors.New("message to enqueue can't be empty")
+	}
+	if len(m.To) == 0 {
+		return nil, errors.New("message has no recipients")
+	}
+
+	if key == "" {
+		var err error
+		if key, err = randomKey(); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	qm := &QueuedMessage{
+		To:          m.To,
+		Sender:      m.Sender,
+		Subject:     m.Subject,
+		Body:        m.Body,
+		HTMLBody:    m.HTMLBody,
+		Category:    m.Category,
+		State:       StatePending,
+		NextAttempt: now,
+		Created:     now,
+	}
+
+	for name, values := range m.Headers {
+		for _, value := range values {
+			qm.Headers = append(qm.Headers, name+": "+value)
+		}
+	}
+
+	dsKey := datastore.NewKey(c, QueueKind, key, 0, nil)
+
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var existing QueuedMessage
+		if err := datastore.Get(tc, dsKey, &existing); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err := datastore.Put(tc, dsKey, qm)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return dsKey, nil
+}
+
+// GetQueuedMessage returns the queued message with the specified idempotency key.
+// Returns NoSuchMessageErr if the key is not found.
+func GetQueuedMessage(c appengine.Context, key string) (*QueuedMessage, error) {
+	if key == "" {
+		return nil, errors.New("key can't be empty")
+	}
+
+	var qm QueuedMessage
+	err := datastore.Get(c, datastore.NewKey(c, QueueKind, key, 0, nil), &qm)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, NoSuchMessageErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &qm, nil
+}
+
+// Deliver sends at most limit of the pending messages which are due, through
+// the DefaultTransport. Failed deliveries are retried with exponential backoff;
+// after MaxAttempts failures the message is moved to the dead-letter list.
+func Deliver(c appengine.Context, limit int) (*DeliveryReport, error) {
+	if limit <= 0 {
+		return nil, errors.New("limit must be positive")
+	}
+
+	query := datastore.NewQuery(QueueKind).
+		Filter("state =", StatePending).
+		Filter("next_attempt <=", time.Now()).
+		Order("next_attempt").
+		Limit(limit).
+		KeysOnly()
+
+	keys, err := query.GetAll(c, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DeliveryReport{}
+
+	for _, key := range keys {
+		qm, err := claim(c, key)
+		if err != nil {
+			return report, err
+		}
+		if qm == nil {
+			// Already delivered or reserved by another worker.
+			continue
+		}
+
+		msg := qm.Message()
+		if msg.To, err = filterRecipients(c, msg); err != nil {
+			return report, err
+		}
+		if len(msg.To) == 0 {
+			if err := recordSuppression(c, key); err != nil {
+				return report, err
+			}
+			report.Suppressed++
+			continue
+		}
+
+		sendErr := DefaultTransport.Send(c, msg)
+		if err := recordDelivery(c, key, sendErr); err != nil {
+			return report, err
+		}
+
+		switch {
+		case sendErr == nil:
+			report.Sent++
+		case qm.Attempts >= MaxAttempts:
+			c.Errorf("mailer: message %v moved to dead-letter list: %v", key.StringID(), sendErr)
+			report.Dead++
+		default:
+			c.Warningf("mailer: delivery of message %v failed: %v", key.StringID(), sendErr)
+			report.Retried++
+		}
+	}
+
+	return report, nil
+}
+
+// claim reserves the message for delivery and counts the delivery attempt.
+// Returns a nil message if the message is not due anymore.
+func claim(c appengine.Context, key *datastore.Key) (*QueuedMessage, error) {
+	var claimed *QueuedMessage
+
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		claimed = nil
+
+		var qm QueuedMessage
+		if err := datastore.Get(tc, key, &qm); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if qm.State != StatePending || qm.NextAttempt.After(now) {
+			return nil
+		}
+
+		qm.Attempts++
+		qm.NextAttempt = now.Add(deliveryLease)
+		if _, err := datastore.Put(tc, key, &qm); err != nil {
+			return err
+		}
+
+		claimed = &qm
+		return nil
+	}, nil)
+
+	return claimed, err
+}
+
+// recordDelivery updates the delivery state of the message after a
+// delivery attempt which returned sendErr.
+func recordDelivery(c appengine.Context, key *datastore.Key, sendErr error) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var qm QueuedMessage
+		if err := datastore.Get(tc, key, &qm); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		switch {
+		case sendErr == nil:
+			qm.State = StateSent
+			qm.Sent = now
+			qm.LastError = ""
+		case qm.Attempts >= MaxAttempts:
+			qm.State = StateDead
+			qm.LastError = sendErr.Error()
+		default:
+			qm.NextAttempt = now.Add(backoff(qm.Attempts))
+			qm.LastError = sendErr.Error()
+		}
+
+		_, err := datastore.Put(tc, key, &qm)
+		return err
+	}, nil)
+}
+
+// recordSuppression marks the message as not to be delivered, as all
+// its recipients are suppressed.
+func recordSuppression(c appengine.Context, key *datastore.Key) error {
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var qm QueuedMessage
+		if err := datastore.Get(tc, key, &qm); err != nil {
+			return err
+		}
+
+		qm.State = StateSuppressed
+		_, err := datastore.Put(tc, key, &qm)
+		return err
+	}, nil)
+}
+
+// backoff returns the delay before the next delivery attempt,
+// after the specified number of failed attempts.
+func backoff(attempts int) time.Duration {
+	if attempts < 1 {
+		return RetryBase
+	}
+
+	d := RetryBase
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= RetryMax {
+			return RetryMax
+		}
+	}
+	return d
+}
+
+// DeadLetters returns at most limit of the messages which failed
+// to be delivered MaxAttempts times, most recent first.
+func DeadLetters(c appengine.Context, limit int) ([]*datastore.Key, []*QueuedMessage, error) {
+	if limit <= 0 {
+		return nil, nil, errors.New("limit must be positive")
+	}
+
+	query := datastore.NewQuery(QueueKind).
+		Filter("state =", StateDead).
+		Order("-created").
+		Limit(limit)
+
+	messages := make([]*QueuedMessage, 0)
+	keys, err := query.GetAll(c, &messages)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, messages, nil
+}
+
+// Requeue moves the dead-lettered message with the specified idempotency key
+// back to the queue, resetting its delivery attempts.
+// Returns NoSuchMessageErr if the key is not found.
+func Requeue(c appengine.Context, key string) error {
+	if key == "" {
+		return errors.New("key can't be empty")
+	}
+
+	dsKey := datastore.NewKey(c, QueueKind, key, 0, nil)
+
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var qm QueuedMessage
+		err := datastore.Get(tc, dsKey, &qm)
+		if err == datastore.ErrNoSuchEntity {
+			return NoSuchMessageErr
+		}
+		if err != nil {
+			return err
+		}
+		if qm.State != StateDead {
+			return errors.New("message is not dead-lettered")
+		}
+
+		qm.State = StatePending
+		qm.Attempts = 0
+		qm.NextAttempt = time.Now()
+
+		_, err = datastore.Put(tc, dsKey, &qm)
+		return err
+	}, nil)
+}
+
+func randomKey() (string, error) {
+	buffer := make([]byte, 16)
+	if _, err := rand.Read(buffer); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/aetest"
+)
+
+type failingTransport struct{}
+
+func (failingTransport) Send(c appengine.Context, m *Message) error {
+	return errors.New("connection refused")
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, RetryBase},
+		{1, RetryBase},
+		{2, 2 * RetryBase},
+		{4, 8 * RetryBase},
+		{100, RetryMax},
+	}
+
+	for _, test := range tests {
+		if got := backoff(test.attempts); got != test.want {
+			t.Errorf("backoff(%d): got %v; want %v", test.attempts, got, test.want)
+		}
+	}
+}
+
+func TestQueue(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	outbox := &Outbox{}
+	DefaultTransport = outbox
+	defer func() { DefaultTransport = AppEngineTransport{} }()
+
+	// Enqueuing twice with the same key stores a single message.
+	if _, err := Enqueue(c, "activation:1", testMessage); err != nil {
+		t.Fatalf("Enqueue: unexpected error: %v", err)
+	}
+	if _, err := Enqueue(c, "activation:1", testMessage); err != nil {
+		t.Fatalf("Enqueue: unexpected error: %v", err)
+	}
+
+	report, err := Deliver(c, 10)
+	if err != nil {
+		t.Fatalf("Deliver: unexpected error: %v", err)
+	}
+	if report.Sent != 1 || len(outbox.Messages()) != 1 {
+		t.Errorf("Deliver: got %d sent, %d in outbox; want 1", report.Sent, len(outbox.Messages()))
+	}
+
+	qm, err := GetQueuedMessage(c, "activation:1")
+	if err != nil {
+		t.Fatalf("GetQueuedMessage: unexpected error: %v", err)
+	}
+	if qm.State != StateSent || qm.Attempts != 1 {
+		t.Errorf("GetQueuedMessage: got state %s after %d attempts; want %s after 1", qm.State, qm.Attempts, StateSent)
+	}
+}
+
+func TestQueueDeadLetter(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	DefaultTransport = failingTransport{}
+	defer func() { DefaultTransport = AppEngineTransport{} }()
+
+	prevMaxAttempts, prevRetryBase := MaxAttempts, RetryBase
+	MaxAttempts, RetryBase = 2, time.Nanosecond
+	defer func() { MaxAttempts, RetryBase = prevMaxAttempts, prevRetryBase }()
+
+	if _, err := Enqueue(c, "reset:1", testMessage); err != nil {
+		t.Fatalf("Enqueue: unexpected error: %v", err)
+	}
+
+	if report, err := Deliver(c, 10); err != nil || report.Retried != 1 {
+		t.Errorf("Deliver: got %+v, %v; want one retried message", report, err)
+	}
+	time.Sleep(time.Millisecond)
+	if report, err := Deliver(c, 10); err != nil || report.Dead != 1 {
+		t.Errorf("Deliver: got %+v, %v; want one dead message", report, err)
+	}
+
+	_, dead, err := DeadLetters(c, 10)
+	if err != nil {
+		t.Fatalf("DeadLetters: unexpected error: %v", err)
+	}
+	if len(dead) != 1 || dead[0].LastError == "" {
+		t.Errorf("DeadLetters: got %v; want the failed message with its error", dead)
+	}
+
+	if err := Requeue(c, "reset:1"); err != nil {
+		t.Errorf("Requeue: unexpected error: %v", err)
+	}
+	if qm, _ := GetQueuedMessage(c, "reset:1"); qm == nil || qm.State != StatePending {
+		t.Errorf("Requeue: message is not pending")
+	}
+}
@@ -0,0 +1,149 @@
+// Part of mailer package. Implements the suppression of messages sent to
+// hard-bounced addresses or to recipients who opted out of their category.
+package mailer
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const BounceKind = "mailbounce"
+
+// Suppressor decides whether a message of a category must not be sent to
+// an address, for instance because the recipient opted out of the category.
+type Suppressor interface {
+	Suppressed(c appengine.Context, address, category string) (bool, error)
+}
+
+// DefaultSuppressor is checked for every recipient before sending a message.
+// If nil, only the hard-bounced addresses are suppressed.
+var DefaultSuppressor Suppressor
+
+// Bounce records the delivery failures reported for an address.
+type Bounce struct {
+	Address string `datastore:"address"`
+	// Hard is true if the address is permanently undeliverable.
+	Hard   bool      `datastore:"hard"`
+	Reason string    `datastore:"reason,noindex"`
+	Count  int       `datastore:"count,noindex"`
+	Last   time.Time `datastore:"last"`
+}
+
+// RecordBounce records a delivery failure for the address. Once an address
+// hard-bounced, no message is sent to it until ClearBounce is called.
+func RecordBounce(c appengine.Context, address string, hard bool, reason string) error {
+	if address == "" {
+		return errors.New("address can't be empty")
+	}
+	address = strings.ToLower(address)
+	key := datastore.NewKey(c, BounceKind, address, 0, nil)
+
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var b Bounce
+		if err := datastore.Get(tc, key, &b); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		b.Address = address
+		b.Hard = b.Hard || hard
+		b.Reason = reason
+		b.Count++
+		b.Last = time.Now()
+
+		_, err := datastore.Put(tc, key, &b)
+		return err
+	}, nil)
+}
+
+// IsHardBounced returns whether the address hard-bounced.
+func IsHardBounced(c appengine.Context, address string) (bool, error) {
+	key := datastore.NewKey(c, BounceKind, strings.ToLower(address), 0, nil)
+
+	var b Bounce
+	err := datastore.Get(c, key, &b)
+	if err == datastore.ErrNoSuchEntity {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return b.Hard, nil
+}
+
+// ClearBounce forgets the delivery failures of the address.
+func ClearBounce(c appengine.Context, address string) error {
+	key := datastore.NewKey(c, BounceKind, strings.ToLower(address), 0, nil)
+
+	if err := datastore.Delete(c, key); err != nil && err != datastore.ErrNoSuchEntity {
+		return err
+	}
+	return nil
+}
+
+// filterRecipients returns the recipients of the message which are
+// neither hard-bounced nor suppressed by the DefaultSuppressor.
+func filterRecipients(c appengine.Context, m *Message) ([]string, error) {
+	to := make([]string, 0, len(m.To))
+
+	for _, address := range m.To {
+		bounced, err := IsHardBounced(c, address)
+		if err != nil {
+			return nil, err
+		}
+		if bounced {
+			c.Infof("mailer: suppressed message to hard-bounced address %s", address)
+			continue
+		}
+
+		if DefaultSuppressor != nil {
+			suppressed, err := DefaultSuppressor.Suppressed(c, address, m.Category)
+			if err != nil {
+				return nil, err
+			}
+			if suppressed {
+				c.Infof("mailer: suppressed %s message to %s", m.Category, address)
+				continue
+			}
+		}
+
+		to = append(to, address)
+	}
+
+	return to, nil
+}
+
+// SetUnsubscribe adds the List-Unsubscribe headers to the message, allowing
+// one-click unsubscription (RFC 8058) through a POST to the provided URL.
+func (m *Message) SetUnsubscribe(url string) {
+	if m.Headers == nil {
+		m.Headers = make(map[string][]string)
+	}
+	m.Headers["List-Unsubscribe"] = []string{"<" + url + ">"}
+	m.Headers["List-Unsubscribe-Post"] = []string{"List-Unsubscribe=One-Click"}
+}
+
+// UnsubscribeSignature signs the unsubscription of the address from the
+// category with the provided secret.
+func UnsubscribeSignature(secret []byte, address, category string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(strings.ToLower(address)))
+	mac.Write([]byte{0})
+	mac.Write([]byte(category))
+
+	return base64.URLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// CheckUnsubscribeSignature returns whether the signature was produced by
+// UnsubscribeSignature for the same secret, address and category.
+func CheckUnsubscribeSignature(secret []byte, address, category, signature string) bool {
+	want := UnsubscribeSignature(secret, address, category)
+
+	return hmac.Equal([]byte(want), []byte(signature))
+}
@@ -0,0 +1,69 @@
+package mailer
+
+import (
+	"testing"
+
+	"appengine"
+	"appengine/aetest"
+)
+
+type optedOut map[string]bool
+
+func (o optedOut) Suppressed(c appengine.Context, address, category string) (bool, error) {
+	return o[address+"/"+category], nil
+}
+
+func TestUnsubscribeSignature(t *testing.T) {
+	secret := []byte("secret")
+	sig := UnsubscribeSignature(secret, "Ana@petsy.ro", "bookings")
+
+	if !CheckUnsubscribeSignature(secret, "ana@petsy.ro", "bookings", sig) {
+		t.Errorf("CheckUnsubscribeSignature: valid signature rejected")
+	}
+	if CheckUnsubscribeSignature(secret, "ana@petsy.ro", "marketing", sig) {
+		t.Errorf("CheckUnsubscribeSignature: signature accepted for another category")
+	}
+	if CheckUnsubscribeSignature([]byte("other"), "ana@petsy.ro", "bookings", sig) {
+		t.Errorf("CheckUnsubscribeSignature: signature accepted for another secret")
+	}
+}
+
+func TestSuppression(t *testing.T) {
+	c, err := aetest.NewContext(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	outbox := &Outbox{}
+	DefaultTransport = outbox
+	DefaultSuppressor = optedOut{"ion@petsy.ro/marketing": true}
+	defer func() {
+		DefaultTransport = AppEngineTransport{}
+		DefaultSuppressor = nil
+	}()
+
+	if err := RecordBounce(c, "Bounced@petsy.ro", true, "no such user"); err != nil {
+		t.Fatalf("RecordBounce: unexpected error: %v", err)
+	}
+
+	msg := &Message{
+		To:       []string{"ana@petsy.ro", "ion@petsy.ro", "bounced@petsy.ro"},
+		Category: "marketing",
+	}
+	if err := Send(c, msg); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+
+	sent := outbox.Messages()
+	if len(sent) != 1 || len(sent[0].To) != 1 || sent[0].To[0] != "ana@petsy.ro" {
+		t.Errorf("Send: got %v; want a single message to ana@petsy.ro", sent)
+	}
+
+	if err := ClearBounce(c, "bounced@petsy.ro"); err != nil {
+		t.Fatalf("ClearBounce: unexpected error: %v", err)
+	}
+	if bounced, _ := IsHardBounced(c, "bounced@petsy.ro"); bounced {
+		t.Errorf("IsHardBounced: address still bounced after ClearBounce")
+	}
+}
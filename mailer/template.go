@@ -0,0 +1,194 @@
+// Part of mailer package. Implements the rendering of emails from
+// named templates.
+package mailer
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// DefaultLocale is the locale used for subjects when the requested
+// locale has no translation.
+const DefaultLocale = "en"
+
+const (
+	layoutName = "layout"
+	textExt    = ".txt"
+	htmlExt    = ".html"
+)
+
+// Error returned when rendering a template which was not parsed.
+var NoSuchTemplateErr = errors.New("no email template with this name")
+
+// Templates holds a set of named email templates sharing a common layout.
+//
+// Every template is made of a <name>.txt file and an optional <name>.html file.
+// The text file defines the localized subjects as "subject.<locale>" blocks and
+// the plain-text body as a "content" block. The HTML file defines the HTML body
+// as a "content" block. The bodies can be localized by "content.<locale>" blocks.
+// Both bodies are rendered inside the "layout" block defined in layout.txt and
+// layout.html, as the Content of the layout.
+type Templates struct {
+	templates map[string]*emailTemplate
+}
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	// The HTML part is nil for plain-text only emails.
+	html *htmltemplate.Template
+}
+
+// ParseTemplates parses all the email templates from the provided directory.
+// Returns an error if the layouts or any of the templates can't be parsed.
+func ParseTemplates(dir string) (*Templates, error) {
+	textLayout, err := texttemplate.ParseFiles(filepath.Join(dir, layoutName+textExt))
+	if err != nil {
+		return nil, err
+	}
+	htmlLayout, err := htmltemplate.ParseFiles(filepath.Join(dir, layoutName+htmlExt))
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+textExt))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Templates{templates: make(map[string]*emailTemplate)}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), textExt)
+		if name == layoutName {
+			continue
+		}
+
+		et := &emailTemplate{}
+
+		if et.text, err = textLayout.Clone(); err != nil {
+			return nil, err
+		}
+		if _, err = et.text.ParseFiles(file); err != nil {
+			return nil, err
+		}
+
+		htmlFile := filepath.Join(dir, name+htmlExt)
+		if _, err := os.Stat(htmlFile); err == nil {
+			if et.html, err = htmlLayout.Clone(); err != nil {
+				return nil, err
+			}
+			if _, err = et.html.ParseFiles(htmlFile); err != nil {
+				return nil, err
+			}
+		}
+
+		t.templates[name] = et
+	}
+
+	return t, nil
+}
+
+// MustParseTemplates is like ParseTemplates, but panics on error.
+func MustParseTemplates(dir string) *Templates {
+	t, err := ParseTemplates(dir)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// layoutData is the data used for rendering the layouts. The "content"
+// blocks are rendered with the data of the email.
+type layoutData struct {
+	Data           interface{}
+	Content        interface{}
+	Locale         string
+	UnsubscribeURL string
+}
+
+// contentName returns the name of the content block of the locale, falling
+// back to the block of the DefaultLocale, then to the "content" block.
+func contentName(lookup func(string) bool, locale string) string {
+	for _, name := range []string{"content." + locale, "content." + DefaultLocale} {
+		if lookup(name) {
+			return name
+		}
+	}
+	return "content"
+}
+
+// Render builds a new message from the named template, using the subject
+// for the provided locale and the data for both the subject and the bodies.
+// Falls back to the DefaultLocale subject if the locale is not translated.
+// The recipients and the sender of the returned message are not set.
+func (t *Templates) Render(name, locale string, data interface{}) (*Message, error) {
+	return t.RenderUnsubscribable(name, locale, data, "")
+}
+
+// RenderUnsubscribable is like Render, but adds to the message the unsubscribe
+// link, both in the bodies and in the List-Unsubscribe headers. No link is
+// added if unsubscribeURL is empty.
+func (t *Templates) RenderUnsubscribable(name, locale string, data interface{}, unsubscribeURL string) (*Message, error) {
+	et, ok := t.templates[name]
+	if !ok {
+		return nil, NoSuchTemplateErr
+	}
+
+	subject := et.text.Lookup("subject." + locale)
+	if subject == nil {
+		subject = et.text.Lookup("subject." + DefaultLocale)
+	}
+	if subject == nil {
+		return nil, errors.New("email template " + name + " has no subject")
+	}
+
+	msg := &Message{}
+	buf := &bytes.Buffer{}
+
+	if err := subject.Execute(buf, data); err != nil {
+		return nil, err
+	}
+	msg.Subject = strings.TrimSpace(buf.String())
+
+	layout := &layoutData{Data: data, Locale: locale, UnsubscribeURL: unsubscribeURL}
+
+	buf.Reset()
+	content := contentName(func(name string) bool { return et.text.Lookup(name) != nil }, locale)
+	if err := et.text.ExecuteTemplate(buf, content, data); err != nil {
+		return nil, err
+	}
+	layout.Content = buf.String()
+
+	buf.Reset()
+	if err := et.text.ExecuteTemplate(buf, layoutName, layout); err != nil {
+		return nil, err
+	}
+	msg.Body = buf.String()
+
+	if et.html != nil {
+		buf.Reset()
+		content := contentName(func(name string) bool { return et.html.Lookup(name) != nil }, locale)
+		if err := et.html.ExecuteTemplate(buf, content, data); err != nil {
+			return nil, err
+		}
+		// The content was escaped when rendered.
+		layout.Content = htmltemplate.HTML(buf.String())
+
+		buf.Reset()
+		if err := et.html.ExecuteTemplate(buf, layoutName, layout); err != nil {
+			return nil, err
+		}
+		msg.HTMLBody = buf.String()
+	}
+
+	if unsubscribeURL != "" {
+		msg.SetUnsubscribe(unsubscribeURL)
+	}
+
+	return msg, nil
+}
@@ -0,0 +1,97 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+const templatesDir = "../app/templates/email"
+
+var templateData = map[string]interface{}{
+	"activation": struct {
+		Name, Link, Validity string
+	}{"Ana", "http://petsy.ro/activate?a=1&b=2", "7 zile"},
+	"booking": struct {
+		OwnerName, SitterName, Service, Start, End, Price, Link string
+	}{"Ana", "Ion", "boarding", "01.06.2015", "05.06.2015", "400.00 RON", "http://petsy.ro/booking?a=1&b=2"},
+}
+
+func TestRenderTemplates(t *testing.T) {
+	tmpl, err := ParseTemplates(templatesDir)
+	if err != nil {
+		t.Fatalf("ParseTemplates: unexpected error: %v", err)
+	}
+
+	for name, data := range templateData {
+		msg, err := tmpl.Render(name, "ro", data)
+		if err != nil {
+			t.Errorf("Render %s: unexpected error: %v", name, err)
+			continue
+		}
+		if msg.Subject == "" || strings.Contains(msg.Subject, "\n") {
+			t.Errorf("Render %s: bad subject %q", name, msg.Subject)
+		}
+		if !strings.Contains(msg.Body, "a=1&b=2") {
+			t.Errorf("Render %s: plain-text body does not contain the raw link", name)
+		}
+		if !strings.Contains(msg.HTMLBody, "a=1&amp;b=2") {
+			t.Errorf("Render %s: HTML body does not contain the escaped link", name)
+		}
+		if !strings.Contains(msg.Body, "Petsy.ro") || !strings.Contains(msg.HTMLBody, "<html>") {
+			t.Errorf("Render %s: bodies are not rendered in the layout", name)
+		}
+	}
+}
+
+func TestRenderLocale(t *testing.T) {
+	tmpl, err := ParseTemplates(templatesDir)
+	if err != nil {
+		t.Fatalf("ParseTemplates: unexpected error: %v", err)
+	}
+	data := templateData["activation"]
+
+	ro, _ := tmpl.Render("activation", "ro", data)
+	en, _ := tmpl.Render("activation", "en", data)
+	unknown, _ := tmpl.Render("activation", "xx", data)
+
+	if ro.Subject == en.Subject {
+		t.Errorf("Render: want different subjects for ro and en, got %q", ro.Subject)
+	}
+	if unknown.Subject != en.Subject {
+		t.Errorf("Render: unknown locale: got subject %q; want %q", unknown.Subject, en.Subject)
+	}
+	if !strings.Contains(ro.Body, "Bună Ana") || !strings.Contains(ro.HTMLBody, "Bună Ana") {
+		t.Errorf("Render: ro bodies are not translated")
+	}
+	if unknown.Body != en.Body || !strings.Contains(en.Body, "Hello Ana") {
+		t.Errorf("Render: unknown locale: got body %q; want %q", unknown.Body, en.Body)
+	}
+
+	if _, err := tmpl.Render("nonexistent", "en", data); err != NoSuchTemplateErr {
+		t.Errorf("Render: nonexistent template: got error %v; want %v", err, NoSuchTemplateErr)
+	}
+}
+
+func TestRenderUnsubscribable(t *testing.T) {
+	tmpl, err := ParseTemplates(templatesDir)
+	if err != nil {
+		t.Fatalf("ParseTemplates: unexpected error: %v", err)
+	}
+	const url = "http://petsy.ro/api/unsubscribe?sig=abc"
+
+	msg, err := tmpl.RenderUnsubscribable("booking", "en", templateData["booking"], url)
+	if err != nil {
+		t.Fatalf("RenderUnsubscribable: unexpected error: %v", err)
+	}
+	if !strings.Contains(msg.Body, url) || !strings.Contains(msg.HTMLBody, url) {
+		t.Errorf("RenderUnsubscribable: bodies do not contain the unsubscribe link")
+	}
+	if got := msg.Headers.Get("List-Unsubscribe"); got != "<"+url+">" {
+		t.Errorf("RenderUnsubscribable: got List-Unsubscribe %q; want <%s>", got, url)
+	}
+
+	msg, _ = tmpl.Render("booking", "en", templateData["booking"])
+	if msg.Headers != nil || strings.Contains(msg.Body, "unsubscribe") {
+		t.Errorf("Render: want no unsubscribe link")
+	}
+}
@@ -0,0 +1,224 @@
+// Part of mailer package. Implements the transports used for
+// delivering the messages.
+package mailer
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/mail"
+	"appengine/socket"
+)
+
+// Transport delivers messages to their recipients.
+type Transport interface {
+	Send(c appengine.Context, m *Message) error
+}
+
+// AppEngineTransport sends messages through the Appengine's mail API.
+// The headers not allowed by the API are dropped.
+type AppEngineTransport struct{}
+
+// appEngineHeaders are the headers accepted by the Appengine's mail API.
+var appEngineHeaders = []string{
+	"Auto-Submitted", "In-Reply-To", "List-Id", "List-Unsubscribe",
+	"On-Behalf-Of", "References", "Resent-Date", "Resent-From", "Resent-To",
+}
+
+// allowedHeaders returns the headers accepted by the Appengine's mail API,
+// or nil if there are none.
+func allowedHeaders(headers netmail.Header) netmail.Header {
+	var allowed netmail.Header
+	for _, name := range appEngineHeaders {
+		if values, ok := headers[name]; ok {
+			if allowed == nil {
+				allowed = make(netmail.Header)
+			}
+			allowed[name] = values
+		}
+	}
+	return allowed
+}
+
+// Send implements Transport.
+func (AppEngineTransport) Send(c appengine.Context, m *Message) error {
+	msg := &mail.Message{
+		Sender:   m.Sender,
+		To:       m.To,
+		Subject:  m.Subject,
+		Body:     m.Body,
+		HTMLBody: m.HTMLBody,
+		Headers:  allowedHeaders(m.Headers),
+	}
+
+	return mail.Send(c, msg)
+}
+
+// SMTPTransport sends messages to a SMTP server. The connection is made
+// through the Sockets API, which must be enabled for the application.
+type SMTPTransport struct {
+	// Addr is the host:port address of the SMTP server.
+	Addr string
+	// Username and Password are used for PLAIN authentication.
+	// No authentication is performed if the username is empty.
+	Username string
+	Password string
+	// StartTLS makes the transport fail if the server does not support
+	// the STARTTLS extension. If false, STARTTLS is still used when
+	// the server supports it.
+	StartTLS bool
+	// TLSConfig is the configuration used for STARTTLS. If nil, a default
+	// configuration checking the host of Addr is used.
+	TLSConfig *tls.Config
+}
+
+// Send implements Transport.
+func (t *SMTPTransport) Send(c appengine.Context, m *Message) error {
+	if len(m.To) == 0 {
+		return errors.New("message has no recipients")
+	}
+
+	data, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(t.Addr)
+	if err != nil {
+		return err
+	}
+
+	conn, err := socket.Dial(c, "tcp", t.Addr)
+	if err != nil {
+		return err
+	}
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		config := t.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: host}
+		}
+		if err := client.StartTLS(config); err != nil {
+			return err
+		}
+	} else if t.StartTLS {
+		return errors.New("smtp server does not support STARTTLS")
+	}
+
+	if t.Username != "" {
+		auth := smtp.PlainAuth("", t.Username, t.Password, host)
+		if err := client.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(m.Sender); err != nil {
+		return err
+	}
+	for _, to := range m.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// Outbox records every sent message instead of delivering it.
+// It is meant for tests and local development.
+type Outbox struct {
+	// Dir is the directory where each message is also written as an
+	// .eml file. Messages are kept only in memory if Dir is empty.
+	Dir string
+
+	mu       sync.Mutex
+	messages []*Message
+}
+
+// Send implements Transport.
+func (o *Outbox) Send(c appengine.Context, m *Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.Dir != "" {
+		data, err := m.Bytes()
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(o.Dir, 0755); err != nil {
+			return err
+		}
+
+		name := fmt.Sprintf("%d-%03d.eml", time.Now().UnixNano(), len(o.messages))
+		if err := ioutil.WriteFile(filepath.Join(o.Dir, name), data, 0644); err != nil {
+			return err
+		}
+	}
+
+	msg := *m
+	o.messages = append(o.messages, &msg)
+
+	return nil
+}
+
+// Messages returns all the recorded messages, oldest first.
+func (o *Outbox) Messages() []*Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]*Message(nil), o.messages...)
+}
+
+// MessagesTo returns the recorded messages sent to the provided address,
+// oldest first.
+func (o *Outbox) MessagesTo(address string) []*Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	messages := make([]*Message, 0)
+	for _, m := range o.messages {
+		for _, to := range m.To {
+			if strings.EqualFold(to, address) {
+				messages = append(messages, m)
+				break
+			}
+		}
+	}
+	return messages
+}
+
+// Reset removes all the recorded messages.
+func (o *Outbox) Reset() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.messages = nil
+}
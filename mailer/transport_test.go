@@ -0,0 +1,100 @@
+package mailer
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var testMessage = &Message{
+	To:       []string{"ana@petsy.ro"},
+	Sender:   "noreply@petsy.ro",
+	Subject:  "Petsy.ro - Detaliile contului pentru Ană",
+	Body:     "Hello Ana,\nhttp://petsy.ro/activate?a=1&b=2\n",
+	HTMLBody: "<p>Hello Ana,</p>",
+}
+
+func TestMessageBytes(t *testing.T) {
+	data, err := testMessage.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes: unexpected error: %v", err)
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Bytes: can't parse message: %v", err)
+	}
+
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != testMessage.Subject {
+		t.Errorf("Bytes: got subject %q; want %q", subject, testMessage.Subject)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("Bytes: got content type %q; want multipart/alternative", mediaType)
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for _, want := range []string{testMessage.Body, testMessage.HTMLBody} {
+		part, err := r.NextPart()
+		if err != nil {
+			t.Fatalf("Bytes: unexpected error reading part: %v", err)
+		}
+		got, _ := ioutil.ReadAll(part)
+		if strings.Replace(string(got), "\r\n", "\n", -1) != want {
+			t.Errorf("Bytes: got part %q; want %q", got, want)
+		}
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	outbox := &Outbox{Dir: dir}
+	if err := outbox.Send(nil, testMessage); err != nil {
+		t.Fatalf("Send: unexpected error: %v", err)
+	}
+	outbox.Send(nil, &Message{To: []string{"ion@petsy.ro"}})
+
+	if n := len(outbox.Messages()); n != 2 {
+		t.Errorf("Messages: got %d messages; want 2", n)
+	}
+	if got := outbox.MessagesTo("Ana@petsy.ro"); len(got) != 1 || got[0].Body != testMessage.Body {
+		t.Errorf("MessagesTo: got %v; want the test message", got)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.eml")); len(files) != 2 {
+		t.Errorf("Send: got %d files in outbox dir; want 2", len(files))
+	}
+
+	outbox.Reset()
+	if n := len(outbox.Messages()); n != 0 {
+		t.Errorf("Reset: got %d messages; want 0", n)
+	}
+}
+
+func TestAllowedHeaders(t *testing.T) {
+	m := &Message{}
+	m.SetUnsubscribe("http://petsy.ro/unsubscribe")
+
+	headers := allowedHeaders(m.Headers)
+	if got := headers.Get("List-Unsubscribe"); got != "<http://petsy.ro/unsubscribe>" {
+		t.Errorf("allowedHeaders: got List-Unsubscribe %q; want %q", got, "<http://petsy.ro/unsubscribe>")
+	}
+	if _, ok := headers["List-Unsubscribe-Post"]; ok {
+		t.Errorf("allowedHeaders: got List-Unsubscribe-Post; want it dropped")
+	}
+	if headers := allowedHeaders(nil); headers != nil {
+		t.Errorf("allowedHeaders(nil): got %v; want nil", headers)
+	}
+}
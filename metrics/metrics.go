@@ -0,0 +1,245 @@
+// Package metrics implements counters and histograms exposed in the
+// Prometheus text format. The metrics are kept in the memory of each
+// instance, so they are reset when the instance is restarted.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets, suited for
+// request latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is a metric which can be written in the text format.
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds the metrics exposed together.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// DefaultRegistry holds the metrics created by NewCounter and NewHistogram.
+var DefaultRegistry = &Registry{}
+
+// Write writes all the metrics of the registry in the Prometheus text format.
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Write writes the metrics of the default registry.
+func Write(w io.Writer) error {
+	return DefaultRegistry.Write(w)
+}
+
+func (r *Registry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// series holds the label names of a metric and the values of its series,
+// keyed by the label values.
+type series struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (s *series) key(values []string) string {
+	if len(values) != len(s.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", s.name, len(s.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels with the values, adding the extra pair if any.
+func (s *series) labelPairs(values []string, extra ...string) string {
+	pairs := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		pairs = append(pairs, s.labels[i]+"="+quote(v))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+"="+quote(extra[1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (s *series) header(w *bufio.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", s.name, s.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", s.name, kind)
+}
+
+// Counter is a monotonically increasing value, for each combination of labels.
+type Counter struct {
+	series
+	mu     sync.Mutex
+	values map[string]float64
+	label  map[string][]string
+}
+
+// NewCounter creates a counter with the label names and registers it
+// in the default registry.
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		series: series{name, help, labels},
+		values: make(map[string]float64),
+		label:  make(map[string][]string),
+	}
+	DefaultRegistry.register(c)
+	return c
+}
+
+// Inc increments the counter of the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds the delta, which must not be negative, to the counter of the label values.
+func (c *Counter) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic("metrics: counters cannot decrease")
+	}
+
+	key := c.key(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.label[key]; !ok {
+		c.label[key] = append([]string(nil), values...)
+	}
+	c.values[key] += delta
+}
+
+// Value returns the counter of the label values.
+func (c *Counter) Value(values ...string) float64 {
+	key := c.key(values)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key]
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.header(w, "counter")
+	for _, key := range sortedKeys(c.label) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelPairs(c.label[key]), formatFloat(c.values[key]))
+	}
+}
+
+// Histogram counts the observed values in buckets, for each combination of labels.
+type Histogram struct {
+	series
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValues
+	label   map[string][]string
+}
+
+type histogramValues struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram creates a histogram with the bucket upper bounds, in increasing
+// order, and the label names and registers it in the default registry.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic("metrics: histogram buckets must be sorted")
+	}
+
+	h := &Histogram{
+		series:  series{name, help, labels},
+		buckets: buckets,
+		values:  make(map[string]*histogramValues),
+		label:   make(map[string][]string),
+	}
+	DefaultRegistry.register(h)
+	return h
+}
+
+// Observe adds the value to the histogram of the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	key := h.key(values)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValues{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+		h.label[key] = append([]string(nil), values...)
+	}
+
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.header(w, "histogram")
+	for _, key := range sortedKeys(h.label) {
+		values, hv := h.label[key], h.values[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", formatFloat(bound)), hv.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(values, "le", "+Inf"), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(values), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(values), hv.count)
+	}
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quote(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests.", "method", "status")
+	c.Inc("GET", "200")
+	c.Inc("GET", "200")
+	c.Add(3, "POST", "500")
+
+	if v := c.Value("GET", "200"); v != 2 {
+		t.Errorf("Value: got %v; want 2", v)
+	}
+	if v := c.Value("GET", "404"); v != 0 {
+		t.Errorf("Value: missing series: got %v; want 0", v)
+	}
+
+	buf := &bytes.Buffer{}
+	if err := Write(buf); err != nil {
+		t.Fatalf("Write: unexpected error: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE test_requests_total counter",
+		`test_requests_total{method="GET",status="200"} 2`,
+		`test_requests_total{method="POST",status="500"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Write: missing line %q in:\n%s", line, buf)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1}, "route")
+	h.Observe(0.05, `/a"b`)
+	h.Observe(0.5, `/a"b`)
+	h.Observe(5, `/a"b`)
+
+	buf := &bytes.Buffer{}
+	if err := Write(buf); err != nil {
+		t.Fatalf("Write: unexpected error: %v", err)
+	}
+	for _, line := range []string{
+		"# TYPE test_latency_seconds histogram",
+		`test_latency_seconds_bucket{route="/a\"b",le="0.1"} 1`,
+		`test_latency_seconds_bucket{route="/a\"b",le="1"} 2`,
+		`test_latency_seconds_bucket{route="/a\"b",le="+Inf"} 3`,
+		`test_latency_seconds_sum{route="/a\"b"} 5.55`,
+		`test_latency_seconds_count{route="/a\"b"} 3`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("Write: missing line %q in:\n%s", line, buf)
+		}
+	}
+}
@@ -0,0 +1,388 @@
+// Part of migrate package. Implements the store of the Cloud Datastore
+// emulator, used by the tools running outside of the application.
+package migrate
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"appengine"
+)
+
+// EmulatorStore is the store of a Cloud Datastore emulator, such as the one
+// used by the development server when started with
+// --support_datastore_emulator, accessed through its HTTP API. The keys of
+// the entities are the JSON representation of their paths.
+type EmulatorStore struct {
+	// Host is the host:port address of the emulator, as set in the
+	// DATASTORE_EMULATOR_HOST environment variable.
+	Host string
+	// Project is the id of the project, as set in the DATASTORE_PROJECT_ID
+	// environment variable.
+	Project string
+	// Client sends the requests. If nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+type emulatorPathElement struct {
+	Kind string `json:"kind"`
+	// ID is the integer id, as a decimal string.
+	ID   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+}
+
+type emulatorPartition struct {
+	ProjectID string `json:"projectId"`
+}
+
+type emulatorKey struct {
+	PartitionID *emulatorPartition    `json:"partitionId,omitempty"`
+	Path        []emulatorPathElement `json:"path"`
+}
+
+type emulatorEntity struct {
+	Key        *emulatorKey          `json:"key"`
+	Properties map[string]*jsonValue `json:"properties,omitempty"`
+}
+
+type emulatorMutation struct {
+	Upsert *emulatorEntity `json:"upsert,omitempty"`
+	Insert *emulatorEntity `json:"insert,omitempty"`
+	Delete *emulatorKey    `json:"delete,omitempty"`
+}
+
+type emulatorKind struct {
+	Name string `json:"name"`
+}
+
+type emulatorQuery struct {
+	Kind        []emulatorKind  `json:"kind"`
+	Filter      *emulatorFilter `json:"filter,omitempty"`
+	Limit       int             `json:"limit,omitempty"`
+	StartCursor string          `json:"startCursor,omitempty"`
+}
+
+type emulatorFilter struct {
+	PropertyFilter *emulatorPropertyFilter `json:"propertyFilter"`
+}
+
+type emulatorPropertyFilter struct {
+	Property emulatorKind `json:"property"`
+	Op       string       `json:"op"`
+	Value    *jsonValue   `json:"value"`
+}
+
+type emulatorEntityResult struct {
+	Entity *emulatorEntity `json:"entity"`
+}
+
+// call sends the request to the method of the API and decodes the response.
+func (s *EmulatorStore) call(method string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	url := fmt.Sprintf("http://%s/v1/projects/%s:%s", s.Host, s.Project, method)
+	r, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(r.Body)
+		var status struct {
+			Error struct {
+				Status string `json:"status"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(msg, &status) == nil && status.Error.Status == "ALREADY_EXISTS" {
+			return ExistsErr
+		}
+		return fmt.Errorf("datastore emulator: %s: %s: %s", method, r.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// key returns the key of the API for the key of an entity, or an incomplete
+// key of the kind if it is empty.
+func (s *EmulatorStore) key(kind, key string) (*emulatorKey, error) {
+	k := &emulatorKey{PartitionID: &emulatorPartition{s.Project}}
+	if key == "" {
+		k.Path = []emulatorPathElement{{Kind: kind}}
+		return k, nil
+	}
+	if err := json.Unmarshal([]byte(key), &k.Path); err != nil || len(k.Path) == 0 {
+		return nil, errors.New("invalid key: " + key)
+	}
+	return k, nil
+}
+
+// entityKey returns the key of an entity for the key of the API.
+func entityKey(k *emulatorKey) (string, error) {
+	data, err := json.Marshal(k.Path)
+	return string(data), err
+}
+
+func (s *EmulatorStore) entity(e *emulatorEntity) (*Entity, error) {
+	key, err := entityKey(e.Key)
+	if err != nil {
+		return nil, err
+	}
+	props, err := decodeProperties(e.Properties)
+	if err != nil {
+		return nil, fmt.Errorf("entity %s: %v", key, err)
+	}
+	return &Entity{key, props}, nil
+}
+
+// Scan implements Store.
+func (s *EmulatorStore) Scan(c appengine.Context, kind string, limit int, cursor string) ([]*Entity, string, error) {
+	entities, next, err := s.runQuery(&emulatorQuery{
+		Kind:        []emulatorKind{{kind}},
+		Limit:       limit,
+		StartCursor: cursor,
+	})
+	if err != nil || len(entities) < limit {
+		return entities, "", err
+	}
+	return entities, next, nil
+}
+
+// Find implements Store.
+func (s *EmulatorStore) Find(c appengine.Context, kind, property string, value interface{}, limit int) ([]*Entity, error) {
+	jv, err := encodeValue(value, false)
+	if err != nil {
+		return nil, err
+	}
+
+	entities, _, err := s.runQuery(&emulatorQuery{
+		Kind:   []emulatorKind{{kind}},
+		Filter: &emulatorFilter{&emulatorPropertyFilter{emulatorKind{property}, "EQUAL", jv}},
+		Limit:  limit,
+	})
+	return entities, err
+}
+
+// runQuery returns the entities of the query and the cursor after them.
+func (s *EmulatorStore) runQuery(q *emulatorQuery) ([]*Entity, string, error) {
+	req := struct {
+		Query *emulatorQuery `json:"query"`
+	}{q}
+
+	var resp struct {
+		Batch struct {
+			EntityResults []emulatorEntityResult `json:"entityResults"`
+			EndCursor     string                 `json:"endCursor"`
+		} `json:"batch"`
+	}
+	if err := s.call("runQuery", &req, &resp); err != nil {
+		return nil, "", err
+	}
+
+	entities := make([]*Entity, len(resp.Batch.EntityResults))
+	for i, result := range resp.Batch.EntityResults {
+		e, err := s.entity(result.Entity)
+		if err != nil {
+			return nil, "", err
+		}
+		entities[i] = e
+	}
+	return entities, resp.Batch.EndCursor, nil
+}
+
+// commit applies the mutations, in the transaction if not empty, returning
+// the keys of the inserted entities.
+func (s *EmulatorStore) commit(transaction string, mutations []emulatorMutation) ([]*emulatorKey, error) {
+	req := struct {
+		Mode        string             `json:"mode"`
+		Transaction string             `json:"transaction,omitempty"`
+		Mutations   []emulatorMutation `json:"mutations"`
+	}{"NON_TRANSACTIONAL", transaction, mutations}
+	if transaction != "" {
+		req.Mode = "TRANSACTIONAL"
+	}
+
+	var resp struct {
+		MutationResults []struct {
+			Key *emulatorKey `json:"key"`
+		} `json:"mutationResults"`
+	}
+	if err := s.call("commit", &req, &resp); err != nil {
+		return nil, err
+	}
+
+	keys := make([]*emulatorKey, len(resp.MutationResults))
+	for i, result := range resp.MutationResults {
+		keys[i] = result.Key
+	}
+	return keys, nil
+}
+
+// Put implements Store.
+func (s *EmulatorStore) Put(c appengine.Context, kind string, entities []*Entity) error {
+	mutations := make([]emulatorMutation, len(entities))
+	for i, e := range entities {
+		key, err := s.key(kind, e.Key)
+		if err != nil {
+			return err
+		}
+		props, err := encodeProperties(e.Properties)
+		if err != nil {
+			return fmt.Errorf("entity %s: %v", e.Key, err)
+		}
+
+		if e.Key == "" {
+			mutations[i].Insert = &emulatorEntity{key, props}
+		} else {
+			mutations[i].Upsert = &emulatorEntity{key, props}
+		}
+	}
+
+	keys, err := s.commit("", mutations)
+	if err != nil {
+		return err
+	}
+	for i, e := range entities {
+		if e.Key != "" {
+			continue
+		}
+		if i >= len(keys) || keys[i] == nil {
+			return errors.New("datastore emulator: no key returned for an inserted entity")
+		}
+		if e.Key, err = entityKey(keys[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete implements Store.
+func (s *EmulatorStore) Delete(c appengine.Context, kind string, keys []string) error {
+	mutations := make([]emulatorMutation, len(keys))
+	for i, k := range keys {
+		key, err := s.key(kind, k)
+		if err != nil {
+			return err
+		}
+		mutations[i].Delete = key
+	}
+
+	_, err := s.commit("", mutations)
+	return err
+}
+
+// NewKey implements Store.
+func (s *EmulatorStore) NewKey(c appengine.Context, kind, name string) (string, int64, error) {
+	if name != "" {
+		key, err := entityKey(&emulatorKey{Path: []emulatorPathElement{{Kind: kind, Name: name}}})
+		return key, 0, err
+	}
+
+	req := struct {
+		Keys []*emulatorKey `json:"keys"`
+	}{[]*emulatorKey{{PartitionID: &emulatorPartition{s.Project}, Path: []emulatorPathElement{{Kind: kind}}}}}
+
+	var resp struct {
+		Keys []*emulatorKey `json:"keys"`
+	}
+	if err := s.call("allocateIds", &req, &resp); err != nil {
+		return "", 0, err
+	}
+	if len(resp.Keys) != 1 || len(resp.Keys[0].Path) != 1 {
+		return "", 0, errors.New("datastore emulator: no key allocated")
+	}
+
+	id, err := strconv.ParseInt(resp.Keys[0].Path[0].ID, 10, 64)
+	if err != nil {
+		return "", 0, err
+	}
+	key, err := entityKey(resp.Keys[0])
+	return key, id, err
+}
+
+// Insert implements Store. The insert mutations of the transaction fail if
+// an entity exists.
+func (s *EmulatorStore) Insert(c appengine.Context, entities []KindEntity) error {
+	mutations := make([]emulatorMutation, len(entities))
+	for i, e := range entities {
+		key, err := s.key(e.Kind, e.Key)
+		if err != nil {
+			return err
+		}
+		props, err := encodeProperties(e.Properties)
+		if err != nil {
+			return fmt.Errorf("entity %s: %v", e.Key, err)
+		}
+		mutations[i].Insert = &emulatorEntity{key, props}
+	}
+
+	var resp struct {
+		Transaction string `json:"transaction"`
+	}
+	if err := s.call("beginTransaction", struct{}{}, &resp); err != nil {
+		return err
+	}
+	_, err := s.commit(resp.Transaction, mutations)
+	return err
+}
+
+func (s *EmulatorStore) progressKey(version int) *emulatorKey {
+	return &emulatorKey{
+		PartitionID: &emulatorPartition{s.Project},
+		Path:        []emulatorPathElement{{Kind: ProgressKind, Name: strconv.Itoa(version)}},
+	}
+}
+
+// GetProgress implements Store.
+func (s *EmulatorStore) GetProgress(c appengine.Context, version int) (*Progress, error) {
+	req := struct {
+		Keys []*emulatorKey `json:"keys"`
+	}{[]*emulatorKey{s.progressKey(version)}}
+
+	var resp struct {
+		Found []emulatorEntityResult `json:"found"`
+	}
+	if err := s.call("lookup", &req, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Found) == 0 {
+		return nil, nil
+	}
+
+	e, err := s.entity(resp.Found[0].Entity)
+	if err != nil {
+		return nil, err
+	}
+	var p Progress
+	if err := e.Load(&p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PutProgress implements Store.
+func (s *EmulatorStore) PutProgress(c appengine.Context, p *Progress) error {
+	var e Entity
+	if err := e.Save(p); err != nil {
+		return err
+	}
+	props, err := encodeProperties(e.Properties)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.commit("", []emulatorMutation{{Upsert: &emulatorEntity{s.progressKey(p.Version), props}}})
+	return err
+}
@@ -0,0 +1,220 @@
+package migrate
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"appengine/datastore"
+)
+
+// fakeEmulator implements the methods of the emulator API used by
+// EmulatorStore, keeping the entities by kind in insertion order.
+type fakeEmulator struct {
+	entities []*emulatorEntity
+	lastID   int
+}
+
+func (f *fakeEmulator) find(key *emulatorKey) int {
+	want, _ := entityKey(key)
+	for i, e := range f.entities {
+		if got, _ := entityKey(e.Key); got == want {
+			return i
+		}
+	}
+	return -1
+}
+
+// matches reports whether the entity has the value of the equality
+// filter, as a single value or in an array.
+func matches(e *emulatorEntity, filter *emulatorFilter) bool {
+	if filter == nil {
+		return true
+	}
+	want, _ := json.Marshal(filter.PropertyFilter.Value)
+	v := e.Properties[filter.PropertyFilter.Property.Name]
+	if v == nil {
+		return false
+	}
+	values := []*jsonValue{v}
+	if v.ArrayValue != nil {
+		values = v.ArrayValue.Values
+	}
+	for _, v := range values {
+		if got, _ := json.Marshal(v); string(got) == string(want) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeEmulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, ":")+1:]
+	if !strings.HasPrefix(r.URL.Path, "/v1/projects/petsy:") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch method {
+	case "runQuery":
+		var req struct {
+			Query emulatorQuery `json:"query"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		start, _ := strconv.Atoi(req.Query.StartCursor)
+		var results []emulatorEntityResult
+		i := start
+		for ; i < len(f.entities) && len(results) < req.Query.Limit; i++ {
+			if f.entities[i].Key.Path[0].Kind == req.Query.Kind[0].Name && matches(f.entities[i], req.Query.Filter) {
+				results = append(results, emulatorEntityResult{f.entities[i]})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"batch": map[string]interface{}{"entityResults": results, "endCursor": strconv.Itoa(i)},
+		})
+
+	case "commit":
+		var req struct {
+			Mutations []emulatorMutation `json:"mutations"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		for _, m := range req.Mutations {
+			if m.Insert != nil && f.find(m.Insert.Key) >= 0 {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"error": {"code": 409, "status": "ALREADY_EXISTS"}}`))
+				return
+			}
+		}
+
+		var results []map[string]interface{}
+		for _, m := range req.Mutations {
+			switch {
+			case m.Insert != nil:
+				if path := m.Insert.Key.Path; path[0].ID == "" && path[0].Name == "" {
+					f.lastID++
+					path[0].ID = strconv.Itoa(f.lastID)
+				}
+				f.entities = append(f.entities, m.Insert)
+				results = append(results, map[string]interface{}{"key": m.Insert.Key})
+			case m.Upsert != nil:
+				if i := f.find(m.Upsert.Key); i >= 0 {
+					f.entities[i] = m.Upsert
+				} else {
+					f.entities = append(f.entities, m.Upsert)
+				}
+				results = append(results, map[string]interface{}{})
+			case m.Delete != nil:
+				if i := f.find(m.Delete); i >= 0 {
+					f.entities = append(f.entities[:i], f.entities[i+1:]...)
+				}
+				results = append(results, map[string]interface{}{})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"mutationResults": results})
+
+	case "lookup":
+		var req struct {
+			Keys []*emulatorKey `json:"keys"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		found := []emulatorEntityResult{}
+		if i := f.find(req.Keys[0]); i >= 0 {
+			found = append(found, emulatorEntityResult{f.entities[i]})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"found": found})
+
+	case "allocateIds":
+		var req struct {
+			Keys []*emulatorKey `json:"keys"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		for _, k := range req.Keys {
+			f.lastID++
+			k.Path[0].ID = strconv.Itoa(f.lastID)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": req.Keys})
+
+	case "beginTransaction":
+		json.NewEncoder(w).Encode(map[string]interface{}{"transaction": "tx"})
+
+	default:
+		http.Error(w, "unknown method", http.StatusBadRequest)
+	}
+}
+
+func TestEmulatorStore(t *testing.T) {
+	server := httptest.NewServer(&fakeEmulator{})
+	defer server.Close()
+
+	s := &EmulatorStore{Host: strings.TrimPrefix(server.URL, "http://"), Project: "petsy"}
+
+	var users []*Entity
+	for i := 0; i < 3; i++ {
+		users = append(users, &Entity{Properties: datastore.PropertyList{
+			{Name: "email", Value: "User" + strconv.Itoa(i) + "@Petsy.ro"},
+			{Name: "roles", Value: "owner", Multiple: true},
+			{Name: "roles", Value: "sitter", Multiple: true},
+		}})
+	}
+	if err := s.Put(nil, "user", users); err != nil {
+		t.Fatalf("Put: unexpected error: %v", err)
+	}
+	if users[0].Key != `[{"kind":"user","id":"1"}]` {
+		t.Errorf("Put: got key %s; want the path of user 1", users[0].Key)
+	}
+
+	entities, cursor, err := s.Scan(nil, "user", 2, "")
+	if err != nil {
+		t.Fatalf("Scan: unexpected error: %v", err)
+	}
+	if len(entities) != 2 || cursor == "" {
+		t.Fatalf("Scan: got %d entities and cursor %q; want 2 and a cursor", len(entities), cursor)
+	}
+	if email, _ := entities[1].Get("email"); email != "User1@Petsy.ro" {
+		t.Errorf("Scan: got email %v; want User1@Petsy.ro", email)
+	}
+	if len(entities[1].Properties) != 3 {
+		t.Errorf("Scan: got %d properties; want 3", len(entities[1].Properties))
+	}
+
+	found, err := s.Find(nil, "user", "email", "User2@Petsy.ro", 1)
+	if err != nil {
+		t.Fatalf("Find: unexpected error: %v", err)
+	}
+	if len(found) != 1 || found[0].Key != users[2].Key {
+		t.Errorf("Find: got %d entities; want user 3", len(found))
+	}
+	if found, _ := s.Find(nil, "user", "roles", "sitter", 5); len(found) != 3 {
+		t.Errorf("Find: multiple property: got %d entities; want 3", len(found))
+	}
+
+	if err := s.Delete(nil, "user", []string{users[2].Key}); err != nil {
+		t.Fatalf("Delete: unexpected error: %v", err)
+	}
+	entities, cursor, err = s.Scan(nil, "user", 2, cursor)
+	if err != nil {
+		t.Fatalf("Scan: unexpected error: %v", err)
+	}
+	if len(entities) != 0 || cursor != "" {
+		t.Errorf("Scan: got %d entities and cursor %q after delete; want none", len(entities), cursor)
+	}
+
+	if p, err := s.GetProgress(nil, 1); p != nil || err != nil {
+		t.Errorf("GetProgress: got %+v, %v; want nil", p, err)
+	}
+}
+
+func TestEmulatorStoreInsert(t *testing.T) {
+	server := httptest.NewServer(&fakeEmulator{})
+	defer server.Close()
+
+	s := &EmulatorStore{Host: strings.TrimPrefix(server.URL, "http://"), Project: "petsy"}
+	testInsert(t, s, `[{"kind":"user","id":"1"}]`, `[{"kind":"user_email","name":"user@petsy.ro"}]`)
+}
@@ -0,0 +1,139 @@
+// Part of migrate package. Implements the JSON representation of the
+// entities used by the Cloud Datastore API, shared by the emulator store
+// and the snapshots of the memory store.
+package migrate
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"appengine/datastore"
+)
+
+// Error returned for the properties whose type has no JSON representation.
+var UnsupportedTypeErr = errors.New("unsupported property type")
+
+// jsonValue is a property value of the Cloud Datastore API.
+type jsonValue struct {
+	NullValue          string     `json:"nullValue,omitempty"`
+	BooleanValue       *bool      `json:"booleanValue,omitempty"`
+	IntegerValue       *string    `json:"integerValue,omitempty"`
+	DoubleValue        *float64   `json:"doubleValue,omitempty"`
+	TimestampValue     *string    `json:"timestampValue,omitempty"`
+	StringValue        *string    `json:"stringValue,omitempty"`
+	BlobValue          *string    `json:"blobValue,omitempty"`
+	ArrayValue         *jsonArray `json:"arrayValue,omitempty"`
+	ExcludeFromIndexes bool       `json:"excludeFromIndexes,omitempty"`
+}
+
+type jsonArray struct {
+	Values []*jsonValue `json:"values"`
+}
+
+// encodeValue returns the JSON representation of a property value.
+func encodeValue(v interface{}, noIndex bool) (*jsonValue, error) {
+	jv := &jsonValue{ExcludeFromIndexes: noIndex}
+
+	switch v := v.(type) {
+	case nil:
+		jv.NullValue = "NULL_VALUE"
+	case bool:
+		jv.BooleanValue = &v
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		jv.IntegerValue = &s
+	case float64:
+		jv.DoubleValue = &v
+	case time.Time:
+		s := v.UTC().Format(time.RFC3339Nano)
+		jv.TimestampValue = &s
+	case string:
+		jv.StringValue = &v
+	case []byte:
+		s := base64.StdEncoding.EncodeToString(v)
+		jv.BlobValue = &s
+	default:
+		return nil, fmt.Errorf("%v: %T", UnsupportedTypeErr, v)
+	}
+	return jv, nil
+}
+
+// decodeValue returns the property value of the JSON representation.
+func decodeValue(jv *jsonValue) (interface{}, error) {
+	switch {
+	case jv.BooleanValue != nil:
+		return *jv.BooleanValue, nil
+	case jv.IntegerValue != nil:
+		return strconv.ParseInt(*jv.IntegerValue, 10, 64)
+	case jv.DoubleValue != nil:
+		return *jv.DoubleValue, nil
+	case jv.TimestampValue != nil:
+		return time.Parse(time.RFC3339Nano, *jv.TimestampValue)
+	case jv.StringValue != nil:
+		return *jv.StringValue, nil
+	case jv.BlobValue != nil:
+		return base64.StdEncoding.DecodeString(*jv.BlobValue)
+	case jv.ArrayValue != nil:
+		return nil, fmt.Errorf("%v: nested array", UnsupportedTypeErr)
+	}
+	return nil, nil
+}
+
+// encodeProperties returns the JSON representation of the properties, by
+// name. The multiple-valued properties are represented as arrays.
+func encodeProperties(props datastore.PropertyList) (map[string]*jsonValue, error) {
+	values := make(map[string]*jsonValue, len(props))
+	for _, p := range props {
+		jv, err := encodeValue(p.Value, p.NoIndex)
+		if err != nil {
+			return nil, fmt.Errorf("property %s: %v", p.Name, err)
+		}
+		if !p.Multiple {
+			values[p.Name] = jv
+			continue
+		}
+
+		array, ok := values[p.Name]
+		if !ok || array.ArrayValue == nil {
+			array = &jsonValue{ArrayValue: &jsonArray{}}
+			values[p.Name] = array
+		}
+		array.ArrayValue.Values = append(array.ArrayValue.Values, jv)
+	}
+	return values, nil
+}
+
+// decodeProperties returns the properties of the JSON representation.
+func decodeProperties(values map[string]*jsonValue) (datastore.PropertyList, error) {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var props datastore.PropertyList
+	for _, name := range names {
+		jv := values[name]
+		if jv.ArrayValue == nil {
+			v, err := decodeValue(jv)
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %v", name, err)
+			}
+			props = append(props, datastore.Property{Name: name, Value: v, NoIndex: jv.ExcludeFromIndexes})
+			continue
+		}
+
+		for _, elem := range jv.ArrayValue.Values {
+			v, err := decodeValue(elem)
+			if err != nil {
+				return nil, fmt.Errorf("property %s: %v", name, err)
+			}
+			props = append(props, datastore.Property{Name: name, Value: v, NoIndex: elem.ExcludeFromIndexes, Multiple: true})
+		}
+	}
+	return props, nil
+}
@@ -0,0 +1,226 @@
+// Part of migrate package. Implements a store kept in memory, used by the
+// tests and by the tools working on snapshots of the datastore.
+package migrate
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// MemoryStore is a store kept in memory. The entities of a kind are scanned
+// in the order they were added. The contexts passed to it are not used.
+type MemoryStore struct {
+	mu       sync.Mutex
+	kinds    map[string][]*Entity
+	progress map[int]Progress
+	// lastID is the last id used for the keys of the added entities.
+	lastID int64
+}
+
+// NewMemoryStore returns an empty store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		kinds:    make(map[string][]*Entity),
+		progress: make(map[int]Progress),
+	}
+}
+
+// Add adds the entities of the kind, replacing the ones with the same key.
+func (s *MemoryStore) Add(kind string, entities ...*Entity) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.put(kind, entities)
+}
+
+// Kinds returns the kinds of the stored entities.
+func (s *MemoryStore) Kinds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kinds := make([]string, 0, len(s.kinds))
+	for kind := range s.kinds {
+		kinds = append(kinds, kind)
+	}
+	return kinds
+}
+
+// Entities returns copies of the entities of the kind.
+func (s *MemoryStore) Entities(kind string) []*Entity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entities := make([]*Entity, len(s.kinds[kind]))
+	for i, e := range s.kinds[kind] {
+		entities[i] = copyEntity(e)
+	}
+	return entities
+}
+
+// Scan implements Store. The cursors are the positions of the entities.
+func (s *MemoryStore) Scan(c appengine.Context, kind string, limit int, cursor string) ([]*Entity, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	start := 0
+	if cursor != "" {
+		var err error
+		if start, err = strconv.Atoi(cursor); err != nil || start < 0 {
+			return nil, "", InvalidCursorErr
+		}
+	}
+
+	all := s.kinds[kind]
+	var entities []*Entity
+	for i := start; i < len(all) && len(entities) < limit; i++ {
+		entities = append(entities, copyEntity(all[i]))
+	}
+
+	if len(entities) < limit {
+		return entities, "", nil
+	}
+	return entities, strconv.Itoa(start + limit), nil
+}
+
+// Find implements Store.
+func (s *MemoryStore) Find(c appengine.Context, kind, property string, value interface{}, limit int) ([]*Entity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var entities []*Entity
+	for _, e := range s.kinds[kind] {
+		if len(entities) == limit {
+			break
+		}
+		for _, p := range e.Properties {
+			if p.Name == property && !p.NoIndex && p.Value == value {
+				entities = append(entities, copyEntity(e))
+				break
+			}
+		}
+	}
+	return entities, nil
+}
+
+// Put implements Store. The keys of the added entities are "kind:id", with
+// increasing ids.
+func (s *MemoryStore) Put(c appengine.Context, kind string, entities []*Entity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range entities {
+		if e.Key == "" {
+			s.lastID++
+			e.Key = kind + ":" + strconv.FormatInt(s.lastID, 10)
+		}
+	}
+	s.put(kind, entities)
+	return nil
+}
+
+// Delete implements Store.
+func (s *MemoryStore) Delete(c appengine.Context, kind string, keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		deleted[k] = true
+	}
+
+	var entities []*Entity
+	for _, e := range s.kinds[kind] {
+		if !deleted[e.Key] {
+			entities = append(entities, e)
+		}
+	}
+	s.kinds[kind] = entities
+	return nil
+}
+
+// NewKey implements Store. The keys are "kind:name" or "kind:id".
+func (s *MemoryStore) NewKey(c appengine.Context, kind, name string) (string, int64, error) {
+	if name != "" {
+		return kind + ":" + name, 0, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	return kind + ":" + strconv.FormatInt(s.lastID, 10), s.lastID, nil
+}
+
+// Insert implements Store.
+func (s *MemoryStore) Insert(c appengine.Context, entities []KindEntity) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, e := range entities {
+		for _, old := range s.kinds[e.Kind] {
+			if old.Key == e.Key {
+				return ExistsErr
+			}
+		}
+	}
+	for _, e := range entities {
+		s.put(e.Kind, []*Entity{e.Entity})
+	}
+	return nil
+}
+
+// GetProgress implements Store.
+func (s *MemoryStore) GetProgress(c appengine.Context, version int) (*Progress, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p, ok := s.progress[version]
+	if !ok {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// PutProgress implements Store.
+func (s *MemoryStore) PutProgress(c appengine.Context, p *Progress) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.progress[p.Version] = *p
+	return nil
+}
+
+func (s *MemoryStore) put(kind string, entities []*Entity) {
+	for _, e := range entities {
+		e = copyEntity(e)
+
+		// The ids of the keys added are not reused.
+		if i := strings.LastIndex(e.Key, ":"); i >= 0 {
+			if id, err := strconv.ParseInt(e.Key[i+1:], 10, 64); err == nil && id > s.lastID {
+				s.lastID = id
+			}
+		}
+
+		replaced := false
+		for i, old := range s.kinds[kind] {
+			if old.Key == e.Key {
+				s.kinds[kind][i] = e
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			s.kinds[kind] = append(s.kinds[kind], e)
+		}
+	}
+}
+
+// copyEntity returns a copy of the entity, so that the stored entities only
+// change when put.
+func copyEntity(e *Entity) *Entity {
+	return &Entity{e.Key, append(datastore.PropertyList(nil), e.Properties...)}
+}
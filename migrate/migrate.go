@@ -0,0 +1,342 @@
+// Package migrate implements the versioned migrations of the datastore
+// entities. A migration changes the entities of a kind, one at a time, and
+// runs in batches whose progress is recorded, so that an interrupted run is
+// resumed where it stopped. The migrations run in the order of their versions,
+// each one starting only after the previous one is done.
+//
+// Migrations must be idempotent: the last batch of an interrupted run is
+// scanned again when resumed, and concurrent runs may scan the same entities.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// MaxBatchSize is the maximum number of entities of a batch.
+const MaxBatchSize = 500
+
+var (
+	InvalidBatchSizeErr = errors.New("batch size must be between 1 and 500")
+	NoSuchMigrationErr  = errors.New("no such migration")
+	InvalidCursorErr    = errors.New("invalid cursor")
+	// Error returned when running without context a migration saving the
+	// entities itself.
+	ContextRequiredErr = errors.New("migration needs the application context")
+	// Error returned by a migration for an entity colliding with another,
+	// e.g. on a unique property. The entity is migrated or not as reported,
+	// and counted in the collisions of the progress instead of failing.
+	CollisionErr = errors.New("the entity collides with another")
+)
+
+// Entity is an entity loaded as a list of properties, so that the properties
+// which no longer match the structs can be changed.
+type Entity struct {
+	// Key identifies the entity within its kind. It is the encoded key for
+	// the datastore.
+	Key        string
+	Properties datastore.PropertyList
+}
+
+// Get returns the value of the first property with the name.
+func (e *Entity) Get(name string) (interface{}, bool) {
+	for _, p := range e.Properties {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+	return nil, false
+}
+
+// Set replaces the values of the property with the value.
+func (e *Entity) Set(name string, value interface{}, noIndex bool) {
+	e.Delete(name)
+	e.Properties = append(e.Properties, datastore.Property{Name: name, Value: value, NoIndex: noIndex})
+}
+
+// Delete removes the property. Returns whether the entity had the property.
+func (e *Entity) Delete(name string) bool {
+	props := e.Properties[:0]
+	for _, p := range e.Properties {
+		if p.Name != name {
+			props = append(props, p)
+		}
+	}
+	deleted := len(props) < len(e.Properties)
+	e.Properties = props
+	return deleted
+}
+
+// Rename renames the property, keeping its values. Returns whether the
+// entity had the property.
+func (e *Entity) Rename(from, to string) bool {
+	renamed := false
+	for i := range e.Properties {
+		if e.Properties[i].Name == from {
+			e.Properties[i].Name = to
+			renamed = true
+		}
+	}
+	return renamed
+}
+
+// Load sets the fields of the struct pointed to by dst from the properties.
+// Returns a *datastore.ErrFieldMismatch if some properties have no field,
+// after setting the other fields.
+func (e *Entity) Load(dst interface{}) error {
+	c := make(chan datastore.Property, len(e.Properties))
+	for _, p := range e.Properties {
+		c <- p
+	}
+	close(c)
+	return datastore.LoadStruct(dst, c)
+}
+
+// Save replaces the properties with the fields of the struct pointed to by src.
+func (e *Entity) Save(src interface{}) error {
+	c := make(chan datastore.Property)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- datastore.SaveStruct(src, c)
+	}()
+
+	var props datastore.PropertyList
+	for p := range c {
+		props = append(props, p)
+	}
+	if err := <-errc; err != nil {
+		return err
+	}
+	e.Properties = props
+	return nil
+}
+
+// Func migrates an entity. Returns true if the entity was changed and
+// must be saved, or false if it is already migrated. Returns CollisionErr
+// if the entity collides with another, for it to be reported. The context is
+// nil when the migrations run outside of the application, e.g. by
+// petsy-admin.
+type Func func(c appengine.Context, e *Entity) (bool, error)
+
+// Migration changes the entities of a kind.
+type Migration struct {
+	// Version orders the migrations. It must be positive and unique.
+	Version     int
+	Kind        string
+	Description string
+	Migrate     Func
+	// Saves is true if Migrate saves the changed entities itself, e.g. in
+	// transactions or under new keys, instead of returning them to be
+	// saved. Such migrations only run in the application, with a context.
+	Saves bool
+}
+
+// Progress records the progress of a migration.
+type Progress struct {
+	Version     int    `datastore:"version"`
+	Kind        string `datastore:"kind,noindex"`
+	Description string `datastore:"description,noindex"`
+	// Cursor is the start of the next batch, empty before the first one.
+	Cursor   string    `datastore:"cursor,noindex"`
+	Batches  int       `datastore:"batches,noindex"`
+	Scanned  int       `datastore:"scanned,noindex"`
+	Migrated int       `datastore:"migrated,noindex"`
+	// Collisions is the number of entities colliding with others, which
+	// need to be fixed by the administrators.
+	Collisions int       `datastore:"collisions,noindex"`
+	Done       bool      `datastore:"done"`
+	Started    time.Time `datastore:"started,noindex"`
+	Updated    time.Time `datastore:"updated,noindex"`
+}
+
+// Registry holds the migrations run together.
+type Registry struct {
+	mu         sync.Mutex
+	migrations []Migration
+}
+
+// DefaultRegistry holds the migrations registered by Register.
+var DefaultRegistry = &Registry{}
+
+// Register adds the migration to the registry. Panics if the migration is
+// invalid or if its version is already registered, since it is a programming
+// error.
+func (r *Registry) Register(m Migration) {
+	if m.Version <= 0 || m.Kind == "" || m.Migrate == nil {
+		panic(fmt.Sprintf("migrate: invalid migration %d of kind %q", m.Version, m.Kind))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, other := range r.migrations {
+		if other.Version == m.Version {
+			panic(fmt.Sprintf("migrate: version %d registered twice", m.Version))
+		}
+	}
+	r.migrations = append(r.migrations, m)
+	sort.Sort(byVersion(r.migrations))
+}
+
+// Register adds the migration to the default registry.
+func Register(m Migration) {
+	DefaultRegistry.Register(m)
+}
+
+// Migrations returns the registered migrations, ordered by version.
+func (r *Registry) Migrations() []Migration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]Migration(nil), r.migrations...)
+}
+
+// Status returns the progress of all the migrations, ordered by version.
+// The migrations which never ran have no cursor and no start time.
+func (r *Registry) Status(c appengine.Context, s Store) ([]*Progress, error) {
+	migrations := r.Migrations()
+	status := make([]*Progress, len(migrations))
+	for i, m := range migrations {
+		p, err := progress(c, s, m)
+		if err != nil {
+			return nil, err
+		}
+		status[i] = p
+	}
+	return status, nil
+}
+
+// Status returns the progress of the migrations of the default registry.
+func Status(c appengine.Context, s Store) ([]*Progress, error) {
+	return DefaultRegistry.Status(c, s)
+}
+
+// Run runs the pending migrations in order, batch by batch, for at most
+// maxBatches batches in total, or until all are done if maxBatches is not
+// positive. Returns the progress of all the migrations. The run is resumed
+// by calling Run again.
+func (r *Registry) Run(c appengine.Context, s Store, batchSize, maxBatches int) ([]*Progress, error) {
+	if batchSize <= 0 || batchSize > MaxBatchSize {
+		return nil, InvalidBatchSizeErr
+	}
+
+	status, err := r.Status(c, s)
+	if err != nil {
+		return nil, err
+	}
+
+	batches := 0
+	for i, m := range r.Migrations() {
+		p := status[i]
+		if !p.Done && m.Saves && c == nil {
+			return status, fmt.Errorf("migration %d: %v", m.Version, ContextRequiredErr)
+		}
+		for !p.Done {
+			if maxBatches > 0 && batches == maxBatches {
+				return status, nil
+			}
+			if err := runBatch(c, s, m, p, batchSize); err != nil {
+				return status, fmt.Errorf("migration %d stopped at cursor %q: %v", m.Version, p.Cursor, err)
+			}
+			batches++
+		}
+	}
+	return status, nil
+}
+
+// Run runs the migrations of the default registry.
+func Run(c appengine.Context, s Store, batchSize, maxBatches int) ([]*Progress, error) {
+	return DefaultRegistry.Run(c, s, batchSize, maxBatches)
+}
+
+// Reset forgets the progress of the migration, so that it runs again from
+// the first entity.
+func (r *Registry) Reset(c appengine.Context, s Store, version int) error {
+	for _, m := range r.Migrations() {
+		if m.Version == version {
+			return s.PutProgress(c, newProgress(m))
+		}
+	}
+	return NoSuchMigrationErr
+}
+
+// Reset forgets the progress of a migration of the default registry.
+func Reset(c appengine.Context, s Store, version int) error {
+	return DefaultRegistry.Reset(c, s, version)
+}
+
+// progress returns the recorded progress of the migration, or a new one.
+func progress(c appengine.Context, s Store, m Migration) (*Progress, error) {
+	p, err := s.GetProgress(c, m.Version)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return newProgress(m), nil
+	}
+	return p, nil
+}
+
+func newProgress(m Migration) *Progress {
+	return &Progress{Version: m.Version, Kind: m.Kind, Description: m.Description}
+}
+
+// runBatch migrates the next batch of entities and records the progress.
+// The progress is only recorded after the changed entities are saved, so a
+// failed batch is scanned again by the next run.
+func runBatch(c appengine.Context, s Store, m Migration, p *Progress, batchSize int) error {
+	entities, next, err := s.Scan(c, m.Kind, batchSize, p.Cursor)
+	if err != nil {
+		return err
+	}
+
+	var changed []*Entity
+	migrated, collisions := 0, 0
+	for _, e := range entities {
+		ok, err := m.Migrate(c, e)
+		if err == CollisionErr {
+			collisions++
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("entity %s: %v", e.Key, err)
+		}
+		if ok {
+			migrated++
+			if !m.Saves {
+				changed = append(changed, e)
+			}
+		}
+	}
+	if len(changed) > 0 {
+		if err := s.Put(c, m.Kind, changed); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	if p.Started.IsZero() {
+		p.Started = now
+	}
+	p.Updated = now
+	p.Cursor = next
+	p.Batches++
+	p.Scanned += len(entities)
+	p.Migrated += migrated
+	p.Collisions += collisions
+	p.Done = next == ""
+
+	return s.PutProgress(c, p)
+}
+
+type byVersion []Migration
+
+func (m byVersion) Len() int           { return len(m) }
+func (m byVersion) Less(i, j int) bool { return m[i].Version < m[j].Version }
+func (m byVersion) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
@@ -0,0 +1,369 @@
+package migrate
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// lowercaseEmails lowercases the "email" property of the users.
+func lowercaseEmails(c appengine.Context, e *Entity) (bool, error) {
+	v, ok := e.Get("email")
+	if !ok {
+		return false, nil
+	}
+	email := v.(string)
+	if email == strings.ToLower(email) {
+		return false, nil
+	}
+	e.Set("email", strings.ToLower(email), false)
+	return true, nil
+}
+
+// renameActive renames the untagged "Active" property of the users.
+func renameActive(c appengine.Context, e *Entity) (bool, error) {
+	return e.Rename("Active", "active"), nil
+}
+
+func newUsers(n int) *MemoryStore {
+	s := NewMemoryStore()
+	for i := 0; i < n; i++ {
+		s.Add("user", &Entity{strconv.Itoa(i), datastore.PropertyList{
+			{Name: "email", Value: "User" + strconv.Itoa(i) + "@Petsy.ro"},
+			{Name: "Active", Value: true},
+		}})
+	}
+	return s
+}
+
+func newRegistry() *Registry {
+	r := &Registry{}
+	r.Register(Migration{Version: 2, Kind: "user", Description: "rename active", Migrate: renameActive})
+	r.Register(Migration{Version: 1, Kind: "user", Description: "lowercase emails", Migrate: lowercaseEmails})
+	return r
+}
+
+func TestRun(t *testing.T) {
+	s := newUsers(25)
+	r := newRegistry()
+
+	if _, err := r.Run(nil, s, 0, 0); err != InvalidBatchSizeErr {
+		t.Errorf("Run: batch size 0: got error %v; want %v", err, InvalidBatchSizeErr)
+	}
+
+	// The first run stops after 2 batches of the first migration.
+	status, err := r.Run(nil, s, 10, 2)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if len(status) != 2 || status[0].Version != 1 || status[1].Version != 2 {
+		t.Fatalf("Run: got status %+v; want migrations 1 and 2", status)
+	}
+	if status[0].Done || status[0].Scanned != 20 || status[0].Migrated != 20 || status[0].Cursor == "" {
+		t.Errorf("Run: got progress %+v; want 20 scanned and migrated, not done", status[0])
+	}
+	if status[1].Batches != 0 {
+		t.Errorf("Run: migration 2 started before migration 1 was done")
+	}
+
+	// The second run resumes from the recorded cursor.
+	status, err = r.Run(nil, s, 10, 0)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	for _, p := range status {
+		if !p.Done || p.Scanned != 25 || p.Migrated != 25 {
+			t.Errorf("Run: got progress %+v; want 25 scanned and migrated, done", p)
+		}
+	}
+
+	for _, e := range s.Entities("user") {
+		email, _ := e.Get("email")
+		if email != strings.ToLower(email.(string)) {
+			t.Errorf("Run: entity %s: got email %v; want lowercase", e.Key, email)
+		}
+		if _, ok := e.Get("Active"); ok {
+			t.Errorf("Run: entity %s: Active was not renamed", e.Key)
+		}
+		if active, _ := e.Get("active"); active != true {
+			t.Errorf("Run: entity %s: got active %v; want true", e.Key, active)
+		}
+	}
+
+	// Running again does not scan the entities.
+	status, err = r.Run(nil, s, 10, 0)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if status[0].Batches != 3 || status[1].Batches != 3 {
+		t.Errorf("Run: done migrations ran again: %+v, %+v", status[0], status[1])
+	}
+
+	// Migrations are idempotent, so a reset one changes nothing.
+	if err := r.Reset(nil, s, 1); err != nil {
+		t.Fatalf("Reset: unexpected error: %v", err)
+	}
+	status, err = r.Run(nil, s, 10, 0)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if !status[0].Done || status[0].Scanned != 25 || status[0].Migrated != 0 {
+		t.Errorf("Run: after reset: got progress %+v; want 25 scanned, none migrated", status[0])
+	}
+	if err := r.Reset(nil, s, 3); err != NoSuchMigrationErr {
+		t.Errorf("Reset: got error %v; want %v", err, NoSuchMigrationErr)
+	}
+}
+
+func TestRunFailure(t *testing.T) {
+	s := newUsers(5)
+	r := &Registry{}
+
+	fail := true
+	r.Register(Migration{Version: 1, Kind: "user", Migrate: func(c appengine.Context, e *Entity) (bool, error) {
+		if fail && e.Key == "3" {
+			return false, errors.New("broken entity")
+		}
+		return lowercaseEmails(c, e)
+	}})
+
+	if _, err := r.Run(nil, s, 2, 0); err == nil {
+		t.Fatalf("Run: want error")
+	}
+	status, _ := r.Status(nil, s)
+	if status[0].Done || status[0].Scanned != 2 || status[0].Cursor != "2" {
+		t.Errorf("Run: got progress %+v; want the failed batch not recorded", status[0])
+	}
+
+	fail = false
+	status, err := r.Run(nil, s, 2, 0)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if !status[0].Done || status[0].Scanned != 5 || status[0].Migrated != 5 {
+		t.Errorf("Run: got progress %+v; want 5 scanned and migrated, done", status[0])
+	}
+}
+
+func TestRunCollisions(t *testing.T) {
+	s := newUsers(5)
+	r := &Registry{}
+	r.Register(Migration{Version: 1, Kind: "user", Migrate: func(c appengine.Context, e *Entity) (bool, error) {
+		migrated, err := lowercaseEmails(c, e)
+		if err == nil && (e.Key == "1" || e.Key == "3") {
+			return migrated, CollisionErr
+		}
+		return migrated, err
+	}})
+
+	status, err := r.Run(nil, s, 2, 0)
+	if err != nil {
+		t.Fatalf("Run: unexpected error: %v", err)
+	}
+	if !status[0].Done || status[0].Migrated != 5 || status[0].Collisions != 2 {
+		t.Errorf("Run: got progress %+v; want 5 migrated and 2 collisions, done", status[0])
+	}
+	if email, _ := s.Entities("user")[3].Get("email"); email != "user3@petsy.ro" {
+		t.Errorf("Run: got email %v for a collision; want it migrated", email)
+	}
+}
+
+func TestRunSaves(t *testing.T) {
+	s := newUsers(5)
+	r := newRegistry()
+	r.Register(Migration{Version: 3, Kind: "user", Migrate: renameActive, Saves: true})
+
+	status, err := r.Run(nil, s, 10, 0)
+	if err == nil || !strings.Contains(err.Error(), ContextRequiredErr.Error()) {
+		t.Errorf("Run: got error %v; want %v", err, ContextRequiredErr)
+	}
+	if len(status) != 3 || !status[1].Done || status[2].Scanned != 0 {
+		t.Errorf("Run: got progress %+v; want the migrations before 3 done", status)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := newRegistry()
+
+	migrations := r.Migrations()
+	if len(migrations) != 2 || migrations[0].Version != 1 || migrations[1].Version != 2 {
+		t.Errorf("Migrations: got %+v; want versions 1 and 2", migrations)
+	}
+
+	for _, m := range []Migration{
+		{Version: 1, Kind: "user", Migrate: renameActive},
+		{Version: 0, Kind: "user", Migrate: renameActive},
+		{Version: 3, Kind: "", Migrate: renameActive},
+		{Version: 3, Kind: "user"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Register(%d, %q): want panic", m.Version, m.Kind)
+				}
+			}()
+			r.Register(m)
+		}()
+	}
+}
+
+func TestMemoryStoreFind(t *testing.T) {
+	s := newUsers(5)
+
+	found, err := s.Find(nil, "user", "email", "User3@Petsy.ro", 1)
+	if err != nil {
+		t.Fatalf("Find: unexpected error: %v", err)
+	}
+	if len(found) != 1 || found[0].Key != "3" {
+		t.Errorf("Find: got %d entities; want user 3", len(found))
+	}
+	if found, _ := s.Find(nil, "user", "Active", true, 2); len(found) != 2 {
+		t.Errorf("Find: limit 2: got %d entities", len(found))
+	}
+	if found, _ := s.Find(nil, "user", "email", "user3@petsy.ro", 1); len(found) != 0 {
+		t.Errorf("Find: got %d entities for another value; want none", len(found))
+	}
+}
+
+// testInsert checks that the store inserts a user and the reservation of
+// its email, and nothing if the reservation exists.
+func testInsert(t *testing.T, s Store, userKey, emailKey string) {
+	insert := func() error {
+		key, id, err := s.NewKey(nil, "user", "")
+		if err != nil {
+			t.Fatalf("NewKey: unexpected error: %v", err)
+		}
+		if id == 0 {
+			t.Errorf("NewKey: got id 0 for key %s", key)
+		}
+		email, _, err := s.NewKey(nil, "user_email", "user@petsy.ro")
+		if err != nil {
+			t.Fatalf("NewKey: unexpected error: %v", err)
+		}
+		if email != emailKey {
+			t.Errorf("NewKey: got key %s; want %s", email, emailKey)
+		}
+
+		return s.Insert(nil, []KindEntity{
+			{"user", &Entity{key, datastore.PropertyList{{Name: "email", Value: "User@Petsy.ro"}}}},
+			{"user_email", &Entity{email, datastore.PropertyList{{Name: "user", Value: id, NoIndex: true}}}},
+		})
+	}
+
+	if err := insert(); err != nil {
+		t.Fatalf("Insert: unexpected error: %v", err)
+	}
+	if err := insert(); err != ExistsErr {
+		t.Errorf("Insert: got %v for an existing entity; want ExistsErr", err)
+	}
+
+	users, _, err := s.Scan(nil, "user", 5, "")
+	if err != nil {
+		t.Fatalf("Scan: unexpected error: %v", err)
+	}
+	if len(users) != 1 || users[0].Key != userKey {
+		t.Errorf("Insert: got %d users; want only %s", len(users), userKey)
+	}
+}
+
+func TestMemoryStoreInsert(t *testing.T) {
+	testInsert(t, NewMemoryStore(), "user:1", "user_email:user@petsy.ro")
+}
+
+func TestEntity(t *testing.T) {
+	e := &Entity{"1", datastore.PropertyList{
+		{Name: "Roles", Value: "owner", Multiple: true},
+		{Name: "Roles", Value: "sitter", Multiple: true},
+		{Name: "name", Value: "Ana"},
+	}}
+
+	if !e.Rename("Roles", "roles") || e.Rename("Roles", "roles") {
+		t.Errorf("Rename: want true, then false")
+	}
+	if v, _ := e.Get("roles"); v != "owner" {
+		t.Errorf("Get: got %v; want owner", v)
+	}
+	if len(e.Properties) != 3 {
+		t.Errorf("Rename: got %d properties; want 3", len(e.Properties))
+	}
+
+	e.Set("name", "Maria", true)
+	if v, _ := e.Get("name"); v != "Maria" || len(e.Properties) != 3 {
+		t.Errorf("Set: got %v and %d properties; want Maria and 3", v, len(e.Properties))
+	}
+
+	if !e.Delete("roles") || e.Delete("roles") {
+		t.Errorf("Delete: want true, then false")
+	}
+	if _, ok := e.Get("roles"); ok || len(e.Properties) != 1 {
+		t.Errorf("Delete: got %d properties; want 1", len(e.Properties))
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	created := time.Date(2014, 5, 1, 10, 30, 0, 0, time.UTC)
+
+	s := NewMemoryStore()
+	s.Add("user", &Entity{"user:7", datastore.PropertyList{
+		{Name: "email", Value: "ana@petsy.ro"},
+		{Name: "Active", Value: true},
+		{Name: "created", Value: created, NoIndex: true},
+		{Name: "hash", Value: []byte{1, 2, 3}, NoIndex: true},
+		{Name: "roles", Value: "owner", Multiple: true},
+		{Name: "roles", Value: "sitter", Multiple: true},
+		{Name: "price", Value: int64(120)},
+		{Name: "rating", Value: 4.5},
+	}})
+	s.PutProgress(nil, &Progress{Version: 1, Kind: "user", Done: true})
+
+	var buf bytes.Buffer
+	if err := s.WriteSnapshot(&buf); err != nil {
+		t.Fatalf("WriteSnapshot: unexpected error: %v", err)
+	}
+
+	loaded := NewMemoryStore()
+	if err := loaded.ReadSnapshot(&buf); err != nil {
+		t.Fatalf("ReadSnapshot: unexpected error: %v", err)
+	}
+
+	entities := loaded.Entities("user")
+	if len(entities) != 1 || entities[0].Key != "user:7" {
+		t.Fatalf("ReadSnapshot: got entities %+v; want user:7", entities)
+	}
+	e := entities[0]
+	for name, want := range map[string]interface{}{
+		"email":   "ana@petsy.ro",
+		"Active":  true,
+		"created": created,
+		"price":   int64(120),
+		"rating":  4.5,
+		"roles":   "owner",
+	} {
+		if got, _ := e.Get(name); got != want {
+			t.Errorf("ReadSnapshot: property %s: got %v (%T); want %v (%T)", name, got, got, want, want)
+		}
+	}
+	if hash, _ := e.Get("hash"); !bytes.Equal(hash.([]byte), []byte{1, 2, 3}) {
+		t.Errorf("ReadSnapshot: property hash: got %v; want [1 2 3]", hash)
+	}
+	if len(e.Properties) != 8 {
+		t.Errorf("ReadSnapshot: got %d properties; want 8", len(e.Properties))
+	}
+
+	if p, _ := loaded.GetProgress(nil, 1); p == nil || !p.Done {
+		t.Errorf("ReadSnapshot: got progress %+v; want done", p)
+	}
+
+	// The ids of the loaded keys are not reused.
+	added := &Entity{Properties: datastore.PropertyList{{Name: "email", Value: "maria@petsy.ro"}}}
+	loaded.Put(nil, "user", []*Entity{added})
+	if added.Key != "user:8" {
+		t.Errorf("Put: got key %s; want user:8", added.Key)
+	}
+}
@@ -0,0 +1,85 @@
+// Part of migrate package. Implements the snapshots of the memory store,
+// which keep the entities and the progress of the migrations in a JSON file.
+package migrate
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// snapshot is the JSON representation of a memory store. The properties of
+// the entities are represented as in the Cloud Datastore API.
+type snapshot struct {
+	Kinds    map[string][]snapshotEntity `json:"kinds"`
+	Progress []Progress                  `json:"progress,omitempty"`
+}
+
+type snapshotEntity struct {
+	Key        string                `json:"key"`
+	Properties map[string]*jsonValue `json:"properties"`
+}
+
+// WriteSnapshot writes the entities and the progress of the migrations as JSON.
+func (s *MemoryStore) WriteSnapshot(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := snapshot{Kinds: make(map[string][]snapshotEntity, len(s.kinds))}
+	for kind, entities := range s.kinds {
+		snapEntities := make([]snapshotEntity, len(entities))
+		for i, e := range entities {
+			props, err := encodeProperties(e.Properties)
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", kind, e.Key, err)
+			}
+			snapEntities[i] = snapshotEntity{e.Key, props}
+		}
+		snap.Kinds[kind] = snapEntities
+	}
+
+	versions := make([]int, 0, len(s.progress))
+	for version := range s.progress {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+	for _, version := range versions {
+		snap.Progress = append(snap.Progress, s.progress[version])
+	}
+
+	data, err := json.MarshalIndent(&snap, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadSnapshot adds the entities and the progress of the migrations of a
+// snapshot written by WriteSnapshot.
+func (s *MemoryStore) ReadSnapshot(r io.Reader) error {
+	var snap snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for kind, snapEntities := range snap.Kinds {
+		entities := make([]*Entity, len(snapEntities))
+		for i, se := range snapEntities {
+			props, err := decodeProperties(se.Properties)
+			if err != nil {
+				return fmt.Errorf("%s %s: %v", kind, se.Key, err)
+			}
+			entities[i] = &Entity{se.Key, props}
+		}
+		s.put(kind, entities)
+	}
+	for _, p := range snap.Progress {
+		s.progress[p.Version] = p
+	}
+	return nil
+}
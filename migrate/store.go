@@ -0,0 +1,218 @@
+// Part of migrate package. Implements the stores of the migrated entities
+// and of the progress of the migrations.
+package migrate
+
+import (
+	"errors"
+	"strconv"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+// ProgressKind is the kind of the progress entities in the datastore.
+const ProgressKind = "migration"
+
+// ExistsErr is returned by Store.Insert if an entity is already stored.
+var ExistsErr = errors.New("the entity already exists")
+
+// KindEntity is an entity along with its kind.
+type KindEntity struct {
+	Kind string
+	*Entity
+}
+
+// Store holds the migrated entities and the progress of the migrations.
+type Store interface {
+	// Scan returns at most limit entities of the kind, starting from the
+	// cursor, which is empty for the first batch. Returns the cursor of
+	// the next batch, which is empty when all the entities were scanned.
+	Scan(c appengine.Context, kind string, limit int, cursor string) ([]*Entity, string, error)
+	// Find returns at most limit entities of the kind having the value
+	// for the indexed property.
+	Find(c appengine.Context, kind, property string, value interface{}, limit int) ([]*Entity, error)
+	// Put saves the entities of the kind. The entities with an empty key are
+	// added, and their key is set.
+	Put(c appengine.Context, kind string, entities []*Entity) error
+	// Delete deletes the entities of the kind having the keys.
+	Delete(c appengine.Context, kind string, keys []string) error
+	// NewKey returns the key of the entity of the kind with the name or, if
+	// the name is empty, a key with a newly allocated id, returned too.
+	NewKey(c appengine.Context, kind, name string) (string, int64, error)
+	// Insert adds the entities, whose keys are set, in a single transaction.
+	// Returns ExistsErr, adding none of them, if one is already stored.
+	Insert(c appengine.Context, entities []KindEntity) error
+	// GetProgress returns the progress of the migration with the version,
+	// or nil if it never ran.
+	GetProgress(c appengine.Context, version int) (*Progress, error)
+	// PutProgress saves the progress of a migration.
+	PutProgress(c appengine.Context, p *Progress) error
+}
+
+// DatastoreStore is the store of the Appengine's datastore.
+type DatastoreStore struct{}
+
+// Scan implements Store.
+func (DatastoreStore) Scan(c appengine.Context, kind string, limit int, cursor string) ([]*Entity, string, error) {
+	query := datastore.NewQuery(kind).Limit(limit)
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(start)
+	}
+
+	var entities []*Entity
+
+	t := query.Run(c)
+	for {
+		var props datastore.PropertyList
+		key, err := t.Next(&props)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		entities = append(entities, &Entity{key.Encode(), props})
+	}
+
+	if len(entities) < limit {
+		return entities, "", nil
+	}
+
+	next, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return entities, next.String(), nil
+}
+
+// Find implements Store.
+func (DatastoreStore) Find(c appengine.Context, kind, property string, value interface{}, limit int) ([]*Entity, error) {
+	query := datastore.NewQuery(kind).Filter(property+" =", value).Limit(limit)
+
+	var entities []*Entity
+	for t := query.Run(c); ; {
+		var props datastore.PropertyList
+		key, err := t.Next(&props)
+		if err == datastore.Done {
+			return entities, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, &Entity{key.Encode(), props})
+	}
+}
+
+// Put implements Store.
+func (DatastoreStore) Put(c appengine.Context, kind string, entities []*Entity) error {
+	keys := make([]*datastore.Key, len(entities))
+	props := make([]datastore.PropertyList, len(entities))
+	for i, e := range entities {
+		if e.Key == "" {
+			keys[i] = datastore.NewIncompleteKey(c, kind, nil)
+		} else {
+			key, err := datastore.DecodeKey(e.Key)
+			if err != nil {
+				return err
+			}
+			keys[i] = key
+		}
+		props[i] = e.Properties
+	}
+
+	keys, err := datastore.PutMulti(c, keys, props)
+	if err != nil {
+		return err
+	}
+	for i, e := range entities {
+		e.Key = keys[i].Encode()
+	}
+	return nil
+}
+
+// Delete implements Store.
+func (DatastoreStore) Delete(c appengine.Context, kind string, keys []string) error {
+	dsKeys := make([]*datastore.Key, len(keys))
+	for i, k := range keys {
+		key, err := datastore.DecodeKey(k)
+		if err != nil {
+			return err
+		}
+		dsKeys[i] = key
+	}
+	return datastore.DeleteMulti(c, dsKeys)
+}
+
+// NewKey implements Store.
+func (DatastoreStore) NewKey(c appengine.Context, kind, name string) (string, int64, error) {
+	if name != "" {
+		return datastore.NewKey(c, kind, name, 0, nil).Encode(), 0, nil
+	}
+	id, _, err := datastore.AllocateIDs(c, kind, nil, 1)
+	if err != nil {
+		return "", 0, err
+	}
+	return datastore.NewKey(c, kind, "", id, nil).Encode(), id, nil
+}
+
+// Insert implements Store. The entities may be in at most 25 entity groups.
+func (DatastoreStore) Insert(c appengine.Context, entities []KindEntity) error {
+	keys := make([]*datastore.Key, len(entities))
+	props := make([]datastore.PropertyList, len(entities))
+	for i, e := range entities {
+		key, err := datastore.DecodeKey(e.Key)
+		if err != nil {
+			return err
+		}
+		keys[i] = key
+		props[i] = e.Properties
+	}
+
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		err := datastore.GetMulti(tc, keys, make([]datastore.PropertyList, len(keys)))
+		if err == nil {
+			return ExistsErr
+		}
+		merr, ok := err.(appengine.MultiError)
+		if !ok {
+			return err
+		}
+		for _, err := range merr {
+			if err == nil {
+				return ExistsErr
+			}
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+		}
+		_, err = datastore.PutMulti(tc, keys, props)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// GetProgress implements Store.
+func (DatastoreStore) GetProgress(c appengine.Context, version int) (*Progress, error) {
+	var p Progress
+	err := datastore.Get(c, progressKey(c, version), &p)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// PutProgress implements Store.
+func (DatastoreStore) PutProgress(c appengine.Context, p *Progress) error {
+	_, err := datastore.Put(c, progressKey(c, p.Version), p)
+	return err
+}
+
+func progressKey(c appengine.Context, version int) *datastore.Key {
+	return datastore.NewKey(c, ProgressKind, strconv.Itoa(version), 0, nil)
+}
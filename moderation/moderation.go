@@ -0,0 +1,184 @@
+// Package moderation implements the queues of user content, like reviews
+// and photos, waiting to be reviewed by the moderators.
+package moderation
+
+import (
+	"errors"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const ItemKind = "moderation"
+
+// Kinds of moderated content.
+const (
+	ReviewItem = "review"
+	PhotoItem  = "photo"
+)
+
+// Kinds lists all the kinds of moderated content.
+var Kinds = []string{ReviewItem, PhotoItem}
+
+// States of the moderated items.
+const (
+	Pending  = "pending"
+	Approved = "approved"
+	Rejected = "rejected"
+)
+
+var (
+	// Error returned if there is no item with the specified id.
+	NoSuchItemErr = errors.New("no moderation item with this id found")
+	// Error returned when deciding on an item which is not pending.
+	AlreadyDecidedErr = errors.New("moderation item was already decided")
+	// Error returned for an unknown kind of content.
+	InvalidKindErr = errors.New("invalid kind of moderated content")
+)
+
+// Item is a piece of content waiting for, or having received, a decision.
+type Item struct {
+	ID   int64  `datastore:"-"`
+	Kind string `datastore:"kind"`
+	// Ref identifies the moderated review or photo.
+	Ref string `datastore:"ref"`
+	// Author is the email of the user who created the content.
+	Author string `datastore:"author"`
+	// Content is the text of a review or the URL of a photo.
+	Content string `datastore:"content,noindex"`
+	// Reason explains why the content needs moderation, e.g. a report.
+	Reason    string    `datastore:"reason,noindex"`
+	State     string    `datastore:"state"`
+	Submitted time.Time `datastore:"submitted"`
+	// Moderator is the email of the user who decided on the item.
+	Moderator string    `datastore:"moderator,noindex"`
+	Decided   time.Time `datastore:"decided,noindex"`
+	Note      string    `datastore:"note,noindex"`
+}
+
+// Submit adds the content to the moderation queue of its kind.
+func Submit(c appengine.Context, kind, ref, author, content, reason string) (*Item, error) {
+	if !isKind(kind) {
+		return nil, InvalidKindErr
+	}
+	if ref == "" {
+		return nil, errors.New("ref can't be empty")
+	}
+
+	item := &Item{
+		Kind:      kind,
+		Ref:       ref,
+		Author:    author,
+		Content:   content,
+		Reason:    reason,
+		State:     Pending,
+		Submitted: time.Now(),
+	}
+
+	key, err := datastore.Put(c, datastore.NewIncompleteKey(c, ItemKind, nil), item)
+	if err != nil {
+		return nil, err
+	}
+	item.ID = key.IntID()
+	return item, nil
+}
+
+// GetPending returns at most limit pending items of the kind, oldest first,
+// starting from the provided cursor, which is empty for the first page.
+// Returns the cursor of the next page, which is empty if there are no more items.
+func GetPending(c appengine.Context, kind string, limit int, cursor string) ([]*Item, string, error) {
+	if !isKind(kind) {
+		return nil, "", InvalidKindErr
+	}
+	if limit <= 0 {
+		return nil, "", errors.New("limit must be positive")
+	}
+
+	query := datastore.NewQuery(ItemKind).
+		Filter("kind =", kind).
+		Filter("state =", Pending).
+		Order("submitted").
+		Limit(limit)
+	if cursor != "" {
+		start, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		query = query.Start(start)
+	}
+
+	items := make([]*Item, 0)
+
+	t := query.Run(c)
+	for {
+		var item Item
+		key, err := t.Next(&item)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+
+		item.ID = key.IntID()
+		items = append(items, &item)
+	}
+
+	if len(items) < limit {
+		return items, "", nil
+	}
+
+	next, err := t.Cursor()
+	if err != nil {
+		return nil, "", err
+	}
+	return items, next.String(), nil
+}
+
+// Decide approves or rejects the pending item with the provided id.
+// Returns NoSuchItemErr if there is no such item and AlreadyDecidedErr
+// if the item is not pending.
+func Decide(c appengine.Context, id int64, approve bool, moderator, note string) (*Item, error) {
+	key := datastore.NewKey(c, ItemKind, "", id, nil)
+
+	var item Item
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		err := datastore.Get(tc, key, &item)
+		if err == datastore.ErrNoSuchEntity {
+			return NoSuchItemErr
+		}
+		if err != nil {
+			return err
+		}
+		if item.State != Pending {
+			return AlreadyDecidedErr
+		}
+
+		item.State = Rejected
+		if approve {
+			item.State = Approved
+		}
+		item.Moderator = moderator
+		item.Decided = time.Now()
+		item.Note = note
+
+		_, err = datastore.Put(tc, key, &item)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	item.ID = id
+	return &item, nil
+}
+
+func isKind(kind string) bool {
+	for _, k := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,48 @@
+package moderation
+
+import (
+	"testing"
+
+	"appengine/aetest"
+)
+
+func TestModeration(t *testing.T) {
+	c, err := aetest.NewContext(&aetest.Options{StronglyConsistentDatastore: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := Submit(c, "video", "1", "ana@petsy.ro", "", ""); err != InvalidKindErr {
+		t.Errorf("Submit: unknown kind: got error %v; want %v", err, InvalidKindErr)
+	}
+
+	review, err := Submit(c, ReviewItem, "1", "ana@petsy.ro", "Great sitter", "reported")
+	if err != nil {
+		t.Fatalf("Submit: unexpected error: %v", err)
+	}
+	Submit(c, PhotoItem, "2", "ana@petsy.ro", "http://petsy.ro/photo.jpg", "new")
+
+	items, _, err := GetPending(c, ReviewItem, 10, "")
+	if err != nil {
+		t.Fatalf("GetPending: unexpected error: %v", err)
+	}
+	if len(items) != 1 || items[0].ID != review.ID {
+		t.Errorf("GetPending: got %v; want the submitted review", items)
+	}
+
+	decided, err := Decide(c, review.ID, false, "admin@petsy.ro", "spam")
+	if err != nil {
+		t.Fatalf("Decide: unexpected error: %v", err)
+	}
+	if decided.State != Rejected || decided.Moderator != "admin@petsy.ro" {
+		t.Errorf("Decide: got %+v; want a rejected item", decided)
+	}
+
+	if _, err := Decide(c, review.ID, true, "admin@petsy.ro", ""); err != AlreadyDecidedErr {
+		t.Errorf("Decide: decided item: got error %v; want %v", err, AlreadyDecidedErr)
+	}
+	if items, _, _ := GetPending(c, ReviewItem, 10, ""); len(items) != 0 {
+		t.Errorf("GetPending: got %d items after decision; want 0", len(items))
+	}
+}
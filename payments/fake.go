@@ -0,0 +1,222 @@
+// Part of payments package. Local fake of a payment provider.
+
+package payments
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"appengine"
+)
+
+// Payment sources and payout accounts making the fake provider fail.
+const (
+	DeclinedSource = "tok_declined"
+	FailingAccount = "failing"
+)
+
+// SignatureHeader holds the signature of the webhooks of the fake provider.
+const SignatureHeader = "X-Fake-Signature"
+
+// Webhook is a request the fake provider would send to the webhook.
+type Webhook struct {
+	Payload   []byte
+	Signature string
+}
+
+// Request returns the webhook as an HTTP request to the URL.
+func (w *Webhook) Request(url string) (*http.Request, error) {
+	r, err := http.NewRequest("POST", url, bytes.NewReader(w.Payload))
+	if err != nil {
+		return nil, err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set(SignatureHeader, w.Signature)
+	return r, nil
+}
+
+type fakeCharge struct {
+	amount   int64
+	currency string
+	captured bool
+	refunded int64
+}
+
+// FakeProvider is an in-memory provider for the development server and the
+// tests. It declines the DeclinedSource and fails the payouts to the
+// FailingAccount. The other payouts are paid at once, and their webhooks
+// are kept until taken by Webhooks.
+type FakeProvider struct {
+	// SecretFunc returns the key signing the webhooks.
+	SecretFunc func(c appengine.Context) ([]byte, error)
+
+	mu      sync.Mutex
+	seq     int
+	charges map[string]*fakeCharge
+	// done holds the results of the calls, by idempotency key.
+	done     map[string]string
+	webhooks []*Webhook
+}
+
+// NewFakeProvider returns a fake provider signing the webhooks with the
+// secret returned by secret.
+func NewFakeProvider(secret func(c appengine.Context) ([]byte, error)) *FakeProvider {
+	return &FakeProvider{
+		SecretFunc: secret,
+		charges:    make(map[string]*fakeCharge),
+		done:       make(map[string]string),
+	}
+}
+
+// nextRef returns a new reference with the prefix. Must be called with mu held.
+func (f *FakeProvider) nextRef(prefix string) string {
+	f.seq++
+	return fmt.Sprintf("%s_%d", prefix, f.seq)
+}
+
+func (f *FakeProvider) Authorize(c appengine.Context, key, source string, amount int64, currency string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if ref, ok := f.done[key]; ok {
+		return ref, nil
+	}
+	if amount <= 0 {
+		return "", InvalidAmountErr
+	}
+	if source == DeclinedSource {
+		return "", DeclinedErr
+	}
+
+	ref := f.nextRef("ch")
+	f.charges[ref] = &fakeCharge{amount: amount, currency: currency}
+	f.done[key] = ref
+	return ref, nil
+}
+
+func (f *FakeProvider) Capture(c appengine.Context, key, charge string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch, ok := f.charges[charge]
+	if !ok {
+		return UnknownChargeErr
+	}
+	ch.captured = true
+	return nil
+}
+
+func (f *FakeProvider) Refund(c appengine.Context, key, charge string, amount int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.done[key]; ok {
+		return nil
+	}
+	ch, ok := f.charges[charge]
+	if !ok || !ch.captured {
+		return UnknownChargeErr
+	}
+	if amount <= 0 || ch.refunded+amount > ch.amount {
+		return InvalidAmountErr
+	}
+
+	ch.refunded += amount
+	f.done[key] = charge
+	return nil
+}
+
+func (f *FakeProvider) Payout(c appengine.Context, key, account string, amount int64, currency string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if ref, ok := f.done[key]; ok {
+		return ref, nil
+	}
+	if amount <= 0 {
+		return "", InvalidAmountErr
+	}
+
+	ref := f.nextRef("po")
+	f.done[key] = ref
+
+	event := &Event{ID: f.nextRef("evt"), Type: PayoutPaid, Ref: ref, Time: time.Now()}
+	if account == FailingAccount {
+		event.Type = PayoutFailed
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	signature, err := f.sign(c, payload)
+	if err != nil {
+		return "", err
+	}
+	f.webhooks = append(f.webhooks, &Webhook{payload, signature})
+	return ref, nil
+}
+
+// Charge returns the captured and the refunded amounts of the charge.
+func (f *FakeProvider) Charge(ref string) (captured, refunded int64, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	ch, ok := f.charges[ref]
+	if !ok {
+		return 0, 0, false
+	}
+	if ch.captured {
+		captured = ch.amount
+	}
+	return captured, ch.refunded, true
+}
+
+// Webhooks returns the webhooks not taken yet.
+func (f *FakeProvider) Webhooks() []*Webhook {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	webhooks := f.webhooks
+	f.webhooks = nil
+	return webhooks
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the payload.
+func (f *FakeProvider) sign(c appengine.Context, payload []byte) (string, error) {
+	secret, err := f.SecretFunc(c)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (f *FakeProvider) ParseEvent(c appengine.Context, r *http.Request) (*Event, error) {
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	expected, err := f.sign(c, payload)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(expected)) {
+		return nil, InvalidSignatureErr
+	}
+
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, err
+	}
+	return &event, nil
+}
@@ -0,0 +1,144 @@
+// Part of payments package. Double-entry ledger of the movements of money.
+
+package payments
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const TransactionKind = "ledger"
+
+// Accounts of the ledger.
+const (
+	// CardsAccount is the money of the owners, collected by the provider.
+	CardsAccount = "cards"
+	// EscrowAccount holds the payments until the stays start.
+	EscrowAccount = "escrow"
+	// FeesAccount is the revenue of the platform.
+	FeesAccount = "fees"
+	// PayoutsAccount is the money sent to the sitters by the provider.
+	PayoutsAccount = "payouts"
+)
+
+// SitterAccount returns the account of the money owed to the sitter.
+func SitterAccount(sitterID int64) string {
+	return "sitter:" + strconv.FormatInt(sitterID, 10)
+}
+
+var UnbalancedErr = errors.New("unbalanced ledger transaction")
+
+// Entry is a change of the balance of an account, positive for a debit
+// and negative for a credit. Money moved to an account is debited.
+type Entry struct {
+	Account string `datastore:"account"`
+	Amount  int64  `datastore:"amount,noindex"`
+}
+
+// Transaction is a movement of money between accounts, whose entries add
+// up to zero. It is identified by the operation making it, so that it is
+// posted only once.
+type Transaction struct {
+	ID          string    `datastore:"-"`
+	Payment     int64     `datastore:"payment"`
+	Currency    string    `datastore:"currency,noindex"`
+	Description string    `datastore:"description,noindex"`
+	Entries     []Entry   `datastore:"entries"`
+	Time        time.Time `datastore:"time"`
+}
+
+// newTransaction returns the transaction of the payment, without entries.
+func newTransaction(id string, p *Payment, description string) *Transaction {
+	return &Transaction{
+		ID:          id,
+		Payment:     p.ID,
+		Currency:    p.Currency,
+		Description: description,
+		Time:        time.Now(),
+	}
+}
+
+// transfer adds the entries moving the amount between the accounts.
+func (t *Transaction) transfer(from, to string, amount int64) *Transaction {
+	if amount != 0 {
+		t.Entries = append(t.Entries, Entry{from, -amount}, Entry{to, amount})
+	}
+	return t
+}
+
+// Validate checks that the transaction moves money and is balanced.
+func (t *Transaction) Validate() error {
+	if t.ID == "" || len(t.Entries) < 2 {
+		return UnbalancedErr
+	}
+	var sum int64
+	for _, e := range t.Entries {
+		if e.Account == "" || e.Amount == 0 {
+			return UnbalancedErr
+		}
+		sum += e.Amount
+	}
+	if sum != 0 {
+		return UnbalancedErr
+	}
+	return nil
+}
+
+// Balances returns the balances of the accounts after the transactions
+// in the currency.
+func Balances(txs []*Transaction, currency string) map[string]int64 {
+	balances := make(map[string]int64)
+	for _, t := range txs {
+		if t.Currency != currency {
+			continue
+		}
+		for _, e := range t.Entries {
+			balances[e.Account] += e.Amount
+		}
+	}
+	return balances
+}
+
+func transactionKey(c appengine.Context, id string) *datastore.Key {
+	return datastore.NewKey(c, TransactionKind, id, 0, nil)
+}
+
+// posted checks if the transaction was already posted.
+func posted(tc appengine.Context, id string) (bool, error) {
+	var t Transaction
+	err := datastore.Get(tc, transactionKey(tc, id), &t)
+	switch err {
+	case nil:
+		return true, nil
+	case datastore.ErrNoSuchEntity:
+		return false, nil
+	}
+	return false, err
+}
+
+// post stores the transaction. Must be called in a datastore transaction,
+// after checking it was not posted.
+func post(tc appengine.Context, t *Transaction) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+	_, err := datastore.Put(tc, transactionKey(tc, t.ID), t)
+	return err
+}
+
+// GetTransactions returns the ledger transactions of the payment, oldest first.
+func GetTransactions(c appengine.Context, paymentID int64) ([]*Transaction, error) {
+	var txs []*Transaction
+	keys, err := datastore.NewQuery(TransactionKind).Filter("payment =", paymentID).Order("time").GetAll(c, &txs)
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range txs {
+		t.ID = keys[i].StringID()
+	}
+	return txs, nil
+}
@@ -0,0 +1,542 @@
+// Package payments charges the owners for the bookings and pays the sitters,
+// through a payment provider.
+//
+// The payment of an owner is stored as pending, then captured when booking
+// and held in escrow until the stay starts. It is then released to the sitter, minus the platform fee,
+// and paid out. Refunds are taken from the held money. Every movement is
+// recorded in a double-entry ledger, whose transactions are identified by
+// the operation making them, so that retrying an operation or receiving a
+// webhook twice doesn't move the money twice.
+package payments
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const (
+	PaymentKind   = "payment"
+	ChargeKeyKind = "payment_charge_key"
+	EventKind     = "payment_event"
+)
+
+// MaxChargeKeyLength is the maximum length of the idempotency keys of the
+// charges, chosen by the clients.
+const MaxChargeKeyLength = 100
+
+// States of the payments.
+const (
+	// Pending payments are stored before charging the owner.
+	Pending = "pending"
+	// Declined payments were refused by the provider.
+	Declined = "declined"
+	// Held payments are captured and kept in escrow.
+	Held = "held"
+	// Refunding payments are held while a refund is asked to the provider,
+	// so that they can't be released meanwhile.
+	Refunding = "refunding"
+	// Released payments are owed to the sitter, their payout is requested.
+	Released = "released"
+	// PaidOut payments were received by the sitter.
+	PaidOut = "paid_out"
+	// Refunded payments were given back to the owner in full.
+	Refunded = "refunded"
+)
+
+// FeePercent is the percentage of the released payments kept by the platform.
+var FeePercent = 15
+
+var (
+	NotHeldErr          = errors.New("the payment is not held")
+	NotStartedErr       = errors.New("the stay has not started")
+	NoSuchPaymentErr    = errors.New("no such payment")
+	InvalidKeyErr       = errors.New("invalid idempotency key")
+	KeyReusedErr        = errors.New("the idempotency key is used by another payment")
+	RefundInProgressErr = errors.New("another refund of the payment is in progress")
+)
+
+// Payment is the payment of a booking by an owner to a sitter.
+type Payment struct {
+	ID       int64  `datastore:"-"`
+	Owner    int64  `datastore:"owner"`
+	Sitter   int64  `datastore:"sitter"`
+	Amount   int64  `datastore:"amount,noindex"`
+	Currency string `datastore:"currency,noindex"`
+	Refunded int64  `datastore:"refunded,noindex"`
+	// Refunding is the key of the refund in progress, and RefundingAmount
+	// its amount, stored before asking the provider.
+	Refunding       string `datastore:"refunding,noindex"`
+	RefundingAmount int64  `datastore:"refunding_amount,noindex"`
+	// Fee is the platform fee, set when released.
+	Fee   int64  `datastore:"fee,noindex"`
+	State string `datastore:"state"`
+	// Start is the start of the stay, when the payment is released.
+	Start   time.Time `datastore:"start"`
+	Charge  string    `datastore:"charge,noindex"`
+	Payout  string    `datastore:"payout"`
+	Created time.Time `datastore:"created,noindex"`
+	Updated time.Time `datastore:"updated,noindex"`
+}
+
+// HeldAmount returns the amount kept in escrow, or owed to the sitter once released.
+func (p *Payment) HeldAmount() int64 {
+	return p.Amount - p.Refunded
+}
+
+// Earnings returns the amount paid out to the sitter, once released.
+func (p *Payment) Earnings() int64 {
+	return p.HeldAmount() - p.Fee
+}
+
+// percent returns the percentage of the amount, rounded half up.
+func percent(amount int64, p int) int64 {
+	return (amount*int64(p) + 50) / 100
+}
+
+// capture returns the ledger transaction of the capture of the payment.
+func (p *Payment) capture() *Transaction {
+	return newTransaction("capture:"+p.key(), p, "payment captured").
+		transfer(CardsAccount, EscrowAccount, p.Amount)
+}
+
+// captured holds the pending payment, once its charge is captured.
+func (p *Payment) captured(charge string) (*Transaction, error) {
+	if p.State != Pending {
+		return nil, errors.New("the payment is not pending")
+	}
+	p.Charge = charge
+	p.State = Held
+	return p.capture(), nil
+}
+
+// startRefund marks the held payment as refunding the amount for the key.
+// Returns the amount to refund, the one of the first attempt if retried.
+func (p *Payment) startRefund(key string, amount int64) (int64, error) {
+	switch p.Refunding {
+	case key:
+		return p.RefundingAmount, nil
+	case "":
+	default:
+		return 0, RefundInProgressErr
+	}
+
+	check := *p
+	if _, err := check.refund(key, amount); err != nil {
+		return 0, err
+	}
+	p.State = Refunding
+	p.Refunding = key
+	p.RefundingAmount = amount
+	return amount, nil
+}
+
+// finishRefund takes back the amount of the refund in progress, once
+// refunded by the provider.
+func (p *Payment) finishRefund(key string) (*Transaction, error) {
+	if p.State != Refunding || p.Refunding != key {
+		return nil, errors.New("the payment is not refunding")
+	}
+	amount := p.RefundingAmount
+	p.State = Held
+	p.Refunding = ""
+	p.RefundingAmount = 0
+	return p.refund(key, amount)
+}
+
+// refund takes the amount back from the held payment.
+func (p *Payment) refund(key string, amount int64) (*Transaction, error) {
+	if p.State != Held {
+		return nil, NotHeldErr
+	}
+	if amount <= 0 || amount > p.HeldAmount() {
+		return nil, InvalidAmountErr
+	}
+
+	p.Refunded += amount
+	if p.HeldAmount() == 0 {
+		p.State = Refunded
+	}
+	return newTransaction("refund:"+key, p, "payment refunded").
+		transfer(EscrowAccount, CardsAccount, amount), nil
+}
+
+// release moves the held payment to the sitter, keeping the fee, once
+// the stay started.
+func (p *Payment) release(now time.Time) (*Transaction, error) {
+	if p.State != Held {
+		return nil, NotHeldErr
+	}
+	if now.Before(p.Start) {
+		return nil, NotStartedErr
+	}
+
+	p.Fee = percent(p.HeldAmount(), FeePercent)
+	p.State = Released
+	return newTransaction("release:"+p.key(), p, "payment released").
+		transfer(EscrowAccount, FeesAccount, p.Fee).
+		transfer(EscrowAccount, SitterAccount(p.Sitter), p.Earnings()), nil
+}
+
+// paidOut records the payout of the released payment.
+func (p *Payment) paidOut() (*Transaction, error) {
+	if p.State != Released {
+		return nil, errors.New("the payment is not released")
+	}
+	p.State = PaidOut
+	return newTransaction("payout:"+p.key(), p, "payment paid out").
+		transfer(SitterAccount(p.Sitter), PayoutsAccount, p.Earnings()), nil
+}
+
+// key returns the id of the payment, used in the idempotency keys.
+func (p *Payment) key() string {
+	return strconv.FormatInt(p.ID, 10)
+}
+
+func paymentKey(c appengine.Context, id int64) *datastore.Key {
+	return datastore.NewKey(c, PaymentKind, "", id, nil)
+}
+
+// GetPayment returns the payment, or nil if there is none.
+func GetPayment(c appengine.Context, id int64) (*Payment, error) {
+	p := &Payment{}
+	if err := datastore.Get(c, paymentKey(c, id), p); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	p.ID = id
+	return p, nil
+}
+
+// update changes the payment by f and posts the ledger transaction it
+// returns, if any, in a datastore transaction. Does nothing if the ledger
+// transaction id was already posted, so that the updates are applied once.
+func update(c appengine.Context, id int64, txID string, f func(p *Payment) (*Transaction, error)) (*Payment, error) {
+	return updateTx(c, id, txID, func(tc appengine.Context, p *Payment) (*Transaction, error) {
+		return f(p)
+	})
+}
+
+// updateTx is like update, but f is also given the datastore transaction.
+func updateTx(c appengine.Context, id int64, txID string, f func(tc appengine.Context, p *Payment) (*Transaction, error)) (*Payment, error) {
+	var p *Payment
+	err := datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		var err error
+		if p, err = GetPayment(tc, id); err != nil {
+			return err
+		}
+		if p == nil {
+			return NoSuchPaymentErr
+		}
+
+		if txID != "" {
+			if done, err := posted(tc, txID); err != nil || done {
+				return err
+			}
+		}
+
+		t, err := f(tc, p)
+		if err != nil {
+			return err
+		}
+		p.Updated = time.Now()
+		if _, err := datastore.Put(tc, paymentKey(tc, id), p); err != nil {
+			return err
+		}
+		if t == nil {
+			return nil
+		}
+		return post(tc, t)
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// chargeKey reserves the idempotency key of a charge for its payment.
+type chargeKey struct {
+	Payment int64 `datastore:"payment,noindex"`
+}
+
+// same reports whether the payments are of the same booking.
+func (p *Payment) same(other *Payment) bool {
+	return p.Owner == other.Owner && p.Sitter == other.Sitter && p.Amount == other.Amount &&
+		p.Currency == other.Currency && p.Start.Equal(other.Start)
+}
+
+// storePending stores the payment as pending under the idempotency key of
+// the owner, unless the key already has a payment, which is returned.
+func storePending(c appengine.Context, p *Payment, key string) (*Payment, error) {
+	id, _, err := datastore.AllocateIDs(c, PaymentKind, nil, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	var stored *Payment
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		k := datastore.NewKey(tc, ChargeKeyKind, strconv.FormatInt(p.Owner, 10)+":"+key, 0, nil)
+		var reserved chargeKey
+		switch err := datastore.Get(tc, k, &reserved); err {
+		case nil:
+			if stored, err = GetPayment(tc, reserved.Payment); err == nil && stored == nil {
+				err = NoSuchPaymentErr
+			}
+			return err
+		case datastore.ErrNoSuchEntity:
+		default:
+			return err
+		}
+
+		pending := *p
+		pending.ID = id
+		pending.State = Pending
+		pending.Created = time.Now()
+		pending.Updated = pending.Created
+		if _, err := datastore.Put(tc, paymentKey(tc, id), &pending); err != nil {
+			return err
+		}
+		if _, err := datastore.Put(tc, k, &chargeKey{id}); err != nil {
+			return err
+		}
+		stored = &pending
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	return stored, err
+}
+
+// Charge collects the payment from the source of the owner and holds it in
+// escrow. The key is chosen by the client for the payment: it is stored as
+// pending with the key before asking the provider, so that retrying it with
+// the same key charges the owner once. The payment must have the owner,
+// sitter, amount, currency and start set, and is filled with the stored one.
+//
+// The held function, if not nil, is called in the datastore transaction
+// holding the payment, to store what was paid with it. It is not called when
+// retrying a payment already held.
+func Charge(c appengine.Context, provider Provider, p *Payment, source, key string, held func(tc appengine.Context, p *Payment) error) error {
+	if p.Amount <= 0 {
+		return InvalidAmountErr
+	}
+	if key == "" || len(key) > MaxChargeKeyLength {
+		return InvalidKeyErr
+	}
+
+	stored, err := storePending(c, p, key)
+	if err != nil {
+		return err
+	}
+	if !stored.same(p) {
+		return KeyReusedErr
+	}
+	*p = *stored
+	switch p.State {
+	case Pending:
+	case Declined:
+		return DeclinedErr
+	default:
+		return nil
+	}
+
+	charge, err := provider.Authorize(c, "authorize:"+p.key(), source, p.Amount, p.Currency)
+	if err == DeclinedErr {
+		_, err := update(c, p.ID, "", func(p *Payment) (*Transaction, error) {
+			if p.State == Pending {
+				p.State = Declined
+			}
+			return nil, nil
+		})
+		if err != nil {
+			return err
+		}
+		return DeclinedErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := provider.Capture(c, "capture:"+p.key(), charge); err != nil {
+		return err
+	}
+
+	stored, err = updateTx(c, p.ID, "capture:"+p.key(), func(tc appengine.Context, p *Payment) (*Transaction, error) {
+		t, err := p.captured(charge)
+		if err != nil || held == nil {
+			return t, err
+		}
+		return t, held(tc, p)
+	})
+	if err != nil {
+		return err
+	}
+	*p = *stored
+	return nil
+}
+
+// Refund gives back the amount of the held payment to the owner. The key
+// identifies the refund, so that retrying it doesn't refund twice, and
+// refunds the amount of the first attempt. The payment is marked as
+// refunding before asking the provider, so that it isn't released meanwhile.
+func Refund(c appengine.Context, provider Provider, id int64, key string, amount int64) (*Payment, error) {
+	var refunding int64
+	p, err := update(c, id, "refund:"+key, func(p *Payment) (*Transaction, error) {
+		var err error
+		refunding, err = p.startRefund(key, amount)
+		return nil, err
+	})
+	if err != nil || refunding == 0 {
+		// Already refunded.
+		return p, err
+	}
+
+	if err := provider.Refund(c, "refund:"+key, p.Charge, refunding); err != nil {
+		return nil, err
+	}
+	return update(c, id, "refund:"+key, func(p *Payment) (*Transaction, error) {
+		return p.finishRefund(key)
+	})
+}
+
+// Release releases the held payment to the sitter once the stay started,
+// and requests its payout.
+func Release(c appengine.Context, provider Provider, id int64, now time.Time) (*Payment, error) {
+	p, err := update(c, id, "release:"+strconv.FormatInt(id, 10), func(p *Payment) (*Transaction, error) {
+		return p.release(now)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payout(c, provider, p)
+}
+
+// payout requests the payout of the released payment, unless requested.
+func payout(c appengine.Context, provider Provider, p *Payment) (*Payment, error) {
+	if p.State != Released || p.Payout != "" {
+		return p, nil
+	}
+
+	ref, err := provider.Payout(c, "payout:"+p.key()+":"+strconv.FormatInt(p.Updated.UnixNano(), 10),
+		SitterAccount(p.Sitter), p.Earnings(), p.Currency)
+	if err != nil {
+		return nil, err
+	}
+	return update(c, p.ID, "", func(p *Payment) (*Transaction, error) {
+		if p.Payout == "" {
+			p.Payout = ref
+		}
+		return nil, nil
+	})
+}
+
+// ReleaseDue releases at most limit of the held payments whose stay
+// started, and retries the payouts which failed. Returns the number of
+// released payments.
+func ReleaseDue(c appengine.Context, provider Provider, now time.Time, limit int) (int, error) {
+	keys, err := datastore.NewQuery(PaymentKind).
+		Filter("state =", Held).Filter("start <=", now).
+		Limit(limit).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, key := range keys {
+		switch _, err := Release(c, provider, key.IntID(), now); err {
+		case nil:
+			released++
+		case NotHeldErr:
+			// Refunded, or being refunded, since the query.
+		default:
+			return released, err
+		}
+	}
+
+	var failed []*Payment
+	keys, err = datastore.NewQuery(PaymentKind).
+		Filter("state =", Released).Filter("payout =", "").
+		Limit(limit).GetAll(c, &failed)
+	if err != nil {
+		return released, err
+	}
+	for i, p := range failed {
+		p.ID = keys[i].IntID()
+		if _, err := payout(c, provider, p); err != nil {
+			return released, err
+		}
+	}
+	return released, nil
+}
+
+// eventRecord marks a processed webhook event.
+type eventRecord struct {
+	Type      string    `datastore:"type,noindex"`
+	Ref       string    `datastore:"ref,noindex"`
+	Processed time.Time `datastore:"processed,noindex"`
+}
+
+// HandleWebhook processes the event of the webhook request. The events
+// already processed are ignored, as providers deliver them at least once.
+func HandleWebhook(c appengine.Context, provider Provider, r *http.Request) error {
+	event, err := provider.ParseEvent(c, r)
+	if err != nil {
+		return err
+	}
+
+	key := datastore.NewKey(c, EventKind, event.ID, 0, nil)
+	var record eventRecord
+	switch err := datastore.Get(c, key, &record); err {
+	case nil:
+		return nil
+	case datastore.ErrNoSuchEntity:
+	default:
+		return err
+	}
+
+	if err := processEvent(c, event); err != nil {
+		return err
+	}
+
+	record = eventRecord{event.Type, event.Ref, time.Now()}
+	_, err = datastore.Put(c, key, &record)
+	return err
+}
+
+// processEvent applies the event to its payment. The events of unknown
+// types or payments are ignored.
+func processEvent(c appengine.Context, event *Event) error {
+	if event.Type != PayoutPaid && event.Type != PayoutFailed {
+		c.Infof("payments: ignored event %s of type %s", event.ID, event.Type)
+		return nil
+	}
+
+	keys, err := datastore.NewQuery(PaymentKind).Filter("payout =", event.Ref).KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		c.Warningf("payments: no payment of payout %s", event.Ref)
+		return nil
+	}
+	id := keys[0].IntID()
+
+	if event.Type == PayoutFailed {
+		// The payout is requested again by ReleaseDue.
+		_, err = update(c, id, "", func(p *Payment) (*Transaction, error) {
+			if p.Payout == event.Ref && p.State == Released {
+				p.Payout = ""
+			}
+			return nil, nil
+		})
+		return err
+	}
+
+	_, err = update(c, id, "payout:"+strconv.FormatInt(id, 10), func(p *Payment) (*Transaction, error) {
+		return p.paidOut()
+	})
+	return err
+}
@@ -0,0 +1,232 @@
+package payments
+
+import (
+	"testing"
+	"time"
+
+	"appengine"
+)
+
+func testSecret(c appengine.Context) ([]byte, error) {
+	return []byte("webhook secret"), nil
+}
+
+func TestPaymentLifecycle(t *testing.T) {
+	defer func(fee int) { FeePercent = fee }(FeePercent)
+	FeePercent = 15
+
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	p := &Payment{ID: 7, Owner: 1, Sitter: 2, Amount: 40000, Currency: "RON", State: Held, Start: start}
+	txs := []*Transaction{p.capture()}
+
+	if _, err := p.release(start.Add(-time.Hour)); err != NotStartedErr {
+		t.Errorf("release: got error %v; want %v", err, NotStartedErr)
+	}
+	if _, err := p.refund("r1", 50000); err != InvalidAmountErr {
+		t.Errorf("refund: got error %v; want %v", err, InvalidAmountErr)
+	}
+
+	tx, err := p.refund("r1", 10000)
+	if err != nil {
+		t.Fatalf("refund: unexpected error: %v", err)
+	}
+	txs = append(txs, tx)
+	if p.State != Held || p.HeldAmount() != 30000 {
+		t.Errorf("refund: got state %s and held %d; want %s and 30000", p.State, p.HeldAmount(), Held)
+	}
+
+	if tx, err = p.release(start); err != nil {
+		t.Fatalf("release: unexpected error: %v", err)
+	}
+	txs = append(txs, tx)
+	if p.State != Released || p.Fee != 4500 || p.Earnings() != 25500 {
+		t.Errorf("release: got state %s, fee %d and earnings %d; want %s, 4500 and 25500",
+			p.State, p.Fee, p.Earnings(), Released)
+	}
+	if _, err := p.refund("r2", 100); err != NotHeldErr {
+		t.Errorf("refund: got error %v after release; want %v", err, NotHeldErr)
+	}
+
+	if tx, err = p.paidOut(); err != nil {
+		t.Fatalf("paidOut: unexpected error: %v", err)
+	}
+	txs = append(txs, tx)
+	if p.State != PaidOut {
+		t.Errorf("paidOut: got state %s; want %s", p.State, PaidOut)
+	}
+
+	ids := map[string]bool{}
+	for _, tx := range txs {
+		if err := tx.Validate(); err != nil {
+			t.Errorf("Validate %s: unexpected error: %v", tx.ID, err)
+		}
+		if ids[tx.ID] {
+			t.Errorf("Validate: duplicate transaction id %s", tx.ID)
+		}
+		ids[tx.ID] = true
+	}
+
+	want := map[string]int64{
+		CardsAccount:     -30000,
+		EscrowAccount:    0,
+		FeesAccount:      4500,
+		SitterAccount(2): 0,
+		PayoutsAccount:   25500,
+	}
+	balances := Balances(txs, "RON")
+	for account, amount := range want {
+		if balances[account] != amount {
+			t.Errorf("Balances: got %d for %s; want %d", balances[account], account, amount)
+		}
+	}
+	if len(Balances(txs, "EUR")) != 0 {
+		t.Errorf("Balances: got balances in another currency")
+	}
+}
+
+func TestFullRefund(t *testing.T) {
+	p := &Payment{ID: 8, Amount: 1000, Currency: "EUR", State: Held}
+	if _, err := p.refund("r", 1000); err != nil {
+		t.Fatalf("refund: unexpected error: %v", err)
+	}
+	if p.State != Refunded {
+		t.Errorf("refund: got state %s; want %s", p.State, Refunded)
+	}
+	if _, err := p.release(time.Now()); err != NotHeldErr {
+		t.Errorf("release: got error %v; want %v", err, NotHeldErr)
+	}
+}
+
+func TestCaptured(t *testing.T) {
+	p := &Payment{ID: 9, Amount: 1000, Currency: "RON", State: Pending}
+	tx, err := p.captured("ch_1")
+	if err != nil {
+		t.Fatalf("captured: unexpected error: %v", err)
+	}
+	if p.State != Held || p.Charge != "ch_1" || tx.ID != "capture:9" {
+		t.Errorf("captured: got state %s, charge %s and transaction %s; want %s, ch_1 and capture:9",
+			p.State, p.Charge, tx.ID, Held)
+	}
+	if _, err := p.captured("ch_2"); err == nil {
+		t.Errorf("captured: want an error for a held payment")
+	}
+}
+
+func TestRefunding(t *testing.T) {
+	start := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	p := &Payment{ID: 10, Amount: 1000, Currency: "RON", State: Held, Start: start}
+
+	if _, err := p.startRefund("r1", 2000); err != InvalidAmountErr {
+		t.Errorf("startRefund: got error %v; want %v", err, InvalidAmountErr)
+	}
+	if amount, err := p.startRefund("r1", 600); err != nil || amount != 600 {
+		t.Fatalf("startRefund: got %d, %v; want 600", amount, err)
+	}
+	if p.State != Refunding {
+		t.Errorf("startRefund: got state %s; want %s", p.State, Refunding)
+	}
+
+	// The retries refund the amount of the first attempt.
+	if amount, err := p.startRefund("r1", 500); err != nil || amount != 600 {
+		t.Errorf("startRefund: retried: got %d, %v; want 600", amount, err)
+	}
+	if _, err := p.startRefund("r2", 100); err != RefundInProgressErr {
+		t.Errorf("startRefund: got error %v; want %v", err, RefundInProgressErr)
+	}
+	if _, err := p.release(start); err != NotHeldErr {
+		t.Errorf("release: got error %v while refunding; want %v", err, NotHeldErr)
+	}
+
+	if _, err := p.finishRefund("r2"); err == nil {
+		t.Errorf("finishRefund: want an error for another key")
+	}
+	tx, err := p.finishRefund("r1")
+	if err != nil {
+		t.Fatalf("finishRefund: unexpected error: %v", err)
+	}
+	if p.State != Held || p.Refunded != 600 || p.Refunding != "" || tx.ID != "refund:r1" {
+		t.Errorf("finishRefund: got state %s, refunded %d and transaction %s; want %s, 600 and refund:r1",
+			p.State, p.Refunded, tx.ID, Held)
+	}
+}
+
+func TestValidateTransaction(t *testing.T) {
+	tests := []*Transaction{
+		{ID: "a"},
+		{ID: "b", Entries: []Entry{{CardsAccount, -10}, {EscrowAccount, 9}}},
+		{ID: "c", Entries: []Entry{{CardsAccount, 0}, {EscrowAccount, 0}}},
+		{Entries: []Entry{{CardsAccount, -10}, {EscrowAccount, 10}}},
+	}
+	for _, tx := range tests {
+		if err := tx.Validate(); err != UnbalancedErr {
+			t.Errorf("Validate(%+v): got error %v; want %v", tx, err, UnbalancedErr)
+		}
+	}
+}
+
+func TestFakeProvider(t *testing.T) {
+	f := NewFakeProvider(testSecret)
+
+	if _, err := f.Authorize(nil, "a0", DeclinedSource, 100, "RON"); err != DeclinedErr {
+		t.Errorf("Authorize: got error %v; want %v", err, DeclinedErr)
+	}
+
+	ref, err := f.Authorize(nil, "a1", "tok_visa", 1000, "RON")
+	if err != nil {
+		t.Fatalf("Authorize: unexpected error: %v", err)
+	}
+	if again, _ := f.Authorize(nil, "a1", "tok_visa", 1000, "RON"); again != ref {
+		t.Errorf("Authorize: got %q for the same key; want %q", again, ref)
+	}
+	if err := f.Refund(nil, "r0", ref, 100); err != UnknownChargeErr {
+		t.Errorf("Refund: got error %v before capture; want %v", err, UnknownChargeErr)
+	}
+	if err := f.Capture(nil, "c1", ref); err != nil {
+		t.Fatalf("Capture: unexpected error: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := f.Refund(nil, "r1", ref, 400); err != nil {
+			t.Errorf("Refund: unexpected error: %v", err)
+		}
+	}
+	if err := f.Refund(nil, "r2", ref, 700); err != InvalidAmountErr {
+		t.Errorf("Refund: got error %v; want %v", err, InvalidAmountErr)
+	}
+	if captured, refunded, _ := f.Charge(ref); captured != 1000 || refunded != 400 {
+		t.Errorf("Charge: got captured %d and refunded %d; want 1000 and 400", captured, refunded)
+	}
+
+	paid, err := f.Payout(nil, "p1", SitterAccount(2), 850, "RON")
+	if err != nil {
+		t.Fatalf("Payout: unexpected error: %v", err)
+	}
+	failed, _ := f.Payout(nil, "p2", FailingAccount, 850, "RON")
+	f.Payout(nil, "p1", SitterAccount(2), 850, "RON")
+
+	webhooks := f.Webhooks()
+	if len(webhooks) != 2 {
+		t.Fatalf("Webhooks: got %d webhooks; want 2", len(webhooks))
+	}
+	want := []struct{ typ, ref string }{{PayoutPaid, paid}, {PayoutFailed, failed}}
+	for i, w := range webhooks {
+		r, _ := w.Request("http://petsy.ro/api/payments/webhook")
+		event, err := f.ParseEvent(nil, r)
+		if err != nil {
+			t.Errorf("ParseEvent: unexpected error: %v", err)
+			continue
+		}
+		if event.Type != want[i].typ || event.Ref != want[i].ref {
+			t.Errorf("ParseEvent: got %s of %s; want %s of %s", event.Type, event.Ref, want[i].typ, want[i].ref)
+		}
+	}
+
+	forged := &Webhook{webhooks[1].Payload, webhooks[0].Signature}
+	r, _ := forged.Request("http://petsy.ro/api/payments/webhook")
+	if _, err := f.ParseEvent(nil, r); err != InvalidSignatureErr {
+		t.Errorf("ParseEvent: got error %v for a forged webhook; want %v", err, InvalidSignatureErr)
+	}
+	if len(f.Webhooks()) != 0 {
+		t.Errorf("Webhooks: the webhooks were not taken")
+	}
+}
@@ -0,0 +1,53 @@
+// Part of payments package. Interface of the payment providers.
+
+package payments
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"appengine"
+)
+
+var (
+	DeclinedErr         = errors.New("the payment was declined")
+	UnknownChargeErr    = errors.New("unknown charge")
+	InvalidAmountErr    = errors.New("invalid amount")
+	InvalidSignatureErr = errors.New("invalid webhook signature")
+)
+
+// Types of the events sent by the providers to the webhook.
+const (
+	PayoutPaid   = "payout.paid"
+	PayoutFailed = "payout.failed"
+)
+
+// Event is a notification of the provider about a charge or a payout.
+type Event struct {
+	// ID identifies the event, which may be delivered more than once.
+	ID   string
+	Type string
+	// Ref is the reference of the charge or the payout.
+	Ref  string
+	Time time.Time
+}
+
+// Provider moves the money on behalf of Petsy. The calls changing a charge
+// or a payout take an idempotency key: retrying a call with the same key
+// doesn't move the money twice.
+type Provider interface {
+	// Authorize holds the amount on the payment source of the owner, like a
+	// card token, and returns the reference of the charge.
+	Authorize(c appengine.Context, key, source string, amount int64, currency string) (string, error)
+	// Capture collects the authorized amount of the charge.
+	Capture(c appengine.Context, key, charge string) error
+	// Refund gives back an amount of the captured charge to the owner.
+	Refund(c appengine.Context, key, charge string, amount int64) error
+	// Payout sends the amount to the account of a sitter and returns the
+	// reference of the payout, whose result is notified by an event.
+	Payout(c appengine.Context, key, account string, amount int64, currency string) (string, error)
+	// ParseEvent returns the event of a webhook request, after checking it
+	// was sent by the provider.
+	ParseEvent(c appengine.Context, r *http.Request) (*Event, error)
+}
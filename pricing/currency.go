@@ -0,0 +1,51 @@
+// Part of pricing package. Currencies of the prices and conversion
+// between them.
+
+package pricing
+
+import (
+	"errors"
+	"math"
+)
+
+// Currencies of the prices. The amounts are in their minor units, bani and
+// cents, 100 to the major unit.
+const (
+	RON = "RON"
+	EUR = "EUR"
+)
+
+var Currencies = []string{RON, EUR}
+
+var UnsupportedCurrencyErr = errors.New("unsupported currency")
+
+// EURExchangeRate is the number of RON for a EUR, used for comparing the
+// prices in different currencies. The application may update it.
+var EURExchangeRate = 4.97
+
+// ValidCurrency checks if the currency is supported.
+func ValidCurrency(currency string) bool {
+	return currency == RON || currency == EUR
+}
+
+// Amount returns the amount in minor units of the price in major units,
+// rounded to the nearest minor unit.
+func Amount(major float64) int64 {
+	return int64(math.Floor(major*100 + 0.5))
+}
+
+// Convert returns the amount in the currency to, rounded to the nearest
+// minor unit.
+func Convert(amount int64, from, to string) (int64, error) {
+	if !ValidCurrency(from) || !ValidCurrency(to) {
+		return 0, UnsupportedCurrencyErr
+	}
+	switch {
+	case from == to:
+		return amount, nil
+	case from == EUR:
+		return int64(math.Floor(float64(amount)*EURExchangeRate + 0.5)), nil
+	default:
+		return int64(math.Floor(float64(amount)/EURExchangeRate + 0.5)), nil
+	}
+}
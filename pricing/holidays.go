@@ -0,0 +1,70 @@
+// Part of pricing package. Public holidays, charged with the holiday premium.
+
+package pricing
+
+import "time"
+
+// Holidays checks if a date is a public holiday.
+type Holidays interface {
+	IsHoliday(date time.Time) bool
+}
+
+// RomanianHolidays are the legal holidays of Romania.
+type RomanianHolidays struct{}
+
+// fixedHolidays are the holidays falling on the same date every year.
+var fixedHolidays = []struct {
+	month time.Month
+	day   int
+	// since is the first year of the holiday, if not always held.
+	since int
+}{
+	{time.January, 1, 0},
+	{time.January, 2, 0},
+	{time.January, 6, 2024},
+	{time.January, 7, 2024},
+	{time.January, 24, 0},
+	{time.May, 1, 0},
+	{time.June, 1, 0},
+	{time.August, 15, 0},
+	{time.November, 30, 0},
+	{time.December, 1, 0},
+	{time.December, 25, 0},
+	{time.December, 26, 0},
+}
+
+// Days of the holidays set relative to the Orthodox Easter: Good Friday,
+// Easter, Easter Monday, Pentecost and Whit Monday.
+var easterOffsets = []int{-2, 0, 1, 49, 50}
+
+func (RomanianHolidays) IsHoliday(date time.Time) bool {
+	y, m, d := date.Date()
+	for _, h := range fixedHolidays {
+		if h.month == m && h.day == d && y >= h.since {
+			return true
+		}
+	}
+
+	easter := OrthodoxEaster(y)
+	day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	for _, offset := range easterOffsets {
+		if day.Equal(easter.AddDate(0, 0, offset)) {
+			return true
+		}
+	}
+	return false
+}
+
+// OrthodoxEaster returns the date of the Orthodox Easter of the year, in the
+// Gregorian calendar, by the Meeus algorithm for the Julian calendar. Valid
+// for the years 1900 to 2099, when the calendars are 13 days apart.
+func OrthodoxEaster(year int) time.Time {
+	a := year % 4
+	b := year % 7
+	c := year % 19
+	d := (19*c + 15) % 30
+	e := (2*a + 4*b - d + 34) % 7
+	month := (d + e + 114) / 31
+	day := (d+e+114)%31 + 1
+	return time.Date(year, time.Month(month), day+13, 0, 0, 0, 0, time.UTC)
+}
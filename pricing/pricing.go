@@ -0,0 +1,320 @@
+// Package pricing holds the rates of the sitters and computes the itemized
+// quotes of the booking requests.
+//
+// Each service has a rate per unit: a night of boarding, a day of daycare,
+// 30 minutes of walking or a drop-in visit. The quote charges the units of
+// the requested days, with the premiums of the weekends and the holidays,
+// the surcharge of the pets after the first and the long-stay discounts.
+package pricing
+
+import (
+	"errors"
+	"time"
+
+	"appengine"
+	"appengine/datastore"
+)
+
+const RatesKind = "rates"
+
+// Services offered by the sitters.
+const (
+	Boarding = "boarding"
+	Daycare  = "daycare"
+	Walk     = "walk"
+	DropIn   = "dropin"
+)
+
+var Services = []string{Boarding, Daycare, Walk, DropIn}
+
+// WalkUnit is the length of walk charged by the walk rate. Longer walks are
+// charged by started unit.
+const WalkUnit = 30
+
+// MaxDays is the maximum number of days of a quote.
+const MaxDays = 366
+
+// Minimum number of days of the stays getting the weekly and the monthly discount.
+const (
+	WeeklyStay  = 7
+	MonthlyStay = 28
+)
+
+var (
+	UnknownServiceErr    = errors.New("unknown service")
+	ServiceNotOfferedErr = errors.New("the service is not offered")
+	InvalidPeriodErr     = errors.New("invalid period")
+	InvalidPetsErr       = errors.New("invalid number of pets")
+	InvalidRatesErr      = errors.New("invalid rates")
+)
+
+// Rates are the prices of a sitter, in minor units of the currency. A
+// service is not offered if its rate is 0.
+type Rates struct {
+	Currency string `datastore:"currency,noindex"`
+	Boarding int64  `datastore:"boarding,noindex"` // per night
+	Daycare  int64  `datastore:"daycare,noindex"`  // per day
+	Walk     int64  `datastore:"walk,noindex"`     // per WalkUnit minutes
+	DropIn   int64  `datastore:"dropin,noindex"`   // per visit
+
+	// The surcharges and discounts are percentages of the rate.
+	ExtraPet        int `datastore:"extra_pet,noindex"` // for each pet after the first
+	Weekend         int `datastore:"weekend,noindex"`
+	Holiday         int `datastore:"holiday,noindex"`
+	WeeklyDiscount  int `datastore:"weekly_discount,noindex"`
+	MonthlyDiscount int `datastore:"monthly_discount,noindex"`
+}
+
+// Rate returns the rate of the service, or 0 if it is not offered.
+func (r *Rates) Rate(service string) int64 {
+	switch service {
+	case Boarding:
+		return r.Boarding
+	case Daycare:
+		return r.Daycare
+	case Walk:
+		return r.Walk
+	case DropIn:
+		return r.DropIn
+	}
+	return 0
+}
+
+// Offers checks if the sitter offers the service.
+func (r *Rates) Offers(service string) bool {
+	return r.Rate(service) > 0
+}
+
+// Validate checks the currency and the bounds of the rates and percentages.
+func (r *Rates) Validate() error {
+	if !ValidCurrency(r.Currency) {
+		return UnsupportedCurrencyErr
+	}
+	for _, rate := range []int64{r.Boarding, r.Daycare, r.Walk, r.DropIn} {
+		if rate < 0 {
+			return InvalidRatesErr
+		}
+	}
+	for _, p := range []int{r.ExtraPet, r.Weekend, r.Holiday, r.WeeklyDiscount, r.MonthlyDiscount} {
+		if p < 0 || p > 100 {
+			return InvalidRatesErr
+		}
+	}
+	return nil
+}
+
+// Request is a booking request to quote. The dates are days, whose time
+// of day is ignored.
+type Request struct {
+	Service string
+	// Start is the first day. End is the day of the pick-up for boarding,
+	// as nights are charged, or the last day for the other services.
+	Start, End time.Time
+	Pets       int
+	// PerDay is the number of walks or drop-in visits a day, 1 if not set.
+	PerDay int
+	// Minutes is the length of the walks, WalkUnit if not set.
+	Minutes int
+}
+
+// days returns the charged days of the request, each charged for the night
+// starting on it for boarding.
+func (r *Request) days() []time.Time {
+	start := dateOf(r.Start)
+	end := dateOf(r.End)
+	if r.Service != Boarding {
+		end = end.AddDate(0, 0, 1)
+	}
+
+	var days []time.Time
+	for d := start; d.Before(end) && len(days) <= MaxDays; d = d.AddDate(0, 0, 1) {
+		days = append(days, d)
+	}
+	return days
+}
+
+// unitsPerDay returns the number of units charged for each day.
+func (r *Request) unitsPerDay() int {
+	perDay := r.PerDay
+	if perDay <= 0 {
+		perDay = 1
+	}
+	switch r.Service {
+	case Walk:
+		minutes := r.Minutes
+		if minutes <= 0 {
+			minutes = WalkUnit
+		}
+		return perDay * ((minutes + WalkUnit - 1) / WalkUnit)
+	case DropIn:
+		return perDay
+	}
+	return 1
+}
+
+// Validate checks the service, the period and the pets of the request.
+func (r *Request) Validate() error {
+	switch r.Service {
+	case Boarding, Daycare, Walk, DropIn:
+	default:
+		return UnknownServiceErr
+	}
+	if r.Pets < 1 {
+		return InvalidPetsErr
+	}
+	if r.Start.IsZero() || r.End.IsZero() {
+		return InvalidPeriodErr
+	}
+	if n := len(r.days()); n == 0 || n > MaxDays {
+		return InvalidPeriodErr
+	}
+	return nil
+}
+
+// isWeekend checks if the day is charged with the weekend premium: the
+// Friday and Saturday nights for boarding, Saturday and Sunday otherwise.
+func (r *Request) isWeekend(day time.Time) bool {
+	switch day.Weekday() {
+	case time.Friday:
+		return r.Service == Boarding
+	case time.Saturday:
+		return true
+	case time.Sunday:
+		return r.Service != Boarding
+	}
+	return false
+}
+
+// dateOf returns the day of the time, at midnight UTC.
+func dateOf(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// Kinds of the items of a quote.
+const (
+	BaseItem     = "base"
+	WeekendItem  = "weekend"
+	HolidayItem  = "holiday"
+	ExtraPetItem = "extra-pet"
+	DiscountItem = "discount"
+)
+
+// Item is a line of a quote. The amount is negative for discounts.
+type Item struct {
+	Kind      string
+	Quantity  int
+	UnitPrice int64
+	Amount    int64
+}
+
+// Quote is the itemized price of a booking request.
+type Quote struct {
+	Service  string
+	Currency string
+	Days     int
+	// Units is the number of charged units of the service.
+	Units int
+	Pets  int
+	Items []Item
+	Total int64
+}
+
+// percent returns the percentage of the amount, rounded half up.
+func percent(amount int64, p int) int64 {
+	return (amount*int64(p) + 50) / 100
+}
+
+// NewQuote returns the price of the request by the rates, using the holidays
+// for the holiday premium.
+func NewQuote(rates *Rates, req *Request, holidays Holidays) (*Quote, error) {
+	if err := req.Validate(); err != nil {
+		return nil, err
+	}
+	if err := rates.Validate(); err != nil {
+		return nil, err
+	}
+	rate := rates.Rate(req.Service)
+	if rate == 0 {
+		return nil, ServiceNotOfferedErr
+	}
+
+	days := req.days()
+	perDay := req.unitsPerDay()
+	q := &Quote{
+		Service:  req.Service,
+		Currency: rates.Currency,
+		Days:     len(days),
+		Units:    len(days) * perDay,
+		Pets:     req.Pets,
+	}
+
+	// Holidays take precedence over weekends, the premiums don't add up.
+	weekend, holiday := 0, 0
+	for _, day := range days {
+		switch {
+		case holidays != nil && holidays.IsHoliday(day):
+			holiday += perDay
+		case req.isWeekend(day):
+			weekend += perDay
+		}
+	}
+
+	q.add(BaseItem, q.Units, rate)
+	q.add(WeekendItem, weekend, percent(rate, rates.Weekend))
+	q.add(HolidayItem, holiday, percent(rate, rates.Holiday))
+	q.add(ExtraPetItem, (req.Pets-1)*q.Units, percent(rate, rates.ExtraPet))
+
+	// Long stays are discounted, after the premiums and surcharges.
+	if req.Service == Boarding || req.Service == Daycare {
+		discount := 0
+		switch {
+		case q.Days >= MonthlyStay:
+			discount = rates.MonthlyDiscount
+		case q.Days >= WeeklyStay:
+			discount = rates.WeeklyDiscount
+		}
+		q.add(DiscountItem, 1, -percent(q.Total, discount))
+	}
+
+	return q, nil
+}
+
+// add adds an item of the quantity and unit price to the quote, unless
+// it is free.
+func (q *Quote) add(kind string, quantity int, unitPrice int64) {
+	amount := int64(quantity) * unitPrice
+	if amount == 0 {
+		return
+	}
+	q.Items = append(q.Items, Item{kind, quantity, unitPrice, amount})
+	q.Total += amount
+}
+
+func ratesKey(c appengine.Context, userID int64) *datastore.Key {
+	return datastore.NewKey(c, RatesKind, "", userID, nil)
+}
+
+// PutRates stores the rates of the sitter.
+func PutRates(c appengine.Context, userID int64, rates *Rates) error {
+	if userID <= 0 {
+		return errors.New("invalid user id")
+	}
+	if err := rates.Validate(); err != nil {
+		return err
+	}
+	_, err := datastore.Put(c, ratesKey(c, userID), rates)
+	return err
+}
+
+// GetRates returns the rates of the sitter, or nil if they are not set.
+func GetRates(c appengine.Context, userID int64) (*Rates, error) {
+	rates := &Rates{}
+	if err := datastore.Get(c, ratesKey(c, userID), rates); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return rates, nil
+}
@@ -0,0 +1,168 @@
+package pricing
+
+import (
+	"testing"
+	"time"
+)
+
+func date(y int, m time.Month, d int) time.Time {
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+var testRates = &Rates{
+	Currency:        RON,
+	Boarding:        10000,
+	Daycare:         6000,
+	Walk:            2500,
+	ExtraPet:        50,
+	Weekend:         20,
+	Holiday:         50,
+	WeeklyDiscount:  10,
+	MonthlyDiscount: 25,
+}
+
+func TestQuote(t *testing.T) {
+	tests := []struct {
+		req   Request
+		items []Item
+		total int64
+	}{
+		// From Thursday to Sunday: the Friday and Saturday nights are on the weekend.
+		{
+			Request{Service: Boarding, Start: date(2015, 6, 4), End: date(2015, 6, 7), Pets: 1},
+			[]Item{{BaseItem, 3, 10000, 30000}, {WeekendItem, 2, 2000, 4000}},
+			34000,
+		},
+		// Pentecost and Whit Monday are holidays, not charged with the weekend premium.
+		{
+			Request{Service: Daycare, Start: date(2015, 5, 30), End: date(2015, 6, 1), Pets: 2},
+			[]Item{{BaseItem, 3, 6000, 18000}, {WeekendItem, 1, 1200, 1200},
+				{HolidayItem, 2, 3000, 6000}, {ExtraPetItem, 3, 3000, 9000}},
+			34200,
+		},
+		// Walks of 45 minutes are charged 2 units, twice a day.
+		{
+			Request{Service: Walk, Start: date(2015, 6, 2), End: date(2015, 6, 3), Pets: 1, PerDay: 2, Minutes: 45},
+			[]Item{{BaseItem, 8, 2500, 20000}},
+			20000,
+		},
+		// A week of boarding is discounted.
+		{
+			Request{Service: Boarding, Start: date(2015, 6, 8), End: date(2015, 6, 15), Pets: 1},
+			[]Item{{BaseItem, 7, 10000, 70000}, {WeekendItem, 2, 2000, 4000}, {DiscountItem, 1, -7400, -7400}},
+			66600,
+		},
+		// Four weeks get the monthly discount.
+		{
+			Request{Service: Boarding, Start: date(2015, 6, 8), End: date(2015, 7, 6), Pets: 1},
+			[]Item{{BaseItem, 28, 10000, 280000}, {WeekendItem, 8, 2000, 16000}, {DiscountItem, 1, -74000, -74000}},
+			222000,
+		},
+	}
+
+	for i, test := range tests {
+		q, err := NewQuote(testRates, &test.req, RomanianHolidays{})
+		if err != nil {
+			t.Errorf("NewQuote %d: unexpected error: %v", i, err)
+			continue
+		}
+		if q.Total != test.total {
+			t.Errorf("NewQuote %d: got total %d; want %d", i, q.Total, test.total)
+		}
+		if len(q.Items) != len(test.items) {
+			t.Errorf("NewQuote %d: got items %v; want %v", i, q.Items, test.items)
+			continue
+		}
+		for j := range q.Items {
+			if q.Items[j] != test.items[j] {
+				t.Errorf("NewQuote %d: got items %v; want %v", i, q.Items, test.items)
+				break
+			}
+		}
+	}
+}
+
+func TestQuoteErrors(t *testing.T) {
+	start := date(2015, 6, 1)
+	tests := []struct {
+		req Request
+		err error
+	}{
+		{Request{Service: "grooming", Start: start, End: start, Pets: 1}, UnknownServiceErr},
+		{Request{Service: DropIn, Start: start, End: start, Pets: 1}, ServiceNotOfferedErr},
+		{Request{Service: Daycare, Start: start, End: start, Pets: 0}, InvalidPetsErr},
+		{Request{Service: Boarding, Start: start, End: start, Pets: 1}, InvalidPeriodErr},
+		{Request{Service: Daycare, Start: start, End: start.AddDate(0, 0, -1), Pets: 1}, InvalidPeriodErr},
+		{Request{Service: Daycare, Start: start, End: start.AddDate(2, 0, 0), Pets: 1}, InvalidPeriodErr},
+		{Request{Service: Daycare, End: start, Pets: 1}, InvalidPeriodErr},
+	}
+
+	for _, test := range tests {
+		if _, err := NewQuote(testRates, &test.req, nil); err != test.err {
+			t.Errorf("NewQuote(%+v): got error %v; want %v", test.req, err, test.err)
+		}
+	}
+
+	rates := *testRates
+	rates.Currency = "USD"
+	req := &Request{Service: Daycare, Start: start, End: start, Pets: 1}
+	if _, err := NewQuote(&rates, req, nil); err != UnsupportedCurrencyErr {
+		t.Errorf("NewQuote: got error %v; want %v", err, UnsupportedCurrencyErr)
+	}
+	rates.Currency, rates.Weekend = EUR, 150
+	if _, err := NewQuote(&rates, req, nil); err != InvalidRatesErr {
+		t.Errorf("NewQuote: got error %v; want %v", err, InvalidRatesErr)
+	}
+}
+
+func TestRomanianHolidays(t *testing.T) {
+	easter := map[int]time.Time{
+		2015: date(2015, 4, 12),
+		2016: date(2016, 5, 1),
+		2024: date(2024, 5, 5),
+		2025: date(2025, 4, 20),
+	}
+	for year, want := range easter {
+		if got := OrthodoxEaster(year); !got.Equal(want) {
+			t.Errorf("OrthodoxEaster(%d): got %v; want %v", year, got, want)
+		}
+	}
+
+	var h RomanianHolidays
+	holidays := []time.Time{
+		date(2015, 1, 1), date(2015, 12, 1), date(2015, 4, 10), date(2015, 4, 13),
+		date(2015, 5, 31), date(2015, 6, 1), date(2024, 1, 6),
+	}
+	for _, d := range holidays {
+		if !h.IsHoliday(d) {
+			t.Errorf("IsHoliday(%v): got false; want true", d)
+		}
+	}
+	for _, d := range []time.Time{date(2015, 1, 6), date(2015, 4, 14), date(2015, 6, 2)} {
+		if h.IsHoliday(d) {
+			t.Errorf("IsHoliday(%v): got true; want false", d)
+		}
+	}
+}
+
+func TestCurrency(t *testing.T) {
+	if a := Amount(80.555); a != 8056 {
+		t.Errorf("Amount: got %d; want 8056", a)
+	}
+
+	defer func(rate float64) { EURExchangeRate = rate }(EURExchangeRate)
+	EURExchangeRate = 5
+
+	if a, _ := Convert(1000, EUR, RON); a != 5000 {
+		t.Errorf("Convert: got %d RON; want 5000", a)
+	}
+	if a, _ := Convert(1002, RON, EUR); a != 200 {
+		t.Errorf("Convert: got %d EUR; want 200", a)
+	}
+	if a, _ := Convert(1002, RON, RON); a != 1002 {
+		t.Errorf("Convert: got %d RON; want 1002", a)
+	}
+	if _, err := Convert(1, "USD", RON); err != UnsupportedCurrencyErr {
+		t.Errorf("Convert: got error %v; want %v", err, UnsupportedCurrencyErr)
+	}
+}
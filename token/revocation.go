@@ -0,0 +1,56 @@
+// Part of token package. Implements the one-time use of tokens, with a
+// revocation list stored in the hashstore.
+package token
+
+import (
+	"time"
+
+	"petsy/hashstore"
+
+	"appengine"
+)
+
+// Prefix of the hashstore scopes of the revoked tokens.
+const revokedScope = "revoked-token:"
+
+// Consume verifies the token like Verify and revokes it, so that it can be used
+// only once. Returns RevokedErr if the token was already used or revoked.
+func (s *Signer) Consume(c appengine.Context, token, scope string) (*Claims, error) {
+	claims, err := s.Verify(token, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Revoke(c, claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Revoke adds the token to the revocation list, until it expires. Returns
+// RevokedErr if the token is already revoked.
+func Revoke(c appengine.Context, claims *Claims) error {
+	valid := claims.ExpiresAt().Sub(time.Now())
+	if valid <= 0 {
+		// Expired tokens need no revocation.
+		return nil
+	}
+
+	_, err := hashstore.AddEntry(c, claims.ID, claims.Subject, revokedScope+claims.Scope, valid)
+	if err == hashstore.DuplicateKeyErr {
+		return RevokedErr
+	}
+	return err
+}
+
+// IsRevoked returns whether the token was revoked or already used.
+func IsRevoked(c appengine.Context, claims *Claims) (bool, error) {
+	_, _, err := hashstore.GetValue(c, claims.ID, hashstore.IgnoreExpired)
+	if err == hashstore.NoSuchKeyErr {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
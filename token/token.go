@@ -0,0 +1,236 @@
+// Package token issues and verifies signed, expiring and scope-bound tokens.
+// The tokens are signed with HMAC-SHA256 and carry their claims, so that their
+// verification needs no storage lookup. The claims are encrypted with AES-GCM,
+// so that the holders of a token can't read its subject. Signing keys can be
+// rotated: tokens are signed with the current key and verified with any of the
+// known keys.
+package token
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+var (
+	// Error returned if the token is malformed or its signature is invalid.
+	InvalidTokenErr = errors.New("invalid token")
+	// Error returned if the token was signed with an unknown key.
+	UnknownKeyErr = errors.New("token signed with unknown key")
+	// Error returned if the token is expired.
+	ExpiredErr = errors.New("token is expired")
+	// Error returned if the token was issued for another scope.
+	ScopeMismatchErr = errors.New("token has another scope")
+	// Error returned if the token was revoked or already used.
+	RevokedErr = errors.New("token was revoked")
+)
+
+// Key is a signing key. The ID is included in the tokens, so that they are
+// verified with the key which signed them. The key encrypting the claims is
+// derived from the secret.
+type Key struct {
+	ID     string
+	Secret []byte
+}
+
+// Claims holds the information carried by a token.
+type Claims struct {
+	// ID uniquely identifies the token.
+	ID string `json:"jti"`
+	// Subject is the entity the token was issued for, e.g. an email address.
+	Subject string `json:"sub"`
+	// Scope is the action the token can be used for.
+	Scope   string `json:"scope"`
+	Expires int64  `json:"exp"`
+}
+
+// ExpiresAt returns the expiration time of the token.
+func (c *Claims) ExpiresAt() time.Time {
+	return time.Unix(c.Expires, 0)
+}
+
+// Signer issues and verifies tokens.
+type Signer struct {
+	// Keys holds the known signing keys. The first key is the current one,
+	// used for signing. The others are only used for verification, so they
+	// can be dropped once the tokens they signed expired.
+	Keys []Key
+	// Now returns the current time, used for the expiration of the tokens.
+	// If nil, time.Now is used.
+	Now func() time.Time
+}
+
+func (s *Signer) now() time.Time {
+	if s.Now != nil {
+		return s.Now()
+	}
+	return time.Now()
+}
+
+// NewSigner creates a new signer with the provided keys, the first being
+// the current one. Returns an error if there is no key or if the keys are
+// invalid.
+func NewSigner(keys ...Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("signer needs at least one key")
+	}
+
+	ids := make(map[string]bool)
+	for _, k := range keys {
+		if k.ID == "" || strings.Contains(k.ID, ".") {
+			return nil, errors.New("key id must be non-empty and can't contain dots")
+		}
+		if len(k.Secret) == 0 {
+			return nil, errors.New("key secret can't be empty")
+		}
+		if ids[k.ID] {
+			return nil, errors.New("duplicate key id " + k.ID)
+		}
+		ids[k.ID] = true
+	}
+
+	return &Signer{Keys: keys}, nil
+}
+
+// Issue returns a new token for the subject and the scope, valid for the
+// provided duration.
+func (s *Signer) Issue(subject, scope string, valid time.Duration) (string, error) {
+	if subject == "" {
+		return "", errors.New("subject can't be empty")
+	}
+	if scope == "" {
+		return "", errors.New("scope can't be empty")
+	}
+	if valid <= 0 {
+		return "", errors.New("duration must be positive")
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	claims := &Claims{
+		ID:      hex.EncodeToString(id),
+		Subject: subject,
+		Scope:   scope,
+		Expires: s.now().Add(valid).Unix(),
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	key := s.Keys[0]
+	if payload, err = encrypt(key.Secret, payload); err != nil {
+		return "", err
+	}
+	signed := key.ID + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	return signed + "." + sign(key.Secret, signed), nil
+}
+
+// Verify checks the signature, the expiration and the scope of the token.
+// Returns the claims of the token if it is valid.
+func (s *Signer) Verify(token, scope string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, InvalidTokenErr
+	}
+
+	key, ok := s.key(parts[0])
+	if !ok {
+		return nil, UnknownKeyErr
+	}
+
+	signed := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(sign(key.Secret, signed)), []byte(parts[2])) {
+		return nil, InvalidTokenErr
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, InvalidTokenErr
+	}
+	if payload, err = decrypt(key.Secret, payload); err != nil {
+		return nil, InvalidTokenErr
+	}
+
+	var claims Claims
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	if err := decoder.Decode(&claims); err != nil {
+		return nil, InvalidTokenErr
+	}
+
+	if claims.Scope != scope {
+		return nil, ScopeMismatchErr
+	}
+	if !claims.ExpiresAt().After(s.now()) {
+		return nil, ExpiredErr
+	}
+
+	return &claims, nil
+}
+
+func (s *Signer) key(id string) (Key, bool) {
+	for _, k := range s.Keys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+func sign(secret []byte, data string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(data))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// aead returns the cipher encrypting the claims, keyed by the secret.
+func aead(secret []byte) (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("token claims encryption"))
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encrypt returns the nonce followed by the encrypted payload.
+func encrypt(secret, payload []byte) ([]byte, error) {
+	gcm, err := aead(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, payload, nil), nil
+}
+
+func decrypt(secret, data []byte) ([]byte, error) {
+	gcm, err := aead(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, InvalidTokenErr
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
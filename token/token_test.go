@@ -0,0 +1,108 @@
+package token
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	oldKey = Key{ID: "1", Secret: []byte("old secret")}
+	newKey = Key{ID: "2", Secret: []byte("new secret")}
+)
+
+func TestIssueVerify(t *testing.T) {
+	s, err := NewSigner(oldKey)
+	if err != nil {
+		t.Fatalf("NewSigner: unexpected error: %v", err)
+	}
+
+	token, err := s.Issue("test@petsy.ro", "register", time.Hour)
+	if err != nil {
+		t.Fatalf("Issue: unexpected error: %v", err)
+	}
+
+	claims, err := s.Verify(token, "register")
+	if err != nil {
+		t.Fatalf("Verify: unexpected error: %v", err)
+	}
+	if claims.Subject != "test@petsy.ro" || claims.ID == "" {
+		t.Errorf("Verify: got claims %+v; want subject test@petsy.ro and an id", claims)
+	}
+
+	if _, err := s.Verify(token, "reset"); err != ScopeMismatchErr {
+		t.Errorf("Verify: other scope: got error %v; want %v", err, ScopeMismatchErr)
+	}
+
+	tampered := strings.Replace(token, token[len(token)-4:], "AAAA", 1)
+	if _, err := s.Verify(tampered, "register"); err != InvalidTokenErr {
+		t.Errorf("Verify: tampered token: got error %v; want %v", err, InvalidTokenErr)
+	}
+	if _, err := s.Verify("garbage", "register"); err != InvalidTokenErr {
+		t.Errorf("Verify: malformed token: got error %v; want %v", err, InvalidTokenErr)
+	}
+}
+
+func TestExpiredToken(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	s, _ := NewSigner(oldKey)
+	s.Now = func() time.Time { return now }
+
+	token, _ := s.Issue("test@petsy.ro", "register", time.Hour)
+	now = now.Add(time.Hour)
+
+	if _, err := s.Verify(token, "register"); err != ExpiredErr {
+		t.Errorf("Verify: got error %v; want %v", err, ExpiredErr)
+	}
+}
+
+func TestEncryptedClaims(t *testing.T) {
+	s, _ := NewSigner(oldKey)
+
+	token, _ := s.Issue("test@petsy.ro", "register", time.Hour)
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[1])
+	if err != nil {
+		t.Fatalf("Issue: can't decode payload: %v", err)
+	}
+	if bytes.Contains(payload, []byte("test@petsy.ro")) || bytes.Contains(payload, []byte("register")) {
+		t.Errorf("Issue: got readable claims %q", payload)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	before, _ := NewSigner(oldKey)
+	after, _ := NewSigner(newKey, oldKey)
+	dropped, _ := NewSigner(newKey)
+
+	token, _ := before.Issue("test@petsy.ro", "register", time.Hour)
+
+	if _, err := after.Verify(token, "register"); err != nil {
+		t.Errorf("Verify: token signed with previous key: unexpected error: %v", err)
+	}
+	if _, err := dropped.Verify(token, "register"); err != UnknownKeyErr {
+		t.Errorf("Verify: token signed with dropped key: got error %v; want %v", err, UnknownKeyErr)
+	}
+
+	token, _ = after.Issue("test@petsy.ro", "register", time.Hour)
+	if !strings.HasPrefix(token, newKey.ID+".") {
+		t.Errorf("Issue: token not signed with the current key")
+	}
+}
+
+func TestNewSigner(t *testing.T) {
+	invalid := [][]Key{
+		nil,
+		{{ID: "", Secret: []byte("secret")}},
+		{{ID: "a.b", Secret: []byte("secret")}},
+		{{ID: "1", Secret: nil}},
+		{oldKey, oldKey},
+	}
+
+	for _, keys := range invalid {
+		if _, err := NewSigner(keys...); err == nil {
+			t.Errorf("NewSigner(%v): want error", keys)
+		}
+	}
+}
@@ -4,33 +4,151 @@ package user
 
 import (
 	"errors"
+	"strings"
+
+	"petsy/migrate"
 
 	"appengine"
 	"appengine/datastore"
 )
 
-const UserKind = "user"
+func init() {
+	migrate.Register(migrate.Migration{
+		Version:     2,
+		Kind:        UserKind,
+		Description: "set and reserve the canonical emails",
+		Migrate:     MigrateCanonicalEmail,
+		Saves:       true,
+	})
+}
+
+const (
+	UserKind  = "user"
+	EmailKind = "user_email"
+)
+
+// UserEmail reserves a canonical email for a user. It is keyed by the
+// canonical email, so that its uniqueness is checked in transactions.
+type UserEmail struct {
+	User int64 `datastore:"user,noindex"`
+}
+
+func emailKey(c appengine.Context, canonical string) *datastore.Key {
+	return datastore.NewKey(c, EmailKind, canonical, 0, nil)
+}
+
+// emailOwner returns the id of the user owning the canonical email, or 0
+// if the email is not reserved.
+func emailOwner(c appengine.Context, canonical string) (int64, error) {
+	var e UserEmail
+	err := datastore.Get(c, emailKey(c, canonical), &e)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, nil
+	}
+	return e.User, err
+}
+
+// reserveEmail reserves the canonical email for the user. Returns
+// DuplicateEmailErr if another user owns it. Must be called in a
+// datastore transaction.
+func reserveEmail(tc appengine.Context, canonical string, id int64) error {
+	owner, err := emailOwner(tc, canonical)
+	if err != nil {
+		return err
+	}
+	if owner == id {
+		return nil
+	}
+	if owner != 0 {
+		return DuplicateEmailErr
+	}
+	_, err = datastore.Put(tc, emailKey(tc, canonical), &UserEmail{id})
+	return err
+}
+
+// releaseEmail deletes the reservation of the canonical email, if the user
+// owns it. Must be called in a datastore transaction.
+func releaseEmail(tc appengine.Context, canonical string, id int64) error {
+	owner, err := emailOwner(tc, canonical)
+	if err != nil || owner != id {
+		return err
+	}
+	return datastore.Delete(tc, emailKey(tc, canonical))
+}
 
 // AddUser adds a new user to the datastore. Returns the key of the new
-// entry and possibly an error.
+// entry and possibly an error. Returns DuplicateEmailErr if another user
+// has the same canonical email.
 func AddUser(c appengine.Context, user *User) (*datastore.Key, error) {
 	if user == nil {
 		return nil, errors.New("user to add to datastore can't be empty")
 	}
-	userKey := datastore.NewIncompleteKey(c, UserKind, nil)
 
-	return datastore.Put(c, userKey, user)
+	user.CanonicalEmail = CanonicalEmail(user.Email)
+	// The users stored before the emails were reserved are only found
+	// by the queries.
+	key, _, err := GetUserByEmail(c, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		return nil, DuplicateEmailErr
+	}
+
+	id, _, err := datastore.AllocateIDs(c, UserKind, nil, 1)
+	if err != nil {
+		return nil, err
+	}
+	key = datastore.NewKey(c, UserKind, "", id, nil)
+
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := reserveEmail(tc, user.CanonicalEmail, id); err != nil {
+			return err
+		}
+		_, err := datastore.Put(tc, key, user)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
 // GetUserByEmail returns from the datastorethe user associated with the provided email.
+// The users are looked up by the canonical form of their email, so the casing
+// of the provided email does not matter.
 // Returns the key of the entry, the user structure and a possible error.
 // The key and the user are nil if there is no user stored with the provided email.
 func GetUserByEmail(c appengine.Context, email string) (*datastore.Key, *User, error) {
-	if email == "" {
+	if strings.TrimSpace(email) == "" {
 		return nil, nil, InvalidEmailErr
 	}
 
-	query := datastore.NewQuery(UserKind).Filter("email =", string(email))
+	canonical := CanonicalEmail(email)
+	id, err := emailOwner(c, canonical)
+	if err != nil {
+		return nil, nil, err
+	}
+	if id != 0 {
+		return GetUser(c, id)
+	}
+
+	// The users stored before the emails were reserved are found by
+	// queries, until MigrateCanonicalEmail migrates them.
+	key, user, err := getUserByFilter(c, "canonical_email =", canonical)
+	if key != nil || err != nil {
+		return key, user, err
+	}
+
+	// The users stored before the canonical emails were introduced are found
+	// by their exact email, until MigrateCanonicalEmail migrates them.
+	return getUserByFilter(c, "email =", email)
+}
+
+// getUserByFilter returns the first user matching the filter, or a nil key
+// and user if none matches.
+func getUserByFilter(c appengine.Context, filter, value string) (*datastore.Key, *User, error) {
+	query := datastore.NewQuery(UserKind).Filter(filter, value).Limit(1)
 
 	for t := query.Run(c); ; {
 		var user User
@@ -68,7 +186,36 @@ func UpdateUser(c appengine.Context, prevEmail string, user *User) (*datastore.K
 		return nil, errors.New("no user with email " + prevEmail + " found for updating.")
 	}
 
-	return datastore.Put(c, key, user)
+	prevCanonical := CanonicalEmail(prevEmail)
+	user.CanonicalEmail = CanonicalEmail(user.Email)
+	if user.CanonicalEmail != prevCanonical {
+		// The users stored before the emails were reserved are only found
+		// by the queries.
+		other, _, err := GetUserByEmail(c, user.Email)
+		if err != nil {
+			return nil, err
+		}
+		if other != nil && !other.Equal(key) {
+			return nil, DuplicateEmailErr
+		}
+	}
+
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := reserveEmail(tc, user.CanonicalEmail, key.IntID()); err != nil {
+			return err
+		}
+		if user.CanonicalEmail != prevCanonical {
+			if err := releaseEmail(tc, prevCanonical, key.IntID()); err != nil {
+				return err
+			}
+		}
+		_, err := datastore.Put(tc, key, user)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
 }
 
 // DeleteUser deletes the user entry having the provided email from the datastore.
@@ -79,7 +226,7 @@ func DeleteUSer(c appengine.Context, email string) error {
 		return InvalidEmailErr
 	}
 
-	key, _, err := GetUserByEmail(c, email)
+	key, user, err := GetUserByEmail(c, email)
 	if err != nil {
 		return err
 	}
@@ -87,5 +234,146 @@ func DeleteUSer(c appengine.Context, email string) error {
 		return errors.New("no user with this email found")
 	}
 
-	return datastore.Delete(c, key)
+	return datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		if err := releaseEmail(tc, CanonicalEmail(user.Email), key.IntID()); err != nil {
+			return err
+		}
+		return datastore.Delete(tc, key)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// GetUser returns from the datastore the user having the provided id.
+// Returns the key of the entry, the user structure and a possible error.
+// The key and the user are nil if there is no user with the provided id.
+func GetUser(c appengine.Context, id int64) (*datastore.Key, *User, error) {
+	if id <= 0 {
+		return nil, nil, errors.New("invalid user id")
+	}
+
+	key := datastore.NewKey(c, UserKind, "", id, nil)
+
+	var user User
+	err := datastore.Get(c, key, &user)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, &user, nil
+}
+
+// GetUsers returns the users having the ids, in the same order. The users
+// not found are nil.
+func GetUsers(c appengine.Context, ids []int64) ([]*User, error) {
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		if id <= 0 {
+			return nil, errors.New("invalid user id")
+		}
+		keys[i] = datastore.NewKey(c, UserKind, "", id, nil)
+	}
+
+	users := make([]*User, len(ids))
+	for i := range users {
+		users[i] = &User{}
+	}
+	err := datastore.GetMulti(c, keys, users)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for i, err := range merr {
+			if err == datastore.ErrNoSuchEntity {
+				users[i] = nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// SearchUsers returns from the datastore at most limit users whose canonical
+// email starts with the provided prefix, regardless of its casing, ordered by
+// canonical email. All the users are returned if the prefix is empty.
+func SearchUsers(c appengine.Context, prefix string, limit int) ([]*datastore.Key, []*User, error) {
+	if limit <= 0 {
+		return nil, nil, errors.New("limit must be positive")
+	}
+
+	query := datastore.NewQuery(UserKind).Order("canonical_email").Limit(limit)
+	if prefix = strings.ToLower(strings.TrimSpace(prefix)); prefix != "" {
+		query = query.Filter("canonical_email >=", prefix).Filter("canonical_email <", prefix+"\ufffd")
+	}
+
+	users := make([]*User, 0)
+	keys, err := query.GetAll(c, &users)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, users, nil
+}
+
+// MigrateCanonicalEmail sets the canonical email of the user stored before it
+// was introduced, and reserves it for the user, in a transaction. The users
+// whose canonical email is reserved by another user are logged and reported
+// by migrate.CollisionErr, since only one of them can be found by email:
+// they need to be merged or changed by the administrators. They are migrated
+// too, without the reservation, and reported again by the next runs.
+func MigrateCanonicalEmail(c appengine.Context, e *migrate.Entity) (bool, error) {
+	key, err := datastore.DecodeKey(e.Key)
+	if err != nil {
+		return false, err
+	}
+
+	var migrated bool
+	var canonical, collision string
+	err = datastore.RunInTransaction(c, func(tc appengine.Context) error {
+		migrated, collision = false, ""
+
+		var user User
+		if err := datastore.Get(tc, key, &user); err != nil {
+			return err
+		}
+
+		canonical = CanonicalEmail(user.Email)
+		owner, err := emailOwner(tc, canonical)
+		if err != nil {
+			return err
+		}
+
+		if owner != 0 && owner != key.IntID() {
+			_, other, err := GetUser(tc, owner)
+			if err != nil {
+				return err
+			}
+			if other != nil {
+				collision = other.Email
+			}
+		}
+		if user.CanonicalEmail == canonical && owner != 0 {
+			return nil
+		}
+		if owner == 0 || owner == key.IntID() {
+			if err := reserveEmail(tc, canonical, key.IntID()); err != nil {
+				return err
+			}
+		}
+
+		user.CanonicalEmail = canonical
+		if _, err := datastore.Put(tc, key, &user); err != nil {
+			return err
+		}
+		migrated = true
+		return nil
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return false, err
+	}
+
+	if collision != "" {
+		c.Warningf("user: user %d collides as %s with the user %s", key.IntID(), canonical, collision)
+		return migrated, migrate.CollisionErr
+	}
+	return migrated, nil
 }
@@ -25,19 +25,41 @@ func TestDatastoreUsers(t *testing.T) {
 		t.Errorf("AddUser: nil key")
 	}
 
-	// // Get user
-	// _, gotUser, err := GetUserByEmail(c, email)
-	// if err != nil {
-	// 	t.Errorf("GetUserByEmail: unexpected error: %v", err)
-	// }
-	// if gotUser == nil {
-	// 	t.Errorf("GetUserByEmail: want one user, got none")
-	// 	return
-	// }
-	// if gotUser.Name != user.Name {
-	// 	t.Errorf("GetUserByEmail: want user %s, got user %s.", user.Name, gotUser.Name)
-	// }
-	// if gotUser.Email != user.Email {
-	// 	t.Errorf("GetUserByEmail: want user %s, got user %s.", user.Email, gotUser.Email)
-	// }
+	// Get user
+	_, gotUser, err := GetUserByEmail(c, email)
+	if err != nil {
+		t.Errorf("GetUserByEmail: unexpected error: %v", err)
+	}
+	if gotUser == nil {
+		t.Errorf("GetUserByEmail: want one user, got none")
+		return
+	}
+	if gotUser.Name != user.Name {
+		t.Errorf("GetUserByEmail: want user %s, got user %s.", user.Name, gotUser.Name)
+	}
+	if gotUser.Email != user.Email {
+		t.Errorf("GetUserByEmail: want user %s, got user %s.", user.Email, gotUser.Email)
+	}
+
+	users, err := GetUsers(c, []int64{key.IntID(), key.IntID() + 1000})
+	if err != nil {
+		t.Errorf("GetUsers: unexpected error: %v", err)
+	} else if len(users) != 2 || users[0] == nil || users[0].Email != user.Email || users[1] != nil {
+		t.Errorf("GetUsers: want the user, then nil")
+	}
+
+	// The emails are unique regardless of their casing.
+	other, _ := NewUser(name, "TEST@petsy.ro")
+	if _, err := AddUser(c, other); err != DuplicateEmailErr {
+		t.Errorf("AddUser: duplicate email: got error %v; want %v", err, DuplicateEmailErr)
+	}
+
+	// Changing the email releases the previous one.
+	user.Email = "new@petsy.ro"
+	if _, err := UpdateUser(c, email, user); err != nil {
+		t.Errorf("UpdateUser: unexpected error: %v", err)
+	}
+	if _, err := AddUser(c, other); err != nil {
+		t.Errorf("AddUser: released email: unexpected error: %v", err)
+	}
 }
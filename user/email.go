@@ -0,0 +1,30 @@
+// Part of user package. Implements the canonical form of the email
+// addresses, used for looking up the users.
+package user
+
+import (
+	"strings"
+
+	"petsy/validation"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// CanonicalEmail returns the canonical form of the email address: trimmed,
+// normalized to NFC, lowercased and with the domain in its ASCII (punycode)
+// form, so that the variants of an address typed by the users or returned by
+// the providers identify the same user. Addresses without a valid domain are
+// only trimmed, normalized and lowercased.
+func CanonicalEmail(email string) string {
+	email = strings.ToLower(norm.NFC.String(strings.TrimSpace(email)))
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	domain, err := validation.DomainToASCII(email[at+1:])
+	if err != nil {
+		return email
+	}
+	return email[:at+1] + domain
+}
@@ -0,0 +1,85 @@
+// Package permission defines the permissions granted to the authorization
+// roles of the users and checks them against the resources of the application.
+package permission
+
+import (
+	"petsy/user"
+)
+
+// Permission is an action which can be performed on a kind of resource.
+type Permission string
+
+// Permissions of the application.
+const (
+	EditProfile       Permission = "profile:edit"
+	EditUserPage      Permission = "userpage:edit"
+	EditPet           Permission = "pet:edit"
+	EditSitterProfile Permission = "sitter:edit"
+
+	ViewUsers        Permission = "users:view"
+	EditUsers        Permission = "users:edit"
+	ResendActivation Permission = "users:resend-activation"
+	ImpersonateUsers Permission = "users:impersonate"
+	ModerateContent  Permission = "content:moderate"
+	ViewHashstore    Permission = "hashstore:view"
+	ViewAuditLog     Permission = "audit:view"
+)
+
+// Resource is a resource owned by a user.
+type Resource interface {
+	// OwnedBy returns whether the user owns the resource.
+	OwnedBy(u *user.User) bool
+}
+
+// Grant gives a permission to a role.
+type Grant struct {
+	Permission Permission
+	// Any is true if the permission is granted for the resources of all the
+	// users. Otherwise, it is only granted for the resources of the user.
+	Any bool
+}
+
+// Grants lists the permissions of each role. Administrators have
+// all the permissions, for all the resources.
+var Grants = map[string][]Grant{
+	user.OwnerRole: {
+		{EditProfile, false},
+		{EditUserPage, false},
+		{EditPet, false},
+	},
+	user.SitterRole: {
+		{EditProfile, false},
+		{EditUserPage, false},
+		{EditSitterProfile, false},
+	},
+	user.SupportRole: {
+		{ViewUsers, true},
+		{ResendActivation, true},
+		{ModerateContent, true},
+	},
+}
+
+// Allowed returns whether the user has the permission for the resource.
+// A nil resource stands for the user's own resources, for instance when
+// creating a new one.
+func Allowed(u *user.User, p Permission, r Resource) bool {
+	if u == nil {
+		return false
+	}
+
+	for _, role := range u.GetRoles() {
+		if role == user.AdminRole {
+			return true
+		}
+
+		for _, g := range Grants[role] {
+			if g.Permission != p {
+				continue
+			}
+			if g.Any || r == nil || r.OwnedBy(u) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package permission
+
+import (
+	"testing"
+
+	"petsy/user"
+)
+
+type resource struct {
+	owner string
+}
+
+func (r resource) OwnedBy(u *user.User) bool {
+	return r.owner == u.Email
+}
+
+func newUser(email string, roles ...string) *user.User {
+	u, _ := user.NewUser("test", email)
+	u.Roles = roles
+	return u
+}
+
+func TestAllowed(t *testing.T) {
+	owner := newUser("owner@petsy.ro")
+	other := newUser("other@petsy.ro", user.OwnerRole)
+	sitter := newUser("sitter@petsy.ro", user.SitterRole)
+	support := newUser("support@petsy.ro", user.SupportRole)
+	admin := newUser("admin@petsy.ro", user.AdminRole)
+
+	pet := resource{owner.Email}
+
+	tests := []struct {
+		user *user.User
+		perm Permission
+		res  Resource
+		want bool
+	}{
+		{nil, EditPet, pet, false},
+		{owner, EditPet, pet, true},
+		{owner, EditPet, nil, true},
+		{other, EditPet, pet, false},
+		{sitter, EditPet, resource{sitter.Email}, false},
+		{sitter, EditSitterProfile, resource{sitter.Email}, true},
+		{support, EditPet, pet, false},
+		{support, ViewUsers, owner, true},
+		{owner, ViewUsers, nil, false},
+		{admin, EditPet, pet, true},
+		{admin, ViewHashstore, nil, true},
+	}
+
+	for _, test := range tests {
+		if got := Allowed(test.user, test.perm, test.res); got != test.want {
+			email := "<nil>"
+			if test.user != nil {
+				email = test.user.Email
+			}
+			t.Errorf("Allowed(%s, %s, %v): got %v; want %v", email, test.perm, test.res, got, test.want)
+		}
+	}
+}
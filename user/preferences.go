@@ -0,0 +1,83 @@
+// Part of user package. Implements the email notification
+// preferences of the users.
+package user
+
+import (
+	"errors"
+
+	"petsy/i18n"
+)
+
+// Categories of the emails sent to the users.
+const (
+	// AccountEmails are transactional and can't be unsubscribed from.
+	AccountEmails   = "account"
+	BookingEmails   = "bookings"
+	MessageEmails   = "messages"
+	MarketingEmails = "marketing"
+)
+
+// EmailCategories lists all the email categories.
+var EmailCategories = []string{AccountEmails, BookingEmails, MessageEmails, MarketingEmails}
+
+var InvalidCategoryErr = errors.New("invalid email category")
+
+// IsTransactional returns whether the emails of the category are always sent.
+func IsTransactional(category string) bool {
+	return category == "" || category == AccountEmails
+}
+
+// WantsEmails returns whether the user accepts emails of the provided category.
+func (u *User) WantsEmails(category string) bool {
+	if IsTransactional(category) {
+		return true
+	}
+
+	for _, c := range u.Unsubscribed {
+		if c == category {
+			return false
+		}
+	}
+	return true
+}
+
+// SetEmailPreference subscribes or unsubscribes the user from the emails
+// of the provided category. Returns InvalidCategoryErr if the category is
+// unknown or transactional.
+func (u *User) SetEmailPreference(category string, subscribed bool) error {
+	if !isEmailCategory(category) || IsTransactional(category) {
+		return InvalidCategoryErr
+	}
+
+	unsubscribed := make([]string, 0, len(u.Unsubscribed)+1)
+	for _, c := range u.Unsubscribed {
+		if c != category {
+			unsubscribed = append(unsubscribed, c)
+		}
+	}
+	if !subscribed {
+		unsubscribed = append(unsubscribed, category)
+	}
+	u.Unsubscribed = unsubscribed
+
+	return nil
+}
+
+func isEmailCategory(category string) bool {
+	for _, c := range EmailCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// SetLocale sets the language of the pages and emails of the user.
+// Returns i18n.InvalidLocaleErr if the locale is not supported.
+func (u *User) SetLocale(locale string) error {
+	if !i18n.Supported(locale) {
+		return i18n.InvalidLocaleErr
+	}
+	u.Locale = locale
+	return nil
+}
@@ -5,7 +5,6 @@ type Sitter struct {
 	Experience   string
 	HousingType  string
 	Space        string
-	Price        int
 	OwnsPets     bool
 	HasCar       bool
 	Permanent    bool
@@ -0,0 +1,86 @@
+// Part of user package. Implements the authorization roles of the users.
+package user
+
+import (
+	"errors"
+)
+
+// Authorization roles of the users.
+const (
+	OwnerRole   = "owner"
+	SitterRole  = "sitter"
+	SupportRole = "support"
+	AdminRole   = "admin"
+)
+
+// AllRoles lists all the authorization roles.
+var AllRoles = []string{OwnerRole, SitterRole, SupportRole, AdminRole}
+
+var (
+	InvalidRoleErr = errors.New("invalid role")
+	LastRoleErr    = errors.New("can't remove the last role")
+)
+
+// GetRoles returns the authorization roles of the user. Users having
+// no role are owners.
+func (u *User) GetRoles() []string {
+	if len(u.Roles) == 0 {
+		return []string{OwnerRole}
+	}
+	return u.Roles
+}
+
+// HasRole returns whether the user has the role.
+func (u *User) HasRole(role string) bool {
+	for _, r := range u.GetRoles() {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRole grants the role to the user. Returns InvalidRoleErr
+// if the role is unknown.
+func (u *User) AddRole(role string) error {
+	if !isRole(role) {
+		return InvalidRoleErr
+	}
+	if u.HasRole(role) {
+		return nil
+	}
+
+	u.Roles = append(u.GetRoles(), role)
+	return nil
+}
+
+// RemoveRole revokes the role of the user. Returns LastRoleErr if it is
+// the only role of the user, since users having no role are owners.
+func (u *User) RemoveRole(role string) error {
+	roles := make([]string, 0, len(u.Roles))
+	for _, r := range u.GetRoles() {
+		if r != role {
+			roles = append(roles, r)
+		}
+	}
+	if len(roles) == 0 {
+		return LastRoleErr
+	}
+	u.Roles = roles
+	return nil
+}
+
+func isRole(role string) bool {
+	for _, r := range AllRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// OwnedBy returns whether the user is the provided one, so that
+// users are the owners of their own account.
+func (u *User) OwnedBy(other *User) bool {
+	return other != nil && u.Email == other.Email
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/sha256"
 	"errors"
 	"io"
+	"time"
 )
 
 type Provider struct {
@@ -21,14 +22,28 @@ type User struct {
 	Email     string `datastore:"email"`
 	AvatarURL string `datastore:"avatar,noindex"`
 	Active    bool
-	Hash      []byte `datastore:"hash,noindex"`
-	Salt      []byte `datastore:"salt,noindex"`
+	Hash      []byte `datastore:"hash,noindex" json:"-"`
+	Salt      []byte `datastore:"salt,noindex" json:"-"`
 	Providers []Provider
+	// Unsubscribed holds the email categories the user opted out of.
+	Unsubscribed []string `datastore:"unsubscribed"`
+	// Roles holds the authorization roles of the user.
+	Roles []string `datastore:"roles"`
+	// SessionsRevoked invalidates the sessions created before it.
+	SessionsRevoked time.Time `datastore:"sessions_revoked,noindex"`
+	// Locale is the language of the pages and emails, empty if not chosen.
+	Locale string `datastore:"locale,noindex"`
+	// CanonicalEmail is the canonical form of Email, used for the lookups.
+	// It is set when the user is stored.
+	CanonicalEmail string `datastore:"canonical_email"`
 }
 
 const saltSize = 16
 
-var InvalidEmailErr = errors.New("invalid email address")
+var (
+	InvalidEmailErr   = errors.New("invalid email address")
+	DuplicateEmailErr = errors.New("email address already used by another user")
+)
 
 // NewUser creates new user with given name and email.
 // Returns an error if the name and email are empty.
@@ -38,9 +53,10 @@ func NewUser(name, email string) (*User, error) {
 	}
 
 	return &User{
-		Name:   name,
-		Email:  email,
-		Active: false,
+		Name:           name,
+		Email:          email,
+		CanonicalEmail: CanonicalEmail(email),
+		Active:         false,
 	}, nil
 }
 
@@ -105,10 +121,30 @@ func (u *User) AddProvider(providerName, providerUserId string) error {
 		return errors.New("user is already registered with this provider")
 	}
 
-	if u.Providers == nil {
-		u.Providers = make([]Provider, 1)
+	u.Providers = append(u.Providers, Provider{Name: providerName, Id: providerUserId})
+
+	return nil
+}
+
+// RemoveProvider removes the provider of the user.
+// Returns an error if the user is not associated with the provider.
+func (u *User) RemoveProvider(providerName string) error {
+	if !u.HasProvider(providerName) {
+		return errors.New("user is not registered with this provider")
 	}
-	u.Providers[0] = Provider{Name: providerName, Id: providerUserId}
+
+	providers := make([]Provider, 0, len(u.Providers)-1)
+	for _, prov := range u.Providers {
+		if prov.Name != providerName {
+			providers = append(providers, prov)
+		}
+	}
+	u.Providers = providers
 
 	return nil
 }
+
+// RevokeSessions invalidates all the current sessions of the user.
+func (u *User) RevokeSessions() {
+	u.SessionsRevoked = time.Now()
+}
@@ -2,6 +2,8 @@ package user
 
 import (
 	"testing"
+
+	"petsy/i18n"
 )
 
 const (
@@ -36,6 +38,29 @@ func TestNewUser(t *testing.T) {
 	}
 }
 
+func TestProviders(t *testing.T) {
+	user, _ := NewUser(name, email)
+	user.AddProvider("facebook", "1")
+	user.AddProvider("google", "2")
+
+	if !user.HasProvider("facebook") || !user.HasProvider("google") {
+		t.Errorf("AddProvider: got providers %v; want facebook and google", user.Providers)
+	}
+	if err := user.AddProvider("google", "3"); err == nil {
+		t.Errorf("AddProvider: duplicate provider: want error")
+	}
+
+	if err := user.RemoveProvider("facebook"); err != nil {
+		t.Errorf("RemoveProvider: unexpected error: %v", err)
+	}
+	if user.HasProvider("facebook") || !user.HasProvider("google") {
+		t.Errorf("RemoveProvider: got providers %v; want google", user.Providers)
+	}
+	if err := user.RemoveProvider("facebook"); err == nil {
+		t.Errorf("RemoveProvider: missing provider: want error")
+	}
+}
+
 func TestUserPassword(t *testing.T) {
 	user, _ := NewUser(name, email)
 	user.SetPassword(pass)
@@ -47,3 +72,104 @@ func TestUserPassword(t *testing.T) {
 		t.Errorf("error testing user: good password does not work")
 	}
 }
+
+func TestEmailPreferences(t *testing.T) {
+	user, _ := NewUser(name, email)
+
+	for _, category := range EmailCategories {
+		if !user.WantsEmails(category) {
+			t.Errorf("new user: does not want %s emails", category)
+		}
+	}
+
+	if err := user.SetEmailPreference(MarketingEmails, false); err != nil {
+		t.Errorf("SetEmailPreference: unexpected error: %v", err)
+	}
+	user.SetEmailPreference(MarketingEmails, false)
+	if user.WantsEmails(MarketingEmails) {
+		t.Errorf("SetEmailPreference: user still wants %s emails", MarketingEmails)
+	}
+	if len(user.Unsubscribed) != 1 {
+		t.Errorf("SetEmailPreference: got %d unsubscribed categories; want 1", len(user.Unsubscribed))
+	}
+
+	user.SetEmailPreference(MarketingEmails, true)
+	if !user.WantsEmails(MarketingEmails) {
+		t.Errorf("SetEmailPreference: user does not want %s emails after resubscribing", MarketingEmails)
+	}
+
+	if err := user.SetEmailPreference(AccountEmails, false); err != InvalidCategoryErr {
+		t.Errorf("SetEmailPreference: %s: got error %v; want %v", AccountEmails, err, InvalidCategoryErr)
+	}
+	if err := user.SetEmailPreference("spam", false); err != InvalidCategoryErr {
+		t.Errorf("SetEmailPreference: unknown category: got error %v; want %v", err, InvalidCategoryErr)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	user, _ := NewUser(name, email)
+
+	if !user.HasRole(OwnerRole) {
+		t.Errorf("new user: does not have role %s", OwnerRole)
+	}
+
+	if err := user.AddRole(SitterRole); err != nil {
+		t.Errorf("AddRole: unexpected error: %v", err)
+	}
+	if !user.HasRole(SitterRole) || !user.HasRole(OwnerRole) {
+		t.Errorf("AddRole: got roles %v; want [%s %s]", user.GetRoles(), OwnerRole, SitterRole)
+	}
+
+	if err := user.RemoveRole(OwnerRole); err != nil {
+		t.Errorf("RemoveRole: unexpected error: %v", err)
+	}
+	if user.HasRole(OwnerRole) || !user.HasRole(SitterRole) {
+		t.Errorf("RemoveRole: got roles %v; want [%s]", user.GetRoles(), SitterRole)
+	}
+	if err := user.RemoveRole(SitterRole); err != LastRoleErr {
+		t.Errorf("RemoveRole: last role: got error %v; want %v", err, LastRoleErr)
+	}
+	if !user.HasRole(SitterRole) {
+		t.Errorf("RemoveRole: last role: got roles %v; want [%s]", user.GetRoles(), SitterRole)
+	}
+
+	if err := user.AddRole("root"); err != InvalidRoleErr {
+		t.Errorf("AddRole: unknown role: got error %v; want %v", err, InvalidRoleErr)
+	}
+}
+
+func TestLocale(t *testing.T) {
+	user, _ := NewUser(name, email)
+
+	if err := user.SetLocale("ro"); err != nil || user.Locale != "ro" {
+		t.Errorf("SetLocale: got locale %q, error %v; want ro", user.Locale, err)
+	}
+	if err := user.SetLocale("de"); err != i18n.InvalidLocaleErr {
+		t.Errorf("SetLocale: unsupported locale: got error %v; want %v", err, i18n.InvalidLocaleErr)
+	}
+}
+
+func TestCanonicalEmail(t *testing.T) {
+	tests := []struct {
+		email, want string
+	}{
+		{"ana@petsy.ro", "ana@petsy.ro"},
+		{"  Ana@Petsy.RO ", "ana@petsy.ro"},
+		{"Ana.Pop+cats@Gmail.com", "ana.pop+cats@gmail.com"},
+		{"ana@Pisică.ro", "ana@xn--pisic-vwa.ro"},
+		{"ana@xn--pisic-vwa.ro", "ana@xn--pisic-vwa.ro"},
+		{"ana\u0306@pisica\u0306.ro", "an\u0103@xn--pisic-vwa.ro"},
+		{"not an email", "not an email"},
+	}
+
+	for _, test := range tests {
+		if got := CanonicalEmail(test.email); got != test.want {
+			t.Errorf("CanonicalEmail(%q): got %q; want %q", test.email, got, test.want)
+		}
+	}
+
+	user, _ := NewUser(name, "Test@Petsy.ro")
+	if user.CanonicalEmail != email {
+		t.Errorf("NewUser: canonical email: got %s; want %s", user.CanonicalEmail, email)
+	}
+}
@@ -1,16 +1,16 @@
 package utils
 
 import (
-//"regexp"
+	"petsy/validation"
 )
 
-const RegexEmail = `^[a-z0-9._\-+]+@[a-z0-9.\-]+\.[a-z]{2,4}$`
+// RegexEmail is a loose pattern of the ASCII email addresses, for the
+// clients. The server validates the addresses with IsEmailAddress.
+const RegexEmail = `^[a-zA-Z0-9._\-+]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,63}$`
 
+// IsEmailAddress returns whether the email is a valid address.
 func IsEmailAddress(email string) bool {
-	// exp, _ := regexp.Compile(RegexEmail)
-
-	// return exp.MatchString(email)
-	return true
+	return validation.IsEmail(email)
 }
 
 func IsEmpty(value interface{}) bool {
@@ -0,0 +1,116 @@
+// Part of validation package. Implements the binding of the forms
+// to structs.
+package validation
+
+import (
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DateLayout is the layout of the dates of the forms.
+const DateLayout = "2006-01-02"
+
+// Bind sets the fields of the struct pointed to by dst from the values of the
+// form of the request, then validates it. The fields are bound to the value
+// named by their "form" tag and can be strings, integers, floats, booleans,
+// dates (in the DateLayout) or slices of strings. The values are trimmed,
+// unless the tag has the "notrim" option, e.g. `form:"password,notrim"`.
+// Returns Errors holding the values which can't be parsed and the validation
+// failures.
+func Bind(r *http.Request, dst interface{}) error {
+	if err := r.ParseForm(); err != nil {
+		return err
+	}
+
+	v := reflect.ValueOf(dst).Elem()
+	t := v.Type()
+	errs := make(Errors)
+
+	for i := 0; i < t.NumField(); i++ {
+		opts := strings.Split(t.Field(i).Tag.Get("form"), ",")
+		name := opts[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		values, ok := r.Form[name]
+		if !ok || len(values) == 0 {
+			continue
+		}
+		trim := len(opts) < 2 || opts[1] != "notrim"
+		bindField(v.Field(i), name, values, trim, errs)
+	}
+
+	// The fields which can't be parsed are not validated further.
+	invalid := errs
+	errs = make(Errors)
+	validate(v, errs)
+	for field, fieldErrs := range invalid {
+		errs[field] = fieldErrs
+	}
+	return errs.Err()
+}
+
+func bindField(f reflect.Value, name string, values []string, trim bool, errs Errors) {
+	value := values[0]
+	if trim {
+		value = strings.TrimSpace(value)
+	}
+
+	if _, ok := f.Interface().(time.Time); ok {
+		if value == "" {
+			return
+		}
+		t, err := time.Parse(DateLayout, value)
+		if err != nil {
+			errs.Add(name, DateMsg)
+			return
+		}
+		f.Set(reflect.ValueOf(t))
+		return
+	}
+
+	switch f.Kind() {
+	case reflect.String:
+		f.SetString(value)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value == "" {
+			return
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			errs.Add(name, NumberMsg)
+			return
+		}
+		f.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		if value == "" {
+			return
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			errs.Add(name, NumberMsg)
+			return
+		}
+		f.SetFloat(n)
+	case reflect.Bool:
+		if value == "" {
+			return
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			errs.Add(name, BoolMsg)
+			return
+		}
+		f.SetBool(b)
+	case reflect.Slice:
+		if f.Type().Elem().Kind() != reflect.String {
+			panic("validation: unsupported field type " + f.Type().String())
+		}
+		f.Set(reflect.ValueOf(append([]string(nil), values...)))
+	default:
+		panic("validation: unsupported field type " + f.Type().String())
+	}
+}
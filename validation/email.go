@@ -0,0 +1,113 @@
+// Part of validation package. Implements the validation of the email
+// addresses (RFC 5322 addr-spec, with internationalized domains and
+// local parts as in RFC 6531).
+package validation
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// IsEmail returns whether the address is a valid addr-spec: a dot-atom or
+// quoted-string local part and a domain name, which may be internationalized.
+// Address literals, comments and obsolete forms are not accepted.
+func IsEmail(address string) bool {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return false
+	}
+	local, domain := address[:at], address[at+1:]
+
+	if len(local) > 64 || !validLocalPart(local) {
+		return false
+	}
+
+	ascii, err := DomainToASCII(domain)
+	if err != nil || strings.HasSuffix(domain, ".") {
+		return false
+	}
+	return validDomain(ascii)
+}
+
+func validLocalPart(local string) bool {
+	if strings.HasPrefix(local, `"`) {
+		return validQuotedString(local)
+	}
+
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, r := range atom {
+			if !isAtext(r) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isAtext returns whether the character can be used in an atom.
+func isAtext(r rune) bool {
+	switch {
+	case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		return true
+	case r >= utf8.RuneSelf:
+		return r != utf8.RuneError
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", r)
+}
+
+func validQuotedString(s string) bool {
+	if len(s) < 2 || !strings.HasSuffix(s, `"`) {
+		return false
+	}
+
+	escaped := false
+	for _, r := range s[1 : len(s)-1] {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '"' || r < ' ' || r == 0x7f:
+			return false
+		}
+	}
+	return !escaped
+}
+
+// validDomain returns whether the ASCII domain is a valid host name with at
+// least two labels and an alphabetic top-level domain.
+func validDomain(domain string) bool {
+	if len(domain) > 253 {
+		return false
+	}
+
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	tld := labels[len(labels)-1]
+	if strings.HasPrefix(tld, acePrefix) {
+		return true
+	}
+	for i := 0; i < len(tld); i++ {
+		if tld[i] < 'a' || tld[i] > 'z' {
+			return false
+		}
+	}
+	return len(tld) >= 2
+}
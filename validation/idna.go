@@ -0,0 +1,152 @@
+// Part of validation package. Implements the conversion of the
+// internationalized domain names to ASCII (RFC 3490, RFC 3492).
+package validation
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Error returned for a domain name which can't be converted to ASCII.
+var InvalidDomainErr = errors.New("invalid domain name")
+
+const acePrefix = "xn--"
+
+// DomainToASCII returns the ASCII form of the domain, in lowercase, with the
+// non-ASCII labels encoded in punycode, e.g. "xn--pisic-vwa.ro" for
+// "pisică.ro". The domain is normalized to NFC and lowercased before being
+// encoded, so that the forms of the same characters give the same result.
+func DomainToASCII(domain string) (string, error) {
+	domain = strings.TrimSuffix(norm.NFC.String(domain), ".")
+	if domain == "" {
+		return "", InvalidDomainErr
+	}
+
+	labels := strings.Split(strings.ToLower(domain), ".")
+	for i, label := range labels {
+		if label == "" {
+			return "", InvalidDomainErr
+		}
+		if isASCII(label) {
+			continue
+		}
+		encoded, err := punycode(label)
+		if err != nil {
+			return "", err
+		}
+		labels[i] = acePrefix + encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Parameters of the punycode bootstring (RFC 3492, section 5).
+const (
+	base        = 36
+	tmin        = 1
+	tmax        = 26
+	skew        = 38
+	damp        = 700
+	initialBias = 72
+	initialN    = 128
+)
+
+// punycode encodes the label (RFC 3492, section 6.3).
+func punycode(label string) (string, error) {
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(initialN), 0, initialBias
+	for handled < len(runes) {
+		m := rune(utf8.MaxRune)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+
+		delta += int(m-n) * (handled + 1)
+		if delta < 0 {
+			return "", InvalidDomainErr
+		}
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+
+			q := delta
+			for k := base; ; k += base {
+				t := k - bias
+				if t < tmin {
+					t = tmin
+				} else if t > tmax {
+					t = tmax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, digit(t+(q-t)%(base-t)))
+				q = (q - t) / (base - t)
+			}
+			out = append(out, digit(q))
+
+			bias = adapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+
+	return string(out), nil
+}
+
+func digit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func adapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= damp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+
+	k := 0
+	for delta > ((base-tmin)*tmax)/2 {
+		delta /= base - tmin
+		k += base
+	}
+	return k + (base-tmin+1)*delta/(delta+skew)
+}
@@ -0,0 +1,236 @@
+// Package validation implements the declarative validation of the request
+// payloads bound to structs, reporting all the failures by field.
+//
+// The rules of a field are listed in its "validate" tag, separated by commas:
+//
+//	required     the field must not be empty
+//	email        the field must be an email address (see IsEmail)
+//	min=N        strings must have at least N characters, numbers must be at least N
+//	max=N        strings must have at most N characters, numbers must be at most N
+//	oneof=a|b    the field must be one of the values
+//	after=Field  the time must be after the time of the other field
+//
+// The rules other than required are not checked for empty fields. Fields are
+// named after their "form" tag, if any, or their name.
+package validation
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Messages of the validation failures, used as keys for the translations.
+const (
+	RequiredMsg  = "is required"
+	EmailMsg     = "must be a valid email address"
+	MinLengthMsg = "must be at least %d characters long"
+	MaxLengthMsg = "must be at most %d characters long"
+	MinMsg       = "must be at least %v"
+	MaxMsg       = "must be at most %v"
+	OneOfMsg     = "must be one of %s"
+	AfterMsg     = "must be after %s"
+	NumberMsg    = "must be a number"
+	BoolMsg      = "must be true or false"
+	DateMsg      = "must be a date (YYYY-MM-DD)"
+)
+
+// FieldError is a validation failure, whose message is formatted with the arguments.
+type FieldError struct {
+	Message string
+	Args    []interface{}
+}
+
+func (e FieldError) String() string {
+	if len(e.Args) == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf(e.Message, e.Args...)
+}
+
+// Errors holds the validation failures, by field name.
+type Errors map[string][]FieldError
+
+// Add adds a failure of the field.
+func (e Errors) Add(field, msg string, args ...interface{}) {
+	e[field] = append(e[field], FieldError{msg, args})
+}
+
+// Error implements error, listing the failures ordered by field.
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var parts []string
+	for _, field := range fields {
+		for _, fe := range e[field] {
+			parts = append(parts, field+": "+fe.String())
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Err returns the errors, or nil if there are none.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Error returned for an invalid validate tag or an unsupported field type.
+var InvalidRuleErr = errors.New("invalid validation rule")
+
+// Validate checks the fields of the struct pointed to by s against their rules.
+// Returns Errors holding all the failures, or nil if the struct is valid.
+// Panics if a rule is invalid, since it is a programming error.
+func Validate(s interface{}) error {
+	errs := make(Errors)
+	validate(reflect.Indirect(reflect.ValueOf(s)), errs)
+	return errs.Err()
+}
+
+func validate(v reflect.Value, errs Errors) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+
+		field := fieldName(t.Field(i))
+		value := v.Field(i)
+
+		rules := strings.Split(tag, ",")
+		if isEmpty(value) {
+			for _, rule := range rules {
+				if rule == "required" {
+					errs.Add(field, RequiredMsg)
+				}
+			}
+			continue
+		}
+
+		for _, rule := range rules {
+			if err := check(v, value, field, rule, errs); err != nil {
+				panic(fmt.Sprintf("validation: %s: %s: %v", t.Field(i).Name, rule, err))
+			}
+		}
+	}
+}
+
+// check checks the value of the field against the rule.
+func check(s, value reflect.Value, field, rule string, errs Errors) error {
+	name, param := rule, ""
+	if i := strings.Index(rule, "="); i >= 0 {
+		name, param = rule[:i], rule[i+1:]
+	}
+
+	switch name {
+	case "required":
+	case "email":
+		if value.Kind() != reflect.String {
+			return InvalidRuleErr
+		}
+		if !IsEmail(value.String()) {
+			errs.Add(field, EmailMsg)
+		}
+	case "min", "max":
+		return checkBound(value, field, name == "min", param, errs)
+	case "oneof":
+		allowed := strings.Split(param, "|")
+		s := fmt.Sprint(value.Interface())
+		for _, a := range allowed {
+			if s == a {
+				return nil
+			}
+		}
+		errs.Add(field, OneOfMsg, strings.Join(allowed, ", "))
+	case "after":
+		other := s.FieldByName(param)
+		t, ok1 := value.Interface().(time.Time)
+		if !other.IsValid() {
+			return InvalidRuleErr
+		}
+		o, ok2 := other.Interface().(time.Time)
+		if !ok1 || !ok2 {
+			return InvalidRuleErr
+		}
+		if !o.IsZero() && !t.After(o) {
+			otherField, _ := s.Type().FieldByName(param)
+			errs.Add(field, AfterMsg, fieldName(otherField))
+		}
+	default:
+		return InvalidRuleErr
+	}
+	return nil
+}
+
+func checkBound(value reflect.Value, field string, min bool, param string, errs Errors) error {
+	switch value.Kind() {
+	case reflect.String:
+		n, err := strconv.Atoi(param)
+		if err != nil {
+			return err
+		}
+		length := utf8.RuneCountInString(value.String())
+		if min && length < n {
+			errs.Add(field, MinLengthMsg, n)
+		} else if !min && length > n {
+			errs.Add(field, MaxLengthMsg, n)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return err
+		}
+		if min && value.Int() < n {
+			errs.Add(field, MinMsg, n)
+		} else if !min && value.Int() > n {
+			errs.Add(field, MaxMsg, n)
+		}
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			return err
+		}
+		if min && value.Float() < n {
+			errs.Add(field, MinMsg, n)
+		} else if !min && value.Float() > n {
+			errs.Add(field, MaxMsg, n)
+		}
+	default:
+		return InvalidRuleErr
+	}
+	return nil
+}
+
+func isEmpty(v reflect.Value) bool {
+	if t, ok := v.Interface().(time.Time); ok {
+		return t.IsZero()
+	}
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	// Numbers and booleans are never empty, since zero is a valid value.
+	return false
+}
+
+// fieldName returns the name of the field in the requests.
+func fieldName(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("form"), ",")[0]; name != "" {
+		return name
+	}
+	return f.Name
+}
@@ -0,0 +1,154 @@
+package validation
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsEmail(t *testing.T) {
+	valid := []string{
+		"ana@petsy.ro",
+		"ana.maria+pets@mail.petsy.ro",
+		"ana@petsy.photography",
+		"o'brien@example.com",
+		`"ana maria"@petsy.ro`,
+		"ana@pisică.ro",
+		"ștefan@petsy.ro",
+		"ana@xn--pisic-vwa.ro",
+	}
+	for _, email := range valid {
+		if !IsEmail(email) {
+			t.Errorf("IsEmail(%q): got false; want true", email)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"ana",
+		"ana@",
+		"@petsy.ro",
+		"ana@petsy",
+		"ana..maria@petsy.ro",
+		".ana@petsy.ro",
+		"ana maria@petsy.ro",
+		"ana@petsy..ro",
+		"ana@-petsy.ro",
+		"ana@petsy.r0",
+		"ana@petsy.ro.",
+		`"ana"maria"@petsy.ro`,
+		"Ana <ana@petsy.ro>",
+		strings.Repeat("a", 65) + "@petsy.ro",
+	}
+	for _, email := range invalid {
+		if IsEmail(email) {
+			t.Errorf("IsEmail(%q): got true; want false", email)
+		}
+	}
+}
+
+func TestDomainToASCII(t *testing.T) {
+	tests := map[string]string{
+		"petsy.ro":  "petsy.ro",
+		"Petsy.RO":  "petsy.ro",
+		"bücher.de": "xn--bcher-kva.de",
+		"pisică.ro": "xn--pisic-vwa.ro",
+		// The decomposed form of "pisică.ro".
+		"pisica\u0306.ro": "xn--pisic-vwa.ro",
+		"münchen":         "xn--mnchen-3ya",
+		"日本語.jp":          "xn--wgv71a119e.jp",
+	}
+	for domain, want := range tests {
+		got, err := DomainToASCII(domain)
+		if err != nil || got != want {
+			t.Errorf("DomainToASCII(%q): got %q, %v; want %q", domain, got, err, want)
+		}
+	}
+	if _, err := DomainToASCII("petsy..ro"); err != InvalidDomainErr {
+		t.Errorf("DomainToASCII: empty label: got error %v; want %v", err, InvalidDomainErr)
+	}
+}
+
+type booking struct {
+	Email   string    `form:"email" validate:"required,email"`
+	Name    string    `form:"name" validate:"required,min=2,max=10"`
+	Pets    int       `form:"pets" validate:"min=1,max=5"`
+	Service string    `form:"service" validate:"required,oneof=boarding|walking"`
+	Start   time.Time `form:"start" validate:"required"`
+	End     time.Time `form:"end" validate:"required,after=Start"`
+	Note    string    `form:"note" validate:"max=5"`
+}
+
+func TestValidate(t *testing.T) {
+	start := time.Date(2015, time.June, 1, 0, 0, 0, 0, time.UTC)
+
+	valid := &booking{"ana@petsy.ro", "Ana", 2, "boarding", start, start.AddDate(0, 0, 3), ""}
+	if err := Validate(valid); err != nil {
+		t.Errorf("Validate: unexpected error: %v", err)
+	}
+
+	invalid := &booking{"ana", "A", 6, "grooming", start, start, "too long"}
+	err := Validate(invalid)
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("Validate: got error %v; want Errors", err)
+	}
+
+	want := map[string]string{
+		"email":   EmailMsg,
+		"name":    MinLengthMsg,
+		"pets":    MaxMsg,
+		"service": OneOfMsg,
+		"end":     AfterMsg,
+		"note":    MaxLengthMsg,
+	}
+	for field, msg := range want {
+		if len(errs[field]) != 1 || errs[field][0].Message != msg {
+			t.Errorf("Validate: %s: got %v; want %q", field, errs[field], msg)
+		}
+	}
+	if len(errs) != len(want) {
+		t.Errorf("Validate: got errors for %d fields; want %d: %v", len(errs), len(want), errs)
+	}
+
+	errs = Validate(&booking{}).(Errors)
+	for _, field := range []string{"email", "name", "service", "start", "end"} {
+		if len(errs[field]) != 1 || errs[field][0].Message != RequiredMsg {
+			t.Errorf("Validate: empty %s: got %v; want %q", field, errs[field], RequiredMsg)
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+	form := url.Values{
+		"email":   {" ana@petsy.ro "},
+		"name":    {"Ana"},
+		"pets":    {"two"},
+		"service": {"walking"},
+		"start":   {"2015-06-01"},
+		"end":     {"01.06.2015"},
+	}
+	r, _ := http.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var b booking
+	errs, ok := Bind(r, &b).(Errors)
+	if !ok {
+		t.Fatalf("Bind: want Errors")
+	}
+
+	if b.Email != "ana@petsy.ro" || b.Service != "walking" || b.Start.Day() != 1 {
+		t.Errorf("Bind: got %+v", b)
+	}
+	if len(errs["pets"]) != 1 || errs["pets"][0].Message != NumberMsg {
+		t.Errorf("Bind: pets: got %v; want %q", errs["pets"], NumberMsg)
+	}
+	if len(errs["end"]) != 1 || errs["end"][0].Message != DateMsg {
+		t.Errorf("Bind: end: got %v; want %q", errs["end"], DateMsg)
+	}
+	if len(errs) != 2 {
+		t.Errorf("Bind: got errors %v; want pets and end", errs)
+	}
+}
@@ -0,0 +1,155 @@
+// Package view implements the rendering of the HTML pages from named
+// templates sharing a common layout.
+package view
+
+import (
+	"errors"
+	"html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	layoutName = "layout"
+	ext        = ".html"
+)
+
+// Error returned when rendering a template which was not parsed.
+var NoSuchTemplateErr = errors.New("no page template with this name")
+
+// Templates holds a set of named page templates sharing a common layout.
+//
+// Every page is a <name>.html file defining the "content" block and optionally
+// other blocks, like "title", of the "layout" template defined in layout.html.
+// The functions provided when parsing are available to every template, and
+// can be replaced when rendering by functions bound to the request.
+type Templates struct {
+	// Reload makes the templates parsed again when a file of the directory
+	// changes, which is meant for development.
+	Reload bool
+
+	dir   string
+	funcs template.FuncMap
+
+	mu     sync.RWMutex
+	pages  map[string]*template.Template
+	loaded time.Time
+}
+
+// ParseTemplates parses the layout and all the page templates of the
+// directory. Returns an error if any of the templates can't be parsed.
+func ParseTemplates(dir string, funcs template.FuncMap) (*Templates, error) {
+	t := &Templates{dir: dir, funcs: funcs}
+	if err := t.parse(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// MustParseTemplates is like ParseTemplates, but panics on error.
+func MustParseTemplates(dir string, funcs template.FuncMap) *Templates {
+	t, err := ParseTemplates(dir, funcs)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t *Templates) parse() error {
+	loaded := time.Now()
+
+	layout, err := template.New(layoutName + ext).Funcs(t.funcs).ParseFiles(filepath.Join(t.dir, layoutName+ext))
+	if err != nil {
+		return err
+	}
+
+	files, err := filepath.Glob(filepath.Join(t.dir, "*"+ext))
+	if err != nil {
+		return err
+	}
+
+	pages := make(map[string]*template.Template)
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ext)
+		if name == layoutName {
+			continue
+		}
+
+		page, err := layout.Clone()
+		if err != nil {
+			return err
+		}
+		if _, err := page.ParseFiles(file); err != nil {
+			return err
+		}
+		pages[name] = page
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pages = pages
+	t.loaded = loaded
+	return nil
+}
+
+// changed returns whether a template was modified since the last parse.
+func (t *Templates) changed() (bool, error) {
+	files, err := filepath.Glob(filepath.Join(t.dir, "*"+ext))
+	if err != nil {
+		return false, err
+	}
+
+	t.mu.RLock()
+	loaded := t.loaded
+	t.mu.RUnlock()
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		if !info.ModTime().Before(loaded) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Render writes the named page, rendered with the data. The functions replace
+// the ones provided when parsing, for this rendering only.
+func (t *Templates) Render(w io.Writer, name string, data interface{}, funcs template.FuncMap) error {
+	if t.Reload {
+		changed, err := t.changed()
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err := t.parse(); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.mu.RLock()
+	page, ok := t.pages[name]
+	t.mu.RUnlock()
+	if !ok {
+		return NoSuchTemplateErr
+	}
+
+	// The stored page is never executed, since it could not be cloned
+	// for the next renderings afterwards.
+	page, err := page.Clone()
+	if err != nil {
+		return err
+	}
+	if len(funcs) > 0 {
+		page.Funcs(funcs)
+	}
+
+	return page.ExecuteTemplate(w, layoutName, data)
+}
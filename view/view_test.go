@@ -0,0 +1,127 @@
+package view
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var funcs = template.FuncMap{
+	"user": func() string { return "" },
+}
+
+func writeTemplates(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	dir, err := ioutil.TempDir("", "view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTemplates(t, dir, map[string]string{
+		"layout.html": `{{define "layout"}}<title>{{block "title" .}}Petsy{{end}}</title>{{user}}:{{template "content" .}}{{end}}`,
+		"hello.html":  `{{define "title"}}Hello{{end}}{{define "content"}}Hello, {{.}}!{{end}}`,
+		"plain.html":  `{{define "content"}}Plain{{end}}`,
+	})
+
+	pages, err := ParseTemplates(dir, funcs)
+	if err != nil {
+		t.Fatalf("ParseTemplates: unexpected error: %v", err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = pages.Render(buf, "hello", "<Rex>", template.FuncMap{
+		"user": func() string { return "ana" },
+	})
+	if err != nil {
+		t.Fatalf("Render: unexpected error: %v", err)
+	}
+	if got, want := buf.String(), "<title>Hello</title>ana:Hello, &lt;Rex&gt;!"; got != want {
+		t.Errorf("Render: got %q; want %q", got, want)
+	}
+
+	buf.Reset()
+	if err := pages.Render(buf, "plain", nil, nil); err != nil {
+		t.Fatalf("Render: unexpected error: %v", err)
+	}
+	if got, want := buf.String(), "<title>Petsy</title>:Plain"; got != want {
+		t.Errorf("Render: got %q; want %q", got, want)
+	}
+
+	// The page is rendered again, with other functions.
+	buf.Reset()
+	err = pages.Render(buf, "plain", nil, template.FuncMap{
+		"user": func() string { return "ion" },
+	})
+	if err != nil {
+		t.Fatalf("Render: rendered page: unexpected error: %v", err)
+	}
+	if got, want := buf.String(), "<title>Petsy</title>ion:Plain"; got != want {
+		t.Errorf("Render: got %q; want %q", got, want)
+	}
+
+	if err := pages.Render(buf, "missing", nil, nil); err != NoSuchTemplateErr {
+		t.Errorf("Render: missing template: got error %v; want %v", err, NoSuchTemplateErr)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := ParseTemplates(dir, funcs); err == nil {
+		t.Errorf("ParseTemplates: missing layout: want error")
+	}
+
+	writeTemplates(t, dir, map[string]string{
+		"layout.html": `{{define "layout"}}{{template "content" .}}{{end}}`,
+		"broken.html": `{{define "content"}}{{unknown}}{{end}}`,
+	})
+	if _, err := ParseTemplates(dir, funcs); err == nil {
+		t.Errorf("ParseTemplates: unknown function: want error")
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeTemplates(t, dir, map[string]string{
+		"layout.html": `{{define "layout"}}{{template "content" .}}{{end}}`,
+		"page.html":   `{{define "content"}}old{{end}}`,
+	})
+
+	pages := MustParseTemplates(dir, funcs)
+	pages.Reload = true
+
+	page := filepath.Join(dir, "page.html")
+	writeTemplates(t, dir, map[string]string{"page.html": `{{define "content"}}new{{end}}`})
+	future := time.Now().Add(time.Second)
+	os.Chtimes(page, future, future)
+
+	buf := &bytes.Buffer{}
+	if err := pages.Render(buf, "page", nil, nil); err != nil {
+		t.Fatalf("Render: unexpected error: %v", err)
+	}
+	if !strings.Contains(buf.String(), "new") {
+		t.Errorf("Render: got %q after reload; want new", buf.String())
+	}
+}